@@ -3,8 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type TargetName string
@@ -18,16 +24,310 @@ type Application interface {
 
 	RunCmd(port int) string
 
+	// The program and arguments that start the app on port: RunCmd run by
+	// the Shell, or the RunArgv.
+	RunArgv(port int) []string
+
 	HealthEndpoint() string
 
+	// The health check paths to try, in order, the first that passes
+	// counting: HealthEndpoints if given, otherwise just HealthEndpoint.
+	HealthEndpoints() []string
+
+	// Prefix of HealthEndpoint in health check URLs, for apps served under
+	// a path. Empty for none.
+	HealthBasePath() string
+
+	// If non-nil, a health check response body must match this to count as
+	// healthy.
+	HealthBodyMatch() *regexp.Regexp
+
+	// Headers a health check response must have, with these values, to
+	// count as healthy.
+	HealthHeaders() map[string]string
+
+	// Whether a health check response with status counts as healthy.
+	HealthyStatus(status int) bool
+
+	// The User-Agent health checks and warmup requests are made with.
+	HealthUserAgent() string
+
+	// Path of the file holding the bearer token health checks send, or
+	// empty to send none.
+	HealthTokenFile() string
+
+	// Path of the file the app creates when it's ready, in place of an
+	// HTTP health check, or empty. The file must contain
+	// ReadinessContent, if that's set.
+	ReadinessFile() string
+	ReadinessContent() string
+
+	// Further checks that must all pass, as well as the health check, for
+	// the app to count as started.
+	HealthChecks() []HealthCheck
+
+	// Command printing the app's readiness as JSON, in place of an HTTP
+	// health check, or nil. ReadinessField of its output must be
+	// ReadinessValue for the app to count as ready.
+	ReadinessCmd(port int) []string
+	ReadinessField() string
+	ReadinessValue() string
+
+	// The directory the deploy.json was loaded from, the deploy dir on
+	// servers.
+	Dir() string
+
+	// Files rendered before the app starts, with paths in Dir.
+	Templates() []TemplateFile
+
+	// How health checks connect to the app.
+	HealthTransport() HealthTransport
+
+	// "https" for HealthHttps apps, otherwise "http".
+	HealthScheme() string
+
+	// How long the certificate of an HTTPS app must still be valid for, 0
+	// for no check, and what happens if it isn't, a HEALTH_CERT_EXPIRY_
+	// value.
+	HealthCertMinValidity() time.Duration
+	HealthCertExpiry() string
+
+	// Health check responses slower than this count as failures, 0 for
+	// no limit.
+	HealthMaxLatency() time.Duration
+
+	// How long after starting the app to wait before checking its health.
+	StartupDelay() time.Duration
+
+	// What it takes for the app to count as started, a STARTUP_CRITERIA_
+	// value.
+	StartupCriteria() string
+
+	// Consecutive startup health checks that may time out before the
+	// start fails, 0 to keep trying until the startup time is up.
+	StartupHealthTimeouts() int
+
+	// How long the app must stay healthy, once it first is, to count as
+	// started.
+	Stabilization() time.Duration
+
+	// Paths requested, in order, once the app is healthy and before it
+	// counts as started. Their responses are ignored.
+	WarmupPaths() []string
+
+	// If true, camus logs each health check it makes while starting the app.
+	Verbose() bool
+
+	// Extra environment variables for the app, as KEY=value.
+	Env() []string
+
+	// If true, the app gets only Env and its port, not camus's environment.
+	CleanEnv() bool
+
+	// If true, the app gets its own process group, so it outlives camus.
+	Detach() bool
+
+	// Name of the environment variable the app's port is passed in.
+	PortEnv() string
+
+	// Names of the extra ports the app listens on besides its main one.
+	NamedPorts() []string
+
+	// One of the DEPLOY_TYPE_ values.
+	Type() string
+
+	// The port Run starts the app on if it's free, 0 for any.
+	PreferredPort() int
+
+	// What Run does when PreferredPort isn't free, one of the
+	// PORT_FALLBACK_ values.
+	PortFallback() string
+
+	// The umask the app is started with, in octal, or empty to inherit
+	// camus's.
+	Umask() string
+
+	// The niceness the app is started with, 0 to inherit camus's, and its
+	// IO scheduling class, an IO_CLASS_ value or empty to inherit, with
+	// the priority within it.
+	Nice() int
+	IoClass() string
+	IoPriority() int
+
+	// What the app is expected to use, counted against the HostBudget.
+	Resources() Resources
+
+	// Names of the secrets passed to the app, on fds 3, 4... in order.
+	Secrets() []string
+
+	// The signal Stop sends to the app's process group.
+	StopSignal() syscall.Signal
+
+	// How long Stop waits for the app to release its port after
+	// StopSignal before killing it, 0 for the server's default.
+	StopTimeout() time.Duration
+
+	// How many times Enforce may restart the app within RestartWindow
+	// before quarantining it, 0 for no limit.
+	MaxRestarts() int
+	RestartWindow() time.Duration
+
+	// What Enforce does when the app exits, and when it's running but keeps
+	// failing its health check, RESTART_POLICY_ values, and how many
+	// health checks in a row it must fail for OnUnhealthy.
+	OnCrash() string
+	OnUnhealthy() string
+	UnhealthyChecks() int
+
+	// How Enforce checks the running app for OnUnhealthy, a
+	// LIVENESS_CHECK_ value, the HTTP path it requests (empty for the
+	// health endpoints) and the least time between checks.
+	LivenessCheck() string
+	LivenessPath() string
+	LivenessInterval() time.Duration
+
 	// e.g. prod -> Target{...}
 	Targets(name TargetName) []*Target
 }
 
 type AppImpl struct {
 	def ApplicationDef
+
+	healthBodyMatch *regexp.Regexp
+
+	// HealthStatuses, empty for just 200
+	healthStatuses []statusRange
+
+	// ReadinessFile, relative to the deploy.json's directory
+	readinessFile string
+
+	// HealthTokenFile, relative to the deploy.json's directory
+	healthTokenFile string
+
+	// the deploy.json's directory
+	dir string
+
+	// Templates, relative to the deploy.json's directory
+	templates []TemplateFile
+
+	stopSignal syscall.Signal
 }
 
+// HealthTransport tunes the connections health checks make. The zero value
+// is plain HTTP/1.1 with camus's default timeouts.
+type HealthTransport struct {
+	// Use HTTP/2 without TLS (h2c), for apps that only speak HTTP/2.
+	Http2 bool
+
+	// Don't verify the certificate of HTTPS health checks.
+	TlsSkipVerify bool
+
+	// How long to wait to connect, 0 for no limit beyond the overall
+	// health check time.
+	ConnectTimeout time.Duration
+
+	// How long each health check can take, 0 for the server's default.
+	Timeout time.Duration
+
+	DisableKeepAlives bool
+
+	// Follow redirects to the same host and port, rather than failing on
+	// any redirect.
+	SameOriginRedirects bool
+}
+
+// HealthCheck is one of the requests in a deploy.json's HealthChecks.
+type HealthCheck struct {
+	// Put after the HealthBasePath, like HealthEndpoint.
+	Path string
+
+	// GET if empty.
+	Method string
+
+	// The status the response must have, 200 if 0.
+	Status int
+}
+
+// TemplateFile is one of the files in a deploy.json's Templates.
+type TemplateFile struct {
+	// A text/template, rendered with a templateContext.
+	Source string
+
+	// Where the rendered file is written, replacing any already there.
+	Dest string
+}
+
+// Deploy Type values.
+const (
+	// A server that keeps running on its port, the default.
+	DEPLOY_TYPE_SERVICE = "service"
+
+	// A command that runs to completion, on no port.
+	DEPLOY_TYPE_JOB = "job"
+)
+
+// PortFallback values.
+const (
+	// Run fails if the preferred port isn't free.
+	PORT_FALLBACK_STRICT = "strict"
+
+	// Run uses another port, as though there were no preferred port.
+	PORT_FALLBACK_DYNAMIC = "dynamic"
+)
+
+// HealthCertExpiry values.
+const (
+	// A certificate within HealthCertMinDays of expiring fails the health
+	// check.
+	HEALTH_CERT_EXPIRY_FAIL = "fail"
+
+	// It's only logged, and reported in Deploy.CertExpiry as always.
+	HEALTH_CERT_EXPIRY_WARN = "warn"
+)
+
+// HealthRedirects values.
+const (
+	// Any redirect fails the health check.
+	HEALTH_REDIRECTS_NONE = "none"
+
+	// Redirects to the same host and port are followed, e.g. / to
+	// /health. Others still fail, as they're likely a misrouted proxy.
+	HEALTH_REDIRECTS_SAME_ORIGIN = "same-origin"
+)
+
+// IoClass values, as in ionice(1).
+const (
+	// Gets the disk first, regardless of others. Needs privileges.
+	IO_CLASS_REALTIME = "realtime"
+
+	// Shares the disk, by IoPriority. The default class.
+	IO_CLASS_BEST_EFFORT = "best-effort"
+
+	// Only gets the disk when nothing else wants it.
+	IO_CLASS_IDLE = "idle"
+)
+
+var namedPortPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// namedPortVar is the environment variable, and the %..% placeholder, a
+// NamedPorts port is passed to the app in.
+func namedPortVar(name string) string {
+	return "PORT_" + strings.ToUpper(name)
+}
+
+// StartupCriteria values.
+const (
+	// Once the app passes its health check, camus checks it again, and
+	// that what it started is still running, before the app counts as
+	// started. A RunCmd that starts the app in the background and exits
+	// is fine, as long as something is left in its process group.
+	STARTUP_CRITERIA_ALIVE_AND_HEALTHY = "alive-and-healthy"
+
+	// Passing the health check is enough, even if the app exits straight
+	// after.
+	STARTUP_CRITERIA_HEALTHY = "healthy"
+)
+
 type Target struct {
 	Ssh string // e.g. user@host
 
@@ -48,8 +348,227 @@ type ApplicationDef struct {
 	// needs a %PORT% part for port subsitution
 	RunCmd string
 
+	// Program and arguments RunCmd is appended to, e.g. ["bash", "-c"].
+	// Defaults to ["sh", "-c"].
+	Shell []string
+
+	// DEPLOY_TYPE_JOB for a deploy that runs to completion rather than
+	// serving on a port. Defaults to DEPLOY_TYPE_SERVICE.
+	Type string
+
+	// Optional program and arguments to run directly, without a shell,
+	// instead of RunCmd. Any of them can have a %PORT% part.
+	RunArgv []string
+
 	HealthEndpoint string
 
+	// Optional health check paths to try in order instead of
+	// HealthEndpoint, for deploys whose versions differ, e.g. /healthz
+	// then /status. The first to pass is used.
+	HealthEndpoints []string
+
+	// Optional further requests that must all get the expected response
+	// while the app starts, as well as the HealthEndpoint, e.g. for apps
+	// that are only ready once /db and /cache are.
+	HealthChecks []HealthCheck
+
+	// Optional path the app is served under, e.g. /app1, that health checks
+	// put before HealthEndpoint.
+	HealthBasePath string
+
+	// Optional regular expression the health check response body must
+	// match, for apps that report their real status in the body.
+	HealthBodyMatch string
+
+	// Optional headers the health check response must have, e.g.
+	// {"X-Health": "ok"}, for apps that report their status in headers.
+	HealthHeaders map[string]string
+
+	// Optional health check statuses that count as healthy, as a list of
+	// statuses and ranges like "200-299" or "200,204". Defaults to 200.
+	HealthStatuses string
+
+	// User-Agent for health checks, so they can be told apart in the app's
+	// logs. Defaults to camus-healthcheck/<Name>.
+	HealthUserAgent string
+
+	// Optional file, absolute or relative to the deploy dir, holding a token
+	// for health checks to send as "Authorization: Bearer <token>". It's
+	// read for every check, so the token can be rotated while the app runs.
+	HealthTokenFile string
+
+	// Optional file, relative to the deploy dir, the app creates once it's
+	// ready, for apps that don't serve HTTP. It's checked instead of the
+	// HealthEndpoint, and removed before the app starts.
+	ReadinessFile string
+
+	// Optional text the ReadinessFile must contain to count as ready.
+	ReadinessContent string
+
+	// Optional command, run with the Shell in the deploy dir, that prints
+	// JSON about whether the app is ready, e.g. "./myapp status --json",
+	// for apps with a management command rather than HTTP readiness. It's
+	// checked instead of the HealthEndpoint: ReadinessField of its output,
+	// a dotted path like "state" or "db.state", must be ReadinessValue.
+	// %PORT% is replaced as in RunCmd.
+	ReadinessCmd   string
+	ReadinessField string
+	ReadinessValue string
+
+	// Make health checks with HTTP/2 over plain http.
+	HealthHttp2 bool
+
+	// Make health checks and warmup requests over HTTPS, for apps that
+	// only serve TLS, optionally without verifying the certificate, e.g.
+	// a self-signed one.
+	HealthHttps         bool
+	HealthTlsSkipVerify bool
+
+	// Optional number of days the app's certificate must still be valid
+	// for in HTTPS health checks, and whether one expiring sooner fails
+	// the health check or is only logged, one of the HEALTH_CERT_EXPIRY_
+	// values (fail if empty).
+	HealthCertMinDays int
+	HealthCertExpiry  string
+
+	// Optional limit on connecting for health checks, in milliseconds.
+	HealthConnectTimeoutMs int
+
+	// Optional limit on each health check, in milliseconds, instead of the
+	// server's HealthTimeoutMs or MAX_HEALTH_CHECK_TIME.
+	HealthTimeoutMs int
+
+	// Optional latency, in milliseconds, above which a health check fails
+	// even if it returned 200.
+	HealthMaxLatencyMs int
+
+	// Use a new connection for every health check.
+	HealthDisableKeepAlives bool
+
+	// Which redirects health checks follow, one of the HEALTH_REDIRECTS_
+	// values. None if empty.
+	HealthRedirects string
+
+	// What it takes for the app to count as started, one of the
+	// STARTUP_CRITERIA_ values. Alive and healthy if empty.
+	StartupCriteria string
+
+	// Optional number of startup health checks in a row that may time out,
+	// i.e. the app accepted the connection but hung, before the start
+	// fails rather than waiting out the startup time. Connections being
+	// refused, as before the app opens its port, never count.
+	StartupHealthTimeouts int
+
+	// Optional time the app is known to take before it opens its port, in
+	// milliseconds. Health checks only start after it.
+	StartupDelayMs int
+
+	// Optional time, in milliseconds, the app must keep passing its health
+	// check after the first pass, for apps that flap while they finish
+	// starting.
+	StabilizationMs int
+
+	// Paths to request once the app is healthy, to warm up caches before
+	// it gets real traffic.
+	WarmupPaths []string
+
+	// Log the details of every startup health check for this deploy.
+	Verbose bool
+
+	// Environment variables set for the app, in addition to camus's own.
+	Env map[string]string
+
+	// Files rendered with the app's port and environment every time it's
+	// started, for apps whose config file needs them, relative to the
+	// deploy dir.
+	Templates []TemplateFile
+
+	// Don't pass camus's own environment to the app, so it can't see
+	// anything camus was started with, e.g. credentials. It only gets Env
+	// and its port.
+	CleanEnv bool
+
+	// Start the app in camus's own process group rather than its own, so
+	// it dies with camus, e.g. in a container where camus is pid 1.
+	NoDetach bool
+
+	// Name of the environment variable set to the app's port, for apps
+	// that don't take it on the command line. Defaults to PORT.
+	PortEnv string
+
+	// Optional port to run the app on, e.g. so it's always the same one,
+	// and what to do if it's taken: PORT_FALLBACK_STRICT (the default) or
+	// PORT_FALLBACK_DYNAMIC.
+	PreferredPort int
+	PortFallback  string
+
+	// Optional names of extra ports the app listens on, e.g. "metrics" and
+	// "admin". Run allocates each from the range as well as the main port,
+	// and they're passed in as %PORT_<NAME>% in RunCmd and RunArgv and as
+	// PORT_<NAME> in the environment, with the name upper-cased. Health
+	// checks and haproxy only use the main port.
+	NamedPorts []string
+
+	// Optional umask for the app, in octal, e.g. "027", so the files it
+	// creates don't depend on camus's umask.
+	Umask string
+
+	// Optional CPU niceness for the app, from -20 (most favoured, which
+	// needs privileges) to 19, e.g. so a batch job doesn't slow down the
+	// services next to it.
+	Nice int
+
+	// Optional IO scheduling class for the app, one of the IO_CLASS_
+	// values, and its priority within realtime and best-effort, from 0
+	// (highest) to 7. Linux only, set with ionice.
+	IoClass    string
+	IoPriority int
+
+	// Optional memory, in megabytes, and CPU, in thousandths of a CPU, the
+	// app is expected to use. A server with a HostBudget in its config
+	// won't run more deploys than it has room for.
+	MemoryMb  int
+	CpuMillis int
+
+	// Names of files in the server's secrets dir to pass to the app. The
+	// first can be read from fd 3, the second from fd 4 and so on.
+	Secrets []string
+
+	// Name of the signal used to stop the app, e.g. SIGINT. Defaults to
+	// SIGTERM.
+	StopSignal string
+
+	// How long the app has to release its port after StopSignal before
+	// it's sent SIGKILL. Defaults to the server's StopTimeoutMs.
+	StopTimeoutMs int
+
+	// Optional limit on how many times Enforce restarts the app within
+	// RestartWindowMs, for apps that start fine but crash soon after. Once
+	// it's reached, the deploy is quarantined instead. Restarts drop out of
+	// the window as it passes, so one that has stayed up for the window is
+	// back to none. RestartWindowMs defaults to DEFAULT_RESTART_WINDOW.
+	MaxRestarts     int
+	RestartWindowMs int
+
+	// What Enforce does when the app has exited, RESTART_POLICY_RESTART
+	// by default, and when it's still running but has failed
+	// UnhealthyChecks (default DEFAULT_UNHEALTHY_CHECKS) health checks in
+	// a row, RESTART_POLICY_LEAVE by default, e.g. as it may just be
+	// overloaded.
+	OnCrash         string
+	OnUnhealthy     string
+	UnhealthyChecks int
+
+	// How Enforce checks the app once it's running, independently of the
+	// startup health check, e.g. a cheap LIVENESS_CHECK_TCP connect rather
+	// than the full HTTP check: one of the LIVENESS_CHECK_ values (HTTP if
+	// empty), the path for an HTTP check (the health endpoints if empty)
+	// and the least time in milliseconds between checks (every Enforce if
+	// 0).
+	LivenessCheck      string
+	LivenessPath       string
+	LivenessIntervalMs int
+
 	// e.g. user@host  (no path)
 	Targets map[TargetName]*Target
 
@@ -58,22 +577,79 @@ type ApplicationDef struct {
 	GroupTargets map[TargetName][]TargetName
 }
 
+// ApplicationFromConfig loads a deploy.json from file, which may also be an
+// http(s) URL. Unknown fields are logged and ignored, see
+// StrictApplicationFromConfig.
 func ApplicationFromConfig(isClient bool, file string) (Application, error) {
+	return applicationFromConfig(isClient, file, "/", nil, false)
+}
+
+// StrictApplicationFromConfig is ApplicationFromConfig, except unknown
+// fields, which are usually typos, are errors.
+func StrictApplicationFromConfig(isClient bool, file string) (Application, error) {
+	return applicationFromConfig(isClient, file, "/", nil, true)
+}
+
+// applicationFromConfig is ApplicationFromConfig, with the HealthEndpoint
+// servers use for deploys that don't give one, an optional schema the file
+// must match as well as deployJsonSchema and whether unknown fields are
+// errors.
+func applicationFromConfig(isClient bool, file string, defaultHealthEndpoint string, schema *jsonSchema, strict bool) (Application, error) {
 	var def ApplicationDef
 
-	data, err := ioutil.ReadFile(file)
+	data, err := readConfigSource(file)
 	if err != nil {
 		return nil, err
 	}
+	data = stripJsonComments(data)
 
 	errMsg := func(str string, args ...interface{}) (Application, error) {
 		return nil, fmt.Errorf("deploy.json: "+str, args...)
 	}
 
+	if data, err = resolveIncludes(file, data); err != nil {
+		return errMsg("%s", err)
+	}
+
+	problems, err := validateJson(deployJsonSchema, data)
+	if err != nil {
+		return errMsg(fmt.Sprintf("Invalid json %s", err))
+	}
+	if !strict {
+		known, unknown := []string{}, []string{}
+		for _, problem := range problems {
+			if isUnknownFieldProblem(problem) {
+				unknown = append(unknown, problem)
+			} else {
+				known = append(known, problem)
+			}
+		}
+		if len(unknown) > 0 {
+			log.Printf("warning: %s: ignoring %s\n", file, strings.Join(unknown, "; "))
+		}
+		problems = known
+	}
+	if schema != nil {
+		more, _ := validateJson(schema, data)
+		problems = append(problems, more...)
+	}
+	if len(problems) > 0 {
+		return errMsg("%d schema problems: %s", len(problems), strings.Join(problems, "; "))
+	}
+	if !strict {
+		if data, err = dropUnknownFields(deployJsonSchema, data); err != nil {
+			return errMsg(fmt.Sprintf("Invalid json %s", err))
+		}
+	}
+
 	if err := json.Unmarshal(data, &def); err != nil {
 		return errMsg(fmt.Sprintf("Invalid json %s", err))
 	}
 
+	if err := expandDefEnv(&def); err != nil {
+		return errMsg("%s", err)
+	}
+
 	if isClient {
 		if len(def.Name) == 0 {
 			return errMsg("Missing Name")
@@ -116,24 +692,418 @@ func ApplicationFromConfig(isClient bool, file string) (Application, error) {
 		}
 	}
 
-	if len(def.RunCmd) == 0 {
+	if len(def.RunArgv) > 0 {
+		if len(def.RunCmd) > 0 {
+			return errMsg("Only one of RunCmd and RunArgv can be given")
+		}
+		if len(def.Shell) > 0 {
+			return errMsg("Shell is only used with RunCmd, not RunArgv")
+		}
+		if def.RunArgv[0] == "" {
+			return errMsg("Missing RunArgv program")
+		}
+	} else if len(def.RunCmd) == 0 {
 		return errMsg("Missing RunCmd")
 	}
+	if len(def.Shell) == 0 {
+		def.Shell = []string{"sh", "-c"}
+	} else if def.Shell[0] == "" {
+		return errMsg("Missing Shell program")
+	}
 
+	for _, endpoint := range def.HealthEndpoints {
+		if endpoint == "" {
+			return errMsg("HealthEndpoints can't have an empty path")
+		}
+	}
+	if len(def.HealthEndpoint) == 0 && len(def.HealthEndpoints) > 0 {
+		def.HealthEndpoint = def.HealthEndpoints[0]
+	}
 	if len(def.HealthEndpoint) == 0 {
 		if isClient {
 			return errMsg("Missing HealthEndpoint")
 		} else {
-			def.HealthEndpoint = "/"
+			def.HealthEndpoint = defaultHealthEndpoint
+		}
+	}
+
+	checks := []HealthCheck{}
+	for _, check := range def.HealthChecks {
+		if !strings.HasPrefix(check.Path, "/") {
+			return errMsg("HealthChecks paths should start with /, not %q", check.Path)
+		}
+		if check.Method == "" {
+			check.Method = "GET"
+		}
+		if check.Status == 0 {
+			check.Status = 200
+		} else if check.Status < 100 || check.Status > 599 {
+			return errMsg("Invalid HealthChecks status %d for %s", check.Status, check.Path)
+		}
+		checks = append(checks, check)
+	}
+	def.HealthChecks = checks
+
+	if def.HealthTimeoutMs < 0 {
+		return errMsg("HealthTimeoutMs must be positive")
+	}
+
+	switch def.HealthRedirects {
+	case "", HEALTH_REDIRECTS_NONE, HEALTH_REDIRECTS_SAME_ORIGIN:
+	default:
+		return errMsg("Unknown HealthRedirects %s", def.HealthRedirects)
+	}
+	if def.HealthHttps && def.HealthHttp2 {
+		return errMsg("HealthHttp2 is plain http, so can't be used with HealthHttps")
+	}
+	if !def.HealthHttps && (def.HealthTlsSkipVerify || def.HealthCertMinDays != 0) {
+		return errMsg("HealthTlsSkipVerify and HealthCertMinDays are only used with HealthHttps")
+	}
+	if def.HealthCertMinDays < 0 {
+		return errMsg("HealthCertMinDays must be positive")
+	}
+	switch def.HealthCertExpiry {
+	case "":
+		def.HealthCertExpiry = HEALTH_CERT_EXPIRY_FAIL
+	case HEALTH_CERT_EXPIRY_FAIL, HEALTH_CERT_EXPIRY_WARN:
+		if def.HealthCertMinDays == 0 {
+			return errMsg("HealthCertExpiry is only used with HealthCertMinDays")
+		}
+	default:
+		return errMsg("Unknown HealthCertExpiry %s", def.HealthCertExpiry)
+	}
+	switch def.StartupCriteria {
+	case "":
+		def.StartupCriteria = STARTUP_CRITERIA_ALIVE_AND_HEALTHY
+	case STARTUP_CRITERIA_ALIVE_AND_HEALTHY, STARTUP_CRITERIA_HEALTHY:
+	default:
+		return errMsg("Unknown StartupCriteria %s", def.StartupCriteria)
+	}
+	if def.StartupHealthTimeouts < 0 {
+		return errMsg("StartupHealthTimeouts must be positive")
+	}
+	if def.HealthMaxLatencyMs < 0 {
+		return errMsg("HealthMaxLatencyMs must be positive")
+	}
+	if def.StartupDelayMs < 0 {
+		return errMsg("StartupDelayMs must be positive")
+	}
+	if def.StabilizationMs < 0 {
+		return errMsg("StabilizationMs must be positive")
+	}
+	if def.StopTimeoutMs < 0 {
+		return errMsg("StopTimeoutMs must be positive")
+	}
+	if def.MaxRestarts < 0 || def.RestartWindowMs < 0 {
+		return errMsg("MaxRestarts and RestartWindowMs must be positive")
+	}
+	if def.RestartWindowMs != 0 && def.MaxRestarts == 0 {
+		return errMsg("RestartWindowMs is only used with MaxRestarts")
+	}
+	if def.OnCrash == "" {
+		def.OnCrash = RESTART_POLICY_RESTART
+	}
+	if def.OnUnhealthy == "" {
+		def.OnUnhealthy = RESTART_POLICY_LEAVE
+	}
+	for _, policy := range []string{def.OnCrash, def.OnUnhealthy} {
+		if policy != RESTART_POLICY_RESTART && policy != RESTART_POLICY_LEAVE {
+			return errMsg("Unknown restart policy %s", policy)
+		}
+	}
+	switch def.LivenessCheck {
+	case "":
+		def.LivenessCheck = LIVENESS_CHECK_HTTP
+	case LIVENESS_CHECK_HTTP, LIVENESS_CHECK_TCP:
+	default:
+		return errMsg("Unknown LivenessCheck %s", def.LivenessCheck)
+	}
+	if def.LivenessPath != "" {
+		if def.LivenessCheck != LIVENESS_CHECK_HTTP {
+			return errMsg("LivenessPath is only used with an %s LivenessCheck", LIVENESS_CHECK_HTTP)
+		}
+		if !strings.HasPrefix(def.LivenessPath, "/") {
+			return errMsg("LivenessPath should start with /, not %q", def.LivenessPath)
+		}
+	}
+	if def.LivenessIntervalMs < 0 {
+		return errMsg("LivenessIntervalMs must be positive")
+	}
+	if def.UnhealthyChecks < 0 {
+		return errMsg("UnhealthyChecks must be positive")
+	} else if def.UnhealthyChecks == 0 {
+		def.UnhealthyChecks = DEFAULT_UNHEALTHY_CHECKS
+	}
+	if def.MemoryMb < 0 || def.CpuMillis < 0 {
+		return errMsg("MemoryMb and CpuMillis must be positive")
+	}
+	if def.Umask != "" {
+		umask, err := strconv.ParseUint(def.Umask, 8, 32)
+		if err != nil || umask > 0777 {
+			return errMsg("Umask should be octal, e.g. 027, not %s", def.Umask)
+		}
+		def.Umask = fmt.Sprintf("%04o", umask)
+	}
+	if def.Nice < -20 || def.Nice > 19 {
+		return errMsg("Nice must be between -20 and 19, not %d", def.Nice)
+	}
+	switch def.IoClass {
+	case "":
+		if def.IoPriority != 0 {
+			return errMsg("IoPriority is only used with IoClass")
+		}
+	case IO_CLASS_IDLE:
+		if def.IoPriority != 0 {
+			return errMsg("IoPriority isn't used with the idle IoClass")
+		}
+	case IO_CLASS_REALTIME, IO_CLASS_BEST_EFFORT:
+		if def.IoPriority < 0 || def.IoPriority > 7 {
+			return errMsg("IoPriority must be between 0 and 7, not %d", def.IoPriority)
+		}
+	default:
+		return errMsg("Unknown IoClass %s", def.IoClass)
+	}
+
+	if def.HealthUserAgent == "" {
+		def.HealthUserAgent = "camus-healthcheck"
+		if def.Name != "" {
+			def.HealthUserAgent += "/" + def.Name
+		}
+	}
+
+	if def.HealthBasePath != "" && !strings.HasPrefix(def.HealthBasePath, "/") {
+		return errMsg("HealthBasePath should start with /")
+	}
+
+	switch def.Type {
+	case "":
+		def.Type = DEPLOY_TYPE_SERVICE
+	case DEPLOY_TYPE_SERVICE, DEPLOY_TYPE_JOB:
+	default:
+		return errMsg("Unknown Type %s", def.Type)
+	}
+
+	if def.PreferredPort < 0 {
+		return errMsg("PreferredPort must be positive")
+	}
+	switch def.PortFallback {
+	case "":
+		def.PortFallback = PORT_FALLBACK_STRICT
+	case PORT_FALLBACK_STRICT, PORT_FALLBACK_DYNAMIC:
+	default:
+		return errMsg("Unknown PortFallback %s", def.PortFallback)
+	}
+
+	if def.PortEnv == "" {
+		def.PortEnv = "PORT"
+	} else if strings.ContainsAny(def.PortEnv, "= ") {
+		return errMsg("Invalid PortEnv %s", def.PortEnv)
+	}
+	namedPorts := map[string]bool{}
+	for _, name := range def.NamedPorts {
+		if !namedPortPattern.MatchString(name) {
+			return errMsg("Invalid NamedPorts name %q, use letters, digits and _", name)
+		}
+		if namedPorts[namedPortVar(name)] {
+			return errMsg("NamedPorts has %s twice", name)
 		}
+		namedPorts[namedPortVar(name)] = true
 	}
 
-	return &AppImpl{def}, nil
+	if def.ReadinessFile != "" {
+		if path.IsAbs(def.ReadinessFile) || strings.HasPrefix(path.Clean(def.ReadinessFile), "..") {
+			return errMsg("ReadinessFile should be relative to the deploy dir, not %s", def.ReadinessFile)
+		}
+	} else if def.ReadinessContent != "" {
+		return errMsg("ReadinessContent is only used with a ReadinessFile")
+	}
+	if def.ReadinessCmd != "" {
+		if def.ReadinessFile != "" {
+			return errMsg("Use a ReadinessFile or a ReadinessCmd, not both")
+		}
+		if def.ReadinessField == "" {
+			return errMsg("ReadinessCmd needs a ReadinessField to check")
+		}
+	} else if def.ReadinessField != "" || def.ReadinessValue != "" {
+		return errMsg("ReadinessField and ReadinessValue are only used with a ReadinessCmd")
+	}
+	healthStatuses, err := parseStatusRanges(def.HealthStatuses)
+	if err != nil {
+		return errMsg("Invalid HealthStatuses: %s", err)
+	}
+	if def.HealthStatuses != "" && (def.ReadinessFile != "" || def.ReadinessCmd != "") {
+		return errMsg("HealthStatuses isn't used with a ReadinessFile or ReadinessCmd")
+	}
+
+	for _, tmpl := range def.Templates {
+		for _, p := range []string{tmpl.Source, tmpl.Dest} {
+			if p == "" || path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+				return errMsg("Templates should have a Source and Dest in the deploy dir, not %q and %q", tmpl.Source, tmpl.Dest)
+			}
+		}
+		if path.Clean(tmpl.Source) == path.Clean(tmpl.Dest) {
+			return errMsg("Template %s would be rendered over itself", tmpl.Source)
+		}
+	}
+
+	app := &AppImpl{def: def, dir: configDir(file), healthStatuses: healthStatuses}
+	for _, tmpl := range def.Templates {
+		app.templates = append(app.templates, TemplateFile{
+			Source: path.Join(app.dir, tmpl.Source),
+			Dest:   path.Join(app.dir, tmpl.Dest),
+		})
+	}
+	if def.ReadinessFile != "" {
+		app.readinessFile = path.Join(configDir(file), def.ReadinessFile)
+	}
+	if def.HealthTokenFile != "" {
+		app.healthTokenFile = def.HealthTokenFile
+		if !path.IsAbs(def.HealthTokenFile) {
+			app.healthTokenFile = path.Join(configDir(file), def.HealthTokenFile)
+		}
+	}
+	if def.HealthBodyMatch != "" {
+		re, err := regexp.Compile(def.HealthBodyMatch)
+		if err != nil {
+			return errMsg("Invalid HealthBodyMatch: %s", err)
+		}
+		app.healthBodyMatch = re
+	}
+
+	if def.StopSignal == "" {
+		def.StopSignal = "SIGTERM"
+	}
+	sig, name, ok := parseSignal(def.StopSignal)
+	if !ok {
+		return errMsg("Unknown StopSignal %s", def.StopSignal)
+	}
+	app.def.StopSignal = name
+	app.stopSignal = sig
+
+	return app, nil
+}
+
+// statusRange is the HTTP statuses from and to, inclusive.
+type statusRange struct {
+	from, to int
+}
+
+// parseStatusRanges parses a list like "200-299,304" into its ranges, a
+// single status being a range of one.
+func parseStatusRanges(list string) ([]statusRange, error) {
+	var ranges []statusRange
+	if strings.TrimSpace(list) == "" {
+		return ranges, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		r := statusRange{}
+		var err error
+		if r.from, err = strconv.Atoi(from); err == nil {
+			r.to, err = strconv.Atoi(to)
+		}
+		if err != nil || r.from < 100 || r.to > 599 || r.from > r.to {
+			return nil, fmt.Errorf("%q isn't a status or range of statuses", part)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// parseSignal looks up a signal by name, with or without the SIG prefix, and
+// returns it with its canonical name.
+func parseSignal(name string) (syscall.Signal, string, bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := stopSignals[name]
+	return sig, name, ok
+}
+
+// expandDefEnv expands ${VAR} references in the string fields of def that
+// hold commands, file and URL paths, and env values. It's done before def is
+// validated, so e.g. a ReadinessFile must still be in the deploy dir once
+// expanded. Secrets aren't expanded, being names in the server's secrets dir.
+func expandDefEnv(def *ApplicationDef) error {
+	fields := []*string{
+		&def.BuildCmd,
+		&def.BuildOutputDir,
+		&def.PostDeployCmd,
+		&def.RunCmd,
+		&def.HealthEndpoint,
+		&def.HealthBasePath,
+		&def.HealthBodyMatch,
+		&def.HealthTokenFile,
+		&def.ReadinessFile,
+		&def.ReadinessCmd,
+		&def.LivenessPath,
+	}
+	for _, list := range [][]string{def.Shell, def.RunArgv, def.HealthEndpoints, def.WarmupPaths} {
+		for i := range list {
+			fields = append(fields, &list[i])
+		}
+	}
+	for i := range def.HealthChecks {
+		fields = append(fields, &def.HealthChecks[i].Path)
+	}
+	for i := range def.Templates {
+		fields = append(fields, &def.Templates[i].Source, &def.Templates[i].Dest)
+	}
+	for _, field := range fields {
+		expanded, err := expandEnv(*field)
+		if err != nil {
+			return err
+		}
+		*field = expanded
+	}
+
+	for key, value := range def.Env {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return fmt.Errorf("Env.%s: %s", key, err)
+		}
+		def.Env[key] = expanded
+	}
+	return nil
+}
+
+// MarshalJSON encodes the app as the deploy.json it was loaded from, with
+// defaults filled in and environment variables expanded.
+func (a *AppImpl) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&a.def)
 }
 
 func (a *AppImpl) RunCmd(port int) string {
+	if len(a.def.RunArgv) > 0 {
+		return strings.Join(a.RunArgv(port), " ")
+	}
 	return strings.Replace(a.def.RunCmd, "%PORT%", fmt.Sprintf("%d", port), -1)
 }
+func (a *AppImpl) RunArgv(port int) []string {
+	if len(a.def.RunArgv) == 0 {
+		return append(append([]string{}, a.def.Shell...), a.RunCmd(port))
+	}
+	argv := []string{}
+	for _, arg := range a.def.RunArgv {
+		argv = append(argv, strings.Replace(arg, "%PORT%", fmt.Sprintf("%d", port), -1))
+	}
+	return argv
+}
 func (a *AppImpl) Targets(name TargetName) (targets []*Target) {
 	if t, ok := a.def.Targets[name]; ok {
 		return []*Target{t}
@@ -161,3 +1131,187 @@ func (a *AppImpl) BuildOutputDir() string {
 func (a *AppImpl) HealthEndpoint() string {
 	return a.def.HealthEndpoint
 }
+func (a *AppImpl) HealthEndpoints() []string {
+	if len(a.def.HealthEndpoints) > 0 {
+		return a.def.HealthEndpoints
+	}
+	return []string{a.def.HealthEndpoint}
+}
+func (a *AppImpl) HealthChecks() []HealthCheck {
+	return a.def.HealthChecks
+}
+func (a *AppImpl) HealthBasePath() string {
+	return a.def.HealthBasePath
+}
+func (a *AppImpl) HealthBodyMatch() *regexp.Regexp {
+	return a.healthBodyMatch
+}
+func (a *AppImpl) ReadinessFile() string {
+	return a.readinessFile
+}
+func (a *AppImpl) ReadinessContent() string {
+	return a.def.ReadinessContent
+}
+func (a *AppImpl) ReadinessCmd(port int) []string {
+	if a.def.ReadinessCmd == "" {
+		return nil
+	}
+	cmd := strings.Replace(a.def.ReadinessCmd, "%PORT%", fmt.Sprintf("%d", port), -1)
+	return append(append([]string{}, a.def.Shell...), cmd)
+}
+func (a *AppImpl) ReadinessField() string {
+	return a.def.ReadinessField
+}
+func (a *AppImpl) ReadinessValue() string {
+	return a.def.ReadinessValue
+}
+func (a *AppImpl) Dir() string {
+	return a.dir
+}
+func (a *AppImpl) Templates() []TemplateFile {
+	return a.templates
+}
+func (a *AppImpl) HealthUserAgent() string {
+	return a.def.HealthUserAgent
+}
+func (a *AppImpl) HealthTokenFile() string {
+	return a.healthTokenFile
+}
+func (a *AppImpl) HealthHeaders() map[string]string {
+	return a.def.HealthHeaders
+}
+func (a *AppImpl) HealthyStatus(status int) bool {
+	if len(a.healthStatuses) == 0 {
+		return status == 200
+	}
+	for _, r := range a.healthStatuses {
+		if status >= r.from && status <= r.to {
+			return true
+		}
+	}
+	return false
+}
+func (a *AppImpl) WarmupPaths() []string {
+	return a.def.WarmupPaths
+}
+func (a *AppImpl) StartupCriteria() string {
+	return a.def.StartupCriteria
+}
+func (a *AppImpl) StartupHealthTimeouts() int {
+	return a.def.StartupHealthTimeouts
+}
+func (a *AppImpl) HealthTransport() HealthTransport {
+	return HealthTransport{
+		Http2:             a.def.HealthHttp2,
+		TlsSkipVerify:     a.def.HealthTlsSkipVerify,
+		ConnectTimeout:    time.Duration(a.def.HealthConnectTimeoutMs) * time.Millisecond,
+		Timeout:           time.Duration(a.def.HealthTimeoutMs) * time.Millisecond,
+		DisableKeepAlives: a.def.HealthDisableKeepAlives,
+
+		SameOriginRedirects: a.def.HealthRedirects == HEALTH_REDIRECTS_SAME_ORIGIN,
+	}
+}
+func (a *AppImpl) HealthScheme() string {
+	if a.def.HealthHttps {
+		return "https"
+	}
+	return "http"
+}
+func (a *AppImpl) HealthCertMinValidity() time.Duration {
+	return time.Duration(a.def.HealthCertMinDays) * 24 * time.Hour
+}
+func (a *AppImpl) HealthCertExpiry() string {
+	return a.def.HealthCertExpiry
+}
+func (a *AppImpl) HealthMaxLatency() time.Duration {
+	return time.Duration(a.def.HealthMaxLatencyMs) * time.Millisecond
+}
+func (a *AppImpl) StartupDelay() time.Duration {
+	return time.Duration(a.def.StartupDelayMs) * time.Millisecond
+}
+func (a *AppImpl) Stabilization() time.Duration {
+	return time.Duration(a.def.StabilizationMs) * time.Millisecond
+}
+func (a *AppImpl) Verbose() bool {
+	return a.def.Verbose
+}
+func (a *AppImpl) Env() []string {
+	env := []string{}
+	for key, value := range a.def.Env {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+func (a *AppImpl) CleanEnv() bool {
+	return a.def.CleanEnv
+}
+func (a *AppImpl) Detach() bool {
+	return !a.def.NoDetach
+}
+func (a *AppImpl) StopTimeout() time.Duration {
+	return time.Duration(a.def.StopTimeoutMs) * time.Millisecond
+}
+func (a *AppImpl) MaxRestarts() int {
+	return a.def.MaxRestarts
+}
+func (a *AppImpl) RestartWindow() time.Duration {
+	if a.def.RestartWindowMs == 0 {
+		return DEFAULT_RESTART_WINDOW
+	}
+	return time.Duration(a.def.RestartWindowMs) * time.Millisecond
+}
+func (a *AppImpl) OnCrash() string {
+	return a.def.OnCrash
+}
+func (a *AppImpl) OnUnhealthy() string {
+	return a.def.OnUnhealthy
+}
+func (a *AppImpl) UnhealthyChecks() int {
+	return a.def.UnhealthyChecks
+}
+func (a *AppImpl) LivenessCheck() string {
+	return a.def.LivenessCheck
+}
+func (a *AppImpl) LivenessPath() string {
+	return a.def.LivenessPath
+}
+func (a *AppImpl) LivenessInterval() time.Duration {
+	return time.Duration(a.def.LivenessIntervalMs) * time.Millisecond
+}
+func (a *AppImpl) Resources() Resources {
+	return Resources{MemoryMb: a.def.MemoryMb, CpuMillis: a.def.CpuMillis}
+}
+func (a *AppImpl) Umask() string {
+	return a.def.Umask
+}
+func (a *AppImpl) Nice() int {
+	return a.def.Nice
+}
+func (a *AppImpl) IoClass() string {
+	return a.def.IoClass
+}
+func (a *AppImpl) IoPriority() int {
+	return a.def.IoPriority
+}
+func (a *AppImpl) PortEnv() string {
+	return a.def.PortEnv
+}
+func (a *AppImpl) NamedPorts() []string {
+	return a.def.NamedPorts
+}
+func (a *AppImpl) Type() string {
+	return a.def.Type
+}
+func (a *AppImpl) PreferredPort() int {
+	return a.def.PreferredPort
+}
+func (a *AppImpl) PortFallback() string {
+	return a.def.PortFallback
+}
+func (a *AppImpl) Secrets() []string {
+	return a.def.Secrets
+}
+func (a *AppImpl) StopSignal() syscall.Signal {
+	return a.stopSignal
+}
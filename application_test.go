@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes contents to a deploy.json in a new temp dir and
+// returns its path.
+func writeTestConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "camus-app-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(dir, "deploy.json")
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestInvalidHealthBodyMatch(t *testing.T) {
+	file := writeTestConfig(t, `{"RunCmd": "true", "HealthBodyMatch": "("}`)
+	defer os.RemoveAll(path.Dir(file))
+
+	if _, err := ApplicationFromConfig(false, file); err == nil {
+		t.Fatalf("expected an invalid HealthBodyMatch to be rejected")
+	}
+}
+
+func TestStopSignalNames(t *testing.T) {
+	for name, valid := range map[string]bool{"SIGINT": true, "int": true, "SIGBOGUS": false} {
+		file := writeTestConfig(t, `{"RunCmd": "true", "StopSignal": "`+name+`"}`)
+		defer os.RemoveAll(path.Dir(file))
+
+		app, err := ApplicationFromConfig(false, file)
+		if valid && (err != nil || app.StopSignal() != syscall.SIGINT) {
+			t.Errorf("expected %s to be SIGINT, got %v", name, err)
+		} else if !valid && err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestApplicationFromUrl(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "camus-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cacheDir)
+
+	var down int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"RunCmd": "node app.js %%PORT%%", "HealthEndpoint": "/status"}`)
+	}))
+	defer ts.Close()
+
+	app, err := ApplicationFromConfig(false, ts.URL+"/deploy.json")
+	if err != nil {
+		t.Fatalf("load from url: %s", err)
+	}
+	if app.HealthEndpoint() != "/status" {
+		t.Errorf("unexpected health endpoint %s", app.HealthEndpoint())
+	}
+
+	// Once the server is down, the saved copy is used.
+	defer func(cacheTime time.Duration) { REMOTE_CONFIG_CACHE_TIME = cacheTime }(REMOTE_CONFIG_CACHE_TIME)
+	REMOTE_CONFIG_CACHE_TIME = 0
+	atomic.StoreInt32(&down, 1)
+	if app, err := ApplicationFromConfig(false, ts.URL+"/deploy.json"); err != nil {
+		t.Errorf("expected the saved copy to be used: %s", err)
+	} else if app.RunCmd(8001) != "node app.js 8001" {
+		t.Errorf("unexpected run command %s", app.RunCmd(8001))
+	}
+
+	if _, err := ApplicationFromConfig(false, ts.URL+"/other.json"); err == nil {
+		t.Errorf("expected a url that was never fetched to fail")
+	} else if !strings.Contains(err.Error(), "status 500") {
+		t.Errorf("expected the fetch error, got %s", err)
+	}
+}
+
+func TestSchemaProblemsAllReported(t *testing.T) {
+	file := writeTestConfig(t, `{
+		"RunCmd": 3,
+		"healthEndpoint": "/status",
+		"Env": {"WORKERS": 4},
+		"Targets": {"prod": {"Ssh": "me@host", "Base": "8000"}}
+	}`)
+	defer os.RemoveAll(path.Dir(file))
+
+	_, err := StrictApplicationFromConfig(false, file)
+	if err == nil {
+		t.Fatalf("expected the manifest to be rejected")
+	}
+	for _, expected := range []string{
+		"RunCmd: should be string, not number",
+		"healthEndpoint: unknown field (did you mean HealthEndpoint?)",
+		"Env.WORKERS: should be string, not number",
+		"Targets.prod.Base: should be integer, not string",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q to be reported, got %s", expected, err)
+		}
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	file := writeTestConfig(t, `{"RunCmd": "true", "HealthEndpont": "/status"}`)
+	defer os.RemoveAll(path.Dir(file))
+
+	app, err := ApplicationFromConfig(false, file)
+	if err != nil {
+		t.Fatalf("expected an unknown field to be ignored by default: %s", err)
+	}
+	if app.HealthEndpoint() != "/" {
+		t.Errorf("expected the default HealthEndpoint, got %s", app.HealthEndpoint())
+	}
+
+	// Even one encoding/json would match, differing only in case.
+	wrongCase := writeTestConfig(t, `{"RunCmd": "true", "healthEndpoint": "/status", "Targets": {"prod": {"ssh": "me@host"}}}`)
+	defer os.RemoveAll(path.Dir(wrongCase))
+	app, err = ApplicationFromConfig(false, wrongCase)
+	if err != nil {
+		t.Fatalf("expected fields in the wrong case to be ignored by default: %s", err)
+	}
+	if app.HealthEndpoint() != "/" {
+		t.Errorf("expected healthEndpoint to be ignored, got %s", app.HealthEndpoint())
+	}
+	if targets := app.Targets("prod"); len(targets) != 1 || targets[0].Ssh != "" {
+		t.Errorf("expected a nested ssh to be ignored too, got %+v", targets)
+	}
+
+	_, err = StrictApplicationFromConfig(false, file)
+	if err == nil {
+		t.Fatalf("expected an unknown field to be rejected in strict mode")
+	}
+	if expected := "HealthEndpont: unknown field"; !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected %q to be reported, got %s", expected, err)
+	}
+
+	wrongType := writeTestConfig(t, `{"RunCmd": "true", "Extra": 1, "StopTimeoutMs": "10"}`)
+	defer os.RemoveAll(path.Dir(wrongType))
+	if _, err := ApplicationFromConfig(false, wrongType); err == nil {
+		t.Errorf("expected a value of the wrong type to be rejected even when unknown fields aren't")
+	} else if strings.Contains(err.Error(), "Extra") {
+		t.Errorf("expected only the wrong type to be reported, got %s", err)
+	}
+}
+
+func TestManifestSchema(t *testing.T) {
+	file := writeTestConfig(t, `{"RunCmd": "true", "Name": "payments api"}`)
+	defer os.RemoveAll(path.Dir(file))
+	schemaFile := path.Join(path.Dir(file), "schema.json")
+	schema := `{
+		"required": ["Name", "HealthEndpoint"],
+		"properties": {"Name": {"type": "string", "pattern": "^[a-z-]+$"}}
+	}`
+	if err := ioutil.WriteFile(schemaFile, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := readSchema(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = applicationFromConfig(false, file, "/", s, false)
+	if err == nil {
+		t.Fatalf("expected the manifest not to match the schema")
+	}
+	for _, expected := range []string{"(top level): missing HealthEndpoint", "Name: should match"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q to be reported, got %s", expected, err)
+		}
+	}
+	if _, err := ApplicationFromConfig(false, file); err != nil {
+		t.Errorf("expected the manifest to be valid without the extra schema: %s", err)
+	}
+}
+
+func TestCommentedConfig(t *testing.T) {
+	file := writeTestConfig(t, `{
+  // how it's started
+  "RunCmd": "./run.sh --url http://localhost/%PORT%", /* not a comment: "// */
+  /* the health
+     check */ "HealthEndpoint": "/status/*", // trailing
+  "Env": {"GREETING": "say \"//hi\""}
+}`)
+	defer os.RemoveAll(path.Dir(file))
+
+	app, err := ApplicationFromConfig(false, file)
+	if err != nil {
+		t.Fatalf("expected a commented deploy.json to load: %s", err)
+	}
+	if app.RunCmd(8001) != "./run.sh --url http://localhost/8001" {
+		t.Errorf("unexpected RunCmd %q", app.RunCmd(8001))
+	}
+	if app.HealthEndpoint() != "/status/*" {
+		t.Errorf("unexpected HealthEndpoint %q", app.HealthEndpoint())
+	}
+	if env := app.Env(); len(env) != 1 || env[0] != `GREETING=say "//hi"` {
+		t.Errorf("unexpected Env %v", env)
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	file := writeTestConfig(t, `{
+  "Include": ["common.json", "health.json"],
+  "RunCmd": "./run.sh",
+  "Env": {"ROLE": "api"}
+}`)
+	dir := path.Dir(file)
+	defer os.RemoveAll(dir)
+	for name, contents := range map[string]string{
+		"common.json": `{"RunCmd": "./default.sh", "Env": {"ROLE": "default", "REGION": "eu"}, "StartupDelayMs": 100}`,
+		"health.json": `{"Include": ["base/endpoint.json"], "HealthTimeoutMs": 500}`,
+		// relative to health.json's directory, which is the same here
+		"base/endpoint.json": `{"HealthEndpoint": "/status", "StartupDelayMs": 200}`,
+	} {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app, err := ApplicationFromConfig(false, file)
+	if err != nil {
+		t.Fatalf("expected the composed deploy.json to load: %s", err)
+	}
+	if app.RunCmd(8001) != "./run.sh" {
+		t.Errorf("expected the local RunCmd to win, got %q", app.RunCmd(8001))
+	}
+	if env := app.Env(); !reflect.DeepEqual(env, []string{"REGION=eu", "ROLE=api"}) {
+		t.Errorf("expected Env to be merged, got %v", env)
+	}
+	if app.HealthEndpoint() != "/status" || app.StartupDelay() != 200*time.Millisecond {
+		t.Errorf("expected the nested include to apply after common.json, got %s, %s",
+			app.HealthEndpoint(), app.StartupDelay())
+	}
+	if app.HealthTransport().Timeout != 500*time.Millisecond {
+		t.Errorf("expected HealthTimeoutMs from health.json, got %s", app.HealthTransport().Timeout)
+	}
+
+	// a cycle
+	if err := ioutil.WriteFile(path.Join(dir, "base/endpoint.json"), []byte(`{"Include": ["../deploy.json"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplicationFromConfig(false, file); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("expected an include cycle to be an error, got %v", err)
+	}
+
+	// files outside the deploy dir
+	outside, err := ioutil.TempFile("", "camus-include-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outside.Name())
+	outside.WriteString(`{"HealthEndpoint": "/status"}`)
+	outside.Close()
+	for _, include := range []string{outside.Name(), "../" + path.Base(outside.Name()), "base/../../" + path.Base(outside.Name())} {
+		escaping := writeTestConfig(t, `{"Include": ["`+include+`"], "RunCmd": "./run.sh"}`)
+		defer os.RemoveAll(path.Dir(escaping))
+		if _, err := ApplicationFromConfig(false, escaping); err == nil || !strings.Contains(err.Error(), "deploy dir") {
+			t.Errorf("expected Include %s to be refused, got %v", include, err)
+		}
+	}
+}
+
+func TestInvalidUmask(t *testing.T) {
+	for _, umask := range []string{"999", "-1", "1000", "rwx"} {
+		file := writeTestConfig(t, `{"RunCmd": "true", "Umask": "`+umask+`"}`)
+		defer os.RemoveAll(path.Dir(file))
+
+		if _, err := ApplicationFromConfig(false, file); err == nil {
+			t.Errorf("expected Umask %s to be rejected", umask)
+		}
+	}
+}
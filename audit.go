@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+const auditLogFileName = "audit.log"
+
+// AuditEntry is one record in the append-only audit log, written for every
+// operation that changes what is running or what is live.
+type AuditEntry struct {
+	Time      time.Time
+	Operation string
+	DeployId  string
+	Port      int
+
+	// Who asked for the operation, e.g. the user running the client, if
+	// they said, see WithActor.
+	Actor string `json:",omitempty"`
+
+	// The routing label, LABEL_ACTIVE or LABEL_CANARY, the operation
+	// changed, for those that change one.
+	Label string `json:",omitempty"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx saying that actor asked for the operations
+// it's given to, e.g. RunContext, for their audit entries.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorOf(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+func (s *ServerImpl) auditLogFile() string {
+	return path.Join(s.root, auditLogFileName)
+}
+
+// recordEvent appends an entry to the audit log and sends it to the
+// configured notifiers. The operation it records has already happened, so
+// failures are logged rather than returned.
+func (s *ServerImpl) recordEvent(operation string, deployId string, port int) {
+	s.recordEntry(AuditEntry{Operation: operation, DeployId: deployId, Port: port})
+}
+
+// recordEventFor is recordEvent for an operation asked for by ctx's actor,
+// if it has one, that changed label, if it's not empty.
+func (s *ServerImpl) recordEventFor(ctx context.Context, label string, operation string, deployId string, port int) {
+	s.recordEntry(AuditEntry{
+		Operation: operation,
+		DeployId:  deployId,
+		Port:      port,
+		Actor:     actorOf(ctx),
+		Label:     label,
+	})
+}
+
+func (s *ServerImpl) recordEntry(entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	if err := s.appendAudit(entry); err != nil {
+		log.Printf("warning: could not write audit entry %+v: %s\n", entry, err)
+	}
+	s.notify(entry)
+}
+
+func (s *ServerImpl) appendAudit(entry AuditEntry) error {
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+
+	f, err := os.OpenFile(s.auditLogFile(),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ReadAudit returns the most recent n audit entries, oldest first. If n <= 0
+// all entries are returned.
+func (s *ServerImpl) ReadAudit(n int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := s.scanAudit(func(entry AuditEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// AuditFilter picks audit entries for QueryAudit. Empty fields match
+// everything.
+type AuditFilter struct {
+	DeployId  string
+	Operation string
+
+	// The routing label, LABEL_ACTIVE or LABEL_CANARY, the entries changed.
+	Label string
+
+	// Entries at or after Since and before Until.
+	Since time.Time
+	Until time.Time
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.DeployId == "" || entry.DeployId == f.DeployId) &&
+		(f.Operation == "" || entry.Operation == f.Operation) &&
+		(f.Label == "" || entry.Label == f.Label) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+// QueryAudit returns the audit entries matching filter, oldest first. The log
+// is read an entry at a time, so only the matches are kept in memory.
+func (s *ServerImpl) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := s.scanAudit(func(entry AuditEntry) {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// scanAudit calls f with each audit entry, oldest first.
+func (s *ServerImpl) scanAudit(f func(entry AuditEntry)) error {
+	s.auditLock.Lock()
+	defer s.auditLock.Unlock()
+
+	file, err := os.Open(s.auditLogFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("warning: skipping unreadable audit entry: %s\n", err)
+			continue
+		}
+		f(entry)
+	}
+	return scanner.Err()
+}
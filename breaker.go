@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// States of a deploy's circuit breaker, as in Deploy.Breaker.
+const (
+	// Enforce starts the deploy as usual.
+	BREAKER_CLOSED = "closed"
+
+	// The deploy failed to start too often recently, so Enforce leaves it
+	// alone until the cooldown has passed.
+	BREAKER_OPEN = "open"
+
+	// The cooldown has passed. The next start decides whether the breaker
+	// closes again or reopens.
+	BREAKER_HALF_OPEN = "half-open"
+)
+
+// Defaults for WithCircuitBreaker.
+const DEFAULT_BREAKER_FAILURES = 3
+
+var DEFAULT_BREAKER_WINDOW = time.Duration(2) * time.Minute
+var DEFAULT_BREAKER_COOLDOWN = time.Duration(1) * time.Minute
+
+// WithCircuitBreaker makes Enforce stop restarting a deploy for cooldown once
+// it has failed to start failures times within window. 0 failures turns the
+// breaker off.
+func WithCircuitBreaker(failures int, window time.Duration, cooldown time.Duration) ServerOption {
+	return func(s *ServerImpl) {
+		s.breakerFailures = failures
+		s.breakerWindow = window
+		s.breakerCooldown = cooldown
+	}
+}
+
+type circuitBreaker struct {
+	// Failed starts within the window, oldest first.
+	failures []time.Time
+
+	// When the breaker last opened, zero if it's closed.
+	openedAt time.Time
+}
+
+func (b *circuitBreaker) state(now time.Time, cooldown time.Duration) string {
+	if b == nil || b.openedAt.IsZero() {
+		return BREAKER_CLOSED
+	} else if now.Before(b.openedAt.Add(cooldown)) {
+		return BREAKER_OPEN
+	}
+	return BREAKER_HALF_OPEN
+}
+
+// breakerState returns the state of deployId's circuit breaker.
+func (s *ServerImpl) breakerState(deployId string) string {
+	s.breakersLock.Lock()
+	defer s.breakersLock.Unlock()
+	return s.breakers[deployId].state(time.Now(), s.breakerCooldown)
+}
+
+// breakerFailed counts a failed start of deployId by Enforce towards its
+// circuit breaker, opening it if there have been too many.
+func (s *ServerImpl) breakerFailed(deployId string) {
+	if s.breakerFailures <= 0 {
+		return
+	}
+	s.breakersLock.Lock()
+	defer s.breakersLock.Unlock()
+
+	now := time.Now()
+	b, ok := s.breakers[deployId]
+	if !ok {
+		b = &circuitBreaker{}
+		s.breakers[deployId] = b
+	}
+	if b.state(now, s.breakerCooldown) == BREAKER_HALF_OPEN {
+		b.openedAt = now
+		log.Printf("circuit breaker for %s reopened for %s\n", deployId, s.breakerCooldown)
+		return
+	}
+
+	recent := []time.Time{}
+	for _, failure := range b.failures {
+		if now.Sub(failure) < s.breakerWindow {
+			recent = append(recent, failure)
+		}
+	}
+	b.failures = append(recent, now)
+	if len(b.failures) >= s.breakerFailures {
+		b.failures = nil
+		b.openedAt = now
+		log.Printf("circuit breaker for %s opened for %s after %d failed starts in %s\n",
+			deployId, s.breakerCooldown, s.breakerFailures, s.breakerWindow)
+	}
+}
+
+// breakerSucceeded closes deployId's circuit breaker.
+func (s *ServerImpl) breakerSucceeded(deployId string) {
+	s.breakersLock.Lock()
+	defer s.breakersLock.Unlock()
+	if b := s.breakers[deployId]; b != nil && !b.openedAt.IsZero() {
+		log.Printf("circuit breaker for %s closed\n", deployId)
+	}
+	delete(s.breakers, deployId)
+}
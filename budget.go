@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Resources is what a deploy is expected to use, from its deploy.json, or
+// what all deploys together may use, from the config's HostBudget. 0 is no
+// limit in a budget.
+type Resources struct {
+	MemoryMb  int
+	CpuMillis int
+}
+
+// checkBudget returns an error if starting app as deployId would take the
+// deploys configured on ports over the config's HostBudget. Deploys that
+// don't say what they use count as using nothing. Call with configLock held.
+func (s *ServerImpl) checkBudget(deployId string, app Application) error {
+	budget := s.config.HostBudget
+	if budget == nil {
+		return nil
+	}
+	used := Resources{}
+	for _, configured := range s.config.Ports {
+		if configured == deployId {
+			continue
+		}
+		other, err := s.loadAppNolock(configured)
+		if err != nil {
+			// nothing to count
+			continue
+		}
+		used.MemoryMb += other.Resources().MemoryMb
+		used.CpuMillis += other.Resources().CpuMillis
+	}
+
+	wanted := app.Resources()
+	shortfalls := []string{}
+	if budget.MemoryMb > 0 && used.MemoryMb+wanted.MemoryMb > budget.MemoryMb {
+		shortfalls = append(shortfalls, fmt.Sprintf("%dMB of memory but only %dMB is left",
+			wanted.MemoryMb, budget.MemoryMb-used.MemoryMb))
+	}
+	if budget.CpuMillis > 0 && used.CpuMillis+wanted.CpuMillis > budget.CpuMillis {
+		shortfalls = append(shortfalls, fmt.Sprintf("%d millicpus but only %d are left",
+			wanted.CpuMillis, budget.CpuMillis-used.CpuMillis))
+	}
+	if len(shortfalls) > 0 {
+		return fmt.Errorf("%s is over the host budget, it needs %s", deployId, strings.Join(shortfalls, ", and "))
+	}
+	return nil
+}
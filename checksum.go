@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Checksums live outside the deploy dirs, so they can't be changed along with
+// the files they describe.
+const checksumsDirName = "checksums"
+
+func (s *ServerImpl) checksumsFile(deployId string) string {
+	return path.Join(s.root, checksumsDirName, deployId+".json")
+}
+
+// RecordChecksums stores a hash of every file in the deploy's directory, to
+// be checked by VerifyChecksums later.
+func (s *ServerImpl) RecordChecksums(deployId string) error {
+	sums, err := computeChecksums(s.deployDir(deployId))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sums, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := s.checksumsFile(deployId)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, os.FileMode(0644))
+}
+
+// VerifyChecksums returns an error listing the files that were changed, added
+// or removed since RecordChecksums was called for the deploy.
+func (s *ServerImpl) VerifyChecksums(deployId string) error {
+	data, err := ioutil.ReadFile(s.checksumsFile(deployId))
+	if err != nil {
+		return fmt.Errorf("No checksums recorded for %s: %s", deployId, err)
+	}
+	recorded := map[string]string{}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return fmt.Errorf("Invalid checksums for %s: %s", deployId, err)
+	}
+
+	current, err := computeChecksums(s.deployDir(deployId))
+	if err != nil {
+		return err
+	}
+
+	changed := []string{}
+	for file, sum := range current {
+		if recordedSum, ok := recorded[file]; !ok {
+			changed = append(changed, file+" (added)")
+		} else if recordedSum != sum {
+			changed = append(changed, file+" (modified)")
+		}
+	}
+	for file := range recorded {
+		if _, ok := current[file]; !ok {
+			changed = append(changed, file+" (removed)")
+		}
+	}
+
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return fmt.Errorf("Deploy %s doesn't match its checksums: %s",
+			deployId, strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// computeChecksums maps the path of each file under dir (relative to dir) to
+// the hex sha256 of its contents, or of its target for symlinks.
+func computeChecksums(dir string) (map[string]string, error) {
+	sums := map[string]string{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if rel == deployPidFileName {
+			// written by camus when the deploy runs
+			return nil
+		}
+
+		h := sha256.New()
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, "symlink:"+target)
+		} else {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		sums[rel] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return sums, err
+}
@@ -23,6 +23,11 @@ type Client interface {
 
 	ListDeploys() ([]*Deploy, error)
 	Stop(deployId string) error
+	Pin(deployId string) error
+	Unpin(deployId string) error
+	Delete(deployId string, force bool) error
+	Doctor() ([]Diagnostic, error)
+	QueryAudit(filter AuditFilter) ([]AuditEntry, error)
 	KillUnknownProcesses()
 	Shutdown()
 }
@@ -70,7 +75,7 @@ func NewClient(deployFile string, targetName TargetName, isLocalTest bool) (*Mul
 			app:         app,
 			client:      client,
 			target:      target,
-			appDir:      path.Dir(deployFile),
+			appDir:      configDir(deployFile),
 			isLocalTest: isLocalTest,
 		})
 	}
@@ -81,7 +86,7 @@ func NewClient(deployFile string, targetName TargetName, isLocalTest bool) (*Mul
 
 	return &MultiServerClient{
 		app:     app,
-		appDir:  path.Dir(deployFile),
+		appDir:  configDir(deployFile),
 		clients: clients,
 	}, nil
 }
@@ -141,6 +146,12 @@ func (c *SingleServerClient) Push(deployId string) error {
 		c.info("post deploy command completed")
 	}
 
+	checksumsReq := &RecordChecksumsRequest{deployId}
+	var checksumsReply RecordChecksumsReply
+	if err := c.client.Call("RpcServer.RecordChecksums", checksumsReq, &checksumsReply); err != nil {
+		return fmt.Errorf("record checksums: %s", err)
+	}
+
 	return nil
 }
 
@@ -167,8 +178,14 @@ func (c *SingleServerClient) runVisibleCmd(command string, args ...string) error
 	return cmd.Run()
 }
 
+// clientActor is who the server's audit log says asked for the client's
+// operations, the user running it.
+func clientActor() string {
+	return os.Getenv("USER")
+}
+
 func (c *SingleServerClient) Run(deployId string) error {
-	req := &RunRequest{deployId}
+	req := &RunRequest{DeployId: deployId, Actor: clientActor()}
 	var reply RunReply
 	err := c.client.Call("RpcServer.Run", req, &reply)
 	if err != nil {
@@ -179,13 +196,29 @@ func (c *SingleServerClient) Run(deployId string) error {
 }
 
 func (c *SingleServerClient) Stop(deployId string) error {
-	req := &StopDeployRequest{deployId}
+	req := &StopDeployRequest{DeployId: deployId, Actor: clientActor()}
 	var reply StopDeployResponse
 	return c.client.Call("RpcServer.StopDeploy", &req, &reply)
 }
 
+func (c *SingleServerClient) Pin(deployId string) error {
+	var reply PinReply
+	return c.client.Call("RpcServer.Pin", &PinRequest{DeployId: deployId}, &reply)
+}
+
+func (c *SingleServerClient) Unpin(deployId string) error {
+	var reply PinReply
+	return c.client.Call("RpcServer.Unpin", &PinRequest{DeployId: deployId}, &reply)
+}
+
+func (c *SingleServerClient) Delete(deployId string, force bool) error {
+	req := &DeleteDeployRequest{DeployId: deployId, Force: force}
+	var reply DeleteDeployReply
+	return c.client.Call("RpcServer.DeleteDeploy", req, &reply)
+}
+
 func (c *SingleServerClient) SetActiveByPort(port int) error {
-	req := &SetActivePortRequest{port}
+	req := &SetActivePortRequest{Port: port, Actor: clientActor()}
 	var reply SetActivePortReply
 	err := c.client.Call("RpcServer.SetActiveByPort", req, &reply)
 	if err != nil {
@@ -196,7 +229,7 @@ func (c *SingleServerClient) SetActiveByPort(port int) error {
 }
 
 func (c *SingleServerClient) SetActiveById(deployId string) error {
-	req := &SetActiveByIdRequest{deployId}
+	req := &SetActiveByIdRequest{Id: deployId, Actor: clientActor()}
 	var reply SetActiveByIdReply
 	err := c.client.Call("RpcServer.SetActiveById", req, &reply)
 	if err != nil {
@@ -216,6 +249,26 @@ func (c *SingleServerClient) ListDeploys() ([]*Deploy, error) {
 	return reply.Deploys, nil
 }
 
+func (c *SingleServerClient) Doctor() ([]Diagnostic, error) {
+	args := &DoctorRequest{}
+	var reply DoctorReply
+	if err := c.client.Call("RpcServer.Doctor", args, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Diagnostics, nil
+}
+
+func (c *SingleServerClient) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	args := &QueryAuditRequest{Filter: filter}
+	var reply QueryAuditReply
+	if err := c.client.Call("RpcServer.QueryAudit", args, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Entries, nil
+}
+
 func (c *SingleServerClient) info(args ...interface{}) {
 	log.Println(prepend("    client: ", args)...)
 }
@@ -313,6 +366,36 @@ func (c *MultiServerClient) Stop(deployId string) error {
 	return nil
 }
 
+func (c *MultiServerClient) Pin(deployId string) error {
+	for _, c := range c.clients {
+		if err := c.Pin(deployId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *MultiServerClient) Unpin(deployId string) error {
+	for _, c := range c.clients {
+		if err := c.Unpin(deployId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *MultiServerClient) Delete(deployId string, force bool) error {
+	for _, c := range c.clients {
+		if err := c.Delete(deployId, force); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *MultiServerClient) SetActiveByPort(port int) error {
 	// Only makes sense if you are connecting to a single backend
 	// server
@@ -347,6 +430,34 @@ func (c *MultiServerClient) ListDeploys() ([]*Deploy, error) {
 	return deploys, nil
 }
 
+func (c *MultiServerClient) Doctor() ([]Diagnostic, error) {
+	var diagnostics []Diagnostic
+
+	for _, c := range c.clients {
+		if diagnosticsForServer, err := c.Doctor(); err != nil {
+			return nil, err
+		} else {
+			diagnostics = append(diagnostics, diagnosticsForServer...)
+		}
+	}
+
+	return diagnostics, nil
+}
+
+func (c *MultiServerClient) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	var entries []AuditEntry
+
+	for _, c := range c.clients {
+		if entriesForServer, err := c.QueryAudit(filter); err != nil {
+			return nil, err
+		} else {
+			entries = append(entries, entriesForServer...)
+		}
+	}
+
+	return entries, nil
+}
+
 func (c *MultiServerClient) KillUnknownProcesses() {
 	for _, c := range c.clients {
 		c.KillUnknownProcesses()
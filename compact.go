@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// CompactConfig drops the entries of config.json that no longer refer to
+// anything: ports of deploys that have been deleted or that are outside the
+// port range, reservations of ports now used by a deploy or out of range, an
+// active port nothing is configured on and a canary whose deploy is gone. It
+// writes the result and returns the entries that were dropped.
+func (s *ServerImpl) CompactConfig() (Config, error) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	removed := Config{Ports: map[int]string{}, Reserved: map[int]string{}, NamedPorts: map[string]map[string]int{}}
+	compacted := s.config
+	compacted.Ports = map[int]string{}
+	compacted.Reserved = map[int]string{}
+
+	for port, deployId := range s.config.Ports {
+		if s.portInRange(port) && s.deployExists(deployId) {
+			compacted.Ports[port] = deployId
+		} else {
+			removed.Ports[port] = deployId
+		}
+	}
+	for port, note := range s.config.Reserved {
+		if _, used := compacted.Ports[port]; s.portInRange(port) && !used {
+			compacted.Reserved[port] = note
+		} else {
+			removed.Reserved[port] = note
+		}
+	}
+	if _, ok := compacted.Ports[compacted.Active]; compacted.Active != 0 && !ok {
+		removed.Active = compacted.Active
+		compacted.Active = 0
+	}
+	if compacted.Canary != nil && !s.deployExists(compacted.Canary.DeployId) {
+		removed.Canary = compacted.Canary
+		compacted.Canary = nil
+	}
+
+	// Only the compacted fields are set, as loadApp reads the others
+	// without configLock.
+	previous := s.config
+	s.config.Ports, s.config.Reserved = compacted.Ports, compacted.Reserved
+	s.config.Active, s.config.Canary = compacted.Active, compacted.Canary
+	previous.NamedPorts = s.dropNamedPortsOffPorts(compacted.Ports)
+	if err := s.writeConfig(); err != nil {
+		s.config.Ports, s.config.Reserved = previous.Ports, previous.Reserved
+		s.config.Active, s.config.Canary = previous.Active, previous.Canary
+		s.config.NamedPorts = previous.NamedPorts
+		return Config{}, fmt.Errorf("write config: %s", err)
+	}
+	for deployId, named := range previous.NamedPorts {
+		if _, kept := s.config.NamedPorts[deployId]; !kept {
+			removed.NamedPorts[deployId] = named
+		}
+	}
+	return removed, nil
+}
+
+func (s *ServerImpl) portInRange(port int) bool {
+	return port >= s.startPort && port <= s.endPort
+}
+
+func (s *ServerImpl) deployExists(deployId string) bool {
+	info, err := os.Stat(s.deployDir(deployId))
+	return err == nil && info.IsDir()
+}
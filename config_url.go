@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deploy.json can be fetched from an http(s) URL instead of read from a file,
+// for teams that keep their deploy definitions in one place.
+
+var REMOTE_CONFIG_TIMEOUT = time.Duration(10) * time.Second
+
+// A fetched config is reused for this long before it's fetched again.
+var REMOTE_CONFIG_CACHE_TIME = time.Duration(60) * time.Second
+
+const maxRemoteConfigSize = 1024 * 1024
+
+type remoteConfig struct {
+	data    []byte
+	fetched time.Time
+}
+
+var remoteConfigLock sync.Mutex
+var remoteConfigs = map[string]*remoteConfig{}
+
+func isConfigUrl(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// configDir is the directory a deploy.json's BuildOutputDir etc. are relative
+// to. For a URL that's the current directory.
+func configDir(file string) string {
+	if isConfigUrl(file) {
+		return "."
+	}
+	return path.Dir(file)
+}
+
+// readConfigSource returns the contents of file, which may be a path or a URL.
+func readConfigSource(file string) ([]byte, error) {
+	if isConfigUrl(file) {
+		return fetchRemoteConfig(file)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// fetchRemoteConfig returns the config at url, fetching it if it hasn't been
+// recently. If the fetch fails, the copy saved by the last successful fetch
+// is used instead, if there is one.
+func fetchRemoteConfig(url string) ([]byte, error) {
+	remoteConfigLock.Lock()
+	defer remoteConfigLock.Unlock()
+
+	if cached, ok := remoteConfigs[url]; ok && time.Since(cached.fetched) < REMOTE_CONFIG_CACHE_TIME {
+		return cached.data, nil
+	}
+
+	data, err := fetchUrl(url)
+	if err != nil {
+		saved, readErr := ioutil.ReadFile(remoteConfigCacheFile(url))
+		if readErr != nil {
+			return nil, fmt.Errorf("Fetch %s: %s", url, err)
+		}
+		log.Printf("warning: fetch %s: %s, using the copy from the last fetch\n", url, err)
+		return saved, nil
+	}
+
+	remoteConfigs[url] = &remoteConfig{data: data, fetched: time.Now()}
+	file := remoteConfigCacheFile(url)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err == nil {
+		err = ioutil.WriteFile(file, data, os.FileMode(0644))
+	}
+	if err != nil {
+		log.Printf("warning: could not save a copy of %s: %s\n", url, err)
+	}
+	return data, nil
+}
+
+func fetchUrl(url string) ([]byte, error) {
+	client := &http.Client{Timeout: REMOTE_CONFIG_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize))
+}
+
+// remoteConfigCacheFile is where the last fetched copy of url is saved.
+func remoteConfigCacheFile(url string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, "camus", "configs", hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// validateConfig checks the in-memory config is consistent before writeConfig
+// writes it, so a bug in one of the changes made to it isn't persisted: ports
+// are real port numbers, each is used once, a deploy is only on one port, and
+// the canary and NamedPorts refer to deploys. Entries that only went stale,
+// e.g. an active port whose deploy was stopped, are left for CompactConfig.
+// Call with configLock held.
+func (s *ServerImpl) validateConfig() error {
+	ports := []int{}
+	for port := range s.config.Ports {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	used := map[int]string{}
+	onPort := map[string]int{}
+	for _, port := range ports {
+		deployId := s.config.Ports[port]
+		if !validPort(port) {
+			return fmt.Errorf("Port %d of %s isn't a valid port", port, deployId)
+		}
+		if deployId == "" {
+			return fmt.Errorf("Port %d has no deploy", port)
+		}
+		if other, ok := onPort[deployId]; ok {
+			return fmt.Errorf("%s is configured on both %d and %d", deployId, other, port)
+		}
+		onPort[deployId] = port
+		used[port] = deployId
+	}
+	for port, note := range s.config.Reserved {
+		if !validPort(port) {
+			return fmt.Errorf("Reserved port %d isn't a valid port", port)
+		}
+		if deployId, ok := used[port]; ok {
+			return fmt.Errorf("Port %d is reserved (%s), but configured for %s", port, note, deployId)
+		}
+	}
+	for deployId, named := range s.config.NamedPorts {
+		if _, ok := onPort[deployId]; !ok {
+			return fmt.Errorf("%s has NamedPorts, but isn't configured on a port", deployId)
+		}
+		for name, port := range named {
+			if !validPort(port) {
+				return fmt.Errorf("NamedPorts %s of %s isn't a valid port: %d", name, deployId, port)
+			}
+			if other, ok := used[port]; ok {
+				return fmt.Errorf("Port %d is NamedPorts %s of %s, but already used by %s", port, name, deployId, other)
+			}
+			if _, ok := s.config.Reserved[port]; ok {
+				return fmt.Errorf("Port %d is NamedPorts %s of %s, but reserved", port, name, deployId)
+			}
+			used[port] = deployId
+		}
+	}
+
+	if s.config.Active != 0 && !validPort(s.config.Active) {
+		return fmt.Errorf("Active port %d isn't a valid port", s.config.Active)
+	}
+	if canary := s.config.Canary; canary != nil {
+		if canary.Weight <= 0 || canary.Weight >= 100 {
+			return fmt.Errorf("Canary weight must be between 1 and 99, not %d", canary.Weight)
+		}
+		if _, ok := onPort[canary.DeployId]; !ok && !s.deployExists(canary.DeployId) {
+			return fmt.Errorf("Canary %s isn't a deploy, CompactConfig would drop it", canary.DeployId)
+		}
+		if s.config.Active != 0 && onPort[canary.DeployId] == s.config.Active {
+			return fmt.Errorf("Canary %s is also the active deploy", canary.DeployId)
+		}
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// States ListDeploysInState can list deploys in.
+const (
+	// Configured on a port, so camus keeps it running.
+	DEPLOYS_RUNNING = "running"
+
+	// Not configured on any port.
+	DEPLOYS_STOPPED = "stopped"
+)
+
+// ListRunning is ListDeploysInState for DEPLOYS_RUNNING.
+func (s *ServerImpl) ListRunning() ([]*Deploy, error) {
+	return s.ListDeploysInState(DEPLOYS_RUNNING)
+}
+
+// ListStopped is ListDeploysInState for DEPLOYS_STOPPED.
+func (s *ServerImpl) ListStopped() ([]*Deploy, error) {
+	return s.ListDeploysInState(DEPLOYS_STOPPED)
+}
+
+// ListDeploysInState is ListDeploys, keeping only the deploys in state, one
+// of the DEPLOYS_ values, or everything for "". Like Enforce it goes by
+// config.Ports, not by what's listening, so a crashed deploy still counts as
+// running. Processes listening in the range that aren't deploys are in
+// neither state.
+func (s *ServerImpl) ListDeploysInState(state string) ([]*Deploy, error) {
+	return s.listDeploysMatching(nil, state)
+}
+
+// listDeploysMatching is ListDeploysWithTags and ListDeploysInState at once.
+func (s *ServerImpl) listDeploysMatching(tags map[string]string, state string) ([]*Deploy, error) {
+	if state != "" && state != DEPLOYS_RUNNING && state != DEPLOYS_STOPPED {
+		return nil, fmt.Errorf("Unknown deploy state %s, use %s or %s", state, DEPLOYS_RUNNING, DEPLOYS_STOPPED)
+	}
+	deploys, err := s.ListDeploysWithTags(tags)
+	if err != nil || state == "" {
+		return deploys, err
+	}
+	matching := []*Deploy{}
+	for _, deploy := range deploys {
+		if deploy.Tracked == (state == DEPLOYS_RUNNING) && s.isDeploy(deploy.Id) {
+			matching = append(matching, deploy)
+		}
+	}
+	return matching, nil
+}
+
+// isDeploy is whether ListDeploys found deployId in the deploys dir, rather
+// than listing an unknown process listening in the range.
+func (s *ServerImpl) isDeploy(deployId string) bool {
+	info, err := os.Stat(s.deployDir(deployId))
+	return err == nil && info.IsDir()
+}
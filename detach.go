@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// DetachOptions says how Detach takes a deploy out of service.
+type DetachOptions struct {
+	// The deploy to make active instead, if the deploy is the active one.
+	// It must be running and healthy. Detach refuses to detach the active
+	// deploy without one, as haproxy would have nothing to send traffic to.
+	Fallback string
+
+	// Remove the deploy once it's stopped, as GC would.
+	Remove bool
+}
+
+// DetachStep is one step Detach took, and why it failed, if it did.
+type DetachStep struct {
+	Step  string
+	Error string
+}
+
+// Detach takes deployId off every routing label, moving LABEL_ACTIVE to
+// opts.Fallback and clearing LABEL_CANARY, then stops it, letting it drain
+// as Stop does, and removes it if opts.Remove. It holds deployId's
+// lockDeploy throughout, so it can't be run or pinned part way. It stops at
+// the first step that fails, returning the steps taken so far along with the
+// error.
+func (s *ServerImpl) Detach(deployId string, opts DetachOptions) ([]DetachStep, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+	steps := []DetachStep{}
+	step := func(description string, err error) error {
+		result := DetachStep{Step: description}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		steps = append(steps, result)
+		return err
+	}
+
+	fallbackPort := 0
+	if opts.Fallback != "" {
+		fallback, err := s.resolveDeployId(opts.Fallback)
+		if err != nil {
+			return steps, err
+		}
+		if fallback == deployId {
+			return steps, fmt.Errorf("%s can't be its own fallback", deployId)
+		}
+		opts.Fallback = fallback
+		port, err := s.warmPort(fallback)
+		if port == 0 {
+			return steps, fmt.Errorf("Fallback %s isn't running", fallback)
+		} else if err != nil {
+			return steps, fmt.Errorf("Fallback %s is failing its health check: %s", fallback, err)
+		}
+		fallbackPort = port
+	}
+
+	if err := s.detachLabels(deployId, opts.Fallback, fallbackPort, step); err != nil {
+		return steps, err
+	}
+
+	s.configLock.Lock()
+	port := s.lookupConfiguredPort(deployId)
+	s.configLock.Unlock()
+	if port != 0 {
+		if err := step(fmt.Sprintf("stop %s on port %d", deployId, port), s.stopNolock(context.Background(), deployId)); err != nil {
+			return steps, err
+		}
+	}
+
+	if opts.Remove {
+		if err := step(fmt.Sprintf("remove %s", deployId), s.removeDeployNolock(deployId, false)); err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+// detachLabels moves LABEL_ACTIVE off deployId to fallback on fallbackPort,
+// and clears LABEL_CANARY if it's deployId, recording each with step.
+func (s *ServerImpl) detachLabels(deployId string, fallback string, fallbackPort int, step func(string, error) error) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	canary := s.config.Canary
+	isCanary := canary != nil && canary.DeployId == deployId
+	if s.config.Active != 0 && s.config.Ports[s.config.Active] == deployId {
+		description := fmt.Sprintf("move %s to %s", LABEL_ACTIVE, fallback)
+		if fallback == "" {
+			return step(description, fmt.Errorf("%s is the active deploy, and there's no fallback to replace it", deployId))
+		}
+		if s.config.Ports[fallbackPort] != fallback {
+			return step(description, fmt.Errorf("%s was moved off port %d", fallback, fallbackPort))
+		}
+		// the fallback can't also be the canary
+		keptCanary := canary
+		if isCanary || (canary != nil && canary.DeployId == fallback) {
+			keptCanary = nil
+		}
+		if err := step(description, s.setActive(fallbackPort, keptCanary)); err != nil {
+			return err
+		}
+		s.recordEventFor(context.Background(), LABEL_ACTIVE, "set-active", fallback, fallbackPort)
+		if canary != nil && keptCanary == nil {
+			step(fmt.Sprintf("clear %s", LABEL_CANARY), nil)
+			s.recordEventFor(context.Background(), LABEL_CANARY, "clear-canary", canary.DeployId, 0)
+		}
+		return nil
+	}
+
+	if isCanary {
+		if err := step(fmt.Sprintf("clear %s", LABEL_CANARY), s.setActive(s.config.Active, nil)); err != nil {
+			return err
+		}
+		s.recordEventFor(context.Background(), LABEL_CANARY, "clear-canary", deployId, 0)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNoDetach(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for deployId, noDetach := range map[string]bool{"detached": false, "attached": true} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+			NoDetach:       noDetach,
+		})
+		if _, err := s.Run(deployId); err != nil {
+			t.Fatalf("run %s: %s", deployId, err)
+		}
+		pid, alive := s.trackedPid(deployId)
+		if !alive {
+			s.Stop(deployId)
+			t.Fatalf("expected %s to be tracked as running", deployId)
+		}
+		pgid, err := syscall.Getpgid(pid)
+		// stopping the attached deploy mustn't signal the test too
+		if err := s.Stop(deployId); err != nil {
+			t.Errorf("stop %s: %s", deployId, err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if noDetach && pgid != syscall.Getpgrp() {
+			t.Errorf("expected %s to be in camus's process group %d, got %d", deployId, syscall.Getpgrp(), pgid)
+		}
+		if !noDetach && pgid != pid {
+			t.Errorf("expected %s to lead its own process group, got %d for pid %d", deployId, pgid, pid)
+		}
+	}
+}
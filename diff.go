@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// DeployDiff describes what changes going from deploy A to deploy B.
+type DeployDiff struct {
+	A string
+	B string
+
+	// Fields of the effective deploy.json that differ, sorted by field.
+	Config []FieldDiff
+
+	// Files that were added, removed or modified, sorted by file. Only
+	// filled in by DiffDeploysWithFiles.
+	Files []FileDiff
+}
+
+// FieldDiff is a deploy.json field that differs between two deploys. Fields
+// inside objects are named with dots, e.g. Env.NODE_ENV. The values are json,
+// or empty if the field isn't set.
+type FieldDiff struct {
+	Field string
+	A     string
+	B     string
+}
+
+type FileDiff struct {
+	File string
+
+	// added, removed or modified
+	Change string
+}
+
+// DiffDeploys compares the effective configs (as EffectiveConfig returns them)
+// of deploys a and b.
+func (s *ServerImpl) DiffDeploys(a string, b string) (DeployDiff, error) {
+	var diff DeployDiff
+	var err error
+	if diff.A, err = s.resolveDeployId(a); err != nil {
+		return diff, err
+	}
+	if diff.B, err = s.resolveDeployId(b); err != nil {
+		return diff, err
+	}
+
+	fieldsA, err := s.configFields(diff.A)
+	if err != nil {
+		return diff, err
+	}
+	fieldsB, err := s.configFields(diff.B)
+	if err != nil {
+		return diff, err
+	}
+	for field, valueA := range fieldsA {
+		if valueB := fieldsB[field]; valueA != valueB {
+			diff.Config = append(diff.Config, FieldDiff{field, valueA, valueB})
+		}
+	}
+	for field, valueB := range fieldsB {
+		if _, ok := fieldsA[field]; !ok {
+			diff.Config = append(diff.Config, FieldDiff{field, "", valueB})
+		}
+	}
+	sort.Slice(diff.Config, func(i, j int) bool {
+		return diff.Config[i].Field < diff.Config[j].Field
+	})
+	return diff, nil
+}
+
+// DiffDeploysWithFiles is DiffDeploys, also comparing every file in the two
+// deploy dirs. It reads all of both deploys, so can be slow for big ones.
+func (s *ServerImpl) DiffDeploysWithFiles(a string, b string) (DeployDiff, error) {
+	diff, err := s.DiffDeploys(a, b)
+	if err != nil {
+		return diff, err
+	}
+	sumsA, err := computeChecksums(s.deployDir(diff.A))
+	if err != nil {
+		return diff, err
+	}
+	sumsB, err := computeChecksums(s.deployDir(diff.B))
+	if err != nil {
+		return diff, err
+	}
+	for file, sumA := range sumsA {
+		if sumB, ok := sumsB[file]; !ok {
+			diff.Files = append(diff.Files, FileDiff{file, "removed"})
+		} else if sumA != sumB {
+			diff.Files = append(diff.Files, FileDiff{file, "modified"})
+		}
+	}
+	for file := range sumsB {
+		if _, ok := sumsA[file]; !ok {
+			diff.Files = append(diff.Files, FileDiff{file, "added"})
+		}
+	}
+	sort.Slice(diff.Files, func(i, j int) bool {
+		return diff.Files[i].File < diff.Files[j].File
+	})
+	return diff, nil
+}
+
+// configFields flattens deployId's effective deploy.json into json values by
+// field name, naming the fields of nested objects with dots.
+func (s *ServerImpl) configFields(deployId string) (map[string]string, error) {
+	app, err := s.loadApp(deployId)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(app)
+	if err != nil {
+		return nil, err
+	}
+	var def map[string]interface{}
+	if err := json.Unmarshal(data, &def); err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	flattenFields("", def, fields)
+	return fields, nil
+}
+
+func flattenFields(prefix string, values map[string]interface{}, fields map[string]string) {
+	for key, value := range values {
+		if value == nil {
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenFields(prefix+key+".", nested, fields)
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		fields[prefix+key] = string(encoded)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+)
+
+type DiagnosticLevel string
+
+const (
+	Pass DiagnosticLevel = "pass"
+	Warn DiagnosticLevel = "warn"
+	Fail DiagnosticLevel = "fail"
+)
+
+// Diagnostic is the outcome of one of Doctor's checks. Hint says how to fix
+// anything that didn't pass.
+type Diagnostic struct {
+	Check   string
+	Level   DiagnosticLevel
+	Message string
+	Hint    string
+}
+
+// Doctor checks the server's setup for the problems that would otherwise
+// show up as confusing failures part way through a Run.
+func (s *ServerImpl) Doctor() ([]Diagnostic, error) {
+	return []Diagnostic{
+		s.checkRootWritable(),
+		s.checkDeploysDir(),
+		s.checkConfigFile(),
+		s.checkPortRange(),
+		checkExecutable("sh", Fail, "Deploys are started with sh -c"),
+		checkExecutable("lsof", Fail, "lsof is used to find what is running on each port"),
+		checkExecutable("haproxy", Warn, "haproxy is needed to set the active deploy"),
+	}, nil
+}
+
+func (s *ServerImpl) checkRootWritable() Diagnostic {
+	d := Diagnostic{Check: "root writable"}
+	f, err := ioutil.TempFile(s.root, ".camus-doctor-")
+	if err != nil {
+		d.Level = Fail
+		d.Message = fmt.Sprintf("Can't write to %s: %s", s.root, err)
+		d.Hint = "Make the root directory writable by the user camus runs as"
+		return d
+	}
+	f.Close()
+	os.Remove(f.Name())
+	d.Level = Pass
+	d.Message = s.root
+	return d
+}
+
+func (s *ServerImpl) checkDeploysDir() Diagnostic {
+	d := Diagnostic{Check: "deploys dir"}
+	if _, err := ioutil.ReadDir(s.deploysPath); err != nil {
+		d.Level = Fail
+		d.Message = fmt.Sprintf("Can't list %s: %s", s.deploysPath, err)
+		d.Hint = "Make sure it is a directory readable by the user camus runs as"
+		return d
+	}
+	d.Level = Pass
+	d.Message = s.deploysPath
+	return d
+}
+
+func (s *ServerImpl) checkConfigFile() Diagnostic {
+	d := Diagnostic{Check: "config file"}
+	if s.configReader != nil {
+		// already parsed by NewServerImpl
+		d.Level = Pass
+		d.Message = "not used, the config was given to the server directly"
+		return d
+	}
+	file := path.Join(s.root, s.configFileName)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		d.Level = Warn
+		d.Message = fmt.Sprintf("%s doesn't exist", file)
+		d.Hint = "It will be created on the first run, or create it containing '{}'"
+		return d
+	}
+	if _, err := readConfig(file); err != nil {
+		d.Level = Fail
+		d.Message = fmt.Sprintf("Can't parse %s: %s", file, err)
+		d.Hint = "Fix the json, or replace it with '{}' and run the deploys again"
+		return d
+	}
+	d.Level = Pass
+	d.Message = file
+	return d
+}
+
+func (s *ServerImpl) checkPortRange() Diagnostic {
+	d := Diagnostic{Check: "port range"}
+	if s.startPort <= 0 || s.endPort > 65535 || s.startPort > s.endPort {
+		d.Level = Fail
+		d.Message = fmt.Sprintf("Invalid port range %d-%d", s.startPort, s.endPort)
+		d.Hint = "Pick a -port between 1 and 65436"
+		return d
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	free := 0
+	for port := s.startPort; port <= s.endPort; port++ {
+		if !s.portConfigured(port) && !s.portReserved(port) && s.portFree(port) {
+			free++
+		}
+	}
+	d.Message = fmt.Sprintf("%d of ports %d-%d free", free, s.startPort, s.endPort)
+	if free == 0 {
+		d.Level = Fail
+		d.Hint = "Stop unused deploys, release reserved ports or run 'cleanup'"
+	} else {
+		d.Level = Pass
+	}
+	return d
+}
+
+func checkExecutable(name string, level DiagnosticLevel, why string) Diagnostic {
+	d := Diagnostic{Check: name + " available"}
+	file, err := exec.LookPath(name)
+	if err != nil {
+		d.Level = level
+		d.Message = fmt.Sprintf("%s not found on PATH", name)
+		d.Hint = fmt.Sprintf("Install %s. %s", name, why)
+		return d
+	}
+	d.Level = Pass
+	d.Message = file
+	return d
+}
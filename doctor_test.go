@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDoctorBrokenRoot(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	diagnostics, err := s.Doctor()
+	if err != nil {
+		t.Fatalf("doctor: %s", err)
+	}
+	levels := map[string]DiagnosticLevel{}
+	for _, d := range diagnostics {
+		levels[d.Check] = d.Level
+	}
+	for _, check := range []string{"root writable", "deploys dir", "port range", "sh available"} {
+		if levels[check] != Pass {
+			t.Errorf("expected %s to pass on a fresh root, got %s", check, levels[check])
+		}
+	}
+
+	// Break the deploys dir, the config and the port range.
+	if err := os.RemoveAll(s.DeploysPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.DeploysPath(), []byte("not a dir"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName), []byte("{oops"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.portFree = func(port int) bool { return false }
+
+	diagnostics, err = s.Doctor()
+	if err != nil {
+		t.Fatalf("doctor: %s", err)
+	}
+	for _, d := range diagnostics {
+		levels[d.Check] = d.Level
+		if d.Level == Fail && d.Hint == "" {
+			t.Errorf("expected failed check %s to have a hint", d.Check)
+		}
+	}
+	for _, check := range []string{"deploys dir", "config file", "port range"} {
+		if levels[check] != Fail {
+			t.Errorf("expected %s to fail on a broken root, got %s", check, levels[check])
+		}
+	}
+	if levels["root writable"] != Pass {
+		t.Errorf("expected the root to still be writable, got %s", levels["root writable"])
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// The weight EnsureDeploy gives a deploy it makes the canary when there's no
+// canary already, whose weight it would keep.
+const DEFAULT_CANARY_WEIGHT = 10
+
+// EnsureDeploy makes deployId running, healthy and routed to with label,
+// LABEL_ACTIVE or LABEL_CANARY, starting it as Run does if it isn't running.
+// It does nothing if that's already how things are, so it can be called
+// again and again, e.g. by something keeping the host in line with a
+// declared state.
+func (s *ServerImpl) EnsureDeploy(deployId string, label Label) error {
+	if label != LABEL_ACTIVE && label != LABEL_CANARY {
+		return fmt.Errorf("Unknown label %s, should be %s or %s", label, LABEL_ACTIVE, LABEL_CANARY)
+	}
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	port, err := s.warmPort(deployId)
+	if port != 0 && err != nil {
+		return fmt.Errorf("%s is running on %d, but failing its health check: %s", deployId, port, err)
+	}
+	if port == 0 {
+		if port, err = s.Run(deployId); err != nil {
+			return err
+		}
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	if s.config.Ports[port] != deployId {
+		return fmt.Errorf("%s was moved off port %d before it could be labelled", deployId, port)
+	}
+	isCanary := s.config.Canary != nil && s.config.Canary.DeployId == deployId
+
+	if label == LABEL_ACTIVE {
+		if s.config.Active == port && !isCanary {
+			return nil
+		}
+		canary := s.config.Canary
+		if isCanary {
+			canary = nil
+		}
+		if err := s.setActive(port, canary); err != nil {
+			return err
+		}
+		s.recordEventFor(context.Background(), LABEL_ACTIVE, "ensure-active", deployId, port)
+		return nil
+	}
+
+	if isCanary {
+		return nil
+	}
+	if s.config.Active == 0 {
+		return fmt.Errorf("No active deploy to split traffic with, set one first")
+	} else if s.config.Active == port {
+		return fmt.Errorf("%s is the active deploy, so can't be the canary", deployId)
+	}
+	canary := &Canary{DeployId: deployId, Weight: DEFAULT_CANARY_WEIGHT}
+	if s.config.Canary != nil {
+		canary.Weight = s.config.Canary.Weight
+		canary.Sticky = s.config.Canary.Sticky
+	}
+	if err := s.setActive(s.config.Active, canary); err != nil {
+		return err
+	}
+	s.recordEventFor(context.Background(), LABEL_CANARY, "ensure-canary", deployId, port)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv replaces ${VAR} references in str with the value of the
+// environment variable VAR. Supported forms:
+//
+//	${VAR}          value of VAR, or "" if unset
+//	${VAR:-default} value of VAR, or default if unset or empty
+//	${VAR:?message} value of VAR, or an error with message if unset or empty
+//	$${             a literal "${"
+//
+// A "$" that isn't followed by "{" is left alone, so plain shell $VAR and
+// $(...) in commands still reach the shell.
+func expandEnv(str string) (string, error) {
+	var out strings.Builder
+	for {
+		i := strings.Index(str, "$")
+		if i == -1 || i == len(str)-1 {
+			out.WriteString(str)
+			return out.String(), nil
+		}
+		out.WriteString(str[:i])
+		str = str[i:]
+
+		if strings.HasPrefix(str, "$${") {
+			out.WriteString("${")
+			str = str[3:]
+			continue
+		}
+		if str[1] != '{' {
+			out.WriteString("$")
+			str = str[1:]
+			continue
+		}
+
+		end := strings.Index(str, "}")
+		if end == -1 {
+			return "", fmt.Errorf("Unterminated ${ in '%s'", str)
+		}
+		value, err := expandReference(str[2:end])
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+		str = str[end+1:]
+	}
+}
+
+// expandReference expands the part of an env reference between ${ and }.
+func expandReference(ref string) (string, error) {
+	name, op, arg := ref, "", ""
+	if i := strings.Index(ref, ":"); i != -1 {
+		name, op = ref[:i], ref[i:]
+		if len(op) < 2 || (op[1] != '-' && op[1] != '?') {
+			return "", fmt.Errorf("Invalid env reference ${%s}", ref)
+		}
+		op, arg = op[:2], op[2:]
+	}
+	if name == "" {
+		return "", fmt.Errorf("Invalid env reference ${%s}", ref)
+	}
+
+	value := os.Getenv(name)
+	switch op {
+	case ":-":
+		if value == "" {
+			value = arg
+		}
+	case ":?":
+		if value == "" {
+			if arg == "" {
+				arg = "required but not set"
+			}
+			return "", fmt.Errorf("%s: %s", name, arg)
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("CAMUS_TEST_SET", "value")
+	os.Setenv("CAMUS_TEST_EMPTY", "")
+	os.Unsetenv("CAMUS_TEST_UNSET")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"no references", "no references"},
+		{"${CAMUS_TEST_SET}/logs", "value/logs"},
+		{"a${CAMUS_TEST_UNSET}b", "ab"},
+		{"${CAMUS_TEST_UNSET:-fallback}", "fallback"},
+		{"${CAMUS_TEST_EMPTY:-fallback}", "fallback"},
+		{"${CAMUS_TEST_SET:-fallback}", "value"},
+		{"${CAMUS_TEST_SET:?needed}", "value"},
+		{"$${CAMUS_TEST_SET}", "${CAMUS_TEST_SET}"},
+		{"echo $HOME $(pwd) $", "echo $HOME $(pwd) $"},
+	}
+	for _, test := range tests {
+		expanded, err := expandEnv(test.input)
+		if err != nil {
+			t.Errorf("expand '%s': %s", test.input, err)
+		} else if expanded != test.expected {
+			t.Errorf("expected '%s' to expand to '%s', got '%s'", test.input, test.expected, expanded)
+		}
+	}
+
+	for _, input := range []string{
+		"${CAMUS_TEST_UNSET:?set it to the secrets dir}",
+		"${CAMUS_TEST_EMPTY:?}",
+		"${CAMUS_TEST_SET",
+		"${}",
+		"${CAMUS_TEST_SET:+x}",
+	} {
+		if _, err := expandEnv(input); err == nil {
+			t.Errorf("expected '%s' to fail to expand", input)
+		}
+	}
+}
+
+func TestApplicationEnvExpansion(t *testing.T) {
+	os.Setenv("CAMUS_TEST_SECRETS", "/etc/secrets")
+	os.Unsetenv("CAMUS_TEST_UNSET")
+
+	file := writeTestConfig(t, `{
+		"RunCmd": "node app.js %PORT% --secrets ${CAMUS_TEST_SECRETS}",
+		"HealthEndpoint": "${CAMUS_TEST_UNSET:-/status}",
+		"Env": {"SECRETS_DIR": "${CAMUS_TEST_SECRETS}/app"}
+	}`)
+	defer os.RemoveAll(path.Dir(file))
+
+	app, err := ApplicationFromConfig(false, file)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if cmd := app.RunCmd(8001); cmd != "node app.js 8001 --secrets /etc/secrets" {
+		t.Errorf("unexpected run command '%s'", cmd)
+	}
+	if app.HealthEndpoint() != "/status" {
+		t.Errorf("unexpected health endpoint '%s'", app.HealthEndpoint())
+	}
+	if env := app.Env(); len(env) != 1 || env[0] != "SECRETS_DIR=/etc/secrets/app" {
+		t.Errorf("unexpected env %v", env)
+	}
+
+	os.Setenv("CAMUS_TEST_STATE_DIR", "run")
+	paths := writeTestConfig(t, `{
+		"RunCmd": "node app.js",
+		"ReadinessFile": "${CAMUS_TEST_STATE_DIR}/ready",
+		"HealthTokenFile": "${CAMUS_TEST_SECRETS}/token",
+		"Templates": [{"Source": "${CAMUS_TEST_STATE_DIR}/app.conf.tmpl", "Dest": "${CAMUS_TEST_STATE_DIR}/app.conf"}]
+	}`)
+	defer os.RemoveAll(path.Dir(paths))
+	app, err = ApplicationFromConfig(false, paths)
+	if err != nil {
+		t.Fatalf("load with paths: %s", err)
+	}
+	if app.ReadinessFile() != path.Join(path.Dir(paths), "run/ready") {
+		t.Errorf("unexpected readiness file '%s'", app.ReadinessFile())
+	}
+	if app.HealthTokenFile() != "/etc/secrets/token" {
+		t.Errorf("unexpected health token file '%s'", app.HealthTokenFile())
+	}
+	if tmpls := app.Templates(); len(tmpls) != 1 || !strings.HasSuffix(tmpls[0].Source, "run/app.conf.tmpl") || !strings.HasSuffix(tmpls[0].Dest, "run/app.conf") {
+		t.Errorf("unexpected templates %+v", tmpls)
+	}
+
+	required := writeTestConfig(t, `{"RunCmd": "node app.js ${CAMUS_TEST_UNSET:?point it at the app}"}`)
+	defer os.RemoveAll(path.Dir(required))
+	_, err = ApplicationFromConfig(false, required)
+	if err == nil || !strings.Contains(err.Error(), "point it at the app") {
+		t.Fatalf("expected missing required var error, got %v", err)
+	}
+}
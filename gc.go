@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// GCPolicy says which deploys GC removes. Deploys that are configured on a
+// port, are the canary or are running are never removed, nor are pinned ones
+// unless it's Forced.
+type GCPolicy struct {
+	// Remove deploys created longer ago than this, 0 for any age.
+	MaxAge time.Duration
+
+	// Keep this many of the newest deploys, whatever their age.
+	KeepLast int
+
+	// Remove pinned deploys too, see Pin.
+	Force bool
+}
+
+// GCRemoval is a deploy GC removed, and why.
+type GCRemoval struct {
+	DeployId string
+	Reason   string
+}
+
+// GC removes the deploys in the deploys dir that policy doesn't keep, along
+// with their state, tags and checksums, and returns what it removed. A deploy
+// that fails to be removed is logged and left for the next GC.
+func (s *ServerImpl) GC(policy GCPolicy) ([]GCRemoval, error) {
+	if policy.MaxAge < 0 || policy.KeepLast < 0 {
+		return nil, fmt.Errorf("GC policy can't be negative")
+	}
+	if policy.MaxAge == 0 && policy.KeepLast == 0 {
+		return nil, fmt.Errorf("GC policy needs a MaxAge or KeepLast, or it would remove everything")
+	}
+
+	deployIds, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		return nil, err
+	}
+	// newest first
+	sort.Slice(deployIds, func(i, j int) bool {
+		return deployIdLess(deployIds[j], deployIds[i])
+	})
+
+	listening := makeProcessDeployIdLookup(FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName))
+
+	removed := []GCRemoval{}
+	now := time.Now()
+	for i, deployId := range deployIds {
+		if i < policy.KeepLast {
+			continue
+		}
+		reason := fmt.Sprintf("not one of the newest %d", policy.KeepLast)
+		if policy.MaxAge > 0 {
+			age := now.Sub(s.deployCreated(deployId))
+			if age <= policy.MaxAge {
+				continue
+			}
+			reason = fmt.Sprintf("older than %s", policy.MaxAge)
+		}
+		if proc, ok := listening[deployId]; ok {
+			log.Printf("gc: not removing %s: listening on port %d\n", deployId, proc.Port)
+			continue
+		}
+		if err := s.removeDeploy(deployId, policy.Force); err != nil {
+			log.Printf("gc: not removing %s: %s\n", deployId, err)
+			continue
+		}
+		s.recordEvent("gc", deployId, 0)
+		removed = append(removed, GCRemoval{DeployId: deployId, Reason: reason})
+	}
+	return removed, nil
+}
+
+// deployCreated returns when deployId was created, as recorded by
+// NewDeployDir, or from the time in its id, or failing those its directory's
+// modification time.
+func (s *ServerImpl) deployCreated(deployId string) time.Time {
+	if state, err := s.readDeployState(deployId); err == nil && !state.Created.IsZero() {
+		return state.Created
+	}
+	if t := deployIdTime(deployId); !t.IsZero() {
+		return t
+	}
+	if info, err := os.Stat(s.deployDir(deployId)); err == nil {
+		return info.ModTime()
+	}
+	return time.Now()
+}
+
+// DeleteDeploy removes deployId, with its state, tags and checksums, unless
+// it's configured on a port, the canary or running. A pinned deploy is only
+// removed if force is set.
+func (s *ServerImpl) DeleteDeploy(deployId string, force bool) error {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	if err := s.removeDeploy(deployId, force); err != nil {
+		return fmt.Errorf("Not deleting %s: %s", deployId, err)
+	}
+	s.recordEvent("delete", deployId, 0)
+	return nil
+}
+
+// removeDeploy deletes deployId's directory and side files, unless it's in
+// use, or pinned and not forced.
+func (s *ServerImpl) removeDeploy(deployId string, force bool) error {
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+	return s.removeDeployNolock(deployId, force)
+}
+
+// removeDeployNolock is removeDeploy for callers already holding deployId's
+// lockDeploy.
+func (s *ServerImpl) removeDeployNolock(deployId string, force bool) error {
+	if _, err := os.Stat(s.deployDir(deployId)); err != nil {
+		return err
+	}
+	s.configLock.Lock()
+	port := s.lookupConfiguredPort(deployId)
+	isCanary := s.config.Canary != nil && s.config.Canary.DeployId == deployId
+	s.configLock.Unlock()
+	if port != 0 {
+		return fmt.Errorf("configured on port %d", port)
+	}
+	if isCanary {
+		return fmt.Errorf("it's the canary")
+	}
+	if pid, alive := s.trackedPid(deployId); alive {
+		return fmt.Errorf("running as pid %d", pid)
+	}
+	if state, err := s.readDeployState(deployId); err != nil {
+		return err
+	} else if state.Pinned && !force {
+		return fmt.Errorf("it's pinned, unpin it or force it")
+	}
+
+	if err := os.RemoveAll(s.deployDir(deployId)); err != nil {
+		return err
+	}
+	s.stateLock.Lock()
+	os.Remove(s.stateFile(deployId))
+	s.stateLock.Unlock()
+	s.tagsLock.Lock()
+	os.Remove(s.tagsFile(deployId))
+	s.tagsLock.Unlock()
+	os.Remove(s.checksumsFile(deployId))
+	os.Remove(s.stderrFile(deployId))
+	s.healthHistoryLock.Lock()
+	delete(s.healthHistory, deployId)
+	s.healthHistoryLock.Unlock()
+	return nil
+}
+
+// Pin stops GC and DeleteDeploy removing deployId, unless they're forced,
+// e.g. to keep a known good deploy to roll back to, until it's unpinned.
+func (s *ServerImpl) Pin(deployId string) error {
+	return s.setPinned(deployId, true)
+}
+
+// Unpin lets GC and DeleteDeploy remove deployId again.
+func (s *ServerImpl) Unpin(deployId string) error {
+	return s.setPinned(deployId, false)
+}
+
+func (s *ServerImpl) setPinned(deployId string, pinned bool) error {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+
+	if _, err := os.Stat(s.deployDir(deployId)); err != nil {
+		return fmt.Errorf("Deploy %s: %s", deployId, err)
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Pinned = pinned
+	})
+	if pinned {
+		s.recordEvent("pin", deployId, 0)
+	} else {
+		s.recordEvent("unpin", deployId, 0)
+	}
+	return nil
+}
@@ -44,19 +44,59 @@ frontend main
     bind *:%FRONT_PORT%
     default_backend thing-%APP_PORT%
 
+`
 
+var backendTemplate = `
 backend thing-%APP_PORT%
     balance leastconn
 
     server app-server-%APP_PORT% 127.0.0.1:%APP_PORT% check inter 2000
 `
 
+// Round robin rather than leastconn, so the split follows the weights
+// regardless of how long requests take.
+var canaryBackendTemplate = `
+backend thing-%APP_PORT%
+    balance roundrobin
+%STICKY%
+    server app-server-%APP_PORT% 127.0.0.1:%APP_PORT% check inter 2000 weight %APP_WEIGHT%%APP_COOKIE%
+    server app-server-%CANARY_PORT% 127.0.0.1:%CANARY_PORT% check inter 2000 weight %CANARY_WEIGHT%%CANARY_COOKIE%
+`
+
 func HaproxyConfig(statsPort int, frontPort int, appPort int) string {
-	str := cfgTemplate
+	str := cfgTemplate + backendTemplate
+
+	str = replace(str, "STATS_PORT", statsPort)
+	str = replace(str, "FRONT_PORT", frontPort)
+	str = replace(str, "APP_PORT", appPort)
+
+	return str
+}
+
+// HaproxyCanaryConfig is like HaproxyConfig, but sends canaryWeight percent
+// of the traffic to canaryPort. If sticky, a cookie pins each client to the
+// server it was first sent to.
+func HaproxyCanaryConfig(statsPort int, frontPort int, appPort int,
+	canaryPort int, canaryWeight int, sticky bool) string {
+	str := cfgTemplate + canaryBackendTemplate
+
+	if sticky {
+		str = strings.Replace(str, "%STICKY%",
+			"    cookie CAMUS_SERVER insert indirect nocache\n", -1)
+		str = strings.Replace(str, "%APP_COOKIE%", " cookie app-%APP_PORT%", -1)
+		str = strings.Replace(str, "%CANARY_COOKIE%", " cookie app-%CANARY_PORT%", -1)
+	} else {
+		str = strings.Replace(str, "%STICKY%", "", -1)
+		str = strings.Replace(str, "%APP_COOKIE%", "", -1)
+		str = strings.Replace(str, "%CANARY_COOKIE%", "", -1)
+	}
 
 	str = replace(str, "STATS_PORT", statsPort)
 	str = replace(str, "FRONT_PORT", frontPort)
 	str = replace(str, "APP_PORT", appPort)
+	str = replace(str, "CANARY_PORT", canaryPort)
+	str = replace(str, "APP_WEIGHT", 100-canaryWeight)
+	str = replace(str, "CANARY_WEIGHT", canaryWeight)
 
 	return str
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHaproxyCanaryConfig(t *testing.T) {
+	cfg := HaproxyCanaryConfig(8099, 8098, 8001, 8002, 10, false)
+
+	for _, expected := range []string{
+		"default_backend thing-8001",
+		"balance roundrobin",
+		"server app-server-8001 127.0.0.1:8001 check inter 2000 weight 90\n",
+		"server app-server-8002 127.0.0.1:8002 check inter 2000 weight 10\n",
+	} {
+		if !strings.Contains(cfg, expected) {
+			t.Errorf("expected config to contain '%s':\n%s", expected, cfg)
+		}
+	}
+	if strings.Contains(cfg, "cookie") || strings.Contains(cfg, "%") {
+		t.Errorf("unexpected cookie or unsubstituted variable in config:\n%s", cfg)
+	}
+
+	sticky := HaproxyCanaryConfig(8099, 8098, 8001, 8002, 10, true)
+	for _, expected := range []string{
+		"cookie CAMUS_SERVER insert indirect nocache",
+		"weight 90 cookie app-8001\n",
+		"weight 10 cookie app-8002\n",
+	} {
+		if !strings.Contains(sticky, expected) {
+			t.Errorf("expected sticky config to contain '%s':\n%s", expected, sticky)
+		}
+	}
+}
+
+func TestHaproxyConfigWithoutCanary(t *testing.T) {
+	cfg := HaproxyConfig(8099, 8098, 8001)
+	if strings.Count(cfg, "server app-server-") != 1 {
+		t.Errorf("expected exactly one backend server:\n%s", cfg)
+	}
+	if strings.Contains(cfg, "weight") || strings.Contains(cfg, "%") {
+		t.Errorf("unexpected weight or unsubstituted variable in config:\n%s", cfg)
+	}
+}
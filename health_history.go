@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// How many recent health checks are kept for each deploy.
+var HEALTH_HISTORY_SIZE = 100
+
+// HealthResult is one health check made by ListDeploys, Enforce or
+// CheckHealth.
+type HealthResult struct {
+	Time time.Time
+
+	// As in Deploy.Health.
+	Health int
+
+	Latency time.Duration
+
+	// The path checked: the first of the deploy's HealthEndpoints that
+	// passed, or the last if none did.
+	Endpoint string
+
+	// Why it failed, if it did.
+	Error string
+}
+
+// recordHealthResult adds result to deployId's history, dropping the oldest
+// once there are HEALTH_HISTORY_SIZE. The history is only kept in memory.
+func (s *ServerImpl) recordHealthResult(deployId string, result HealthResult) {
+	s.healthHistoryLock.Lock()
+	defer s.healthHistoryLock.Unlock()
+
+	history := append(s.healthHistory[deployId], result)
+	if len(history) > HEALTH_HISTORY_SIZE {
+		history = append([]HealthResult{}, history[len(history)-HEALTH_HISTORY_SIZE:]...)
+	}
+	s.healthHistory[deployId] = history
+}
+
+// HealthHistory returns deployId's most recent n health checks, oldest first,
+// or all those kept if n <= 0. It's empty if camus hasn't checked the deploy
+// since it started.
+func (s *ServerImpl) HealthHistory(deployId string, n int) ([]HealthResult, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return nil, err
+	}
+	s.healthHistoryLock.Lock()
+	defer s.healthHistoryLock.Unlock()
+
+	history := s.healthHistory[deployId]
+	if n > 0 && len(history) > n {
+		history = history[len(history)-n:]
+	}
+	return append([]HealthResult{}, history...), nil
+}
+
+// CheckHealth checks the health of deployId where it's running now, on its
+// port in the config, the same way ListDeploys does, without restarting it. A
+// failed check is in the result, the error is for a deploy that can't be
+// checked because it isn't running.
+func (s *ServerImpl) CheckHealth(deployId string) (HealthResult, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return HealthResult{}, err
+	}
+	app, err := s.loadApp(deployId)
+	if err != nil {
+		return HealthResult{}, err
+	}
+	s.configLock.Lock()
+	port := s.lookupConfiguredPort(deployId)
+	s.configLock.Unlock()
+	if port == 0 {
+		return HealthResult{}, fmt.Errorf("Deploy %s isn't running", deployId)
+	}
+	if s.portFree(port) {
+		return HealthResult{}, fmt.Errorf("Deploy %s isn't running, nothing is listening on its port %d", deployId, port)
+	}
+	return s.checkAppHealth(&Deploy{Id: deployId, Port: port}, app), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate for localhost that expires at
+// notAfter.
+func testCert(t *testing.T, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHealthCertExpiry(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	expiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{testCert(t, expiry)}}
+	ts.StartTLS()
+	defer ts.Close()
+	port := testServerPort(t, ts)
+
+	for _, c := range []struct {
+		deployId string
+		minDays  int
+		policy   string
+		fails    bool
+	}{
+		{"unchecked", 0, "", false},
+		{"lenient", 1, "", false},
+		{"strict", 7, "", true},
+		{"warned", 7, HEALTH_CERT_EXPIRY_WARN, false},
+	} {
+		writeTestDeploy(t, s, c.deployId, ApplicationDef{
+			RunCmd:              "true",
+			HealthEndpoint:      "/status",
+			HealthHttps:         true,
+			HealthTlsSkipVerify: true,
+			HealthCertMinDays:   c.minDays,
+			HealthCertExpiry:    c.policy,
+		})
+		app, err := s.loadApp(c.deployId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deploy := &Deploy{Id: c.deployId, Port: port}
+		s.checkAppHealth(deploy, app)
+		if failed := deploy.Health != http.StatusOK; failed != c.fails {
+			t.Errorf("%s: expected the health check failing to be %t, got %d %v", c.deployId, c.fails, deploy.Health, deploy.Errors)
+		}
+		if c.fails && (len(deploy.Errors) == 0 || !strings.Contains(deploy.Errors[0], "HealthCertMinDays 7")) {
+			t.Errorf("%s: expected the error to be the expiry, got %v", c.deployId, deploy.Errors)
+		}
+		if !deploy.CertExpiry.Equal(expiry) {
+			t.Errorf("%s: expected the expiry %s, got %s", c.deployId, expiry, deploy.CertExpiry)
+		}
+	}
+
+	// The certificate is verified unless told not to.
+	writeTestDeploy(t, s, "verified", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+		HealthHttps:    true,
+	})
+	app, err := s.loadApp("verified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.testApp(port, app); err == nil {
+		t.Errorf("expected the self-signed certificate to fail verification")
+	}
+
+	writeTestDeploy(t, s, "plain", ApplicationDef{RunCmd: "true", HealthCertMinDays: 7})
+	if _, err := s.loadApp("plain"); err == nil {
+		t.Errorf("expected HealthCertMinDays without HealthHttps to be rejected")
+	}
+}
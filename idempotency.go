@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// How long the result of a Run is remembered against its idempotency key.
+var RUN_IDEMPOTENCY_WINDOW = time.Duration(10) * time.Minute
+
+type idempotentRun struct {
+	deployId string
+	started  time.Time
+
+	// closed once port and err are set
+	done chan struct{}
+	port int
+	err  error
+}
+
+// RunIdempotent is like Run, but if the same key was used for a Run in the
+// last RUN_IDEMPOTENCY_WINDOW, that Run's result is returned (waiting for it
+// to finish if need be) instead of starting the deploy again. Only a Run that
+// succeeded is remembered, so retrying after a failure runs again, and it's
+// kept in the deploy's state, so a retry after camus restarts returns the
+// port it's still configured on. After a restart, reusing a key for another
+// deploy isn't noticed. An empty key always runs.
+func (s *ServerImpl) RunIdempotent(key string, deployId string) (int, error) {
+	return s.RunIdempotentContext(context.Background(), key, deployId)
+}
+
+// RunIdempotentContext is RunIdempotent, with RunContext.
+func (s *ServerImpl) RunIdempotentContext(ctx context.Context, key string, deployId string) (int, error) {
+	if key == "" {
+		return s.RunContext(ctx, deployId)
+	}
+
+	s.idempotencyLock.Lock()
+	now := time.Now()
+	for k, run := range s.recentRuns {
+		if now.Sub(run.started) > RUN_IDEMPOTENCY_WINDOW {
+			delete(s.recentRuns, k)
+		}
+	}
+	if run, ok := s.recentRuns[key]; ok {
+		s.idempotencyLock.Unlock()
+		if run.deployId != deployId {
+			return -1, fmt.Errorf("Idempotency key %s was already used to run %s", key, run.deployId)
+		}
+		<-run.done
+		return run.port, run.err
+	}
+	if port := s.idempotentRunPort(key, deployId, now); port != 0 {
+		s.idempotencyLock.Unlock()
+		return port, nil
+	}
+	run := &idempotentRun{
+		deployId: deployId,
+		started:  now,
+		done:     make(chan struct{}),
+	}
+	s.recentRuns[key] = run
+	s.idempotencyLock.Unlock()
+
+	run.port, run.err = s.RunContext(ctx, deployId)
+	close(run.done)
+	if run.err != nil {
+		s.idempotencyLock.Lock()
+		if s.recentRuns[key] == run {
+			delete(s.recentRuns, key)
+		}
+		s.idempotencyLock.Unlock()
+		return run.port, run.err
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.IdempotencyKey = key
+		state.IdempotentRun = run.started
+	})
+	return run.port, run.err
+}
+
+// idempotentRunPort returns the port deployId is configured on if its state
+// says key started it in the window before now, e.g. before camus restarted,
+// or 0 if not.
+func (s *ServerImpl) idempotentRunPort(key string, deployId string, now time.Time) int {
+	state, err := s.readDeployState(deployId)
+	if err != nil || state.IdempotencyKey != key || now.Sub(state.IdempotentRun) > RUN_IDEMPOTENCY_WINDOW {
+		return 0
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	if port := s.lookupConfiguredPort(deployId); port == state.Port {
+		return port
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// resolveIncludes merges the files named in data's Include list, in order,
+// under data itself, so a deploy.json can share settings with others. Later
+// files win, except that objects (e.g. Env) are merged key by key. Included
+// files are relative to the file including them, and may include others, but
+// must be in file's directory, the deploy dir, so a deploy.json can't pull
+// in other files on the server. file is where data was read from, and data
+// is returned unchanged if it has no Include.
+func resolveIncludes(file string, data []byte) ([]byte, error) {
+	return resolveIncludesFrom(absConfigPath(configDir(file)), file, data, []string{absConfigPath(file)})
+}
+
+func resolveIncludesFrom(deployDir string, file string, data []byte, stack []string) ([]byte, error) {
+	var def map[string]interface{}
+	if err := decodeJsonNumbers(data, &def); err != nil || def["Include"] == nil {
+		// left for the schema to complain about
+		return data, nil
+	}
+	list, ok := def["Include"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Include should be a list of files")
+	}
+
+	merged := map[string]interface{}{}
+	for _, item := range list {
+		name, ok := item.(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Include should be a list of files")
+		}
+		if path.IsAbs(name) {
+			return nil, fmt.Errorf("Include %s should be relative to the deploy dir", name)
+		}
+		included := absConfigPath(path.Join(configDir(file), name))
+		if rel, err := filepath.Rel(deployDir, included); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("Include %s is outside the deploy dir", name)
+		}
+		for _, including := range stack {
+			if including == included {
+				return nil, fmt.Errorf("Include cycle: %s -> %s", strings.Join(stack, " -> "), included)
+			}
+		}
+
+		includedData, err := ioutil.ReadFile(included)
+		if err != nil {
+			return nil, fmt.Errorf("Include %s: %s", name, err)
+		}
+		includedData, err = resolveIncludesFrom(deployDir, included, stripJsonComments(includedData), append(stack, included))
+		if err != nil {
+			return nil, err
+		}
+		var includedDef map[string]interface{}
+		if err := decodeJsonNumbers(includedData, &includedDef); err != nil {
+			return nil, fmt.Errorf("Include %s: %s", name, err)
+		}
+		mergeJson(merged, includedDef)
+	}
+	delete(def, "Include")
+	mergeJson(merged, def)
+	return json.Marshal(merged)
+}
+
+// mergeJson sets everything in src on dst, merging objects both have.
+func mergeJson(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcObject, srcIsObject := value.(map[string]interface{})
+		dstObject, dstIsObject := dst[key].(map[string]interface{})
+		if srcIsObject && dstIsObject {
+			mergeJson(dstObject, srcObject)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// decodeJsonNumbers is json.Unmarshal, keeping numbers as written.
+func decodeJsonNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func absConfigPath(file string) string {
+	if isConfigUrl(file) {
+		return file
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		return abs
+	}
+	return path.Clean(file)
+}
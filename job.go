@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// JobResult is how a run of a job deploy went.
+type JobResult struct {
+	Started  time.Time
+	Duration time.Duration
+
+	// The command's exit code, -1 if it was killed by a signal.
+	ExitCode int
+
+	// Why it failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// RunJob runs deployId, whose deploy.json has "Type": "job", to completion
+// and returns how it went. The error is for a job that couldn't be started,
+// a job that fails is in the result.
+func (s *ServerImpl) RunJob(deployId string) (JobResult, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return JobResult{}, err
+	}
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+
+	if err := s.checkNotQuarantined(deployId); err != nil {
+		return JobResult{}, err
+	}
+	return s.runJob(deployId)
+}
+
+// runJob runs job deploy deployId, which is locked, to completion. A job has
+// no port, so it's started with 0 for %PORT%, isn't health checked and isn't
+// configured in the config.
+func (s *ServerImpl) runJob(deployId string) (JobResult, error) {
+	app, cmd, err := s.commandForDeploy(deployId, 0, nil)
+	if err != nil {
+		return JobResult{}, err
+	}
+	if app.Type() != DEPLOY_TYPE_JOB {
+		closePipes(cmd)
+		return JobResult{}, fmt.Errorf("Deploy %s is a %s, not a %s", deployId, app.Type(), DEPLOY_TYPE_JOB)
+	}
+
+	result := JobResult{Started: time.Now().UTC()}
+	if err := startCmd(cmd); err != nil {
+		return JobResult{}, err
+	}
+	err = waitCmd(cmd)
+	result.Duration = time.Since(result.Started)
+	if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				result.ExitCode = status.ExitStatus()
+			}
+		}
+	}
+	if app.Detach() {
+		// whatever it left running in its process group goes too
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	s.updateDeployState(deployId, func(state *DeployState) {
+		if state.FirstRun.IsZero() {
+			state.FirstRun = result.Started
+		}
+		state.LastJob = &result
+	})
+	s.recordEvent("job", deployId, 0)
+	return result, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+)
+
+// JsonRpcHandler serves the methods of an rpc.Server (i.e. RpcServer's) as
+// JSON-RPC 1.0, one call per POST, for clients that can't speak gob, e.g.
+//
+//	{"method": "RpcServer.ListDeploys", "params": [{}], "id": 1}
+type JsonRpcHandler struct {
+	server *rpc.Server
+}
+
+func NewJsonRpcHandler(server *rpc.Server) *JsonRpcHandler {
+	return &JsonRpcHandler{server: server}
+}
+
+func (h *JsonRpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a JSON-RPC request", http.StatusMethodNotAllowed)
+		return
+	}
+	if status, err := checkLocalRequest(r, "application/json"); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	conn := &httpConn{Reader: r.Body, Writer: w}
+	if err := h.server.ServeRequest(jsonrpc.NewServerCodec(conn)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// httpConn is the connection a codec reads a request from and writes the
+// reply to.
+type httpConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (c *httpConn) Close() error {
+	return nil
+}
+
+// checkLocalRequest returns an error, and the status to reply with, unless r
+// was sent to localhost (not e.g. a rebound DNS name), from no page or one
+// on the same host, with one of contentTypes. Being listened for on
+// localhost doesn't stop a page on any site the operator visits posting to
+// it, and those types aren't ones a page can post without CORS allowing it.
+func checkLocalRequest(r *http.Request, contentTypes ...string) (int, error) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	switch host {
+	case "localhost", "127.0.0.1", "::1":
+	default:
+		return http.StatusForbidden, fmt.Errorf("Requests must be sent to localhost, not %s", r.Host)
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return http.StatusForbidden, fmt.Errorf("Requests from %s aren't allowed", origin)
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	for _, allowed := range contentTypes {
+		if mediaType == allowed {
+			return 0, nil
+		}
+	}
+	return http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type must be one of %v", contentTypes)
+}
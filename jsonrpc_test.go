@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestJsonRpcRequest(request string) *http.Request {
+	r := httptest.NewRequest("POST", "/jsonrpc", strings.NewReader(request))
+	r.Host = "localhost:8000"
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func postTestJsonRpc(t *testing.T, h *JsonRpcHandler, request string, reply interface{}) string {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestJsonRpcRequest(request))
+	var response struct {
+		Id     int
+		Result json.RawMessage
+		Error  interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %s", w.Body.String(), err)
+	}
+	if response.Id != 1 {
+		t.Fatalf("expected the reply to have the request's id, got %q", w.Body.String())
+	}
+	if response.Error != nil {
+		return response.Error.(string)
+	}
+	if err := json.Unmarshal(response.Result, reply); err != nil {
+		t.Fatal(err)
+	}
+	return ""
+}
+
+func TestJsonRpc(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "listed", ApplicationDef{RunCmd: "true"})
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(&RpcServer{s}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewJsonRpcHandler(rpcServer)
+
+	var deploys ListDeploysReply
+	if err := postTestJsonRpc(t, h,
+		`{"method": "RpcServer.ListDeploys", "params": [{}], "id": 1}`, &deploys); err != "" {
+		t.Fatalf("ListDeploys: %s", err)
+	}
+	if len(deploys.Deploys) != 1 || deploys.Deploys[0].Id != "listed" {
+		t.Fatalf("expected the one deploy, got %+v", deploys.Deploys)
+	}
+
+	var stopped StopDeployResponse
+	if err := postTestJsonRpc(t, h,
+		`{"method": "RpcServer.StopDeploy", "params": [{"DeployId": "missing"}], "id": 1}`, &stopped); err == "" {
+		t.Fatalf("expected stopping an unknown deploy to return an error")
+	}
+}
+
+func TestJsonRpcRejectsCrossSiteRequests(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.Register(&RpcServer{s}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewJsonRpcHandler(rpcServer)
+	request := `{"method": "RpcServer.ListDeploys", "params": [{}], "id": 1}`
+
+	for _, test := range []struct {
+		name   string
+		modify func(r *http.Request)
+		status int
+	}{
+		{"form post", func(r *http.Request) { r.Header.Set("Content-Type", "application/x-www-form-urlencoded") }, http.StatusUnsupportedMediaType},
+		{"text post", func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, http.StatusUnsupportedMediaType},
+		{"no content type", func(r *http.Request) { r.Header.Del("Content-Type") }, http.StatusUnsupportedMediaType},
+		{"rebound host", func(r *http.Request) { r.Host = "attacker.example.com:8000" }, http.StatusForbidden},
+		{"foreign origin", func(r *http.Request) { r.Header.Set("Origin", "http://attacker.example.com") }, http.StatusForbidden},
+		{"null origin", func(r *http.Request) { r.Header.Set("Origin", "null") }, http.StatusForbidden},
+		{"same origin", func(r *http.Request) { r.Header.Set("Origin", "http://localhost:8000") }, http.StatusOK},
+		{"loopback address", func(r *http.Request) { r.Host = "127.0.0.1:8000" }, http.StatusOK},
+	} {
+		r := newTestJsonRpcRequest(request)
+		test.modify(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %q", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+}
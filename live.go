@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoLiveDeploy is returned by LiveDeploy when the config has no LiveLabel,
+// or no deploy has that label.
+var ErrNoLiveDeploy = errors.New("No live deploy")
+
+// LiveDeploy returns the deploy with the config's LiveLabel, i.e. the one
+// serving as the active deploy or the canary, with the port it's on, for
+// scripts that just want whatever is live.
+func (s *ServerImpl) LiveDeploy() (Deploy, error) {
+	s.configLock.Lock()
+	label := s.config.LiveLabel
+	s.configLock.Unlock()
+	if label == "" {
+		return Deploy{}, fmt.Errorf("%w: the config has no LiveLabel", ErrNoLiveDeploy)
+	}
+
+	liveId := ""
+	for deployId, labels := range s.routingLabels() {
+		for _, l := range labels {
+			if l == label {
+				liveId = deployId
+			}
+		}
+	}
+	if liveId == "" {
+		return Deploy{}, fmt.Errorf("%w: nothing is labelled %s", ErrNoLiveDeploy, label)
+	}
+
+	deploys, err := s.ListDeploys()
+	if err != nil {
+		return Deploy{}, err
+	}
+	for _, deploy := range deploys {
+		if deploy.Id == liveId {
+			return *deploy, nil
+		}
+	}
+	return Deploy{}, fmt.Errorf("%w: %s is labelled %s, but isn't deployed", ErrNoLiveDeploy, liveId, label)
+}
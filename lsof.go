@@ -18,9 +18,10 @@ type Process struct {
 
 // FindListeningProcesses returns a list of Processes that are listening on
 // ports between lowPort and highPort. It will try and use the current working
-// directory to determine which deployId the running process has.
+// directory (a child of a directory named deploysDirName) to determine which
+// deployId the running process has.
 // TODO(koz): Provide a fake shell so we can test this function.
-func FindListeningProcesses(lowPort, highPort int) []Process {
+func FindListeningProcesses(lowPort, highPort int, deploysDirName string) []Process {
 	// List all TCP sockets listening between lowPort and highPort (-P prevents
 	// trying to resolve port numbers to well-known service names).
 	portRange := fmt.Sprintf(":%d-%d", lowPort, highPort)
@@ -37,17 +38,17 @@ func FindListeningProcesses(lowPort, highPort int) []Process {
 			fmt.Printf("Failed to lookup cwd for %d: %s\n", procs[i].Pid, err)
 			continue
 		}
-		procs[i].DeployId = deriveDeployIdFromCwd(cwd)
+		procs[i].DeployId = deriveDeployIdFromCwd(cwd, deploysDirName)
 	}
 	return procs
 }
 
-func deriveDeployIdFromCwd(cwd string) string {
+func deriveDeployIdFromCwd(cwd string, deploysDirName string) string {
 	dir, deployId := path.Split(cwd)
 	dir, deploysDir := path.Split(strings.TrimSuffix(dir, "/"))
 	// Check to see if this process is one of ours.
 	// TODO(koz): Make this strict by passing in the server root.
-	if deploysDir != "deploys" {
+	if deploysDir != deploysDirName {
 		return ""
 	}
 	return deployId
@@ -3,23 +3,35 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"runtime"
 	"time"
 )
 
 // TODO the rest
 
-var serverRoot = flag.String("serverRoot", "", "Path to the root directory in the prod machine")
+var serverRoot = flag.String("serverRoot", "", "Path to the root directory in the prod machine (default $CAMUS_ROOT, or the current directory)")
 var port = flag.Int("port", 8000, "port to serve on / connect to")
 var serverMode = flag.Bool("server", false, "If true, run as a server.")
 var runBackgroundCheck = flag.Bool("enforce", false, "Run background enforcer")
 var deployFile = flag.String("cfg", "deploy.json", "Deploy config file")
 var targetName = flag.String("target", "prod", "Target backend")
 var isLocalTest = flag.Bool("is-local-test", false, "Don't use ssh, and connect to a camus server running locally")
+var verifyChecksums = flag.Bool("verifyChecksums", false, "Refuse to run deploys whose files have changed since they were pushed")
+var debug = flag.Bool("debug", false, "Log details that are normally too noisy, e.g. why ports were skipped")
+var portCheckRetries = flag.Int("portCheckRetries", 0, "Times to recheck a busy port before giving it up when running a deploy")
+var quarantineThreshold = flag.Int("quarantineAfter", DEFAULT_QUARANTINE_THRESHOLD, "Stop restarting a deploy after it fails to start this many times in a row (0 for never)")
+var breakerFailures = flag.Int("breakerFailures", DEFAULT_BREAKER_FAILURES, "Failed starts within -breakerWindow after which a deploy isn't restarted for -breakerCooldown (0 for never)")
+var breakerWindow = flag.Duration("breakerWindow", DEFAULT_BREAKER_WINDOW, "See -breakerFailures")
+var breakerCooldown = flag.Duration("breakerCooldown", DEFAULT_BREAKER_COOLDOWN, "See -breakerFailures")
+var configStdin = flag.Bool("configStdin", false, "Read the server config from stdin, and keep changes to it in memory only")
+var healthCheckConcurrency = flag.Int("healthCheckConcurrency", runtime.NumCPU(), "Most deploys to health check at once")
 
 func main() {
 	// seed random number generator
@@ -36,16 +48,31 @@ func main() {
 }
 
 func serverMain() {
-	server, err := NewServerImpl(
-		*serverRoot,
-		*runBackgroundCheck,
-		*port)
+	root, err := resolveServerRoot(*serverRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []ServerOption{
+		WithVerifyChecksums(*verifyChecksums),
+		WithHealthCheckConcurrency(*healthCheckConcurrency),
+		WithPortCheckRetry(*portCheckRetries, PORT_CHECK_RETRY_DELAY, PORT_SEARCH_TIMEOUT),
+		WithDebug(*debug),
+		WithQuarantineThreshold(*quarantineThreshold),
+		WithCircuitBreaker(*breakerFailures, *breakerWindow, *breakerCooldown),
+	}
+	if *configStdin {
+		opts = append(opts, WithConfigReader(os.Stdin), WithConfigWrites(false))
+	}
+	server, err := NewServerImpl(root, *runBackgroundCheck, *port, opts...)
 	if err != nil {
 		log.Fatal("NewServer:", err)
 	}
 	rpcServer := &RpcServer{server}
 	rpc.Register(rpcServer)
 	rpc.HandleHTTP()
+	http.Handle("/upload", NewUploadHandler(server))
+	http.Handle("/jsonrpc", NewJsonRpcHandler(rpc.DefaultServer))
+	http.Handle("/ui", NewUIHandler(server))
 
 	// Localhost only, in case it's not behind a firewall!
 	portStr := fmt.Sprintf("localhost:%d", *port)
@@ -68,6 +95,34 @@ func clientMain() {
 	}
 }
 
+// resolveServerRoot picks the server root from the -serverRoot flag, then the
+// CAMUS_ROOT environment variable, then the current directory, and checks
+// camus can write to it.
+func resolveServerRoot(flagRoot string) (string, error) {
+	root := flagRoot
+	if root == "" {
+		root = os.Getenv("CAMUS_ROOT")
+	}
+	if root == "" {
+		root = "."
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server root: %s", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("Invalid server root: %s is not a directory", root)
+	}
+	f, err := ioutil.TempFile(root, ".camus-write-check-")
+	if err != nil {
+		return "", fmt.Errorf("Server root %s is not writable: %s", root, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return root, nil
+}
+
 func welcome() {
 	println()
 	println("  " + QUOTES[time.Now().UnixNano()%int64(len(QUOTES))])
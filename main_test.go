@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolveServerRoot(t *testing.T) {
+	flagRoot := createTestRoot(t)
+	defer os.RemoveAll(flagRoot)
+	envRoot := createTestRoot(t)
+	defer os.RemoveAll(envRoot)
+
+	defer os.Setenv("CAMUS_ROOT", os.Getenv("CAMUS_ROOT"))
+	os.Setenv("CAMUS_ROOT", envRoot)
+	if root, err := resolveServerRoot(flagRoot); root != flagRoot || err != nil {
+		t.Errorf("expected the flag to win, got (%s, %v)", root, err)
+	}
+	if root, err := resolveServerRoot(""); root != envRoot || err != nil {
+		t.Errorf("expected CAMUS_ROOT without the flag, got (%s, %v)", root, err)
+	}
+	os.Setenv("CAMUS_ROOT", "")
+	if root, err := resolveServerRoot(""); root != "." || err != nil {
+		t.Errorf("expected the current directory without either, got (%s, %v)", root, err)
+	}
+
+	file := path.Join(flagRoot, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{path.Join(flagRoot, "missing"), file} {
+		if _, err := resolveServerRoot(invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(flagRoot); len(entries) != 1 {
+		t.Errorf("expected the write check to clean up, found %d entries", len(entries))
+	}
+}
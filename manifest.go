@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// DeployManifest returns the deploy.json of deployId as it is on disk, for
+// auditing what's deployed.
+func (s *ServerImpl) DeployManifest(deployId string) ([]byte, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return nil, err
+	}
+	// The id becomes part of a path, so it mustn't lead out of the deploys
+	// dir.
+	if !validDeployId.MatchString(deployId) {
+		return nil, fmt.Errorf("Invalid deploy id %q", deployId)
+	}
+	if !s.deployExists(deployId) {
+		return nil, fmt.Errorf("No deploy %s", deployId)
+	}
+	return ioutil.ReadFile(s.deployConfigFile(deployId))
+}
+
+// EffectiveDeployManifest is DeployManifest with the comments stripped and
+// the files it lists in Include merged in, as camus reads it.
+func (s *ServerImpl) EffectiveDeployManifest(deployId string) ([]byte, error) {
+	data, err := s.DeployManifest(deployId)
+	if err != nil {
+		return nil, err
+	}
+	deployId, _ = s.resolveDeployId(deployId)
+	data, err = resolveIncludes(s.deployConfigFile(deployId), stripJsonComments(data))
+	if err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		return nil, fmt.Errorf("Invalid json %s", err)
+	}
+	return indented.Bytes(), nil
+}
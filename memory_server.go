@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+)
+
+// MemoryServer is a Server that keeps everything in memory, for testing code
+// that uses a Server without a root dir or running anything. ListDeploys and
+// ListLabels return what they're set to, and Run, Stop and Label are only
+// recorded.
+type MemoryServer struct {
+	lock sync.Mutex
+
+	deploys []*Deploy
+	labels  []Label
+
+	// Errors to return from each call, by name, e.g. "Run".
+	errors map[string]error
+
+	calls []ServerCall
+}
+
+// ServerCall is a call recorded by MemoryServer. Label is empty other than
+// for Label calls.
+type ServerCall struct {
+	Method   string
+	DeployId string
+	Label    Label
+}
+
+func NewMemoryServer(deploys []*Deploy, labels []Label) *MemoryServer {
+	return &MemoryServer{
+		deploys: deploys,
+		labels:  labels,
+		errors:  map[string]error{},
+	}
+}
+
+// SetDeploys changes what ListDeploys returns.
+func (m *MemoryServer) SetDeploys(deploys []*Deploy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deploys = deploys
+}
+
+// SetLabels changes what ListLabels returns.
+func (m *MemoryServer) SetLabels(labels []Label) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.labels = labels
+}
+
+// SetError makes method return err, or succeed again if err is nil.
+func (m *MemoryServer) SetError(method string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err == nil {
+		delete(m.errors, method)
+	} else {
+		m.errors[method] = err
+	}
+}
+
+// Calls returns the Run, Stop and Label calls made so far, oldest first,
+// including those that returned an error.
+func (m *MemoryServer) Calls() []ServerCall {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]ServerCall{}, m.calls...)
+}
+
+func (m *MemoryServer) ListLabels() ([]Label, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.errors["ListLabels"]; err != nil {
+		return nil, err
+	}
+	return append([]Label{}, m.labels...), nil
+}
+
+func (m *MemoryServer) ListDeploys() ([]*Deploy, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.errors["ListDeploys"]; err != nil {
+		return nil, err
+	}
+	return append([]*Deploy{}, m.deploys...), nil
+}
+
+func (m *MemoryServer) Run(deployId string) error {
+	return m.record(ServerCall{Method: "Run", DeployId: deployId})
+}
+
+func (m *MemoryServer) Stop(deployId string) error {
+	return m.record(ServerCall{Method: "Stop", DeployId: deployId})
+}
+
+func (m *MemoryServer) Label(deployId string, label Label) error {
+	return m.record(ServerCall{Method: "Label", DeployId: deployId, Label: label})
+}
+
+func (m *MemoryServer) record(call ServerCall) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.calls = append(m.calls, call)
+	return m.errors[call.Method]
+}
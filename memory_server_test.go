@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryServer(t *testing.T) {
+	var server Server = NewMemoryServer(
+		[]*Deploy{{Id: "first", Port: 8001}},
+		[]Label{"prod"})
+	m := server.(*MemoryServer)
+
+	deploys, err := server.ListDeploys()
+	if err != nil || len(deploys) != 1 || deploys[0].Id != "first" {
+		t.Fatalf("expected the canned deploy, got %v, %v", deploys, err)
+	}
+	labels, err := server.ListLabels()
+	if err != nil || !reflect.DeepEqual(labels, []Label{"prod"}) {
+		t.Fatalf("expected the canned labels, got %v, %v", labels, err)
+	}
+
+	m.SetLabels([]Label{"prod", "staging"})
+	if labels, _ := server.ListLabels(); len(labels) != 2 {
+		t.Fatalf("expected the new labels, got %v", labels)
+	}
+
+	failed := errors.New("no")
+	m.SetError("Stop", failed)
+	if err := server.Run("first"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if err := server.Stop("first"); err != failed {
+		t.Fatalf("expected the canned Stop error, got %v", err)
+	}
+	if err := server.Label("first", "prod"); err != nil {
+		t.Fatalf("label: %s", err)
+	}
+
+	expected := []ServerCall{
+		{Method: "Run", DeployId: "first"},
+		{Method: "Stop", DeployId: "first"},
+		{Method: "Label", DeployId: "first", Label: "prod"},
+	}
+	if calls := m.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, calls)
+	}
+}
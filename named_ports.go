@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// findNamedPorts picks a free port for each of the NamedPorts in deployId's
+// deploy.json, for it starting on port, which the caller holds. Like
+// findUnusedPort it's called without configLock, and the ports are held
+// until the caller unholds them; if it fails, the ones found so far are let
+// go and released.
+func (s *ServerImpl) findNamedPorts(ctx context.Context, deployId string, port int) (map[string]int, error) {
+	app, err := s.loadApp(deployId)
+	if err != nil || len(app.NamedPorts()) == 0 {
+		// a broken deploy.json is reported when it's run
+		return nil, nil
+	}
+	named := map[string]int{}
+	for _, name := range app.NamedPorts() {
+		p, err := s.findUnusedPort(ctx, deployId)
+		if err != nil {
+			for _, held := range named {
+				s.unholdPort(held)
+			}
+			s.releaseNamedPorts(deployId, named)
+			return nil, fmt.Errorf("Port for %s: %s", name, err)
+		}
+		named[name] = p
+	}
+	return named, nil
+}
+
+// setNamedPorts records named as deployId's NamedPorts in the config, or that
+// it has none. Call with configLock held.
+func (s *ServerImpl) setNamedPorts(deployId string, named map[string]int) {
+	if len(named) == 0 {
+		delete(s.config.NamedPorts, deployId)
+		return
+	}
+	if s.config.NamedPorts == nil {
+		s.config.NamedPorts = map[string]map[string]int{}
+	}
+	s.config.NamedPorts[deployId] = named
+}
+
+// dropNamedPortsOffPorts removes the NamedPorts of every deploy that isn't
+// on one of ports from the config, e.g. before writing ports as its Ports,
+// returning the NamedPorts it had to put back if the write fails. Call with
+// configLock held.
+func (s *ServerImpl) dropNamedPortsOffPorts(ports map[int]string) map[string]map[string]int {
+	previous := s.config.NamedPorts
+	onPort := map[string]bool{}
+	for _, deployId := range ports {
+		onPort[deployId] = true
+	}
+	s.config.NamedPorts = map[string]map[string]int{}
+	for deployId, named := range previous {
+		s.config.NamedPorts[deployId] = named
+	}
+	for deployId := range previous {
+		if !onPort[deployId] {
+			s.setNamedPorts(deployId, nil)
+		}
+	}
+	return previous
+}
+
+// configuredNamedPorts returns a copy of deployId's NamedPorts in the config.
+func (s *ServerImpl) configuredNamedPorts(deployId string) map[string]int {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	named := map[string]int{}
+	for name, port := range s.config.NamedPorts[deployId] {
+		named[name] = port
+	}
+	return named
+}
+
+// releaseNamedPorts runs the PortReleaseCmd for each of named, like
+// releasePort.
+func (s *ServerImpl) releaseNamedPorts(deployId string, named map[string]int) {
+	for _, port := range named {
+		s.releasePort(port, deployId)
+	}
+}
+
+// expandNamedPorts replaces the %PORT_<NAME>% placeholders of named in arg.
+func expandNamedPorts(arg string, named map[string]int) string {
+	for name, port := range named {
+		arg = strings.Replace(arg, "%"+namedPortVar(name)+"%", strconv.Itoa(port), -1)
+	}
+	return arg
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Notifier tells something outside camus about a deploy event.
+type Notifier interface {
+	Notify(event AuditEntry) error
+}
+
+// NotifierConfig configures a notifier in config.json. Type is "webhook"
+// (POST the event as json to Url) or "exec" (run Command with the event in
+// CAMUS_EVENT_* environment variables).
+type NotifierConfig struct {
+	Type    string
+	Url     string `json:",omitempty"`
+	Command string `json:",omitempty"`
+
+	// Times to try again when sending an event fails, waiting RetryDelayMs
+	// (default 1000) before the first retry and twice as long before each
+	// one after that. Events that still aren't sent go in the undelivered
+	// log.
+	Retries      int `json:",omitempty"`
+	RetryDelayMs int `json:",omitempty"`
+}
+
+var WEBHOOK_TIMEOUT = time.Duration(5) * time.Second
+
+const DEFAULT_NOTIFIER_RETRY_DELAY = time.Duration(1) * time.Second
+
+const undeliveredLogFileName = "undelivered.log"
+
+// UndeliveredEntry is one record in the undelivered log: an event a
+// notifier couldn't send, even after retrying.
+type UndeliveredEntry struct {
+	Time     time.Time
+	Notifier NotifierConfig
+	Event    AuditEntry
+	Error    string
+}
+
+func newNotifier(config NotifierConfig) (Notifier, error) {
+	switch config.Type {
+	case "webhook":
+		if config.Url == "" {
+			return nil, fmt.Errorf("webhook notifier needs a Url")
+		}
+		return &WebhookNotifier{
+			Url:    config.Url,
+			client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		}, nil
+	case "exec":
+		if config.Command == "" {
+			return nil, fmt.Errorf("exec notifier needs a Command")
+		}
+		return &ExecNotifier{Command: config.Command}, nil
+	}
+	return nil, fmt.Errorf("Unknown notifier type '%s'", config.Type)
+}
+
+func newNotifiers(configs []NotifierConfig) ([]*retryingNotifier, error) {
+	notifiers := []*retryingNotifier{}
+	for _, config := range configs {
+		n, err := newNotifier(config)
+		if err != nil {
+			return nil, err
+		}
+		if config.Retries < 0 || config.RetryDelayMs < 0 {
+			return nil, fmt.Errorf("%s notifier's Retries and RetryDelayMs can't be negative", config.Type)
+		}
+		delay := DEFAULT_NOTIFIER_RETRY_DELAY
+		if config.RetryDelayMs > 0 {
+			delay = time.Duration(config.RetryDelayMs) * time.Millisecond
+		}
+		notifiers = append(notifiers, &retryingNotifier{Notifier: n, config: config, delay: delay})
+	}
+	return notifiers, nil
+}
+
+// retryingNotifier retries a notifier as its config says.
+type retryingNotifier struct {
+	Notifier
+	config NotifierConfig
+	delay  time.Duration
+}
+
+func (n *retryingNotifier) Notify(event AuditEntry) error {
+	delay := n.delay
+	for retry := 0; ; retry++ {
+		err := n.Notifier.Notify(event)
+		if err == nil || retry >= n.config.Retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// notify sends the event to every notifier in the background, so a slow or
+// broken notifier never holds up a deploy. Events a notifier gives up on are
+// written to the undelivered log.
+func (s *ServerImpl) notify(event AuditEntry) {
+	for _, n := range s.notifiers {
+		go func(n *retryingNotifier) {
+			err := n.Notify(event)
+			if err == nil {
+				return
+			}
+			log.Printf("warning: %T failed to send %s event: %s\n", n.Notifier, event.Operation, err)
+			entry := UndeliveredEntry{
+				Time:     time.Now().UTC(),
+				Notifier: n.config,
+				Event:    event,
+				Error:    err.Error(),
+			}
+			if err := s.appendUndelivered(entry); err != nil {
+				log.Printf("warning: could not write undelivered entry %+v: %s\n", entry, err)
+			}
+		}(n)
+	}
+}
+
+func (s *ServerImpl) undeliveredLogFile() string {
+	return path.Join(s.root, undeliveredLogFileName)
+}
+
+func (s *ServerImpl) appendUndelivered(entry UndeliveredEntry) error {
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	s.undeliveredLock.Lock()
+	defer s.undeliveredLock.Unlock()
+
+	f, err := os.OpenFile(s.undeliveredLogFile(),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// ReadUndelivered returns the events notifiers couldn't send, oldest first.
+func (s *ServerImpl) ReadUndelivered() ([]UndeliveredEntry, error) {
+	s.undeliveredLock.Lock()
+	defer s.undeliveredLock.Unlock()
+
+	file, err := os.Open(s.undeliveredLogFile())
+	if os.IsNotExist(err) {
+		return []UndeliveredEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []UndeliveredEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry UndeliveredEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("warning: skipping unreadable undelivered entry: %s\n", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+type WebhookNotifier struct {
+	Url    string
+	client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(event AuditEntry) error {
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.Url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type ExecNotifier struct {
+	Command string
+}
+
+func (n *ExecNotifier) Notify(event AuditEntry) error {
+	cmd := exec.Command("sh", "-c", n.Command)
+	cmd.Env = append(os.Environ(),
+		"CAMUS_EVENT_TIME="+event.Time.Format(time.RFC3339),
+		"CAMUS_EVENT_OPERATION="+event.Operation,
+		"CAMUS_EVENT_DEPLOY_ID="+event.DeployId,
+		"CAMUS_EVENT_PORT="+strconv.Itoa(event.Port),
+		"CAMUS_EVENT_ACTOR="+event.Actor,
+		"CAMUS_EVENT_LABEL="+event.Label,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testEvent = AuditEntry{
+	Time:      time.Date(2015, 3, 15, 14, 43, 8, 0, time.UTC),
+	Operation: "run",
+	DeployId:  "amazing-sydney-2015-03-15-14-43-08",
+	Port:      8001,
+}
+
+func TestExecNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camus-notifier-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := path.Join(dir, "env")
+
+	n, err := newNotifier(NotifierConfig{Type: "exec", Command: "env > " + out})
+	if err != nil {
+		t.Fatalf("new notifier: %s", err)
+	}
+	if err := n.Notify(testEvent); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"CAMUS_EVENT_TIME=2015-03-15T14:43:08Z",
+		"CAMUS_EVENT_OPERATION=run",
+		"CAMUS_EVENT_DEPLOY_ID=amazing-sydney-2015-03-15-14-43-08",
+		"CAMUS_EVENT_PORT=8001",
+	} {
+		if !strings.Contains(string(data), expected+"\n") {
+			t.Errorf("expected command environment to contain %s", expected)
+		}
+	}
+
+	failing, _ := newNotifier(NotifierConfig{Type: "exec", Command: "exit 3"})
+	if err := failing.Notify(testEvent); err == nil {
+		t.Errorf("expected a failing command to return an error")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan AuditEntry, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AuditEntry
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		received <- event
+	}))
+	defer ts.Close()
+
+	n, err := newNotifier(NotifierConfig{Type: "webhook", Url: ts.URL})
+	if err != nil {
+		t.Fatalf("new notifier: %s", err)
+	}
+	if err := n.Notify(testEvent); err != nil {
+		t.Fatalf("notify: %s", err)
+	}
+	if event := <-received; event != testEvent {
+		t.Fatalf("expected webhook to receive %+v, got %+v", testEvent, event)
+	}
+}
+
+func TestInvalidNotifierConfig(t *testing.T) {
+	for _, config := range []NotifierConfig{
+		{Type: "carrier-pigeon"},
+		{Type: "webhook"},
+		{Type: "exec"},
+	} {
+		if _, err := newNotifier(config); err == nil {
+			t.Errorf("expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestNotifierRetries(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	var lock sync.Mutex
+	attempts := 0
+	received := make(chan AuditEntry, 1)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		failing := attempts <= 2
+		lock.Unlock()
+		if failing {
+			w.WriteHeader(503)
+			return
+		}
+		var event AuditEntry
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer flaky.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer down.Close()
+
+	s.notifiers, err = newNotifiers([]NotifierConfig{
+		{Type: "webhook", Url: flaky.URL, Retries: 3, RetryDelayMs: 10},
+		{Type: "webhook", Url: down.URL, Retries: 1, RetryDelayMs: 10},
+	})
+	if err != nil {
+		t.Fatalf("new notifiers: %s", err)
+	}
+	s.notify(testEvent)
+
+	select {
+	case event := <-received:
+		if event != testEvent {
+			t.Fatalf("expected webhook to receive %+v, got %+v", testEvent, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the flaky webhook to receive the event after retrying")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var undelivered []UndeliveredEntry
+	for len(undelivered) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		undelivered, err = s.ReadUndelivered()
+		if err != nil {
+			t.Fatalf("read undelivered: %s", err)
+		}
+	}
+	if len(undelivered) != 1 || undelivered[0].Notifier.Url != down.URL || undelivered[0].Event != testEvent {
+		t.Fatalf("expected the event the down webhook missed to be undelivered, got %+v", undelivered)
+	}
+
+	if _, err := newNotifiers([]NotifierConfig{{Type: "exec", Command: "true", Retries: -1}}); err == nil {
+		t.Errorf("expected negative Retries to be rejected")
+	}
+}
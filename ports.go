@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// How a port is used, as in PortInfo.Use.
+const (
+	// Configured for a deploy.
+	PORT_ALLOCATED = "allocated"
+
+	// Kept free with ReservePort.
+	PORT_RESERVED = "reserved"
+
+	// Neither, and nothing is listening on it.
+	PORT_FREE = "free"
+
+	// Neither, but something camus didn't start is listening on it.
+	PORT_BUSY = "busy"
+)
+
+// PortReport is how every port of the deploy range is being used, for
+// working out where the ports have gone.
+type PortReport struct {
+	// The deploy port range, inclusive.
+	Start int
+	End   int
+
+	// Every port in the range, then any configured or reserved ports
+	// outside it, in order.
+	Ports []PortInfo
+
+	// Allocated ports nothing is listening on, e.g. because the deploy
+	// crashed.
+	NotListening []int
+}
+
+type PortInfo struct {
+	Port int
+
+	// One of the PORT_ values.
+	Use string
+
+	// The deploy an allocated port is configured for.
+	DeployId string
+
+	// What a reserved port is reserved for.
+	Note string
+
+	Listening bool
+}
+
+// PortMap reports what each port is used for, according to the config and to
+// what's listening.
+func (s *ServerImpl) PortMap() (PortReport, error) {
+	s.configLock.Lock()
+	allocated := map[int]string{}
+	for port, deployId := range s.config.Ports {
+		allocated[port] = deployId
+	}
+	reserved := map[int]string{}
+	for port, note := range s.config.Reserved {
+		reserved[port] = note
+	}
+	s.configLock.Unlock()
+
+	ports := map[int]bool{}
+	for port := s.startPort; port <= s.endPort; port++ {
+		ports[port] = true
+	}
+	for port := range allocated {
+		ports[port] = true
+	}
+	for port := range reserved {
+		ports[port] = true
+	}
+	sorted := []int{}
+	for port := range ports {
+		sorted = append(sorted, port)
+	}
+	sort.Ints(sorted)
+
+	report := PortReport{Start: s.startPort, End: s.endPort, NotListening: []int{}}
+	for _, port := range sorted {
+		info := PortInfo{Port: port, Listening: !s.portFree(port)}
+		if deployId, ok := allocated[port]; ok {
+			info.Use = PORT_ALLOCATED
+			info.DeployId = deployId
+			if !info.Listening {
+				report.NotListening = append(report.NotListening, port)
+			}
+		} else if note, ok := reserved[port]; ok {
+			info.Use = PORT_RESERVED
+			info.Note = note
+		} else if info.Listening {
+			info.Use = PORT_BUSY
+		} else {
+			info.Use = PORT_FREE
+		}
+		report.Ports = append(report.Ports, info)
+	}
+	return report, nil
+}
+
+// PortUsage counts how much of the deploy port range is used, according to
+// the config, e.g. for alerting before it runs out.
+type PortUsage struct {
+	// Ports in the range.
+	Total int
+
+	// Ports in the range that are configured for a deploy, or reserved
+	// and not configured.
+	Allocated int
+	Reserved  int
+
+	// Neither. Something outside camus may still be listening on them.
+	Free int
+
+	// Allocated and reserved ports as a percentage of Total.
+	Utilization float64
+}
+
+// PortUtilization counts the ports in the range by whether the config has
+// them allocated, reserved or free. Unlike PortMap it doesn't check what's
+// listening.
+func (s *ServerImpl) PortUtilization() PortUsage {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	usage := PortUsage{}
+	for port := s.startPort; port <= s.endPort; port++ {
+		usage.Total++
+		if s.portConfigured(port) {
+			usage.Allocated++
+		} else if s.portReserved(port) {
+			usage.Reserved++
+		} else {
+			usage.Free++
+		}
+	}
+	if usage.Total > 0 {
+		usage.Utilization = 100 * float64(usage.Allocated+usage.Reserved) / float64(usage.Total)
+	}
+	return usage
+}
+
+// AvailablePortCount counts the ports in the range a new deploy could be
+// given now: not configured for a deploy, reserved or held for a smoke test,
+// with nothing listening on them. It doesn't allocate any, so another run may
+// take them before the caller gets to, e.g. an upload checking for capacity
+// first.
+func (s *ServerImpl) AvailablePortCount() (int, error) {
+	ports, err := s.unallocatedPorts()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, port := range ports {
+		if s.portFree(port) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// HasFreePort is whether AvailablePortCount is more than 0, stopping at the
+// first available port.
+func (s *ServerImpl) HasFreePort() (bool, error) {
+	ports, err := s.unallocatedPorts()
+	if err != nil {
+		return false, err
+	}
+	for _, port := range ports {
+		if s.portFree(port) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unallocatedPorts returns the ports in the range findUnusedPort would
+// consider, before checking whether anything is listening on them.
+func (s *ServerImpl) unallocatedPorts() ([]int, error) {
+	if s.startPort > s.endPort {
+		return nil, errors.New("No deploy ports in range")
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	ports := []int{}
+	for port := s.startPort; port <= s.endPort; port++ {
+		if _, smoke := s.smokePorts[port]; smoke || s.portConfigured(port) || s.portReserved(port) {
+			continue
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// How long the config's PortReserveCmd and PortReleaseCmd may run. A reserve
+// command that takes longer rejects the port.
+var PORT_HOOK_TIMEOUT = time.Duration(10) * time.Second
+
+// portAccepted is whether the PortReserveCmd lets deployId have port, logging
+// why not.
+func (s *ServerImpl) portAccepted(port int, deployId string) bool {
+	if err := s.reservePort(port, deployId); err != nil {
+		log.Printf("skipping port %d: rejected by PortReserveCmd: %s\n", port, err)
+		return false
+	}
+	return true
+}
+
+// reservePort runs the PortReserveCmd, if there is one, for deployId about to
+// be given port, which it shouldn't be if this fails. Call it without
+// configLock, which isn't held while the command runs.
+func (s *ServerImpl) reservePort(port int, deployId string) error {
+	s.configLock.Lock()
+	command := s.config.PortReserveCmd
+	s.configLock.Unlock()
+	if command == "" {
+		return nil
+	}
+	return runPortHook(command, port, deployId)
+}
+
+// releasePort runs the PortReleaseCmd, if there is one, for deployId giving up
+// port. Like reservePort, call it without configLock.
+func (s *ServerImpl) releasePort(port int, deployId string) {
+	s.configLock.Lock()
+	command := s.config.PortReleaseCmd
+	s.configLock.Unlock()
+	if command == "" {
+		return
+	}
+	if err := runPortHook(command, port, deployId); err != nil {
+		log.Printf("warning: PortReleaseCmd for port %d of %s: %s\n", port, deployId, err)
+	}
+}
+
+// runPortHook runs command in the shell like an ExecNotifier, with the port and
+// deploy in its environment.
+func runPortHook(command string, port int, deployId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PORT_HOOK_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"CAMUS_PORT="+strconv.Itoa(port),
+		"CAMUS_DEPLOY_ID="+deployId,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
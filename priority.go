@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// ProcessPriority is the CPU and IO priority a process is running with, see
+// Deploy.Priority.
+type ProcessPriority struct {
+	Nice int
+
+	// An IO_CLASS_ value, empty if none was set, in which case the kernel
+	// uses best-effort at a priority following Nice.
+	IoClass    string
+	IoPriority int
+}
+
+// ionice's numbers for the IO_CLASS_ values, which are also the kernel's.
+var ioClassNumbers = map[string]int{
+	IO_CLASS_REALTIME:    1,
+	IO_CLASS_BEST_EFFORT: 2,
+	IO_CLASS_IDLE:        3,
+}
+
+// priorityArgv returns the ionice and nice commands to run app's argv under
+// for its IoClass and Nice, which both exec it, so it keeps their pid. nice
+// adds to camus's own niceness, which is normally 0.
+func priorityArgv(app Application) ([]string, error) {
+	argv := []string{}
+	if class := app.IoClass(); class != "" {
+		if _, err := exec.LookPath("ionice"); err != nil {
+			return nil, fmt.Errorf("Can't set IoClass %s: %s", class, err)
+		}
+		argv = append(argv, "ionice", "-c", strconv.Itoa(ioClassNumbers[class]))
+		if class != IO_CLASS_IDLE {
+			argv = append(argv, "-n", strconv.Itoa(app.IoPriority()))
+		}
+	}
+	if nice := app.Nice(); nice != 0 {
+		if _, err := exec.LookPath("nice"); err != nil {
+			return nil, fmt.Errorf("Can't set Nice %d: %s", nice, err)
+		}
+		argv = append(argv, "nice", "-n", strconv.Itoa(nice))
+	}
+	return argv, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+// For ioprio_get, see ioprio_set(2).
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioDataMask   = 0xff
+)
+
+// processPriority reads the niceness of pid from /proc and its IO priority
+// with ioprio_get.
+func processPriority(pid int) (ProcessPriority, error) {
+	data, err := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return ProcessPriority{}, err
+	}
+	stat, err := parseProcStat(string(data))
+	if err != nil {
+		return ProcessPriority{}, err
+	}
+	priority := ProcessPriority{Nice: stat.nice}
+
+	ioprio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(pid), 0)
+	if errno != 0 {
+		return priority, errno
+	}
+	for class, number := range ioClassNumbers {
+		if int(ioprio>>ioprioClassShift) == number {
+			priority.IoClass = class
+		}
+	}
+	if priority.IoClass != "" && priority.IoClass != IO_CLASS_IDLE {
+		priority.IoPriority = int(ioprio & ioprioDataMask)
+	}
+	return priority, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestProcessPriority(t *testing.T) {
+	if _, err := exec.LookPath("ionice"); err != nil {
+		t.Skipf("no ionice: %s", err)
+	}
+	self, err := processPriority(os.Getpid())
+	if err != nil {
+		t.Fatalf("priority of the test: %s", err)
+	}
+	if self.Nice+5 > 19 {
+		t.Skipf("already running at nice %d", self.Nice)
+	}
+
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "batch", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+		Nice:           5,
+		IoClass:        IO_CLASS_BEST_EFFORT,
+		IoPriority:     6,
+	})
+	defer s.Stop("batch")
+	if _, err := s.Run("batch"); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	pid, alive := s.trackedPid("batch")
+	if !alive {
+		t.Fatalf("expected batch to be running")
+	}
+	expected := ProcessPriority{Nice: self.Nice + 5, IoClass: IO_CLASS_BEST_EFFORT, IoPriority: 6}
+	if priority, err := processPriority(pid); err != nil || priority != expected {
+		t.Errorf("expected the child to run at %+v, got %+v, %v", expected, priority, err)
+	}
+
+	deploys, err := s.ListDeploys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, deploy := range deploys {
+		if deploy.Id == "batch" && (deploy.Priority == nil || *deploy.Priority != expected) {
+			t.Errorf("expected ListDeploys to show %+v, got %+v", expected, deploy.Priority)
+		}
+	}
+}
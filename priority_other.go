@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func processPriority(pid int) (ProcessPriority, error) {
+	return ProcessPriority{}, fmt.Errorf("Process priorities are only available on Linux")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Prewarm starts deployId and waits for it to be healthy, like Run, without
+// sending it any traffic, so that promoting it later is just the switch. A
+// deploy already running healthily on its port is left as it is.
+func (s *ServerImpl) Prewarm(deployId string) (int, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return -1, err
+	}
+	port, err := s.warmPort(deployId)
+	if port != 0 {
+		if err != nil {
+			return -1, fmt.Errorf("%s is running on %d, but failing its health check: %s", deployId, port, err)
+		}
+		return port, nil
+	}
+	port, err = s.Run(deployId)
+	if err != nil {
+		return -1, err
+	}
+	s.recordEvent("prewarm", deployId, port)
+	return port, nil
+}
+
+// Promote makes deployId the active deploy. One that's already running and
+// healthy, e.g. from Prewarm, is switched to straight away, without starting
+// it again. Otherwise it's started first, as by Run.
+func (s *ServerImpl) Promote(deployId string) error {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	port, err := s.warmPort(deployId)
+	if port != 0 && err != nil {
+		return fmt.Errorf("Not promoting %s, it's running on %d but failing its health check: %s", deployId, port, err)
+	}
+	if port == 0 {
+		if port, err = s.Run(deployId); err != nil {
+			return err
+		}
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	if s.config.Ports[port] != deployId {
+		return fmt.Errorf("%s was moved off port %d before it could be promoted", deployId, port)
+	}
+	if err := s.setActive(port, nil); err != nil {
+		return err
+	}
+	s.recordEventFor(context.Background(), LABEL_ACTIVE, "promote", deployId, port)
+	return nil
+}
+
+// warmPort returns the port deployId is configured and running on, and why
+// it isn't healthy there, if it isn't. The port is 0 if it isn't running.
+func (s *ServerImpl) warmPort(deployId string) (int, error) {
+	s.configLock.Lock()
+	port := s.lookupConfiguredPort(deployId)
+	s.configLock.Unlock()
+	if port == 0 {
+		return 0, nil
+	}
+	if _, alive := s.trackedPid(deployId); !alive && s.portFree(port) {
+		return 0, nil
+	}
+	app, err := s.loadApp(deployId)
+	if err != nil {
+		return port, err
+	}
+	status, err := s.testApp(port, app)
+	if err == nil && !app.HealthyStatus(status) {
+		err = fmt.Errorf("status %d", status)
+	}
+	return port, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// Quarantine records why Enforce gave up restarting a deploy.
+type Quarantine struct {
+	Time   time.Time
+	Reason string
+}
+
+// Enforce quarantines a deploy after this many failed starts in a row, unless
+// overridden with WithQuarantineThreshold.
+const DEFAULT_QUARANTINE_THRESHOLD = 5
+
+// The window a deploy's MaxRestarts applies to, unless its deploy.json has a
+// RestartWindowMs.
+var DEFAULT_RESTART_WINDOW = time.Duration(10) * time.Minute
+
+// WithQuarantineThreshold sets how many times in a row Enforce can fail to
+// start a deploy before quarantining it. 0 means never.
+func WithQuarantineThreshold(n int) ServerOption {
+	return func(s *ServerImpl) {
+		s.quarantineThreshold = n
+	}
+}
+
+// enforceFailed counts a failed start of deployId on port by Enforce, and
+// quarantines the deploy once there have been too many in a row: it's
+// stopped, its port is freed and Enforce no longer restarts it.
+func (s *ServerImpl) enforceFailed(deployId string, port int, err error) {
+	failures := 0
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Failures++
+		failures = state.Failures
+	})
+	log.Printf("failed to start %s on %d (%d in a row): %s\n", deployId, port, failures, err)
+	if s.quarantineThreshold <= 0 || failures < s.quarantineThreshold {
+		return
+	}
+	s.quarantine(deployId, port, fmt.Sprintf("Failed to start %d times in a row, last: %s", failures, err))
+}
+
+// countRestart records that Enforce is about to restart deployId, and returns
+// whether that's more than app's MaxRestarts within its RestartWindow, in
+// which case the deploy is quarantined instead.
+func (s *ServerImpl) countRestart(deployId string, port int, app Application) bool {
+	if app.MaxRestarts() <= 0 {
+		return false
+	}
+	now := time.Now().UTC()
+	since := now.Add(-app.RestartWindow())
+	restarts := 0
+	s.updateDeployState(deployId, func(state *DeployState) {
+		recent := []time.Time{}
+		for _, restart := range state.Restarts {
+			if restart.After(since) {
+				recent = append(recent, restart)
+			}
+		}
+		state.Restarts = append(recent, now)
+		restarts = len(state.Restarts)
+	})
+	if restarts <= app.MaxRestarts() {
+		return false
+	}
+	s.quarantine(deployId, port, fmt.Sprintf("Restarted %d times within %s, more than MaxRestarts %d",
+		restarts-1, app.RestartWindow(), app.MaxRestarts()))
+	return true
+}
+
+// quarantine stops deployId, frees its port and stops Enforce restarting it,
+// until ClearQuarantine.
+func (s *ServerImpl) quarantine(deployId string, port int, reason string) {
+	if pid, ok := s.trackedPid(deployId); ok {
+		if target := signalTarget(pid); target != 0 {
+			syscall.Kill(target, syscall.SIGKILL)
+		}
+	}
+	s.configLock.Lock()
+	freed := s.config.Ports[port] == deployId
+	named := s.config.NamedPorts[deployId]
+	if freed {
+		delete(s.config.Ports, port)
+		s.setNamedPorts(deployId, nil)
+		if err := s.writeConfig(); err != nil {
+			log.Printf("warning: could not free port %d of quarantined %s: %s\n", port, deployId, err)
+		}
+	}
+	s.configLock.Unlock()
+	if freed {
+		s.releasePort(port, deployId)
+		s.releaseNamedPorts(deployId, named)
+	}
+
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Quarantine = &Quarantine{Time: now, Reason: reason}
+		state.Restarts = nil
+		state.Lifecycle = LIFECYCLE_QUARANTINED
+		state.Pid = 0
+		state.Port = 0
+		delete(s.processes, deployId)
+	})
+	s.removePidFile(deployId)
+	log.Printf("quarantined %s: %s\n", deployId, reason)
+	s.recordPortFreed(port)
+	s.recordEvent("quarantine", deployId, port)
+}
+
+// ClearQuarantine lets a quarantined deploy be run again.
+func (s *ServerImpl) ClearQuarantine(deployId string) error {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	state, err := s.readDeployState(deployId)
+	if err != nil {
+		return err
+	}
+	if state.Quarantine == nil {
+		return fmt.Errorf("Deploy %s isn't quarantined", deployId)
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Quarantine = nil
+		state.Failures = 0
+		state.Lifecycle = LIFECYCLE_STOPPED
+	})
+	s.recordEvent("clear-quarantine", deployId, 0)
+	return nil
+}
+
+// checkNotQuarantined returns an error if deployId is quarantined.
+func (s *ServerImpl) checkNotQuarantined(deployId string) error {
+	state, err := s.readDeployState(deployId)
+	if err != nil {
+		return err
+	}
+	if state.Quarantine != nil {
+		return fmt.Errorf("Deploy %s is quarantined (%s), clear the quarantine to run it",
+			deployId, state.Quarantine.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// The children startCmd started that waitCmd hasn't waited for yet, which
+// the reaper leaves to it, so it still gets their exit status. The lock is
+// held while starting one, so the reaper can't see it exit before it's here.
+var (
+	waitedLock sync.Mutex
+	waited     = map[int]bool{}
+)
+
+// startWaited starts cmd, which the caller must then waitCmd.
+func startWaited(cmd *exec.Cmd) error {
+	waitedLock.Lock()
+	defer waitedLock.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waited[cmd.Process.Pid] = true
+	return nil
+}
+
+// waitCmd waits for cmd, started by startWaited, to exit.
+func waitCmd(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	waitedLock.Lock()
+	delete(waited, cmd.Process.Pid)
+	waitedLock.Unlock()
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// From prctl(2).
+const PR_SET_CHILD_SUBREAPER = 36
+
+var reaperOnce sync.Once
+var reaperErr error
+
+// startReaper makes camus a child subreaper and reaps its zombie children on
+// every SIGCHLD, for the config's ReapOrphans. It's for the whole process, so
+// it's only started once however many servers there are.
+func startReaper() error {
+	reaperOnce.Do(func() {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_CHILD_SUBREAPER, 1, 0); errno != 0 {
+			reaperErr = fmt.Errorf("Become a child subreaper: %s", errno)
+			return
+		}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGCHLD)
+		go func() {
+			for range signals {
+				reapOrphans()
+			}
+		}()
+		// any that exited before the handler was installed
+		reapOrphans()
+	})
+	return reaperErr
+}
+
+// reapOrphans waits for every zombie child of camus that nothing else will:
+// not one startCmd started, which waitCmd waits for, and not in camus's own
+// process group, as that's where the commands camus runs and waits for
+// itself are, e.g. lsof. Orphans of a deploy are in the deploy's group, apart
+// from those of NoDetach deploys, which are left alone.
+func reapOrphans() {
+	waitedLock.Lock()
+	defer waitedLock.Unlock()
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		log.Printf("warning: could not look for zombies to reap: %s\n", err)
+		return
+	}
+	self, group := os.Getpid(), syscall.Getpgrp()
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || waited[pid] {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		stat, err := parseProcStat(string(data))
+		if err != nil || stat.state != "Z" || stat.ppid != self || stat.pgrp == group {
+			continue
+		}
+		var status syscall.WaitStatus
+		if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && reaped == pid {
+			log.Printf("reaped orphaned process %d (exit status %d)\n", pid, status.ExitStatus())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// zombieFor waits a second for pid to exit and be reaped, returning whether
+// it's been left a zombie.
+func zombieFor(pid int) bool {
+	state := ""
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		data, err := ioutil.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+		if err != nil {
+			return false
+		}
+		if stat, err := parseProcStat(string(data)); err == nil {
+			state = stat.state
+		}
+	}
+	return state == "Z"
+}
+
+func TestReapExitedDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "exiting", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	if _, err := s.Run("exiting"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	pid, alive := s.trackedPid("exiting")
+	if !alive {
+		t.Fatalf("expected exiting to be running")
+	}
+	// exits by itself, not through Stop
+	syscall.Kill(-pid, syscall.SIGKILL)
+	if zombieFor(pid) {
+		t.Errorf("expected the exited deploy %d to be reaped", pid)
+	}
+}
+
+func TestReapOrphans(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// In a process of its own, as being a subreaper can't be undone.
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "--", "orphan", root)
+	cmd.Env = append(os.Environ(), "CAMUS_TEST_HELPER=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read orphan pid: %s", err)
+	}
+	orphan, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("expected the orphan's pid, got %q", line)
+	}
+	if zombieFor(orphan) {
+		t.Errorf("expected the orphan %d to be reaped", orphan)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func startReaper() error {
+	return fmt.Errorf("ReapOrphans is only supported on Linux")
+}
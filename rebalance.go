@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// RebalanceResult is what Rebalance did with one deploy.
+type RebalanceResult struct {
+	DeployId string
+	OldPort  int
+
+	// 0 if it wasn't moved.
+	NewPort int
+
+	// Why it wasn't moved, or what went wrong stopping the old instance.
+	Error string
+}
+
+// Rebalance moves every running deploy to a new port, e.g. after the port
+// range changes. Each is started again on a free port, and once that's
+// healthy the config and haproxy are switched to it before the old instance
+// is stopped, so the deploy keeps serving throughout. A deploy that fails to
+// start on its new port is left where it was. The error is for not getting
+// as far as trying.
+func (s *ServerImpl) Rebalance() ([]RebalanceResult, error) {
+	s.configLock.Lock()
+	ports := []int{}
+	deployIds := map[int]string{}
+	for port, deployId := range s.config.Ports {
+		ports = append(ports, port)
+		deployIds[port] = deployId
+	}
+	s.configLock.Unlock()
+	sort.Ints(ports)
+
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+	listening := makeProcessDeployIdLookup(procs)
+
+	results := []RebalanceResult{}
+	for _, port := range ports {
+		deployId := deployIds[port]
+		pid := 0
+		if proc, ok := listening[deployId]; ok && proc.Port == port {
+			pid = proc.Pid
+		} else if tracked, alive := s.trackedPid(deployId); alive && !s.portFree(port) {
+			// e.g. started by camus before it restarted, as in Stop
+			pid = tracked
+		}
+		if pid == 0 {
+			continue
+		}
+		result := RebalanceResult{DeployId: deployId, OldPort: port}
+		newPort, err := s.rebalanceDeploy(deployId, port, pid)
+		result.NewPort = newPort
+		if err != nil {
+			log.Printf("rebalancing %s: %s\n", deployId, err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// rebalanceDeploy moves deployId from oldPort, where it's running as oldPid,
+// returning the port it moved to, or 0 if it didn't.
+func (s *ServerImpl) rebalanceDeploy(deployId string, oldPort int, oldPid int) (int, error) {
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+
+	// The old instance keeps its NamedPorts until it's stopped, so the new
+	// one would need others, and switching them isn't supported.
+	if app, err := s.loadApp(deployId); err == nil && len(app.NamedPorts()) > 0 {
+		return 0, errors.New("Deploys with NamedPorts aren't moved")
+	}
+
+	s.configLock.Lock()
+	configured := s.config.Ports[oldPort] == deployId
+	s.configLock.Unlock()
+	if !configured {
+		return 0, fmt.Errorf("No longer on port %d", oldPort)
+	}
+	// Held like a smoke test's port until the new instance is healthy.
+	newPort, err := s.findUnusedPort(context.Background(), deployId)
+	if err != nil {
+		return 0, err
+	}
+	moved := false
+	defer func() {
+		s.unholdPort(newPort)
+		if !moved {
+			s.releasePort(newPort, deployId)
+		}
+	}()
+
+	app, cmd, err := s.commandForDeploy(deployId, newPort, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := startCmd(cmd); err != nil {
+		return 0, err
+	}
+	s.statsd.count("deploy.start", deployId)
+	err = s.waitForProcessToStart(newPort, app, watchExit(cmd))
+	s.startupFinished(deployId, start, err)
+	if err != nil {
+		target := startedTarget(app, cmd.Process.Pid)
+		syscall.Kill(target, syscall.SIGKILL)
+		go s.awaitStopped(deployId, target)
+		return 0, fmt.Errorf("New instance on %d didn't start: %s", newPort, err)
+	}
+
+	if err := s.switchDeployPort(deployId, oldPort, newPort); err != nil {
+		target := startedTarget(app, cmd.Process.Pid)
+		syscall.Kill(target, syscall.SIGKILL)
+		go s.awaitStopped(deployId, target)
+		return 0, err
+	}
+	moved = true
+	defer s.releasePort(oldPort, deployId)
+	s.recordStarted(deployId, cmd.Process.Pid, newPort)
+	s.recordRun(deployId)
+	s.recordEvent("rebalance", deployId, newPort)
+
+	// The old instance, the same way Stop would.
+	target := signalTarget(oldPid)
+	if target == 0 {
+		return newPort, fmt.Errorf("Moved to %d, but couldn't stop the old instance: pid %d isn't running", newPort, oldPid)
+	}
+	syscall.Kill(target, app.StopSignal())
+	go s.awaitStopped(deployId, target)
+	if !s.awaitPortReleased(oldPort, s.stopTimeout(app)) {
+		syscall.Kill(target, syscall.SIGKILL)
+		if !s.awaitPortReleased(oldPort, s.stopTimeout(app)) {
+			return newPort, fmt.Errorf("Moved to %d, but port %d is still in use", newPort, oldPort)
+		}
+	}
+	s.recordPortFreed(oldPort)
+	return newPort, nil
+}
+
+// switchDeployPort moves deployId from oldPort to newPort in the config,
+// pointing haproxy at newPort first if deployId is the active deploy or the
+// canary. It's only an error if nothing was switched.
+func (s *ServerImpl) switchDeployPort(deployId string, oldPort int, newPort int) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.config.Ports[oldPort] != deployId {
+		return fmt.Errorf("No longer on port %d", oldPort)
+	}
+	delete(s.config.Ports, oldPort)
+	s.config.Ports[newPort] = deployId
+	active := s.config.Active
+	if active == oldPort {
+		active = newPort
+	}
+	isCanary := s.config.Canary != nil && s.config.Canary.DeployId == deployId
+	if active != s.config.Active || isCanary {
+		if err := s.reloadHaproxy(active, s.config.Canary); err != nil {
+			delete(s.config.Ports, newPort)
+			s.config.Ports[oldPort] = deployId
+			return fmt.Errorf("reload haproxy: %s", err)
+		}
+	}
+	s.config.Active = active
+	// haproxy already sends traffic to newPort, so there's no going back.
+	if err := s.writeConfig(); err != nil {
+		log.Printf("warning: could not write config after moving %s to %d: %s\n", deployId, newPort, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Kinds of ReconcileProblem.
+const (
+	// A port is configured for a deploy that isn't in the deploys dir.
+	RECONCILE_MISSING_DEPLOY = "missing-deploy"
+
+	// A port is configured for a deploy that isn't running.
+	RECONCILE_DEAD_PORT = "dead-port"
+
+	// A deploy is running on a port that isn't configured for anything.
+	RECONCILE_UNCONFIGURED_PROCESS = "unconfigured-process"
+
+	// Something is running on a port configured for another deploy.
+	RECONCILE_WRONG_PORT = "wrong-port"
+
+	// A deploy is in the deploys dir, but on no port and not running.
+	RECONCILE_IDLE_DEPLOY = "idle-deploy"
+
+	// The active port has no deploy configured on it.
+	RECONCILE_UNCONFIGURED_ACTIVE = "unconfigured-active"
+)
+
+// ReconcileProblem is one way the config and what's on disk and running
+// disagree.
+type ReconcileProblem struct {
+	// One of the RECONCILE_ values.
+	Kind     string
+	DeployId string
+	Port     int
+	Detail   string
+
+	// Whether Reconcile fixed it.
+	Fixed bool
+}
+
+// ReconcileReport is what Reconcile found, in port order, then deploy id
+// order for deploys on no port.
+type ReconcileReport struct {
+	Problems []ReconcileProblem
+}
+
+// Reconcile compares the ports in the config with the deploys dir and the
+// processes listening in the port range, and reports where they disagree.
+// If fix is true, it also fixes what can be fixed without stopping anything
+// or changing where haproxy sends traffic: ports of missing or dead deploys
+// are freed, unless they're the active deploy or the canary, and deploys
+// running on a free port are configured there. The config is written once
+// with all the fixes.
+func (s *ServerImpl) Reconcile(fix bool) (ReconcileReport, error) {
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+	procsByPort := makeProcessPortLookup(procs)
+	deployIds, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	report := ReconcileReport{Problems: []ReconcileProblem{}}
+	ports := map[int]string{}
+	for port, deployId := range s.config.Ports {
+		ports[port] = deployId
+	}
+	changed := false
+
+	for port, deployId := range s.config.Ports {
+		proc, listening := procsByPort[port]
+		if tracked, alive := s.trackedPid(deployId); alive && !listening {
+			// e.g. still starting up, or started before camus restarted
+			proc, listening = Process{Port: port, Pid: tracked, DeployId: deployId}, true
+		}
+		routed := port == s.config.Active ||
+			(s.config.Canary != nil && s.config.Canary.DeployId == deployId)
+
+		problem := ReconcileProblem{DeployId: deployId, Port: port}
+		switch {
+		case !s.deployExists(deployId):
+			problem.Kind = RECONCILE_MISSING_DEPLOY
+			problem.Detail = "not in the deploys dir"
+		case !listening:
+			problem.Kind = RECONCILE_DEAD_PORT
+			problem.Detail = "not running"
+		case proc.DeployId != deployId:
+			running := proc.DeployId
+			if running == "" {
+				running = proc.Name
+			}
+			problem.Kind = RECONCILE_WRONG_PORT
+			problem.Detail = fmt.Sprintf("%s is running there instead (pid %d)", running, proc.Pid)
+			report.Problems = append(report.Problems, problem)
+			continue
+		default:
+			continue
+		}
+		if listening {
+			problem.Detail += fmt.Sprintf(", but pid %d is listening there", proc.Pid)
+		} else if routed {
+			problem.Detail += ", left as haproxy routes to it"
+		} else if fix {
+			delete(ports, port)
+			problem.Fixed = true
+			changed = true
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	for port, proc := range procsByPort {
+		if proc.DeployId == "" || !s.deployExists(proc.DeployId) {
+			// not one of ours
+			continue
+		}
+		if _, configured := s.config.Ports[port]; configured {
+			continue
+		}
+		problem := ReconcileProblem{
+			Kind:     RECONCILE_UNCONFIGURED_PROCESS,
+			DeployId: proc.DeployId,
+			Port:     port,
+			Detail:   fmt.Sprintf("pid %d is listening, but the port isn't configured", proc.Pid),
+		}
+		if configuredPort := s.lookupConfiguredPort(proc.DeployId); configuredPort != 0 {
+			problem.Detail += fmt.Sprintf(", the deploy is configured on %d", configuredPort)
+		} else if fix {
+			ports[port] = proc.DeployId
+			problem.Fixed = true
+			changed = true
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	if _, ok := s.config.Ports[s.config.Active]; s.config.Active != 0 && !ok {
+		report.Problems = append(report.Problems, ReconcileProblem{
+			Kind:   RECONCILE_UNCONFIGURED_ACTIVE,
+			Port:   s.config.Active,
+			Detail: "haproxy routes to a port with no deploy configured",
+		})
+	}
+
+	running := makeProcessDeployIdLookup(procs)
+	idle := []ReconcileProblem{}
+	for _, deployId := range deployIds {
+		if s.lookupConfiguredPort(deployId) != 0 {
+			continue
+		}
+		if _, ok := running[deployId]; ok {
+			continue
+		}
+		if _, alive := s.trackedPid(deployId); alive {
+			continue
+		}
+		idle = append(idle, ReconcileProblem{
+			Kind:     RECONCILE_IDLE_DEPLOY,
+			DeployId: deployId,
+			Detail:   "on no port and not running, see GC",
+		})
+	}
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Port < report.Problems[j].Port
+	})
+	report.Problems = append(report.Problems, idle...)
+
+	if changed {
+		previous := s.config.Ports
+		s.config.Ports = ports
+		previousNamed := s.dropNamedPortsOffPorts(ports)
+		if err := s.writeConfig(); err != nil {
+			s.config.Ports = previous
+			s.config.NamedPorts = previousNamed
+			return ReconcileReport{}, fmt.Errorf("write config: %s", err)
+		}
+		for _, problem := range report.Problems {
+			if problem.Fixed {
+				s.recordEvent("reconcile", problem.DeployId, problem.Port)
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+)
+
+// Deploy ids are used as file and directory names, so are kept to characters
+// that are safe in both. They can't start with _, which is used for the
+// deploys dir's own entries like _latest.
+var validDeployId = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// RenameDeploy gives deploy oldId the id newId, moving its directory and
+// updating the config (its Ports, NamedPorts and Canary), its state, tags,
+// checksums and stderr file, and what's kept about it in memory, to match.
+// It refuses to rename a running deploy, see ForceRenameDeploy.
+func (s *ServerImpl) RenameDeploy(oldId string, newId string) error {
+	return s.renameDeploy(oldId, newId, false)
+}
+
+// ForceRenameDeploy is RenameDeploy, also for running deploys. Their
+// processes keep running in the moved directory.
+func (s *ServerImpl) ForceRenameDeploy(oldId string, newId string) error {
+	return s.renameDeploy(oldId, newId, true)
+}
+
+func (s *ServerImpl) renameDeploy(oldId string, newId string, force bool) error {
+	oldId, err := s.resolveDeployId(oldId)
+	if err != nil {
+		return err
+	}
+	if !validDeployId.MatchString(newId) {
+		return fmt.Errorf("Invalid deploy id %q: use letters, digits, '.', '-' and '_', not starting with '.', '-' or '_'", newId)
+	}
+	if newId == oldId {
+		return fmt.Errorf("Deploy %s already has that id", oldId)
+	}
+	// Always locked in the same order, so renames between two ids in
+	// opposite directions can't deadlock.
+	first, second := oldId, newId
+	if second < first {
+		first, second = second, first
+	}
+	unlockFirst := s.lockDeploy(first)
+	defer unlockFirst()
+	unlockSecond := s.lockDeploy(second)
+	defer unlockSecond()
+
+	if !s.deployExists(oldId) {
+		return fmt.Errorf("No deploy %s", oldId)
+	}
+	if _, err := os.Lstat(s.deployDir(newId)); err == nil {
+		return fmt.Errorf("Deploy %s already exists", newId)
+	}
+	if !force {
+		procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+		_, listening := makeProcessDeployIdLookup(procs)[oldId]
+		if _, alive := s.trackedPid(oldId); alive || listening {
+			return fmt.Errorf("Deploy %s is running, stop it first or force the rename", oldId)
+		}
+	}
+
+	s.configLock.Lock()
+	if err := os.Rename(s.deployDir(oldId), s.deployDir(newId)); err != nil {
+		s.configLock.Unlock()
+		return err
+	}
+	previous := s.config
+	ports := map[int]string{}
+	for port, deployId := range s.config.Ports {
+		if deployId == oldId {
+			deployId = newId
+		}
+		ports[port] = deployId
+	}
+	s.config.Ports = ports
+	namedPorts := map[string]map[string]int{}
+	for deployId, named := range s.config.NamedPorts {
+		if deployId == oldId {
+			deployId = newId
+		}
+		namedPorts[deployId] = named
+	}
+	s.config.NamedPorts = namedPorts
+	if s.config.Canary != nil && s.config.Canary.DeployId == oldId {
+		canary := *s.config.Canary
+		canary.DeployId = newId
+		s.config.Canary = &canary
+	}
+	if err := s.writeConfig(); err != nil {
+		s.config.Ports, s.config.Canary = previous.Ports, previous.Canary
+		s.config.NamedPorts = previous.NamedPorts
+		os.Rename(s.deployDir(newId), s.deployDir(oldId))
+		s.configLock.Unlock()
+		return fmt.Errorf("write config: %s", err)
+	}
+	s.configLock.Unlock()
+
+	s.stateLock.Lock()
+	s.renameSideFile(s.stateFile(oldId), s.stateFile(newId))
+	if pid, ok := s.processes[oldId]; ok {
+		delete(s.processes, oldId)
+		s.processes[newId] = pid
+	}
+	if checked, ok := s.livenessChecked[oldId]; ok {
+		delete(s.livenessChecked, oldId)
+		s.livenessChecked[newId] = checked
+	}
+	s.stateLock.Unlock()
+	s.tagsLock.Lock()
+	s.renameSideFile(s.tagsFile(oldId), s.tagsFile(newId))
+	s.tagsLock.Unlock()
+	s.renameSideFile(s.checksumsFile(oldId), s.checksumsFile(newId))
+	s.healthHistoryLock.Lock()
+	if history, ok := s.healthHistory[oldId]; ok {
+		delete(s.healthHistory, oldId)
+		s.healthHistory[newId] = history
+	}
+	s.healthHistoryLock.Unlock()
+	s.breakersLock.Lock()
+	if breaker, ok := s.breakers[oldId]; ok {
+		delete(s.breakers, oldId)
+		s.breakers[newId] = breaker
+	}
+	s.breakersLock.Unlock()
+	s.renameSideFile(s.stderrFile(oldId), s.stderrFile(newId))
+
+	log.Printf("renamed %s to %s\n", oldId, newId)
+	s.recordEvent("rename", newId, 0)
+	return nil
+}
+
+// renameSideFile moves one of the files kept about a deploy outside its
+// directory. The deploy has already been renamed, so failures are logged
+// rather than returned.
+func (s *ServerImpl) renameSideFile(oldFile string, newFile string) {
+	if err := os.Rename(oldFile, newFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("warning: could not move %s to %s: %s\n", oldFile, newFile, err)
+	}
+}
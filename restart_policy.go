@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// Restart policies, for a deploy.json's OnCrash and OnUnhealthy.
+const (
+	// Enforce starts the deploy again on its port.
+	RESTART_POLICY_RESTART = "restart"
+
+	// Enforce leaves the deploy as it is, for someone to look at.
+	RESTART_POLICY_LEAVE = "leave"
+)
+
+// How many health checks in a row a running deploy must fail before its
+// OnUnhealthy applies, unless its deploy.json has UnhealthyChecks.
+const DEFAULT_UNHEALTHY_CHECKS = 3
+
+// LivenessCheck values, how Enforce checks a running deploy.
+const (
+	// The health check, or a GET of the LivenessPath.
+	LIVENESS_CHECK_HTTP = "http"
+
+	// Just that something accepts connections on its port.
+	LIVENESS_CHECK_TCP = "tcp"
+)
+
+// leaveCrashed is whether Enforce should leave deployId, whose OnCrash is
+// RESTART_POLICY_LEAVE, stopped on port rather than start it. It should if
+// the deploy was running, so it's crashed, which is recorded, or has already
+// failed. One that was never started or was stopped is started as usual.
+func (s *ServerImpl) leaveCrashed(deployId string, port int) bool {
+	crashed, leave := false, false
+	s.updateDeployState(deployId, func(state *DeployState) {
+		switch state.Lifecycle {
+		case LIFECYCLE_STARTING, LIFECYCLE_RUNNING:
+			state.Lifecycle = LIFECYCLE_FAILED
+			state.Pid = 0
+			delete(s.processes, deployId)
+			crashed, leave = true, true
+		case LIFECYCLE_FAILED:
+			leave = true
+		}
+	})
+	if crashed {
+		log.Printf("%s exited, leaving it stopped on %d as its OnCrash is %s\n", deployId, port, RESTART_POLICY_LEAVE)
+		s.removePidFile(deployId)
+		s.recordEvent("crash", deployId, port)
+	} else if leave {
+		s.debugf("not starting %s: it failed and its OnCrash is %s\n", deployId, RESTART_POLICY_LEAVE)
+	}
+	return leave
+}
+
+// enforceHealth checks the health of deployId, running on port as pid, for
+// Enforce. If its OnUnhealthy is RESTART_POLICY_RESTART and it has failed
+// UnhealthyChecks in a row, it's stopped and started again.
+func (s *ServerImpl) enforceHealth(deployId string, port int, pid int) {
+	app, err := s.loadApp(deployId)
+	if err != nil || app.OnUnhealthy() != RESTART_POLICY_RESTART || s.supervisionPaused(deployId) {
+		return
+	}
+	unlock := s.lockDeploy(deployId)
+	s.configLock.Lock()
+	stillConfigured := s.config.Ports[port] == deployId
+	s.configLock.Unlock()
+	if !stillConfigured {
+		unlock()
+		return
+	}
+
+	if !s.livenessDue(deployId, app) {
+		unlock()
+		return
+	}
+	err = s.checkLiveness(port, app)
+	healthy := err == nil
+	failures := 0
+	s.updateDeployState(deployId, func(state *DeployState) {
+		if healthy {
+			state.UnhealthyChecks = 0
+		} else {
+			state.UnhealthyChecks++
+		}
+		failures = state.UnhealthyChecks
+	})
+	if healthy || failures < app.UnhealthyChecks() {
+		unlock()
+		return
+	}
+
+	log.Printf("%s failed %d health checks in a row on %d (%s), restarting it\n",
+		deployId, failures, port, err)
+	s.recordHealthFailure(deployId)
+	s.recordEvent("restart-unhealthy", deployId, port)
+	if target := signalTarget(pid); target != 0 {
+		syscall.Kill(target, app.StopSignal())
+		if !s.awaitPortReleased(port, s.stopTimeout(app)) {
+			syscall.Kill(target, syscall.SIGKILL)
+			s.awaitPortReleased(port, s.stopTimeout(app))
+		}
+		go s.awaitStopped(deployId, target)
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.UnhealthyChecks = 0
+	})
+	unlock()
+
+	s.enforceDeploy(deployId, port)
+}
+
+// livenessDue is whether Enforce should check deployId's liveness now, given
+// its LivenessInterval, and if so notes that it's being checked.
+func (s *ServerImpl) livenessDue(deployId string, app Application) bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	now := time.Now()
+	if last, ok := s.livenessChecked[deployId]; ok && now.Sub(last) < app.LivenessInterval() {
+		return false
+	}
+	s.livenessChecked[deployId] = now
+	return true
+}
+
+// checkLiveness checks app running on port the way its LivenessCheck says,
+// returning an error if it fails.
+func (s *ServerImpl) checkLiveness(port int, app Application) error {
+	if app.LivenessCheck() == LIVENESS_CHECK_TCP {
+		if s.portFree(port) {
+			return fmt.Errorf("nothing accepting connections on %d", port)
+		}
+		return nil
+	}
+	var status int
+	var err error
+	if app.LivenessPath() != "" {
+		status, err = s.testAppEndpoint(port, app, app.LivenessPath())
+	} else {
+		status, err = s.testApp(port, app)
+	}
+	if err == nil && !app.HealthyStatus(status) {
+		err = fmt.Errorf("status %d", status)
+	}
+	return err
+}
@@ -1,18 +1,29 @@
 package main
 
+import (
+	"context"
+)
+
 type RpcServer struct {
 	server *ServerImpl
 }
 
 ////////////////
 
-type ListDeploysRequest struct{}
+type ListDeploysRequest struct {
+	// If set, only deploys with all of these tags are listed.
+	Tags map[string]string
+
+	// If set, only deploys in this state, DEPLOYS_RUNNING or
+	// DEPLOYS_STOPPED, are listed.
+	State string
+}
 type ListDeploysReply struct {
 	Deploys []*Deploy
 }
 
 func (s *RpcServer) ListDeploys(arg ListDeploysRequest, reply *ListDeploysReply) error {
-	deploys, err := s.server.ListDeploys()
+	deploys, err := s.server.listDeploysMatching(arg.Tags, arg.State)
 	if err != nil {
 		return err
 	}
@@ -24,31 +35,44 @@ func (s *RpcServer) ListDeploys(arg ListDeploysRequest, reply *ListDeploysReply)
 
 type SetActivePortRequest struct {
 	Port int
+
+	// Optional, who's asking, for the audit log.
+	Actor string
 }
 type SetActivePortReply struct {
 }
 
 func (s *RpcServer) SetActiveByPort(arg SetActivePortRequest,
 	reply *SetActivePortReply) error {
-	return s.server.SetActiveByPort(arg.Port)
+	return s.server.SetActiveByPortContext(WithActor(context.Background(), arg.Actor), arg.Port)
 }
 
 ////////////////
 
 type SetActiveByIdRequest struct {
 	Id string
+
+	// Optional, who's asking, for the audit log.
+	Actor string
 }
 type SetActiveByIdReply struct{}
 
 func (s *RpcServer) SetActiveById(arg SetActiveByIdRequest,
 	reply *SetActiveByIdReply) error {
-	return s.server.SetActiveById(arg.Id)
+	return s.server.SetActiveByIdContext(WithActor(context.Background(), arg.Actor), arg.Id)
 }
 
 ////////////////
 
 type RunRequest struct {
 	DeployId string
+
+	// Optional. Retried requests with the same key return the first
+	// request's result rather than running the deploy again.
+	IdempotencyKey string
+
+	// Optional, who's asking, for the audit log.
+	Actor string
 }
 type RunReply struct {
 	Port int
@@ -60,7 +84,8 @@ func (s *RpcServer) Run(arg RunRequest, reply *RunReply) error {
 		return err
 	}
 
-	port, err := s.server.Run(deployId)
+	ctx := WithActor(context.Background(), arg.Actor)
+	port, err := s.server.RunIdempotentContext(ctx, arg.IdempotencyKey, deployId)
 	if err != nil {
 		return err
 	}
@@ -99,8 +124,22 @@ func (s *RpcServer) GetDeploysPath(arg GetDeploysPathRequest, reply *GetDeploysP
 
 ////////////////
 
+type RecordChecksumsRequest struct {
+	DeployId string
+}
+type RecordChecksumsReply struct{}
+
+func (s *RpcServer) RecordChecksums(arg RecordChecksumsRequest, reply *RecordChecksumsReply) error {
+	return s.server.RecordChecksums(arg.DeployId)
+}
+
+////////////////
+
 type StopDeployRequest struct {
 	DeployId string
+
+	// Optional, who's asking, for the audit log.
+	Actor string
 }
 type StopDeployResponse struct {
 }
@@ -111,7 +150,110 @@ func (s *RpcServer) StopDeploy(arg StopDeployRequest, reply *StopDeployResponse)
 		return err
 	}
 
-	return s.server.Stop(deployId)
+	return s.server.StopContext(WithActor(context.Background(), arg.Actor), deployId)
+}
+
+////////////////
+
+type PinRequest struct {
+	DeployId string
+}
+type PinReply struct {
+}
+
+func (s *RpcServer) Pin(arg PinRequest, reply *PinReply) error {
+	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	if err != nil {
+		return err
+	}
+	return s.server.Pin(deployId)
+}
+
+func (s *RpcServer) Unpin(arg PinRequest, reply *PinReply) error {
+	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	if err != nil {
+		return err
+	}
+	return s.server.Unpin(deployId)
+}
+
+////////////////
+
+type DeleteDeployRequest struct {
+	DeployId string
+
+	// Delete it even if it's pinned.
+	Force bool
+}
+type DeleteDeployReply struct {
+}
+
+func (s *RpcServer) DeleteDeploy(arg DeleteDeployRequest, reply *DeleteDeployReply) error {
+	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	if err != nil {
+		return err
+	}
+	return s.server.DeleteDeploy(deployId, arg.Force)
+}
+
+////////////////
+
+type DetachRequest struct {
+	DeployId string
+	Options  DetachOptions
+}
+type DetachReply struct {
+	Steps []DetachStep
+
+	// Why the detach stopped, if it did, in the reply so the steps taken
+	// before it are too.
+	Error string
+}
+
+func (s *RpcServer) Detach(arg DetachRequest, reply *DetachReply) error {
+	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	if err != nil {
+		return err
+	}
+	reply.Steps, err = s.server.Detach(deployId, arg.Options)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	return nil
+}
+
+////////////////
+
+type DoctorRequest struct{}
+type DoctorReply struct {
+	Diagnostics []Diagnostic
+}
+
+func (s *RpcServer) Doctor(arg DoctorRequest, reply *DoctorReply) error {
+	diagnostics, err := s.server.Doctor()
+	if err != nil {
+		return err
+	}
+	reply.Diagnostics = diagnostics
+	return nil
+}
+
+////////////////
+
+type QueryAuditRequest struct {
+	Filter AuditFilter
+}
+type QueryAuditReply struct {
+	Entries []AuditEntry
+}
+
+func (s *RpcServer) QueryAudit(arg QueryAuditRequest, reply *QueryAuditReply) error {
+	entries, err := s.server.QueryAudit(arg.Filter)
+	if err != nil {
+		return err
+	}
+	reply.Entries = entries
+	return nil
 }
 
 ////////////////
@@ -139,3 +281,94 @@ func (s *RpcServer) Shutdown(arg ShutdownRequest, reply *ShutdownResponse) error
 	s.server.Shutdown()
 	return nil
 }
+
+////////////////
+
+type DeployManifestRequest struct {
+	DeployId string
+
+	// If true, with comments stripped and Include merged in.
+	Effective bool
+}
+
+type DeployManifestReply struct {
+	Manifest string
+}
+
+func (s *RpcServer) DeployManifest(arg DeployManifestRequest, reply *DeployManifestReply) error {
+	var manifest []byte
+	var err error
+	if arg.Effective {
+		manifest, err = s.server.EffectiveDeployManifest(arg.DeployId)
+	} else {
+		manifest, err = s.server.DeployManifest(arg.DeployId)
+	}
+	if err != nil {
+		return err
+	}
+	reply.Manifest = string(manifest)
+	return nil
+}
+
+////////////////
+
+type StopDryRunRequest struct {
+	DeployId string
+}
+
+type StopDryRunReply struct {
+	Plan StopPlan
+}
+
+func (s *RpcServer) StopDryRun(arg StopDryRunRequest, reply *StopDryRunReply) error {
+	deployId, err := s.server.GetFullDeployIdFromShortName(arg.DeployId)
+	if err != nil {
+		return err
+	}
+	reply.Plan, err = s.server.StopDryRun(deployId)
+	return err
+}
+
+////////////////
+
+type TimelineRequest struct {
+}
+
+type TimelineReply struct {
+	Events []TimelineEvent
+}
+
+func (s *RpcServer) Timeline(arg TimelineRequest, reply *TimelineReply) error {
+	events, err := s.server.Timeline()
+	reply.Events = events
+	return err
+}
+
+////////////////
+
+type LiveDeployRequest struct {
+}
+
+type LiveDeployReply struct {
+	Deploy Deploy
+}
+
+func (s *RpcServer) LiveDeploy(arg LiveDeployRequest, reply *LiveDeployReply) error {
+	deploy, err := s.server.LiveDeploy()
+	reply.Deploy = deploy
+	return err
+}
+
+////////////////
+
+type EnsureDeployRequest struct {
+	DeployId string
+	Label    Label
+}
+
+type EnsureDeployReply struct {
+}
+
+func (s *RpcServer) EnsureDeploy(arg EnsureDeployRequest, reply *EnsureDeployReply) error {
+	return s.server.EnsureDeploy(arg.DeployId, arg.Label)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the part of JSON Schema deploy.json files are checked with:
+// type, properties, required, additionalProperties, items, enum, pattern and
+// minimum. Other keywords are ignored.
+type jsonSchema struct {
+	// A type name or a list of them.
+	Type interface{} `json:"type,omitempty"`
+
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+
+	// false, or the schema of properties not in Properties.
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+
+	Items *jsonSchema `json:"items,omitempty"`
+
+	Enum    []interface{} `json:"enum,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+	Minimum *float64      `json:"minimum,omitempty"`
+}
+
+// deployJsonSchema is the schema every deploy.json must match, derived from
+// ApplicationDef so the two can't disagree.
+var deployJsonSchema = schemaForType(reflect.TypeOf(ApplicationDef{}))
+
+func schemaForType(t reflect.Type) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem())
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Slice:
+		return &jsonSchema{Type: []interface{}{"array", "null"}, Items: schemaForType(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: []interface{}{"object", "null"}, AdditionalProperties: schemaForType(t.Elem())}
+	case reflect.Struct:
+		schema := &jsonSchema{
+			Type:                 []interface{}{"object", "null"},
+			Properties:           map[string]*jsonSchema{},
+			AdditionalProperties: false,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			schema.Properties[field.Name] = schemaForType(field.Type)
+		}
+		return schema
+	}
+	panic(fmt.Sprintf("no schema for %s", t))
+}
+
+// readSchema reads a JSON Schema from file.
+func readSchema(file string) (*jsonSchema, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("Invalid schema %s: %s", file, err)
+	}
+	return &schema, nil
+}
+
+// validateJson returns every way data doesn't match schema, sorted.
+func validateJson(schema *jsonSchema, data []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	schema.validate("", value, &problems)
+	sort.Strings(problems)
+	return problems, nil
+}
+
+func (schema *jsonSchema) validate(at string, value interface{}, problems *[]string) {
+	problem := func(format string, args ...interface{}) {
+		name := at
+		if name == "" {
+			name = "(top level)"
+		}
+		*problems = append(*problems, name+": "+fmt.Sprintf(format, args...))
+	}
+
+	if schema.Type != nil {
+		types := []interface{}{schema.Type}
+		if list, ok := schema.Type.([]interface{}); ok {
+			types = list
+		}
+		matched := false
+		for _, t := range types {
+			if name, ok := t.(string); ok && jsonHasType(value, name) {
+				matched = true
+			}
+		}
+		if !matched {
+			problem("should be %s, not %s", typeNames(types), jsonTypeName(value))
+			return
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			problem("should be one of %v", schema.Enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if schema.Pattern != "" {
+			if re, err := regexp.Compile(schema.Pattern); err != nil {
+				problem("invalid pattern in schema: %s", err)
+			} else if !re.MatchString(v) {
+				problem("should match %s", schema.Pattern)
+			}
+		}
+	case json.Number:
+		if f, err := v.Float64(); err == nil && schema.Minimum != nil && f < *schema.Minimum {
+			problem("should be at least %v", *schema.Minimum)
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				schema.Items.validate(fmt.Sprintf("%s[%d]", at, i), item, problems)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				problem("missing %s", name)
+			}
+		}
+		for name, property := range v {
+			propertyAt := name
+			if at != "" {
+				propertyAt = at + "." + name
+			}
+			if propertySchema, ok := schema.Properties[name]; ok {
+				propertySchema.validate(propertyAt, property, problems)
+				continue
+			}
+			switch additional := schema.AdditionalProperties.(type) {
+			case bool:
+				if !additional {
+					*problems = append(*problems, propertyAt+unknownFieldProblem+similarField(name, schema.Properties))
+				}
+			case *jsonSchema:
+				additional.validate(propertyAt, property, problems)
+			case map[string]interface{}:
+				// from a schema file
+				if data, err := json.Marshal(additional); err == nil {
+					var nested jsonSchema
+					if json.Unmarshal(data, &nested) == nil {
+						nested.validate(propertyAt, property, problems)
+					}
+				}
+			}
+		}
+	}
+}
+
+// dropUnknownFields returns data without the fields schema doesn't allow,
+// which validate reports as unknown. encoding/json matches field names
+// without regard to case, so e.g. a "runcmd" has to be removed to really be
+// ignored.
+func dropUnknownFields(schema *jsonSchema, data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	schema.dropUnknown(value)
+	return json.Marshal(value)
+}
+
+func (schema *jsonSchema) dropUnknown(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		if schema.Items != nil {
+			for _, item := range v {
+				schema.Items.dropUnknown(item)
+			}
+		}
+	case map[string]interface{}:
+		for name, property := range v {
+			if propertySchema, ok := schema.Properties[name]; ok {
+				propertySchema.dropUnknown(property)
+				continue
+			}
+			switch additional := schema.AdditionalProperties.(type) {
+			case bool:
+				if !additional {
+					delete(v, name)
+				}
+			case *jsonSchema:
+				additional.dropUnknown(property)
+			}
+		}
+	}
+}
+
+// What validate reports for a field the schema doesn't allow, after its path.
+const unknownFieldProblem = ": unknown field"
+
+// isUnknownFieldProblem reports whether a problem from validateJson is only
+// an unknown field.
+func isUnknownFieldProblem(problem string) bool {
+	return strings.Contains(problem, unknownFieldProblem)
+}
+
+// similarField suggests the known field name is probably meant to be, e.g.
+// HealthEndpoint for healthEndpoint or health_endpoint.
+func similarField(name string, properties map[string]*jsonSchema) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Replace(s, "_", "", -1))
+	}
+	for known := range properties {
+		if normalize(known) == normalize(name) {
+			return fmt.Sprintf(" (did you mean %s?)", known)
+		}
+	}
+	return ""
+}
+
+func jsonHasType(value interface{}, name string) bool {
+	switch name {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	}
+	return jsonTypeName(value) == name
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func typeNames(types []interface{}) string {
+	names := []string{}
+	for _, t := range types {
+		names = append(names, fmt.Sprint(t))
+	}
+	return strings.Join(names, " or ")
+}
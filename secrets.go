@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Secrets are kept in files under the root, outside the deploy dirs, and are
+// passed to deploys over pipes rather than in the environment or on disk
+// where they could be read.
+const secretsDirName = "secrets"
+
+func (s *ServerImpl) secretFile(name string) string {
+	return path.Join(s.root, secretsDirName, name)
+}
+
+// attachSecrets gives cmd a pipe for each of app's secrets, in order from fd
+// 3, which the secret is written to. Call startCmd to start cmd, or
+// closePipes if it won't be started.
+func (s *ServerImpl) attachSecrets(cmd *exec.Cmd, app Application) error {
+	for _, name := range app.Secrets() {
+		if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			closePipes(cmd)
+			return fmt.Errorf("Invalid secret name %q", name)
+		}
+		secret, err := ioutil.ReadFile(s.secretFile(name))
+		if err != nil {
+			closePipes(cmd)
+			return fmt.Errorf("Read secret %s: %s", name, err)
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			closePipes(cmd)
+			return err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		// If the app never reads it, the write fails once the app exits
+		// and the last read end is closed.
+		go func() {
+			w.Write(secret)
+			w.Close()
+		}()
+	}
+	return nil
+}
+
+// startCmd starts cmd, then closes camus's copies of the secret pipes and
+// stderr file, which the child has its own copies of.
+func startCmd(cmd *exec.Cmd) error {
+	err := startWaited(cmd)
+	closePipes(cmd)
+	return err
+}
+
+func closePipes(cmd *exec.Cmd) {
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	if f, ok := cmd.Stderr.(*os.File); ok {
+		f.Close()
+	}
+}
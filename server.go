@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -41,7 +47,29 @@ type Deploy struct {
 	// if 0, and port is specified, then it's safe to run the binary
 	Health int
 
+	// How long the health check took, 0 if none was made.
+	HealthLatency time.Duration
+
 	Errors []string
+
+	// Lifecycle timestamps, for deploys in the deploys dir.
+	State DeployState
+
+	// Free-form metadata set with SetTag. Unrelated to routing labels.
+	Tags map[string]string
+
+	// State of Enforce's circuit breaker for the deploy, one of the
+	// BREAKER_ values.
+	Breaker string
+
+	// When the certificate of a HealthHttps deploy expires, as seen by its
+	// last health check. Zero for other deploys.
+	CertExpiry time.Time
+
+	// The CPU and IO priority the running process has, as set by the
+	// deploy.json's Nice and IoClass. nil if it isn't running, or not on
+	// Linux.
+	Priority *ProcessPriority
 }
 
 type Label string
@@ -68,27 +96,411 @@ const (
 
 type Config struct {
 	Ports map[int]string
+
+	// Port of the deploy haproxy is sending traffic to, 0 if none has been
+	// set yet.
+	Active int
+
+	// Optional deploy receiving a weighted share of the active traffic.
+	Canary *Canary
+
+	// Told about runs, stops and changes to the active deploy.
+	Notifiers []NotifierConfig
+
+	// Ports kept free for things other than deploys, with a note on what
+	// each is for.
+	Reserved map[int]string
+
+	// The extra ports of deploys whose deploy.json has NamedPorts, by
+	// deploy and then name. They're taken like the deploy's port in Ports.
+	NamedPorts map[string]map[string]int
+
+	// Health check path for deploys whose deploy.json doesn't have one,
+	// "/" if empty.
+	DefaultHealthEndpoint string
+
+	// What Run does with a deploy that's configured on a port but isn't
+	// running there, one of the DEAD_PORT_ values. Restart if empty.
+	DeadPortPolicy string
+
+	// Defaults, in milliseconds, for how long deploys have to start, each
+	// health check can take and Stop waits for a deploy to exit, for
+	// deploys whose deploy.json doesn't have a HealthTimeoutMs or
+	// StopTimeoutMs. MAX_STARTUP_TIME, MAX_HEALTH_CHECK_TIME and
+	// DEFAULT_STOP_TIMEOUT if 0.
+	StartupTimeoutMs int
+	HealthTimeoutMs  int
+	StopTimeoutMs    int
+
+	// How much of the end of a deploy's stderr, in bytes, is included in
+	// the error when it fails to start. If it's not 0, each deploy's
+	// stderr is written to a file in the root's stderr dir, emptied each
+	// time it's started, rather than discarded.
+	StderrTailBytes int
+
+	// What ListDeploys and Run do if the deploys dir has gone, e.g. it was
+	// removed by mistake or its disk is being remounted, one of the
+	// MISSING_DEPLOYS_DIR_ values. Fail if empty.
+	MissingDeploysDir string
+
+	// Name of the file in each deploy dir its deploy.json is read from,
+	// deploy.json if empty.
+	ManifestFileName string
+
+	// Optional JSON Schema file, relative to the root, that deploy.json
+	// files must match as well as the built in schema.
+	ManifestSchema string
+
+	// If true, unknown fields in deploy.json files are errors rather than
+	// logged and ignored.
+	StrictManifests bool
+
+	// How free ports are picked for deploys, one of the PORT_STRATEGY_
+	// values. Lowest if empty.
+	PortStrategy string
+
+	// Optional programs deploys may be run with, as written in their
+	// RunArgv, e.g. "./bin/server". If set, nothing else is run, which
+	// rules out RunCmd unless its Shell is allowed.
+	AllowedCommands []string
+
+	// Optional limit on what the deploys configured on ports may use
+	// between them, according to their deploy.json.
+	HostBudget *Resources
+
+	// Optional statsd server to send metrics about deploy starts and
+	// health checks to.
+	Statsd *StatsdConfig
+
+	// Most health check requests, over all deploys, in flight at once.
+	// 0 means DEFAULT_MAX_HEALTH_CHECKS.
+	MaxHealthChecks int
+
+	// Make camus a child subreaper, so processes deploys leave behind are
+	// reparented to it rather than to init when their parent exits, and
+	// reap them so they don't stay zombies. It's always on when camus is
+	// pid 1, e.g. in a container. Linux only.
+	ReapOrphans bool
+
+	// Most Runs in progress at once, e.g. during a mass deploy, 0 for no
+	// limit. Others wait up to RunQueueTimeoutMs (0 means
+	// DEFAULT_RUN_QUEUE_TIMEOUT) for one to finish, then fail with
+	// ErrTooManyRuns.
+	MaxConcurrentRuns int
+	RunQueueTimeoutMs int
+
+	// Optional shell commands run with CAMUS_PORT and CAMUS_DEPLOY_ID
+	// set, e.g. to open and close the port in a firewall. A port is only
+	// allocated if PortReserveCmd exits 0, otherwise the next one is
+	// tried. PortReleaseCmd is run when a port is given up, e.g. by Stop;
+	// it failing is only logged.
+	PortReserveCmd string
+	PortReleaseCmd string
+
+	// The routing label of the deploy LiveDeploy returns, LABEL_ACTIVE or
+	// LABEL_CANARY. LiveDeploy fails if it's empty.
+	LiveLabel string
+}
+
+// PortStrategy values.
+const (
+	// The lowest free port, so ports are predictable.
+	PORT_STRATEGY_LOWEST = "lowest"
+
+	// Any free port, so they're spread over the range.
+	PORT_STRATEGY_RANDOM = "random"
+)
+
+// DeadPortPolicy values.
+const (
+	// Return an error, leaving the deploy for Enforce to restart.
+	DEAD_PORT_FAIL = "fail"
+
+	// Start the deploy again on its configured port.
+	DEAD_PORT_RESTART = "restart"
+
+	// Return the configured port without starting anything.
+	DEAD_PORT_EXISTING = "existing"
+)
+
+// MissingDeploysDir values.
+const (
+	// Return ErrDeploysDirMissing, so the dir isn't recreated where the
+	// disk it was on should be mounted.
+	MISSING_DEPLOYS_DIR_FAIL = "fail"
+
+	// Create the deploys dir again, empty.
+	MISSING_DEPLOYS_DIR_RECREATE = "recreate"
+)
+
+// ErrDeploysDirMissing is returned by ListDeploys and Run when the deploys dir
+// has gone and the config's MissingDeploysDir is MISSING_DEPLOYS_DIR_FAIL.
+var ErrDeploysDirMissing = errors.New("The deploys dir is missing")
+
+// ErrTooManyRuns is returned by Run when the config's MaxConcurrentRuns are
+// in progress and none finished within its RunQueueTimeoutMs.
+var ErrTooManyRuns = errors.New("Too many concurrent deploys")
+
+// How long a Run waits for one of the MaxConcurrentRuns in progress to
+// finish, unless the config has RunQueueTimeoutMs.
+var DEFAULT_RUN_QUEUE_TIMEOUT = time.Duration(60) * time.Second
+
+// Canary sends Weight percent of the frontend's traffic to a deploy other
+// than the active one.
+type Canary struct {
+	DeployId string
+	Weight   int
+
+	// If true, a client keeps going to the same deploy once chosen.
+	Sticky bool
+}
+
+// configJson is the on-disk representation of Config; json object keys must
+// be strings.
+type configJson struct {
+	Ports     map[string]string
+	Active    int               `json:",omitempty"`
+	Canary    *Canary           `json:",omitempty"`
+	Notifiers []NotifierConfig  `json:",omitempty"`
+	Reserved  map[string]string `json:",omitempty"`
+
+	NamedPorts map[string]map[string]int `json:",omitempty"`
+
+	DefaultHealthEndpoint string `json:",omitempty"`
+	DeadPortPolicy        string `json:",omitempty"`
+	MissingDeploysDir     string `json:",omitempty"`
+	StartupTimeoutMs      int    `json:",omitempty"`
+	HealthTimeoutMs       int    `json:",omitempty"`
+	StopTimeoutMs         int    `json:",omitempty"`
+	StderrTailBytes       int    `json:",omitempty"`
+	ManifestFileName      string `json:",omitempty"`
+	ManifestSchema        string `json:",omitempty"`
+	StrictManifests       bool   `json:",omitempty"`
+	PortStrategy          string `json:",omitempty"`
+
+	AllowedCommands []string      `json:",omitempty"`
+	HostBudget      *Resources    `json:",omitempty"`
+	Statsd          *StatsdConfig `json:",omitempty"`
+	MaxHealthChecks int           `json:",omitempty"`
+	ReapOrphans     bool          `json:",omitempty"`
+
+	MaxConcurrentRuns int    `json:",omitempty"`
+	RunQueueTimeoutMs int    `json:",omitempty"`
+	PortReserveCmd    string `json:",omitempty"`
+	PortReleaseCmd    string `json:",omitempty"`
+	LiveLabel         string `json:",omitempty"`
 }
 
 type ServerImpl struct {
-	root         string
-	config       Config
-	startPort    int
-	endPort      int
-	client       *http.Client
-	deploysPath  string
-	enforceDelay time.Duration
+	root string
+
+	// guards config. The helpers that read or write it (portConfigured,
+	// lookupConfiguredPort, writeConfig, setActive...)
+	// expect it to be held.
+	configLock sync.Mutex
+	config     Config
+
+	startPort      int
+	endPort        int
+	client         *http.Client
+	deploysDirName string
+	configFileName string
+	deploysPath    string
+	enforceDelay   time.Duration
+
+	// where the config is read from instead of configFileName, if set, and
+	// whether changes to it are written to configFileName
+	configReader io.Reader
+	configWrites bool
+
+	// reports whether nothing is listening on a port, overridable for tests
+	portFree func(port int) bool
+
+	// if true, deploys only start if their files match their checksums
+	verifyChecksums bool
+
+	// the most health checks checkAllHealth makes at once
+	healthCheckConcurrency int
+
+	// how many more times findUnusedPort checks a busy port, how long it
+	// waits between checks, and how long it can take overall (0 for no
+	// limit), see WithPortCheckRetry
+	portCheckRetries    int
+	portCheckRetryDelay time.Duration
+	portSearchTimeout   time.Duration
+
+	// log details that are normally too noisy, see debugf
+	debug bool
+
+	// failed starts in a row before Enforce quarantines a deploy
+	quarantineThreshold int
+
+	// read from the config's ManifestSchema, nil if it has none
+	manifestSchema *jsonSchema
+
+	// recent checkHealth results by deploy id, see HealthHistory
+	healthHistory     map[string][]HealthResult
+	healthHistoryLock sync.Mutex
+
+	// ports held for a deploy while they're checked and it's started on
+	// them, before they're configured if they ever are, e.g. scratch ports
+	// of running SmokeTests, see holdPort. Guarded by configLock
+	smokePorts map[int]string
+
+	// when Enforce last checked each deploy's liveness, for its
+	// LivenessIntervalMs, guarded by stateLock
+	livenessChecked map[string]time.Time
+
+	// when the certificates of HTTPS deploys expire, by port, see checkCert
+	certExpiries     map[int]time.Time
+	certExpiriesLock sync.Mutex
+
+	// Enforce's circuit breakers, by deploy id, see WithCircuitBreaker
+	breakersLock    sync.Mutex
+	breakers        map[string]*circuitBreaker
+	breakerFailures int
+	breakerWindow   time.Duration
+	breakerCooldown time.Duration
+
+	// guards appends to, and reads of, the audit log
+	auditLock sync.Mutex
+
+	// guards the per deploy state files, and processes
+	stateLock sync.Mutex
+
+	// pids of the deploys camus started that are still running, by deploy id
+	processes map[string]int
+
+	// when Stop last freed each port, see PORT_REUSE_DELAY
+	freedLock     sync.Mutex
+	recentlyFreed map[int]time.Time
+
+	// guards the per deploy tag files
+	tagsLock sync.Mutex
+
+	// one lock per deploy id, see lockDeploy
+	deployLocksLock sync.Mutex
+	deployLocks     map[string]*sync.Mutex
+
+	// health check clients for apps with their own HealthTransport, so
+	// their connections are reused
+	healthClientsLock sync.Mutex
+	healthClients     map[HealthTransport]*http.Client
+
+	notifiers []*retryingNotifier
+
+	// nil unless the config has Statsd
+	statsd *statsdClient
+
+	// Holds a value for each health check request in flight, so there are
+	// never more than the config's MaxHealthChecks.
+	healthChecks chan struct{}
+
+	// Holds a value for each Run in progress, so there are never more than
+	// the config's MaxConcurrentRuns. nil for no limit.
+	runSlots chan struct{}
+
+	// guards appends to, and reads of, the undelivered log
+	undeliveredLock sync.Mutex
+
+	// Runs by idempotency key, see RunIdempotent
+	idempotencyLock sync.Mutex
+	recentRuns      map[string]*idempotentRun
+}
+
+// ServerOption customises a ServerImpl created by NewServerImpl.
+type ServerOption func(*ServerImpl)
+
+// WithDeploysDirName overrides the name of the directory under the root
+// that holds the deploys (default "deploys").
+func WithDeploysDirName(name string) ServerOption {
+	return func(s *ServerImpl) {
+		s.deploysDirName = name
+	}
+}
+
+// WithVerifyChecksums makes deploys refuse to start unless their files match
+// the checksums recorded by RecordChecksums.
+func WithVerifyChecksums(verify bool) ServerOption {
+	return func(s *ServerImpl) {
+		s.verifyChecksums = verify
+	}
+}
+
+// WithConfigFileName overrides the name of the server config file under the
+// root (default "config.json").
+func WithConfigFileName(name string) ServerOption {
+	return func(s *ServerImpl) {
+		s.configFileName = name
+	}
+}
+
+// WithHealthCheckConcurrency limits how many deploys are health checked at
+// once when checking them all (default the number of CPUs).
+func WithHealthCheckConcurrency(n int) ServerOption {
+	return func(s *ServerImpl) {
+		s.healthCheckConcurrency = n
+	}
+}
+
+// WithPortCheckRetry makes findUnusedPort check a busy port up to retries
+// more times, delay apart, before moving on, so a port that is only
+// momentarily busy (e.g. in TIME_WAIT) isn't skipped. The whole search gives
+// up after timeout, if it's non-zero.
+func WithPortCheckRetry(retries int, delay time.Duration, timeout time.Duration) ServerOption {
+	return func(s *ServerImpl) {
+		s.portCheckRetries = retries
+		s.portCheckRetryDelay = delay
+		s.portSearchTimeout = timeout
+	}
+}
+
+// WithConfigReader reads the server config from r instead of the config
+// file, e.g. for a container given its config on stdin. Changes are still
+// written to the config file unless WithConfigWrites(false) is also given.
+func WithConfigReader(r io.Reader) ServerOption {
+	return func(s *ServerImpl) {
+		s.configReader = r
+	}
+}
+
+// WithConfigWrites(false) keeps changes to the config in memory only, for
+// ephemeral servers whose config isn't theirs to change. They're lost when
+// camus stops.
+func WithConfigWrites(write bool) ServerOption {
+	return func(s *ServerImpl) {
+		s.configWrites = write
+	}
+}
+
+// WithDebug turns on logging of details that are normally too noisy.
+func WithDebug(debug bool) ServerOption {
+	return func(s *ServerImpl) {
+		s.debug = debug
+	}
 }
 
 func readConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		data = nil
+	}
+	return parseConfig(data)
+}
+
+// parseConfig decodes a config.json, or returns the default config if data is
+// nil.
+func parseConfig(data []byte) (Config, error) {
 	config := Config{
-		Ports: map[int]string{},
+		Ports:      map[int]string{},
+		Reserved:   map[int]string{},
+		NamedPorts: map[string]map[string]int{},
 	}
-	if data, err := ioutil.ReadFile(path); err == nil {
-		c := struct {
-			Ports map[string]string
-		}{}
-		err = json.Unmarshal(data, &c)
+	if data != nil {
+		c := configJson{}
+		// Comments are allowed, but are lost the next time camus writes
+		// the config.
+		err := json.Unmarshal(stripJsonComments(data), &c)
 		if err != nil {
 			return Config{}, err
 		}
@@ -99,6 +511,92 @@ func readConfig(path string) (Config, error) {
 			}
 			config.Ports[port] = deployId
 		}
+		for portStr, note := range c.Reserved {
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				return Config{}, fmt.Errorf("Reserved keys should be numbers")
+			}
+			config.Reserved[port] = note
+		}
+		for deployId, named := range c.NamedPorts {
+			config.NamedPorts[deployId] = named
+		}
+		config.Active = c.Active
+		config.Canary = c.Canary
+		config.Notifiers = c.Notifiers
+		config.DefaultHealthEndpoint = c.DefaultHealthEndpoint
+		switch c.DeadPortPolicy {
+		case "", DEAD_PORT_FAIL, DEAD_PORT_RESTART, DEAD_PORT_EXISTING:
+			config.DeadPortPolicy = c.DeadPortPolicy
+		default:
+			return Config{}, fmt.Errorf("Unknown DeadPortPolicy %s", c.DeadPortPolicy)
+		}
+		switch c.MissingDeploysDir {
+		case "", MISSING_DEPLOYS_DIR_FAIL, MISSING_DEPLOYS_DIR_RECREATE:
+			config.MissingDeploysDir = c.MissingDeploysDir
+		default:
+			return Config{}, fmt.Errorf("Unknown MissingDeploysDir %s", c.MissingDeploysDir)
+		}
+		if c.StartupTimeoutMs < 0 || c.HealthTimeoutMs < 0 || c.StopTimeoutMs < 0 {
+			return Config{}, fmt.Errorf("StartupTimeoutMs, HealthTimeoutMs and StopTimeoutMs can't be negative")
+		}
+		config.StartupTimeoutMs = c.StartupTimeoutMs
+		config.HealthTimeoutMs = c.HealthTimeoutMs
+		config.StopTimeoutMs = c.StopTimeoutMs
+		if c.StderrTailBytes < 0 {
+			return Config{}, fmt.Errorf("StderrTailBytes can't be negative")
+		}
+		config.StderrTailBytes = c.StderrTailBytes
+		if strings.Contains(c.ManifestFileName, "/") || c.ManifestFileName == "." || c.ManifestFileName == ".." {
+			return Config{}, fmt.Errorf("ManifestFileName should be a file name, not %s", c.ManifestFileName)
+		}
+		config.ManifestFileName = c.ManifestFileName
+		config.ManifestSchema = c.ManifestSchema
+		config.StrictManifests = c.StrictManifests
+		switch c.PortStrategy {
+		case "", PORT_STRATEGY_LOWEST, PORT_STRATEGY_RANDOM:
+			config.PortStrategy = c.PortStrategy
+		default:
+			return Config{}, fmt.Errorf("Unknown PortStrategy %s", c.PortStrategy)
+		}
+		for _, command := range c.AllowedCommands {
+			if command == "" {
+				return Config{}, fmt.Errorf("AllowedCommands can't have an empty command")
+			}
+		}
+		config.AllowedCommands = c.AllowedCommands
+		if c.HostBudget != nil && (c.HostBudget.MemoryMb < 0 || c.HostBudget.CpuMillis < 0) {
+			return Config{}, fmt.Errorf("HostBudget can't be negative")
+		}
+		config.HostBudget = c.HostBudget
+		if c.Statsd != nil && c.Statsd.Address == "" {
+			return Config{}, fmt.Errorf("Statsd needs an Address")
+		}
+		config.Statsd = c.Statsd
+		if c.MaxHealthChecks < 0 {
+			return Config{}, fmt.Errorf("MaxHealthChecks can't be negative")
+		}
+		config.MaxHealthChecks = c.MaxHealthChecks
+		config.ReapOrphans = c.ReapOrphans
+		if c.MaxConcurrentRuns < 0 {
+			return Config{}, fmt.Errorf("MaxConcurrentRuns can't be negative")
+		}
+		if c.RunQueueTimeoutMs < 0 {
+			return Config{}, fmt.Errorf("RunQueueTimeoutMs can't be negative")
+		}
+		if c.RunQueueTimeoutMs != 0 && c.MaxConcurrentRuns == 0 {
+			return Config{}, fmt.Errorf("RunQueueTimeoutMs is only used with MaxConcurrentRuns")
+		}
+		config.MaxConcurrentRuns = c.MaxConcurrentRuns
+		config.RunQueueTimeoutMs = c.RunQueueTimeoutMs
+		config.PortReserveCmd = c.PortReserveCmd
+		config.PortReleaseCmd = c.PortReleaseCmd
+		switch c.LiveLabel {
+		case "", LABEL_ACTIVE, LABEL_CANARY:
+			config.LiveLabel = c.LiveLabel
+		default:
+			return Config{}, fmt.Errorf("Unknown LiveLabel %s", c.LiveLabel)
+		}
 	}
 	return config, nil
 }
@@ -106,20 +604,13 @@ func readConfig(path string) (Config, error) {
 func NewServerImpl(
 	root string,
 	autoEnforce bool,
-	portBase int) (*ServerImpl, error) {
+	portBase int,
+	opts ...ServerOption) (*ServerImpl, error) {
 
 	root, err := filepath.Abs(root)
 	if err != nil {
 		log.Fatal("Root path:", err)
 	}
-	config, err := readConfig(path.Join(root, serverConfigFileName))
-	if err != nil {
-		return nil, err
-	}
-	deploysPath := path.Join(root, deploysDirName)
-	if _, err = os.Open(deploysPath); os.IsNotExist(err) {
-		os.MkdirAll(deploysPath, 0744)
-	}
 	client := &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return errors.New("health check should not redirect")
@@ -128,13 +619,88 @@ func NewServerImpl(
 	}
 
 	server := &ServerImpl{
-		root:         root,
-		config:       config,
-		startPort:    portBase + 1,
-		endPort:      portBase + 99,
-		client:       client,
-		deploysPath:  deploysPath,
-		enforceDelay: time.Duration(5) * time.Second,
+		root:           root,
+		startPort:      portBase + 1,
+		endPort:        portBase + 99,
+		client:         client,
+		deploysDirName: deploysDirName,
+		configFileName: serverConfigFileName,
+		configWrites:   true,
+		enforceDelay:   time.Duration(5) * time.Second,
+		portFree:       portFree,
+		recentRuns:     map[string]*idempotentRun{},
+		processes:      map[string]int{},
+		recentlyFreed:  map[int]time.Time{},
+		healthClients:  map[HealthTransport]*http.Client{},
+		deployLocks:    map[string]*sync.Mutex{},
+
+		healthCheckConcurrency: runtime.NumCPU(),
+		quarantineThreshold:    DEFAULT_QUARANTINE_THRESHOLD,
+		smokePorts:             map[int]string{},
+		livenessChecked:        map[string]time.Time{},
+		certExpiries:           map[int]time.Time{},
+		healthHistory:          map[string][]HealthResult{},
+		breakers:               map[string]*circuitBreaker{},
+		breakerFailures:        DEFAULT_BREAKER_FAILURES,
+		breakerWindow:          DEFAULT_BREAKER_WINDOW,
+		breakerCooldown:        DEFAULT_BREAKER_COOLDOWN,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	if server.healthCheckConcurrency < 1 {
+		return nil, fmt.Errorf("Health check concurrency must be at least 1, got %d",
+			server.healthCheckConcurrency)
+	}
+
+	if server.configReader != nil {
+		var data []byte
+		if data, err = ioutil.ReadAll(server.configReader); err != nil {
+			return nil, fmt.Errorf("read config: %s", err)
+		}
+		server.config, err = parseConfig(data)
+	} else {
+		server.config, err = readConfig(path.Join(root, server.configFileName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	server.client.Timeout = server.healthCheckTime(nil)
+	server.notifiers, err = newNotifiers(server.config.Notifiers)
+	if err != nil {
+		return nil, err
+	}
+	server.statsd, err = newStatsdClient(server.config.Statsd)
+	if err != nil {
+		return nil, err
+	}
+	maxHealthChecks := server.config.MaxHealthChecks
+	if maxHealthChecks == 0 {
+		maxHealthChecks = DEFAULT_MAX_HEALTH_CHECKS
+	}
+	server.healthChecks = make(chan struct{}, maxHealthChecks)
+	if server.config.MaxConcurrentRuns > 0 {
+		server.runSlots = make(chan struct{}, server.config.MaxConcurrentRuns)
+	}
+	if server.config.ReapOrphans || os.Getpid() == 1 {
+		if err := startReaper(); err != nil {
+			return nil, err
+		}
+	}
+	if schemaFile := server.config.ManifestSchema; schemaFile != "" {
+		if !filepath.IsAbs(schemaFile) {
+			schemaFile = path.Join(root, schemaFile)
+		}
+		if server.manifestSchema, err = readSchema(schemaFile); err != nil {
+			return nil, err
+		}
+	}
+	server.deploysPath = path.Join(root, server.deploysDirName)
+	if _, err = os.Open(server.deploysPath); os.IsNotExist(err) {
+		os.MkdirAll(server.deploysPath, 0744)
+	}
+	if err := server.reconcileState(); err != nil {
+		return nil, err
 	}
 
 	if autoEnforce {
@@ -146,6 +712,7 @@ func NewServerImpl(
 
 func (s *ServerImpl) NewDeployDir() NewDeployDirResponse {
 	deployId := NewDeployId()
+	s.recordCreated(deployId)
 
 	return NewDeployDirResponse{
 		DeployId: deployId,
@@ -159,7 +726,13 @@ func (s *ServerImpl) DeploysPath() string {
 func (s *ServerImpl) deployDir(deployId string) string {
 	return path.Join(s.deploysPath, deployId)
 }
+
+// deployConfigFile is the deploy.json of deployId. Like loadApp, it reads the
+// config without configLock.
 func (s *ServerImpl) deployConfigFile(deployId string) string {
+	if s.config.ManifestFileName != "" {
+		return path.Join(s.deployDir(deployId), s.config.ManifestFileName)
+	}
 	return path.Join(s.deployDir(deployId), deployConfigFileName)
 }
 
@@ -171,15 +744,15 @@ func (s *ServerImpl) EnforceLoop() {
 }
 
 func (s *ServerImpl) Enforce() {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
 	procsByPort := makeProcessPortLookup(procs)
-	for port, deployId := range s.config.Ports {
+	for port, deployId := range s.configuredPorts() {
 		// deployId should be running on port.
 		running, ok := procsByPort[port]
 		if !ok {
 			// Nothing is running on port, so we should run our deploy.
 			// TODO(koz): Wait for health of all started deploys in parallel.
-			s.startDeployAndWaitForHealth(deployId, port)
+			s.enforceDeploy(deployId, port)
 			continue
 		}
 
@@ -190,6 +763,7 @@ func (s *ServerImpl) Enforce() {
 		} else if pid < 0 {
 			//no pid override
 		} else if running.Pid == pid {
+			s.enforceHealth(deployId, port, running.Pid)
 			continue
 		}
 
@@ -203,7 +777,59 @@ func (s *ServerImpl) Enforce() {
 			fmt.Printf("%s, not %s is running on %d\n", runningDeploy, deployId, port)
 			continue
 		}
+		s.enforceHealth(deployId, port, running.Pid)
+	}
+}
+
+// enforceDeploy starts deployId on port, unless a Run or Stop while Enforce
+// was looking has moved it, stopped it or already started it.
+func (s *ServerImpl) enforceDeploy(deployId string, port int) {
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+
+	s.configLock.Lock()
+	stillConfigured := s.config.Ports[port] == deployId
+	s.configLock.Unlock()
+
+	if !stillConfigured || !s.portFree(port) {
+		return
+	}
+	if s.supervisionPaused(deployId) {
+		s.debugf("not starting %s: its supervision is paused\n", deployId)
+		return
+	}
+	if s.breakerState(deployId) == BREAKER_OPEN {
+		s.debugf("not starting %s: its circuit breaker is open\n", deployId)
+		return
+	}
+	app, err := s.loadApp(deployId)
+	if err == nil && app.OnCrash() == RESTART_POLICY_LEAVE && s.leaveCrashed(deployId, port) {
+		return
+	}
+	if err == nil && s.countRestart(deployId, port, app) {
+		return
+	}
+	if err := s.startDeployAndWaitForHealth(deployId, port); err != nil {
+		s.breakerFailed(deployId)
+		s.enforceFailed(deployId, port, err)
+	} else {
+		s.breakerSucceeded(deployId)
+		s.updateDeployState(deployId, func(state *DeployState) {
+			state.Failures = 0
+		})
+	}
+}
+
+// configuredPorts returns a copy of the configured ports, for looking through
+// without holding configLock.
+func (s *ServerImpl) configuredPorts() map[int]string {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	ports := map[int]string{}
+	for port, deployId := range s.config.Ports {
+		ports[port] = deployId
 	}
+	return ports
 }
 
 func (s *ServerImpl) getDeployPidOverride(deployId string) (int, error) {
@@ -241,41 +867,131 @@ func makeProcessDeployIdLookup(procs []Process) map[string]Process {
 	return result
 }
 
+// startDeployAndWaitForHealth starts deployId on port for Enforce, and waits
+// for it to be healthy. Like RunContext, it records the start and, once it's
+// healthy, the run, which sets the deploy's FirstRun if it's never run.
 func (s *ServerImpl) startDeployAndWaitForHealth(deployId string, port int) error {
-	app, cmd, err := s.commandForDeploy(deployId, port)
+	app, cmd, err := s.commandForDeploy(deployId, port, s.configuredNamedPorts(deployId))
 	if err != nil {
 		return err
 	}
 
-	if err := cmd.Start(); err != nil {
+	start := time.Now()
+	if err := startCmd(cmd); err != nil {
 		return err
 	}
+	s.recordStarted(deployId, cmd.Process.Pid, port)
+	s.statsd.count("deploy.start", deployId)
 
-	if err := s.waitForAppToStart(port, app); err != nil {
-		return err
+	err = s.waitForProcessToStart(port, app, watchExit(cmd))
+	s.startupFinished(deployId, start, err)
+	if err != nil {
+		s.recordHealthFailure(deployId)
+		return s.withStderrTail(deployId, err)
 	}
+	s.recordRun(deployId)
 	return nil
 }
 
-func (s *ServerImpl) readDeployIdsFromDisk() []string {
+// ensureDeploysDir makes sure the deploys dir is still there, following the
+// config's MissingDeploysDir if it isn't.
+func (s *ServerImpl) ensureDeploysDir() error {
+	_, err := os.Stat(s.deploysPath)
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("deploys dir: %s", err)
+	}
+	if s.config.MissingDeploysDir != MISSING_DEPLOYS_DIR_RECREATE {
+		return ErrDeploysDirMissing
+	}
+	log.Printf("warning: %s is missing, creating it again\n", s.deploysPath)
+	if err := os.MkdirAll(s.deploysPath, 0744); err != nil {
+		return fmt.Errorf("recreate deploys dir: %s", err)
+	}
+	return nil
+}
+
+// readDeployIdsFromDisk returns the names of the directories in the deploys
+// dir. Files and symlinks (even to deploy directories, e.g. a "latest" link)
+// are not deploys, so are skipped. A missing deploys dir is handled by
+// ensureDeploysDir first.
+func (s *ServerImpl) readDeployIdsFromDisk() ([]string, error) {
+	if err := s.ensureDeploysDir(); err != nil {
+		return nil, err
+	}
 	infos, err := ioutil.ReadDir(s.deploysPath)
 	if err != nil {
-		panic(fmt.Errorf("read deploy dir: %s", err))
+		return nil, fmt.Errorf("read deploy dir: %s", err)
 	}
 	var result []string
 	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
 		result = append(result, info.Name())
 	}
-	return result
+	return result, nil
+}
+
+// LATEST_DEPLOY can be given to Run and Stop in place of a deploy id, to mean
+// whichever deploy is newest at the time of the call.
+const LATEST_DEPLOY = "@latest"
+
+// resolveDeployId returns deployId, or the id of the newest deploy if it is
+// LATEST_DEPLOY.
+func (s *ServerImpl) resolveDeployId(deployId string) (string, error) {
+	if deployId != LATEST_DEPLOY {
+		return deployId, nil
+	}
+	deployIds, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, id := range deployIds {
+		if latest == "" || deployIdLess(latest, id) {
+			latest = id
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("No deploys in %s for %s", s.deploysPath, LATEST_DEPLOY)
+	}
+	return latest, nil
+}
+
+// deployIdLess orders deploy ids by the time in the ids made by NewDeployId,
+// since they start with random words. Ids without a time sort first.
+func deployIdLess(a string, b string) bool {
+	aTime, bTime := deployIdTime(a), deployIdTime(b)
+	if !aTime.Equal(bTime) {
+		return aTime.Before(bTime)
+	}
+	return a < b
+}
+
+func deployIdTime(deployId string) time.Time {
+	const layout = "2006-01-02-15-04-05"
+	if len(deployId) < len(layout) {
+		return time.Time{}
+	}
+	t, err := time.Parse(layout, deployId[len(deployId)-len(layout):])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
 
 func (s *ServerImpl) checkAllHealth(deploys []*Deploy) {
 	healthChecks := 0
 	checkSync := make(chan int)
+	slots := make(chan struct{}, s.healthCheckConcurrency)
 	for _, deploy := range deploys {
 		healthChecks++
 		go func(deploy *Deploy) {
+			slots <- struct{}{}
 			s.checkHealth(deploy)
+			<-slots
 			checkSync <- 0
 		}(deploy)
 	}
@@ -287,13 +1003,20 @@ func (s *ServerImpl) checkAllHealth(deploys []*Deploy) {
 }
 
 func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
+	if err := s.ensureDeploysDir(); err != nil {
+		return nil, err
+	}
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
 	procsByDeployId := makeProcessDeployIdLookup(procs)
 	procsByPid := makeProcessPidLookup(procs)
 	unaccountedProcsByPort := makeProcessPortLookup(procs)
 	knownRunningDeploys := []*Deploy{}
-	deployIds := s.readDeployIdsFromDisk()
+	deployIds, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		return nil, err
+	}
 	knownDeploys := []*Deploy{}
+	s.configLock.Lock()
 	for _, deployId := range deployIds {
 		proc, running := procsByDeployId[deployId]
 		if pidOverride, err := s.getDeployPidOverride(deployId); err == nil {
@@ -308,7 +1031,21 @@ func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
 			Port:    proc.Port,
 			Tracked: s.lookupConfiguredPort(deployId) != 0,
 		}
+		deploy.Breaker = s.breakerState(deployId)
+		if state, err := s.readDeployState(deployId); err == nil {
+			deploy.State = state
+		} else {
+			deploy.Errors = append(deploy.Errors, fmt.Sprintf("Unreadable state (%s)", err))
+		}
+		if tags, err := s.GetTags(deployId); err == nil {
+			deploy.Tags = tags
+		} else {
+			deploy.Errors = append(deploy.Errors, fmt.Sprintf("Unreadable tags (%s)", err))
+		}
 		if running {
+			if priority, err := processPriority(proc.Pid); err == nil {
+				deploy.Priority = &priority
+			}
 			delete(unaccountedProcsByPort, proc.Port)
 			knownRunningDeploys = append(knownRunningDeploys, deploy)
 		} else {
@@ -316,6 +1053,7 @@ func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
 		}
 		knownDeploys = append(knownDeploys, deploy)
 	}
+	s.configLock.Unlock()
 	// Any processes that haven't been accounted for yet, we list them as deploys, too.
 	unaccounted := []*Deploy{}
 	for _, proc := range unaccountedProcsByPort {
@@ -331,7 +1069,7 @@ func (s *ServerImpl) ListDeploys() ([]*Deploy, error) {
 }
 
 func (s *ServerImpl) checkHealth(deploy *Deploy) {
-	app, err := ApplicationFromConfig(false, s.deployConfigFile(deploy.Id))
+	app, err := s.loadApp(deploy.Id)
 	if err != nil {
 		deploy.Errors = append(deploy.Errors,
 			fmt.Sprintf("Missing deploy config (%s)", err))
@@ -339,27 +1077,216 @@ func (s *ServerImpl) checkHealth(deploy *Deploy) {
 		deploy.Health = -2
 		return
 	}
+	s.checkAppHealth(deploy, app)
+}
 
-	status, err := s.testApp(deploy.Port, app)
+// checkAppHealth checks the health of deploy, running app, and records the
+// result.
+func (s *ServerImpl) checkAppHealth(deploy *Deploy, app Application) HealthResult {
+	start := time.Now()
+	status, endpoint, err := s.testAppEndpoints(deploy.Port, app)
+	deploy.HealthLatency = time.Since(start)
+	if app.HealthScheme() == "https" {
+		deploy.CertExpiry = s.certExpiry(deploy.Port)
+	}
+	result := HealthResult{Time: start.UTC(), Latency: deploy.HealthLatency, Endpoint: endpoint}
 	if err != nil {
 		deploy.Errors = append(deploy.Errors, fmt.Sprintf("%s", err))
 		log.Println("Got http err ", err, " for ", deploy.Id)
 		deploy.Health = -1
-		return
+		result.Health = -1
+		result.Error = err.Error()
+		s.recordHealthResult(deploy.Id, result)
+		s.statsd.count("deploy.health_failure", deploy.Id)
+		return result
+	}
+	if !app.HealthyStatus(status) {
+		s.statsd.count("deploy.health_failure", deploy.Id)
 	}
 
 	deploy.Health = status
+	result.Health = status
+	s.recordHealthResult(deploy.Id, result)
+	s.recordHealth(deploy.Id, status)
+	return result
 }
 
-func (s *ServerImpl) findUnusedPort() (int, error) {
+// Ports freed by Stop this recently are only reused if there's no other free
+// port, so clients with keepalives to the old process don't reach a new one.
+var PORT_REUSE_DELAY = time.Duration(60) * time.Second
+
+// Defaults for the -portCheckRetries flag's WithPortCheckRetry.
+var PORT_CHECK_RETRY_DELAY = time.Duration(100) * time.Millisecond
+var PORT_SEARCH_TIMEOUT = time.Duration(10) * time.Second
+
+// findUnusedPort returns the first port in range that isn't configured and
+// has nothing listening on it, preferring ports that weren't just freed, or a
+// random such port with PORT_STRATEGY_RANDOM, and that the PortReserveCmd
+// accepts for deployId. The scan stops early if ctx is done or the port search
+// timeout passes. Call it without configLock, which is only taken to claim
+// each port in turn, so readers of the config don't wait on the checks and
+// the PortReserveCmd. The port is held for deployId, see holdPort, until the
+// caller calls unholdPort.
+func (s *ServerImpl) findUnusedPort(ctx context.Context, deployId string) (int, error) {
+	if s.portSearchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.portSearchTimeout)
+		defer cancel()
+	}
+
+	candidates := []int{}
 	for i := s.startPort; i <= s.endPort; i++ {
-		if !s.portConfigured(i) && portFree(i) {
+		candidates = append(candidates, i)
+	}
+	s.configLock.Lock()
+	strategy := s.config.PortStrategy
+	s.configLock.Unlock()
+	if strategy == PORT_STRATEGY_RANDOM {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+
+	recent := []int{}
+	for _, i := range candidates {
+		if err := ctx.Err(); err != nil {
+			return -1, fmt.Errorf("find unused port: %w", err)
+		}
+		if s.portRecentlyFreed(i) {
+			s.debugf("skipping port %d for now: recently freed\n", i)
+			recent = append(recent, i)
+		} else if s.claimPort(ctx, i, deployId) {
+			return i, nil
+		}
+	}
+	for _, i := range recent {
+		if err := ctx.Err(); err != nil {
+			return -1, fmt.Errorf("find unused port: %w", err)
+		}
+		if s.claimPort(ctx, i, deployId) {
 			return i, nil
 		}
 	}
 	return -1, errors.New("Could not find free port")
 }
 
+// claimPort holds port for deployId if it isn't taken, then keeps it if
+// nothing's listening on it and the PortReserveCmd accepts it.
+func (s *ServerImpl) claimPort(ctx context.Context, port int, deployId string) bool {
+	if taken := s.holdPort(port, deployId); taken != "" {
+		s.debugf("skipping port %d: %s\n", port, taken)
+		return false
+	}
+	if s.portFreeWithRetry(ctx, port) && s.portAccepted(port, deployId) {
+		return true
+	}
+	s.unholdPort(port)
+	return false
+}
+
+// holdPort keeps port from being given to anything but deployId, in memory
+// only like a smoke test's port, while it's checked and started on. It
+// returns what port is taken by instead, if it is.
+func (s *ServerImpl) holdPort(port int, deployId string) string {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if id, ok := s.portConfiguredFor(port); ok {
+		return fmt.Sprintf("configured for %s", id)
+	}
+	if s.portReserved(port) {
+		return fmt.Sprintf("reserved (%s)", s.config.Reserved[port])
+	}
+	if id, ok := s.smokePorts[port]; ok {
+		return fmt.Sprintf("held for %s", id)
+	}
+	s.smokePorts[port] = deployId
+	return ""
+}
+
+// unholdPort lets go of a port from holdPort or findUnusedPort.
+func (s *ServerImpl) unholdPort(port int) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	delete(s.smokePorts, port)
+}
+
+// newPortForDeploy picks the port to run deployId on, its deploy.json's
+// PreferredPort if that's usable, otherwise an unused one if its
+// PortFallback allows. Like findUnusedPort, it's called without configLock
+// and the port is held until unholdPort.
+func (s *ServerImpl) newPortForDeploy(ctx context.Context, deployId string) (int, error) {
+	app, err := s.loadApp(deployId)
+	if err != nil || app.PreferredPort() == 0 {
+		// a broken deploy.json is reported when it's run
+		return s.findUnusedPort(ctx, deployId)
+	}
+	preferred := app.PreferredPort()
+	var problem string
+	if preferred < s.startPort || preferred > s.endPort {
+		problem = fmt.Sprintf("outside the port range %d-%d", s.startPort, s.endPort)
+	} else if taken := s.holdPort(preferred, deployId); taken != "" {
+		problem = taken
+	} else if !s.portFreeWithRetry(ctx, preferred) {
+		problem = "in use"
+		s.unholdPort(preferred)
+	} else if err := s.reservePort(preferred, deployId); err != nil {
+		problem = fmt.Sprintf("rejected by PortReserveCmd: %s", err)
+		s.unholdPort(preferred)
+	}
+	if problem == "" {
+		return preferred, nil
+	}
+	if app.PortFallback() != PORT_FALLBACK_DYNAMIC {
+		return -1, fmt.Errorf("Preferred port %d is %s", preferred, problem)
+	}
+	log.Printf("preferred port %d of %s is %s, using another\n", preferred, deployId, problem)
+	return s.findUnusedPort(ctx, deployId)
+}
+
+// portFreeWithRetry checks whether port is free, checking again up to
+// portCheckRetries times if it's busy.
+func (s *ServerImpl) portFreeWithRetry(ctx context.Context, port int) bool {
+	for attempt := 0; ; attempt++ {
+		if s.portFree(port) {
+			return true
+		}
+		if attempt >= s.portCheckRetries {
+			s.debugf("skipping port %d: in use after %d checks\n", port, attempt+1)
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			s.debugf("skipping port %d: in use when the search timed out\n", port)
+			return false
+		case <-time.After(s.portCheckRetryDelay):
+		}
+	}
+}
+
+func (s *ServerImpl) debugf(format string, args ...interface{}) {
+	if s.debug {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *ServerImpl) recordPortFreed(port int) {
+	s.freedLock.Lock()
+	defer s.freedLock.Unlock()
+	s.recentlyFreed[port] = time.Now()
+}
+
+func (s *ServerImpl) portRecentlyFreed(port int) bool {
+	s.freedLock.Lock()
+	defer s.freedLock.Unlock()
+	freed, ok := s.recentlyFreed[port]
+	if ok && time.Since(freed) >= PORT_REUSE_DELAY {
+		delete(s.recentlyFreed, port)
+		return false
+	}
+	return ok
+}
+
 // lookupConfiguredPort returns the port the specified deploy is configured to
 // run on, or 0 if it's not configured to run anywhere.
 func (s *ServerImpl) lookupConfiguredPort(deployId string) int {
@@ -372,14 +1299,89 @@ func (s *ServerImpl) lookupConfiguredPort(deployId string) int {
 }
 
 func (s *ServerImpl) portConfigured(port int) bool {
-	_, taken := s.config.Ports[port]
+	_, taken := s.portConfiguredFor(port)
 	return taken
 }
 
-func portFree(port int) bool {
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-	if err != nil {
-		// TODO: Is this now safe to assume the port is free?
+// portConfiguredFor returns the deploy port is configured for, as its port or
+// one of its NamedPorts.
+func (s *ServerImpl) portConfiguredFor(port int) (string, bool) {
+	if deployId, taken := s.config.Ports[port]; taken {
+		return deployId, true
+	}
+	for deployId, named := range s.config.NamedPorts {
+		for _, p := range named {
+			if p == port {
+				return deployId, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (s *ServerImpl) portReserved(port int) bool {
+	_, reserved := s.config.Reserved[port]
+	return reserved
+}
+
+// ReservePort stops port from being given to deploys, e.g. so something run
+// outside camus can use it. note says what it's reserved for. Like
+// findUnusedPort, it refuses a port configured for a deploy, including as one
+// of its NamedPorts, held for one being started or smoke tested, or that
+// something is already listening on.
+func (s *ServerImpl) ReservePort(port int, note string) error {
+	if port < s.startPort || port > s.endPort {
+		return fmt.Errorf("Port %d is outside the deploy range %d-%d", port, s.startPort, s.endPort)
+	}
+	// probed without configLock, as findUnusedPort does
+	if !s.portFree(port) {
+		return fmt.Errorf("Port %d is already in use", port)
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if deployId, ok := s.portConfiguredFor(port); ok {
+		return fmt.Errorf("Port %d is already used by %s", port, deployId)
+	}
+	if reservedFor, ok := s.config.Reserved[port]; ok {
+		return fmt.Errorf("Port %d is already reserved (%s)", port, reservedFor)
+	}
+	if deployId, ok := s.smokePorts[port]; ok {
+		return fmt.Errorf("Port %d is held for %s", port, deployId)
+	}
+
+	s.config.Reserved[port] = note
+	if err := s.writeConfig(); err != nil {
+		delete(s.config.Reserved, port)
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
+
+// ReleasePort makes a port reserved with ReservePort available to deploys
+// again.
+func (s *ServerImpl) ReleasePort(port int) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	note, ok := s.config.Reserved[port]
+	if !ok {
+		return fmt.Errorf("Port %d isn't reserved", port)
+	}
+
+	delete(s.config.Reserved, port)
+	if err := s.writeConfig(); err != nil {
+		s.config.Reserved[port] = note
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
+
+func portFree(port int) bool {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		// TODO: Is this now safe to assume the port is free?
 		// NOTE(dan): I tried implementing listening on the port
 		// instead, but it always succeeded even if there was
 		// actually something already there...
@@ -390,44 +1392,182 @@ func portFree(port int) bool {
 	}
 }
 
+// writeConfig writes the config to the config file, unless it fails
+// validateConfig.
 func (s *ServerImpl) writeConfig() error {
-	c := struct {
-		Ports map[string]string
-	}{
-		Ports: map[string]string{},
+	if err := s.validateConfig(); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+	if !s.configWrites {
+		return nil
+	}
+	c := configJson{
+		Ports:     map[string]string{},
+		Active:    s.config.Active,
+		Canary:    s.config.Canary,
+		Notifiers: s.config.Notifiers,
+		Reserved:  map[string]string{},
+
+		NamedPorts: s.config.NamedPorts,
+
+		DefaultHealthEndpoint: s.config.DefaultHealthEndpoint,
+		DeadPortPolicy:        s.config.DeadPortPolicy,
+		MissingDeploysDir:     s.config.MissingDeploysDir,
+		StartupTimeoutMs:      s.config.StartupTimeoutMs,
+		HealthTimeoutMs:       s.config.HealthTimeoutMs,
+		StopTimeoutMs:         s.config.StopTimeoutMs,
+		StderrTailBytes:       s.config.StderrTailBytes,
+		ManifestFileName:      s.config.ManifestFileName,
+		ManifestSchema:        s.config.ManifestSchema,
+		StrictManifests:       s.config.StrictManifests,
+		PortStrategy:          s.config.PortStrategy,
+
+		AllowedCommands: s.config.AllowedCommands,
+		HostBudget:      s.config.HostBudget,
+		Statsd:          s.config.Statsd,
+		MaxHealthChecks: s.config.MaxHealthChecks,
+		ReapOrphans:     s.config.ReapOrphans,
+
+		MaxConcurrentRuns: s.config.MaxConcurrentRuns,
+		RunQueueTimeoutMs: s.config.RunQueueTimeoutMs,
+		PortReserveCmd:    s.config.PortReserveCmd,
+		PortReleaseCmd:    s.config.PortReleaseCmd,
+		LiveLabel:         s.config.LiveLabel,
 	}
 	for port, deployId := range s.config.Ports {
 		c.Ports[strconv.Itoa(port)] = deployId
 	}
+	for port, note := range s.config.Reserved {
+		c.Reserved[strconv.Itoa(port)] = note
+	}
 	data, err := json.MarshalIndent(&c, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path.Join(s.root, serverConfigFileName),
+	return ioutil.WriteFile(path.Join(s.root, s.configFileName),
 		data, os.FileMode(0644))
 }
 
+// SetActiveByPort sends all frontend traffic to the deploy on port, removing
+// any canary.
 func (s *ServerImpl) SetActiveByPort(port int) error {
-	return s.reloadHaproxy(port)
+	return s.SetActiveByPortContext(context.Background(), port)
+}
+
+// SetActiveByPortContext is SetActiveByPort, recording ctx's actor, see
+// WithActor.
+func (s *ServerImpl) SetActiveByPortContext(ctx context.Context, port int) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if err := s.setActive(port, nil); err != nil {
+		return err
+	}
+	s.recordEventFor(ctx, LABEL_ACTIVE, "set-active", s.config.Ports[port], port)
+	return nil
 }
 
 func (s *ServerImpl) SetActiveById(id string) error {
+	return s.SetActiveByIdContext(context.Background(), id)
+}
+
+// SetActiveByIdContext is SetActiveById, recording ctx's actor, see
+// WithActor.
+func (s *ServerImpl) SetActiveByIdContext(ctx context.Context, id string) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
 	for port, deployId := range s.config.Ports {
 		if deployId == id {
-			return s.reloadHaproxy(port)
+			if err := s.setActive(port, nil); err != nil {
+				return err
+			}
+			s.recordEventFor(ctx, LABEL_ACTIVE, "set-active", deployId, port)
+			return nil
 		}
 	}
 
 	return fmt.Errorf("No deploy %s, run 'list' to see valid deploys", id)
 }
 
+// SetCanary sends weight percent of the frontend traffic to canaryDeployId,
+// and the rest to the active deploy.
+func (s *ServerImpl) SetCanary(canaryDeployId string, weight int, sticky bool) error {
+	if weight <= 0 || weight >= 100 {
+		return fmt.Errorf("Canary weight must be between 1 and 99, not %d", weight)
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.config.Active == 0 {
+		return fmt.Errorf("No active deploy to split traffic with, set one first")
+	}
+	canaryPort := s.lookupConfiguredPort(canaryDeployId)
+	if canaryPort == 0 {
+		return fmt.Errorf("No deploy %s, run 'list' to see valid deploys", canaryDeployId)
+	}
+	if canaryPort == s.config.Active {
+		return fmt.Errorf("%s is already the active deploy", canaryDeployId)
+	}
+
+	canary := &Canary{
+		DeployId: canaryDeployId,
+		Weight:   weight,
+		Sticky:   sticky,
+	}
+	if err := s.setActive(s.config.Active, canary); err != nil {
+		return err
+	}
+	s.recordEventFor(context.Background(), LABEL_CANARY, "set-canary", canaryDeployId, canaryPort)
+	return nil
+}
+
+// ClearCanary sends all frontend traffic back to the active deploy.
+func (s *ServerImpl) ClearCanary() error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.config.Canary == nil {
+		return nil
+	}
+	deployId := s.config.Canary.DeployId
+	if err := s.setActive(s.config.Active, nil); err != nil {
+		return err
+	}
+	s.recordEventFor(context.Background(), LABEL_CANARY, "clear-canary", deployId, 0)
+	return nil
+}
+
+// setActive points haproxy at the deploy on port (plus an optional canary)
+// and remembers the choice in the config.
+func (s *ServerImpl) setActive(port int, canary *Canary) error {
+	if err := s.reloadHaproxy(port, canary); err != nil {
+		return err
+	}
+	s.config.Active = port
+	s.config.Canary = canary
+	if err := s.writeConfig(); err != nil {
+		return fmt.Errorf("write config: %s", err)
+	}
+	return nil
+}
+
+// GetFullDeployIdFromShortName returns the one deploy id containing
+// deployShortName, or the newest deploy's for LATEST_DEPLOY.
 func (s *ServerImpl) GetFullDeployIdFromShortName(deployShortName string) (string, error) {
+	if deployShortName == LATEST_DEPLOY {
+		return s.resolveDeployId(deployShortName)
+	}
 	if len(deployShortName) < minShortNameLength {
 		return "", fmt.Errorf("Deploy name substring is too short, needs to be at least %d characters", minShortNameLength)
 	}
 
+	deployIds, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		return "", err
+	}
 	var matchingIds []string
-	for _, deployId := range s.readDeployIdsFromDisk() {
+	for _, deployId := range deployIds {
 		if strings.Contains(deployId, deployShortName) {
 			matchingIds = append(matchingIds, deployId)
 		}
@@ -441,62 +1581,239 @@ func (s *ServerImpl) GetFullDeployIdFromShortName(deployShortName string) (strin
 	return matchingIds[0], nil
 }
 
+// Run starts deployIdToRun on a port, returning the port once it's healthy.
+// A job deploy is run to completion instead, on port 0, see RunJob.
 func (s *ServerImpl) Run(deployIdToRun string) (int, error) {
-	for port, deployId := range s.config.Ports {
-		if deployIdToRun == deployId {
-			return -1, fmt.Errorf("Already configured for port %d", port)
-		}
-	}
+	return s.RunContext(context.Background(), deployIdToRun)
+}
 
-	port, err := s.findUnusedPort()
+// RunContext is like Run, but gives up looking for a port to run on once ctx
+// is done.
+func (s *ServerImpl) RunContext(ctx context.Context, deployIdToRun string) (int, error) {
+	if err := s.ensureDeploysDir(); err != nil {
+		return -1, err
+	}
+	deployIdToRun, err := s.resolveDeployId(deployIdToRun)
 	if err != nil {
 		return -1, err
 	}
-
-	app, cmd, err := s.commandForDeploy(deployIdToRun, port)
+	release, err := s.acquireRunSlot(ctx)
 	if err != nil {
 		return -1, err
 	}
+	defer release()
+	unlock := s.lockDeploy(deployIdToRun)
+	defer unlock()
 
-	s.config.Ports[port] = deployIdToRun
-	err = s.writeConfig()
+	if err := s.checkNotQuarantined(deployIdToRun); err != nil {
+		return -1, err
+	}
+	if app, err := s.loadApp(deployIdToRun); err == nil && app.Type() == DEPLOY_TYPE_JOB {
+		result, err := s.runJob(deployIdToRun)
+		if err != nil {
+			return -1, err
+		} else if result.Error != "" {
+			return -1, fmt.Errorf("Job %s failed: %s", deployIdToRun, result.Error)
+		}
+		return 0, nil
+	}
+	port, app, cmd, err := s.allocatePort(ctx, deployIdToRun)
 	if err != nil {
-		return -1, fmt.Errorf("write config: %s", err)
+		return -1, err
+	} else if cmd == nil {
+		return port, nil
 	}
 
-	err = cmd.Start()
+	start := time.Now()
+	err = startCmd(cmd)
 	if err != nil {
 		return -1, err
 	}
+	s.recordStarted(deployIdToRun, cmd.Process.Pid, port)
+	s.statsd.count("deploy.start", deployIdToRun)
 
-	if err := s.waitForAppToStart(port, app); err != nil {
-		return -1, err
+	err = s.waitForProcessToStart(port, app, watchExit(cmd))
+	s.startupFinished(deployIdToRun, start, err)
+	if err != nil {
+		s.recordHealthFailure(deployIdToRun)
+		return -1, s.withStderrTail(deployIdToRun, err)
 	}
 
+	s.recordRun(deployIdToRun)
+	s.recordEventFor(ctx, "", "run", deployIdToRun, port)
 	return port, nil
 }
 
+// acquireRunSlot waits for one of the config's MaxConcurrentRuns to be free,
+// for up to its RunQueueTimeoutMs or until ctx is done. Call the returned
+// func once the Run is finished.
+func (s *ServerImpl) acquireRunSlot(ctx context.Context) (func(), error) {
+	if s.runSlots == nil {
+		return func() {}, nil
+	}
+	timeout := DEFAULT_RUN_QUEUE_TIMEOUT
+	if s.config.RunQueueTimeoutMs > 0 {
+		timeout = time.Duration(s.config.RunQueueTimeoutMs) * time.Millisecond
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.runSlots <- struct{}{}:
+		return func() { <-s.runSlots }, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %d in progress, waited %s", ErrTooManyRuns, s.config.MaxConcurrentRuns, timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// allocatePort configures deployId to run on a free port, returning the port
+// and the command to start it there. For a deploy already configured on a
+// port it isn't running on, it follows the DeadPortPolicy, and returns no
+// command if there's nothing to start.
+func (s *ServerImpl) allocatePort(ctx context.Context, deployId string) (int, Application, *exec.Cmd, error) {
+	s.configLock.Lock()
+	if port := s.lookupConfiguredPort(deployId); port != 0 {
+		if _, alive := s.trackedPid(deployId); alive || !s.portFree(port) {
+			s.configLock.Unlock()
+			return -1, nil, nil, fmt.Errorf("Already configured for port %d", port)
+		}
+		policy := s.config.DeadPortPolicy
+		s.configLock.Unlock()
+		switch policy {
+		case DEAD_PORT_FAIL:
+			return -1, nil, nil, fmt.Errorf("Configured for port %d, but not running", port)
+		case DEAD_PORT_EXISTING:
+			return port, nil, nil, nil
+		}
+		log.Printf("%s is configured for port %d but not running, restarting it\n", deployId, port)
+		// deployId is locked, so its named ports stay put until it starts
+		app, cmd, err := s.commandForDeploy(deployId, port, s.configuredNamedPorts(deployId))
+		if err != nil {
+			return -1, nil, nil, err
+		}
+		return port, app, cmd, nil
+	}
+	s.configLock.Unlock()
+
+	port, err := s.newPortForDeploy(ctx, deployId)
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	named, err := s.findNamedPorts(ctx, deployId, port)
+	if err != nil {
+		s.unholdPort(port)
+		s.releasePort(port, deployId)
+		return -1, nil, nil, err
+	}
+	// Once they're configured the holds aren't needed; if they aren't, the
+	// PortReleaseCmd is run for them too.
+	unhold := func() {
+		s.unholdPort(port)
+		for _, p := range named {
+			s.unholdPort(p)
+		}
+	}
+	release := func() {
+		unhold()
+		s.releasePort(port, deployId)
+		s.releaseNamedPorts(deployId, named)
+	}
+
+	app, cmd, err := s.commandForDeploy(deployId, port, named)
+	if err != nil {
+		release()
+		return -1, nil, nil, err
+	}
+	s.configLock.Lock()
+	if err := s.checkBudget(deployId, app); err != nil {
+		s.configLock.Unlock()
+		closePipes(cmd)
+		release()
+		return -1, nil, nil, err
+	}
+
+	s.config.Ports[port] = deployId
+	s.setNamedPorts(deployId, named)
+	if err := s.writeConfig(); err != nil {
+		delete(s.config.Ports, port)
+		s.setNamedPorts(deployId, nil)
+		s.configLock.Unlock()
+		closePipes(cmd)
+		release()
+		return -1, nil, nil, fmt.Errorf("write config: %s", err)
+	}
+	s.configLock.Unlock()
+	unhold()
+	return port, app, cmd, nil
+}
+
+// lockDeploy serializes Run, Stop and Enforce on deployId, while letting them
+// go ahead on other deploys. Call the returned func to unlock.
+func (s *ServerImpl) lockDeploy(deployId string) func() {
+	s.deployLocksLock.Lock()
+	lock, ok := s.deployLocks[deployId]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.deployLocks[deployId] = lock
+	}
+	s.deployLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
 func (s *ServerImpl) Stop(deployIdToStop string) error {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
+	return s.StopContext(context.Background(), deployIdToStop)
+}
+
+// StopContext is Stop, recording ctx's actor, see WithActor.
+func (s *ServerImpl) StopContext(ctx context.Context, deployIdToStop string) error {
+	deployIdToStop, err := s.resolveDeployId(deployIdToStop)
+	if err != nil {
+		return err
+	}
+	unlock := s.lockDeploy(deployIdToStop)
+	defer unlock()
+	return s.stopNolock(ctx, deployIdToStop)
+}
+
+// stopNolock is StopContext for callers already holding deployIdToStop's
+// lockDeploy.
+func (s *ServerImpl) stopNolock(ctx context.Context, deployIdToStop string) error {
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
 	procsByDeployId := makeProcessDeployIdLookup(procs)
 	proc, running := procsByDeployId[deployIdToStop]
-	port := s.lookupConfiguredPort(deployIdToStop)
-	if port == 0 {
-		return fmt.Errorf("Deploy not running or not on a port")
+	if !running {
+		// e.g. not listening yet, or started by camus before it restarted
+		proc.Pid, running = s.trackedPid(deployIdToStop)
 	}
-
-	delete(s.config.Ports, port)
-	err := s.writeConfig()
+	if err := s.clearCanaryOf(ctx, deployIdToStop); err != nil {
+		return err
+	}
+	port, named, err := s.deallocatePort(deployIdToStop)
 	if err != nil {
-		return fmt.Errorf("write config: %s", err)
+		return err
+	}
+	defer s.releasePort(port, deployIdToStop)
+	defer s.releaseNamedPorts(deployIdToStop, named)
+
+	sig := syscall.SIGTERM
+	timeout := s.stopTimeout(nil)
+	if app, err := s.loadApp(deployIdToStop); err == nil {
+		sig = app.StopSignal()
+		timeout = s.stopTimeout(app)
+	} else {
+		log.Printf("warning: stopping %s with %s: %s\n", deployIdToStop, sig, err)
 	}
 
 	//kill the proc *after* removing it from the list so it doesn't auto-restart
+	target := 0
 	if running {
 		if p, err := os.FindProcess(proc.Pid); err == nil {
 			//try to kill by process group id so the whole bundle incl. children gets cleaned up
-			if pgid, pgerr := syscall.Getpgid(proc.Pid); pgerr == nil {
-				syscall.Kill(-pgid, 15) //minus is required
+			if target = signalTarget(proc.Pid); target != 0 {
+				syscall.Kill(target, sig)
 			} else {
 				p.Kill()
 			}
@@ -506,75 +1823,881 @@ func (s *ServerImpl) Stop(deployIdToStop string) error {
 	} else {
 		return fmt.Errorf("Deploy not running")
 	}
+	s.recordStopped(deployIdToStop)
+	go s.awaitStopped(deployIdToStop, target)
+
+	if !s.awaitPortReleased(port, timeout) {
+		log.Printf("%s didn't release port %d within %s of %s, killing it\n", deployIdToStop, port, timeout, sig)
+		if target != 0 {
+			syscall.Kill(target, syscall.SIGKILL)
+		} else if p, err := os.FindProcess(proc.Pid); err == nil {
+			p.Kill()
+		}
+		if !s.awaitPortReleased(port, timeout) {
+			return fmt.Errorf("Port %d still in use after killing %s", port, deployIdToStop)
+		}
+	}
+	s.recordPortFreed(port)
+	s.recordEventFor(ctx, "", "stop", deployIdToStop, port)
 	return nil
 }
 
-func (s *ServerImpl) commandForDeploy(deployIdToRun string, port int) (Application, *exec.Cmd, error) {
-	deployPath := s.deployDir(deployIdToRun)
-	app, err := ApplicationFromConfig(false,
-		path.Join(deployPath, "deploy.json"))
+// clearCanaryOf sends all the traffic back to the active deploy if deployId is
+// the canary, so stopping it doesn't leave the canary on a dead port.
+func (s *ServerImpl) clearCanaryOf(ctx context.Context, deployId string) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.config.Canary == nil || s.config.Canary.DeployId != deployId {
+		return nil
+	}
+	if err := s.setActive(s.config.Active, nil); err != nil {
+		return fmt.Errorf("Not stopping the canary %s, as it couldn't be cleared: %s", deployId, err)
+	}
+	s.recordEventFor(ctx, LABEL_CANARY, "clear-canary", deployId, 0)
+	return nil
+}
+
+// awaitPortReleased waits up to timeout for nothing to be listening on port,
+// returning whether it was released.
+func (s *ServerImpl) awaitPortReleased(port int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !s.portFree(port) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(STOP_CHECK_INTERVAL)
+	}
+	return true
+}
+
+// deallocatePort removes deployId from the port it's configured on, and from
+// its NamedPorts, returning them.
+func (s *ServerImpl) deallocatePort(deployId string) (int, map[string]int, error) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	port := s.lookupConfiguredPort(deployId)
+	if port == 0 {
+		return 0, nil, fmt.Errorf("Deploy not running or not on a port")
+	}
+
+	named := s.config.NamedPorts[deployId]
+	delete(s.config.Ports, port)
+	s.setNamedPorts(deployId, nil)
+	if err := s.writeConfig(); err != nil {
+		s.config.Ports[port] = deployId
+		s.setNamedPorts(deployId, named)
+		return 0, nil, fmt.Errorf("write config: %s", err)
+	}
+	return port, named, nil
+}
 
+// RenderRunCommand returns the command that would be run to start deployId on
+// port, without running anything.
+func (s *ServerImpl) RenderRunCommand(deployId string, port int) (string, error) {
+	app, err := s.loadApp(deployId)
+	if err != nil {
+		return "", err
+	}
+	return app.RunCmd(port), nil
+}
+
+// EffectiveConfig returns deployId's Application as Run would use it. It
+// encodes to json as the resolved deploy.json.
+func (s *ServerImpl) EffectiveConfig(deployId string) (Application, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadApp(deployId)
+}
+
+// loadApp loads deployId's deploy.json. Call without configLock; it takes
+// it to read the config's DefaultHealthEndpoint.
+func (s *ServerImpl) loadApp(deployId string) (Application, error) {
+	s.configLock.Lock()
+	defaultHealthEndpoint := s.config.DefaultHealthEndpoint
+	s.configLock.Unlock()
+	return s.loadAppWithDefaults(deployId, defaultHealthEndpoint)
+}
+
+// loadAppNolock is loadApp for callers holding configLock.
+func (s *ServerImpl) loadAppNolock(deployId string) (Application, error) {
+	return s.loadAppWithDefaults(deployId, s.config.DefaultHealthEndpoint)
+}
+
+// loadAppWithDefaults loads deployId's deploy.json, using
+// defaultHealthEndpoint if it doesn't have one. The rest of the config it
+// reads doesn't change after NewServerImpl.
+func (s *ServerImpl) loadAppWithDefaults(deployId string, defaultHealthEndpoint string) (Application, error) {
+	if defaultHealthEndpoint == "" {
+		defaultHealthEndpoint = "/"
+	}
+	app, err := applicationFromConfig(false, s.deployConfigFile(deployId), defaultHealthEndpoint, s.manifestSchema, s.config.StrictManifests)
+	if err != nil {
+		return nil, err
+	}
+	if timeout := app.HealthTransport().Timeout; timeout > s.startupTime() {
+		return nil, fmt.Errorf("deploy.json: HealthTimeoutMs %d is longer than the %s allowed for startup",
+			timeout.Milliseconds(), s.startupTime())
+	}
+	return app, nil
+}
+
+// commandForDeploy returns deployIdToRun's deploy.json and the command to
+// start it on port with its named ports. Call without configLock.
+func (s *ServerImpl) commandForDeploy(deployIdToRun string, port int, named map[string]int) (Application, *exec.Cmd, error) {
+	deployPath := s.deployDir(deployIdToRun)
+	if s.verifyChecksums {
+		if err := s.VerifyChecksums(deployIdToRun); err != nil {
+			return nil, nil, err
+		}
+	}
+	app, err := s.loadApp(deployIdToRun)
 	if err != nil {
 		return nil, nil, err
 	}
-	cmd := exec.Command("sh", "-c", app.RunCmd(port))
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	for _, name := range app.NamedPorts() {
+		if _, ok := named[name]; !ok {
+			return nil, nil, fmt.Errorf("No port for %s of its NamedPorts", name)
+		}
+	}
+	argv := app.RunArgv(port)
+	for i, arg := range argv {
+		argv[i] = expandNamedPorts(arg, named)
+	}
+	if err := s.checkAllowed(argv[0]); err != nil {
+		return nil, nil, err
+	}
+	if err := checkRunnable(deployPath, argv[0]); err != nil {
+		return nil, nil, err
+	}
+	if err := renderTemplates(app, deployIdToRun, port, named); err != nil {
+		return nil, nil, err
+	}
+	if readinessFile := app.ReadinessFile(); readinessFile != "" {
+		// so a file left by the last run doesn't count
+		if err := os.Remove(readinessFile); err != nil && !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("Remove stale readiness file: %s", err)
+		}
+	}
+	priority, err := priorityArgv(app)
+	if err != nil {
+		return nil, nil, err
+	}
+	argv = append(priority, argv...)
+	if umask := app.Umask(); umask != "" {
+		// There's no umask in SysProcAttr, so a shell sets it and then
+		// becomes the app, keeping the pid.
+		argv = append([]string{"/bin/sh", "-c", "umask " + umask + ` && exec "$@"`, "sh"}, argv...)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
 	cmd.Dir = deployPath
-	detachProc(cmd)
+	cmd.Env = appEnv(app, port, named)
+	if app.Detach() {
+		detachProc(cmd)
+	}
+	if err := s.attachSecrets(cmd, app); err != nil {
+		return nil, nil, err
+	}
+	if err := s.captureStderr(deployIdToRun, cmd); err != nil {
+		closePipes(cmd)
+		return nil, nil, err
+	}
 	return app, cmd, nil
 }
 
+// checkAllowed returns an error if the config has AllowedCommands and
+// program isn't one of them. Like loadApp, it reads the config without
+// configLock, as AllowedCommands doesn't change after NewServerImpl.
+func (s *ServerImpl) checkAllowed(program string) error {
+	if len(s.config.AllowedCommands) == 0 {
+		return nil
+	}
+	for _, allowed := range s.config.AllowedCommands {
+		if program == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't in the config's AllowedCommands, use a RunArgv with one of %s",
+		program, strings.Join(s.config.AllowedCommands, ", "))
+}
+
+// checkRunnable returns an error if program can't be run from dir, either
+// as a path relative to dir or by looking it up in PATH.
+func checkRunnable(dir string, program string) error {
+	if !strings.Contains(program, "/") {
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("Can't run %s: %s", program, err)
+		}
+		return nil
+	}
+	if !filepath.IsAbs(program) {
+		program = filepath.Join(dir, program)
+	}
+	info, err := os.Stat(program)
+	if err != nil {
+		return fmt.Errorf("Can't run %s: %s", program, err)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("Can't run %s: not an executable file", program)
+	}
+	return nil
+}
+
+// appEnv is the environment app is run with on port, and its NamedPorts on
+// named.
+func appEnv(app Application, port int, named map[string]int) []string {
+	env := os.Environ()
+	if app.CleanEnv() {
+		env = []string{}
+	}
+	// The ports last, so they can't be overridden by mistake.
+	env = append(env, app.Env()...)
+	for _, name := range app.NamedPorts() {
+		if p, ok := named[name]; ok {
+			env = append(env, fmt.Sprintf("%s=%d", namedPortVar(name), p))
+		}
+	}
+	return append(env, fmt.Sprintf("%s=%d", app.PortEnv(), port))
+}
+
 func detachProc(cmd *exec.Cmd) {
 	// give it its own process group, so it doesn't die
 	// when the manager process exits for whatever reason
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 }
 
+// How long a deploy has to pass its health check once started, unless the
+// config has a StartupTimeoutMs.
 var MAX_STARTUP_TIME = time.Duration(20) * time.Second
+
+// How long Stop waits for a deploy to release its port, unless its
+// deploy.json or the config has a StopTimeoutMs.
+var DEFAULT_STOP_TIMEOUT = time.Duration(10) * time.Second
+
+// How many health check requests may be in flight at once, unless the config
+// says otherwise.
+const DEFAULT_MAX_HEALTH_CHECKS = 16
+
+// How long a health check can take, unless the deploy.json or the config has
+// a HealthTimeoutMs.
 var MAX_HEALTH_CHECK_TIME = time.Duration(2) * time.Second
+
+func (s *ServerImpl) startupTime() time.Duration {
+	if s.config.StartupTimeoutMs > 0 {
+		return time.Duration(s.config.StartupTimeoutMs) * time.Millisecond
+	}
+	return MAX_STARTUP_TIME
+}
+
+// healthCheckTime is how long each health check of app can take. With a nil
+// app, it's the server's default.
+func (s *ServerImpl) healthCheckTime(app Application) time.Duration {
+	if app != nil && app.HealthTransport().Timeout > 0 {
+		return app.HealthTransport().Timeout
+	}
+	if s.config.HealthTimeoutMs > 0 {
+		return time.Duration(s.config.HealthTimeoutMs) * time.Millisecond
+	}
+	return MAX_HEALTH_CHECK_TIME
+}
+
+// stopTimeout is how long Stop gives app to exit. With a nil app, it's the
+// server's default.
+func (s *ServerImpl) stopTimeout(app Application) time.Duration {
+	if app != nil && app.StopTimeout() > 0 {
+		return app.StopTimeout()
+	}
+	if s.config.StopTimeoutMs > 0 {
+		return time.Duration(s.config.StopTimeoutMs) * time.Millisecond
+	}
+	return DEFAULT_STOP_TIMEOUT
+}
+
 var STARTUP_HEALTH_CHECK_INTERVAL = time.Duration(100) * time.Millisecond
 
+// Once something is listening on the port the app is probably close to
+// healthy, so health checks are made more often.
+var STARTUP_OPEN_PORT_CHECK_INTERVAL = time.Duration(10) * time.Millisecond
+
+// processExit is when, and how, a started command exited.
+type processExit struct {
+	pid int
+
+	// closed once it has exited
+	done chan struct{}
+	err  error
+}
+
+// watchExit waits for cmd, which has been started, in the background. As it
+// reaps cmd, later waits for it get ECHILD.
+func watchExit(cmd *exec.Cmd) *processExit {
+	exit := &processExit{pid: cmd.Process.Pid, done: make(chan struct{})}
+	go func() {
+		exit.err = waitCmd(cmd)
+		close(exit.done)
+	}()
+	return exit
+}
+
+// waitForAppToStart waits for the port to be opened with cheap TCP checks,
+// then polls the health endpoint quickly until the app is healthy, logging
+// one line once it is (and progress along the way for Verbose apps).
 func (s *ServerImpl) waitForAppToStart(port int, app Application) error {
-	end := time.Now().Add(MAX_STARTUP_TIME)
-	for {
-		log.Print(".")
+	return s.waitForProcessToStart(port, app, nil)
+}
 
-		status, err := s.testApp(port, app)
+// waitForProcessToStart is waitForAppToStart for an app camus started, which
+// fails as soon as the app exits with an error, rather than at the end of the
+// startup time. Exiting successfully is fine, e.g. for a RunCmd that starts
+// the app in the background.
+func (s *ServerImpl) waitForProcessToStart(port int, app Application, exit *processExit) error {
+	var exited chan struct{}
+	if exit != nil {
+		exited = exit.done
+	}
+	// pause sleeps for d, returning an error if the app exits with one
+	// first.
+	pause := func(d time.Duration) error {
+		select {
+		case <-exited:
+			exited = nil
+			if exit.err != nil {
+				return fmt.Errorf("App exited while starting: %s", exit.err)
+			}
+			<-time.After(d)
+		case <-time.After(d):
+		}
+		return nil
+	}
 
-		if err == nil {
-			if status == 200 {
-				log.Println("ok")
-				return nil
+	// The delay is on top of the startup time, as the app won't be up
+	// before it anyway.
+	if err := pause(app.StartupDelay()); err != nil {
+		return err
+	}
+	start := time.Now()
+	end := start.Add(s.startupTime())
+	// An app with a readiness file or command needn't listen on its port
+	// at all.
+	portOpen := app.ReadinessFile() != "" || app.ReadinessCmd(port) != nil
+	// the first of the HealthChecks failing at the last check
+	var pending error
+	// health checks in a row that timed out
+	timeouts := 0
+	for checks := 1; ; checks++ {
+		if !portOpen {
+			portOpen = !s.portFree(port)
+			if app.Verbose() {
+				if portOpen {
+					log.Printf("port %d is open\n", port)
+				} else {
+					log.Printf("port %d not open yet\n", port)
+				}
+			}
+		}
+
+		if portOpen {
+			status, endpoint, err := s.testAppEndpoints(port, app)
+			if app.Verbose() {
+				log.Printf("health check on %d: status %d, err %v\n", port, status, err)
+			}
+			if err != nil && classifyHealthError(err) == HEALTH_ERROR_TIMEOUT {
+				timeouts++
+				if limit := app.StartupHealthTimeouts(); limit > 0 && timeouts >= limit {
+					return fmt.Errorf("Health check timed out %d times in a row: %s", timeouts, err)
+				}
 			} else {
-				log.Println("bad:", status)
-				return errors.New(fmt.Sprintf("Health check failed %d", status))
+				timeouts = 0
+			}
+
+			pending = nil
+			if err == nil && app.HealthyStatus(status) {
+				pending = s.testHealthChecks(port, app)
+				if pending != nil && app.Verbose() {
+					log.Printf("health check on %d: %s\n", port, pending)
+				}
+			}
+			if err == nil && pending == nil {
+				if app.HealthyStatus(status) {
+					if len(app.HealthEndpoints()) > 1 {
+						log.Printf("port %d passed its health check on %s\n", port, endpoint)
+						// the rest of startup sticks to the endpoint that passed
+						app = &healthEndpointApp{Application: app, endpoint: endpoint}
+					}
+					if err := s.waitForStableHealth(port, app); err != nil {
+						return err
+					}
+					if err := s.checkStillStarted(port, app, exit); err != nil {
+						return err
+					}
+					log.Printf("port %d healthy after %d checks in %s\n",
+						port, checks, time.Since(start).Round(time.Millisecond))
+					s.warmUp(port, app)
+					return nil
+				} else {
+					log.Println("bad:", status)
+					return errors.New(fmt.Sprintf("Health check failed %d", status))
+				}
 			}
 		}
 
 		if time.Now().After(end) {
+			if pending != nil {
+				return fmt.Errorf("Not all health checks passed before the timeout: %s", pending)
+			}
 			return errors.New("Failed to connect to app after timeout")
 		}
 
+		interval := STARTUP_HEALTH_CHECK_INTERVAL
+		if portOpen {
+			interval = STARTUP_OPEN_PORT_CHECK_INTERVAL
+		}
+		if err := pause(interval); err != nil {
+			return err
+		}
+	}
+}
+
+// Kinds of health check error, see classifyHealthError.
+const (
+	// Nothing is listening on the port, normal while the app starts.
+	HEALTH_ERROR_REFUSED = "refused"
+
+	// The app took the connection but didn't answer in time, i.e. hung.
+	HEALTH_ERROR_TIMEOUT = "timeout"
+
+	// Anything else, e.g. a bad response.
+	HEALTH_ERROR_OTHER = "other"
+)
+
+// classifyHealthError returns which HEALTH_ERROR_ kind err, from a health
+// check request, is.
+func classifyHealthError(err error) string {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return HEALTH_ERROR_REFUSED
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return HEALTH_ERROR_TIMEOUT
+	}
+	return HEALTH_ERROR_OTHER
+}
+
+// checkStillStarted checks again, once the app camus started has passed its
+// health check, that it still does and that it hasn't exited, unless its
+// StartupCriteria is just healthy. Otherwise an app that answers one health
+// check and dies would count as started.
+func (s *ServerImpl) checkStillStarted(port int, app Application, exit *processExit) error {
+	if exit == nil || app.StartupCriteria() == STARTUP_CRITERIA_HEALTHY {
+		return nil
+	}
+	status, err := s.testApp(port, app)
+	if err == nil && !app.HealthyStatus(status) {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		return fmt.Errorf("App passed its health check, then failed it: %s", err)
+	}
+	select {
+	case <-exit.done:
+		if exit.err != nil {
+			return fmt.Errorf("App exited after passing its health check: %s", exit.err)
+		}
+		// A RunCmd that started the app in the background. A NoDetach
+		// app's group is camus's, so it's taken at its word.
+		if app.Detach() && syscall.Kill(-exit.pid, 0) == syscall.ESRCH {
+			return errors.New("App exited after passing its health check, leaving nothing running")
+		}
+	default:
+	}
+	return nil
+}
+
+// testHealthChecks makes the app's HealthChecks, returning an error for the
+// first that fails.
+func (s *ServerImpl) testHealthChecks(port int, app Application) error {
+	for _, check := range app.HealthChecks() {
+		resp, err := s.healthRequest(app, check.Method, fmt.Sprintf("%s://localhost:%d%s%s",
+			app.HealthScheme(), port, strings.TrimSuffix(app.HealthBasePath(), "/"), check.Path))
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", check.Method, check.Path, err)
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxHealthBodySize))
+		resp.Body.Close()
+		if resp.StatusCode != check.Status {
+			return fmt.Errorf("%s %s: status %d, not %d", check.Method, check.Path, resp.StatusCode, check.Status)
+		}
+	}
+	return nil
+}
+
+// healthEndpointApp is an Application whose health is only checked on one of
+// its HealthEndpoints.
+type healthEndpointApp struct {
+	Application
+	endpoint string
+}
+
+func (a *healthEndpointApp) HealthEndpoint() string {
+	return a.endpoint
+}
+func (a *healthEndpointApp) HealthEndpoints() []string {
+	return []string{a.endpoint}
+}
+
+// warmUp requests each of the app's warmup paths in turn, ignoring the
+// responses.
+func (s *ServerImpl) warmUp(port int, app Application) {
+	for _, warmupPath := range app.WarmupPaths() {
+		resp, err := s.healthGet(app, fmt.Sprintf("%s://localhost:%d%s", app.HealthScheme(), port, warmupPath))
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if app.Verbose() {
+			if err != nil {
+				log.Printf("warmup %s on %d: err %v\n", warmupPath, port, err)
+			} else {
+				log.Printf("warmup %s on %d: status %d\n", warmupPath, port, resp.StatusCode)
+			}
+		}
+	}
+}
+
+// healthGet requests url from app with its health check client and
+// User-Agent.
+func (s *ServerImpl) healthGet(app Application, url string) (*http.Response, error) {
+	return s.healthRequest(app, "GET", url)
+}
+
+func (s *ServerImpl) healthRequest(app Application, method string, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", app.HealthUserAgent())
+	if tokenFile := app.HealthTokenFile(); tokenFile != "" {
+		token, err := readHealthToken(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	s.healthChecks <- struct{}{}
+	resp, err := s.healthClient(app).Do(req)
+	if err != nil {
+		<-s.healthChecks
+		return nil, err
+	}
+	if err := s.checkCert(app, resp); err != nil {
+		resp.Body.Close()
+		<-s.healthChecks
+		return nil, err
+	}
+	// the request is in flight until its body is closed
+	resp.Body = &healthCheckBody{ReadCloser: resp.Body, done: s.healthChecks}
+	return resp, nil
+}
+
+// checkCert records when the certificate of an HTTPS health check response
+// expires, for Deploy.CertExpiry. It's an error if that's within the app's
+// HealthCertMinValidity and its HealthCertExpiry is fail.
+func (s *ServerImpl) checkCert(app Application, resp *http.Response) error {
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	expiry := resp.TLS.PeerCertificates[0].NotAfter
+	port, _ := strconv.Atoi(resp.Request.URL.Port())
+	s.certExpiriesLock.Lock()
+	s.certExpiries[port] = expiry
+	s.certExpiriesLock.Unlock()
+
+	minValidity := app.HealthCertMinValidity()
+	if minValidity == 0 || time.Until(expiry) >= minValidity {
+		return nil
+	}
+	msg := fmt.Sprintf("Certificate expires %s, within HealthCertMinDays %d",
+		expiry.UTC().Format(time.RFC3339), int(minValidity/(24*time.Hour)))
+	if app.HealthCertExpiry() == HEALTH_CERT_EXPIRY_WARN {
+		log.Printf("warning: port %d: %s\n", port, msg)
+		return nil
+	}
+	return errors.New(msg)
+}
+
+// certExpiry is when the certificate of the HTTPS app on port expires, as
+// seen by its last health check, or zero if none has been seen.
+func (s *ServerImpl) certExpiry(port int) time.Time {
+	s.certExpiriesLock.Lock()
+	defer s.certExpiriesLock.Unlock()
+	return s.certExpiries[port]
+}
+
+// readHealthToken reads the bearer token for health checks from tokenFile.
+func readHealthToken(tokenFile string) (string, error) {
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Read HealthTokenFile: %s", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("HealthTokenFile %s is empty", tokenFile)
+	}
+	return token, nil
+}
+
+// healthCheckBody is the body of a health check response, which frees the
+// request's place in ServerImpl.healthChecks once it's closed.
+type healthCheckBody struct {
+	io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+func (b *healthCheckBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { <-b.done })
+	return err
+}
+
+// healthClient returns the client to health check app with.
+func (s *ServerImpl) healthClient(app Application) *http.Client {
+	settings := app.HealthTransport()
+	if settings == (HealthTransport{}) {
+		return s.client
+	}
+
+	s.healthClientsLock.Lock()
+	defer s.healthClientsLock.Unlock()
+	if client, ok := s.healthClients[settings]; ok {
+		return client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = settings.DisableKeepAlives
+	if settings.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: settings.ConnectTimeout}).DialContext
+	}
+	if settings.Http2 {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if settings.TlsSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: s.client.CheckRedirect,
+		Timeout:       s.client.Timeout,
+	}
+	if settings.Timeout > 0 {
+		client.Timeout = settings.Timeout
+	}
+	if settings.SameOriginRedirects {
+		client.CheckRedirect = sameOriginRedirect
+	}
+	s.healthClients[settings] = client
+	return client
+}
+
+// sameOriginRedirect is the CheckRedirect for HEALTH_REDIRECTS_SAME_ORIGIN.
+func sameOriginRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("health check redirected too many times")
+	}
+	if req.URL.Scheme != via[0].URL.Scheme || req.URL.Host != via[0].URL.Host {
+		return fmt.Errorf("health check should not redirect to %s", req.URL)
+	}
+	return nil
+}
+
+// waitForStableHealth checks the app on port stays healthy for its
+// Stabilization after first passing its health check.
+func (s *ServerImpl) waitForStableHealth(port int, app Application) error {
+	if err := s.healthyFor(port, app, app.Stabilization()); err != nil {
+		return fmt.Errorf("App on %d became unhealthy after passing its health check: %s", port, err)
+	}
+	return nil
+}
+
+// healthyFor health checks the app on port every
+// STARTUP_HEALTH_CHECK_INTERVAL for duration, returning the first failure.
+func (s *ServerImpl) healthyFor(port int, app Application, duration time.Duration) error {
+	end := time.Now().Add(duration)
+	for time.Now().Before(end) {
 		time.Sleep(STARTUP_HEALTH_CHECK_INTERVAL)
+		status, err := s.testApp(port, app)
+		if app.Verbose() {
+			log.Printf("health check on %d: status %d, err %v\n", port, status, err)
+		}
+		if err == nil && !app.HealthyStatus(status) {
+			err = fmt.Errorf("status %d", status)
+		}
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
+// checkReadinessFile is testApp for apps with a ReadinessFile, returning 200
+// if it's there with the right content.
+func checkReadinessFile(app Application) (int, error) {
+	data, err := ioutil.ReadFile(app.ReadinessFile())
+	if err != nil {
+		return -1, fmt.Errorf("Not ready: %s", err)
+	}
+	if content := app.ReadinessContent(); content != "" && !strings.Contains(string(data), content) {
+		return -1, fmt.Errorf("Not ready: %s doesn't contain %q", app.ReadinessFile(), content)
+	}
+	return 200, nil
+}
+
+// How long a timed out ReadinessCmd's output is waited for once its process
+// group is killed.
+var READINESS_CMD_WAIT_DELAY = time.Duration(100) * time.Millisecond
+
+// checkReadinessCmd is testApp for apps with a ReadinessCmd, returning 200 if
+// the ReadinessField of its output is the ReadinessValue. It has as long as
+// a health check would, and like the RunCmd must be in any AllowedCommands.
+func (s *ServerImpl) checkReadinessCmd(port int, app Application) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.healthCheckTime(app))
+	defer cancel()
+
+	argv := app.ReadinessCmd(port)
+	if err := s.checkAllowed(argv[0]); err != nil {
+		return -1, fmt.Errorf("Not ready: %s", err)
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = app.Dir()
+	cmd.Env = appEnv(app, port, nil)
+	// in its own process group, so a timeout kills whatever it started
+	// too, rather than leaving it holding stdout open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = READINESS_CMD_WAIT_DELAY
+	out, err := cmd.Output()
+	if err != nil {
+		return -1, fmt.Errorf("Not ready: readiness command failed: %s", err)
+	}
+	var readiness interface{}
+	if err := json.Unmarshal(out, &readiness); err != nil {
+		return -1, fmt.Errorf("Not ready: readiness command didn't print json: %s", err)
+	}
+	value, ok := jsonField(readiness, app.ReadinessField())
+	if !ok {
+		return -1, fmt.Errorf("Not ready: no %s in the readiness command's output", app.ReadinessField())
+	}
+	if value != app.ReadinessValue() {
+		return -1, fmt.Errorf("Not ready: %s is %q, not %q", app.ReadinessField(), value, app.ReadinessValue())
+	}
+	return 200, nil
+}
+
+// jsonField returns the field of decoded json data at a dotted path like
+// "db.state", as a string if it is one and as json otherwise.
+func jsonField(data interface{}, field string) (string, bool) {
+	for _, key := range strings.Split(field, ".") {
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if data, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+	if str, ok := data.(string); ok {
+		return str, true
+	}
+	encoded, err := json.Marshal(data)
+	return string(encoded), err == nil
+}
+
+// Only this much of a health check response body is read when matching it.
+const maxHealthBodySize = 64 * 1024
+
 func (s *ServerImpl) testApp(port int, app Application) (int, error) {
-	resp, err := s.client.Get(
-		fmt.Sprintf("http://localhost:%d%s", port, app.HealthEndpoint()))
+	status, _, err := s.testAppEndpoints(port, app)
+	return status, err
+}
 
-	if err == nil {
-		return resp.StatusCode, nil
+// testAppEndpoints checks the app's health endpoints in order until one
+// passes, returning its result and path, or the last one's result if none
+// do.
+func (s *ServerImpl) testAppEndpoints(port int, app Application) (int, string, error) {
+	if app.ReadinessFile() != "" {
+		status, err := checkReadinessFile(app)
+		return status, "", err
+	}
+	if app.ReadinessCmd(port) != nil {
+		status, err := s.checkReadinessCmd(port, app)
+		return status, "", err
+	}
+	var status int
+	var endpoint string
+	var err error
+	for _, endpoint = range app.HealthEndpoints() {
+		status, err = s.testAppEndpoint(port, app, endpoint)
+		if err == nil && app.HealthyStatus(status) {
+			break
+		}
+	}
+	return status, endpoint, err
+}
+
+func (s *ServerImpl) testAppEndpoint(port int, app Application, endpoint string) (int, error) {
+	start := time.Now()
+	resp, err := s.healthGet(app, fmt.Sprintf("%s://localhost:%d%s%s",
+		app.HealthScheme(), port, strings.TrimSuffix(app.HealthBasePath(), "/"), endpoint))
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if app.HealthyStatus(resp.StatusCode) {
+		for name, expected := range app.HealthHeaders() {
+			if value := resp.Header.Get(name); value != expected {
+				return -1, fmt.Errorf("Health check header %s is %q, not %q", name, value, expected)
+			}
+		}
+	}
+	if re := app.HealthBodyMatch(); re != nil && app.HealthyStatus(resp.StatusCode) {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthBodySize))
+		if err != nil {
+			return -1, err
+		}
+		if !re.Match(body) {
+			return -1, fmt.Errorf("Health check body doesn't match %s", re)
+		}
 	}
 
-	return -1, err
+	maxLatency := app.HealthMaxLatency()
+	if latency := time.Since(start); maxLatency > 0 && latency > maxLatency {
+		return -1, fmt.Errorf("Health check took %s, more than %s",
+			latency.Round(time.Millisecond), maxLatency)
+	}
+	return resp.StatusCode, nil
 }
 
-func (s *ServerImpl) reloadHaproxy(port int) error {
+func (s *ServerImpl) reloadHaproxy(port int, canary *Canary) error {
 	if port < s.startPort {
 		return fmt.Errorf("Invalid prod port %d", port)
 	}
 	cfg := HaproxyConfig(s.endPort, s.endPort-1, port)
+	if canary != nil {
+		canaryPort := s.lookupConfiguredPort(canary.DeployId)
+		if canaryPort == 0 {
+			return fmt.Errorf("Canary deploy %s is not on a port", canary.DeployId)
+		}
+		cfg = HaproxyCanaryConfig(s.endPort, s.endPort-1, port,
+			canaryPort, canary.Weight, canary.Sticky)
+	}
 
 	cfgFile := path.Join(s.root, haproxyConfig)
 	pidFile := path.Join(s.root, haproxyPid)
@@ -590,7 +2713,11 @@ func (s *ServerImpl) reloadHaproxy(port int) error {
 
 	cmd := haproxyCmd(cfgFile, pidFile, runningPid)
 
-	return cmd.Run()
+	// in its own process group, so as not to be taken by the reaper
+	if err := startWaited(cmd); err != nil {
+		return err
+	}
+	return waitCmd(cmd)
 }
 
 func haproxyCmd(cfgFile string, pidFile string, runningPid int) *exec.Cmd {
@@ -639,20 +2766,31 @@ func contains(strs []string, str string) bool {
 }
 
 // TODO(koz): Don't return haproxy processes here.
-func (s *ServerImpl) findUnknownProcesses() []Process {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
-	deployIds := s.readDeployIdsFromDisk()
+func (s *ServerImpl) findUnknownProcesses() ([]Process, error) {
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+	deployIds, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		return nil, err
+	}
 	unknown := []Process{}
 	for _, proc := range procs {
 		if !contains(deployIds, proc.DeployId) {
 			unknown = append(unknown, proc)
 		}
 	}
-	return unknown
+	return unknown, nil
 }
 
+// KillUnknownProcesses kills the processes in the port range that aren't
+// deploys. Nothing is killed if the deploys can't be read, as every process
+// would look unknown.
 func (s *ServerImpl) KillUnknownProcesses() {
-	for _, proc := range s.findUnknownProcesses() {
+	unknown, err := s.findUnknownProcesses()
+	if err != nil {
+		log.Printf("not killing unknown processes: %s\n", err)
+		return
+	}
+	for _, proc := range unknown {
 		if p, err := os.FindProcess(proc.Pid); err == nil {
 			p.Kill()
 		}
@@ -661,7 +2799,7 @@ func (s *ServerImpl) KillUnknownProcesses() {
 
 // Shutdown kills all processes in the range of camus and then exits.
 func (s *ServerImpl) Shutdown() {
-	procs := FindListeningProcesses(s.startPort, s.endPort)
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
 	for _, proc := range procs {
 		if p, err := os.FindProcess(proc.Pid); err == nil {
 			p.Kill()
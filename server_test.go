@@ -0,0 +1,5379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess isn't a real test. It is started by deploys created with
+// helperRunCmd to stand in for an application. The helper's mode and port
+// follow a "--" in its arguments.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("CAMUS_TEST_HELPER") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: -- mode port\n")
+		os.Exit(2)
+	}
+	mode, port := args[1], args[2]
+
+	switch mode {
+	case "serve":
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "I'm ok!")
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "signal":
+		// Serves like "serve", and writes the first signal it gets to
+		// CAMUS_TEST_SIGNAL_FILE before exiting.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			sig := <-signals
+			ioutil.WriteFile(os.Getenv("CAMUS_TEST_SIGNAL_FILE"), []byte(sig.String()), 0644)
+			os.Exit(0)
+		}()
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "I'm ok!")
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "envport":
+		// Serves like "serve", on the port in the environment variable
+		// CAMUS_TEST_PORT_ENV names, ignoring the port argument.
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "I'm ok!")
+		})
+		http.ListenAndServe("127.0.0.1:"+os.Getenv(os.Getenv("CAMUS_TEST_PORT_ENV")), nil)
+	case "drain":
+		// Serves like "serve", but takes a while to exit once signalled,
+		// as if finishing its requests. It stops listening straight away.
+		l, err := net.Listen("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			os.Exit(2)
+		}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+		go func() {
+			<-signals
+			l.Close()
+			time.Sleep(300 * time.Millisecond)
+			os.Exit(0)
+		}()
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "I'm ok!")
+		})
+		http.Serve(l, nil)
+		select {}
+	case "stubborn":
+		// Serves like "serve", ignoring SIGTERM.
+		signal.Ignore(syscall.SIGTERM)
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "I'm ok!")
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "sickfile":
+		// Serves like "serve", but returns 503 while the file
+		// CAMUS_TEST_SICK_FILE names exists, which it removes on starting.
+		os.Remove(os.Getenv("CAMUS_TEST_SICK_FILE"))
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			if _, err := os.Stat(os.Getenv("CAMUS_TEST_SICK_FILE")); err == nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			fmt.Fprintf(w, "%d", os.Getpid())
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "readfile":
+		// Serves what the file CAMUS_TEST_READ_FILE names held when it
+		// started as its status.
+		data, err := ioutil.ReadFile(os.Getenv("CAMUS_TEST_READ_FILE"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read file: %s\n", err)
+			os.Exit(2)
+		}
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "orphan":
+		// With the server root in place of the port, starts a server
+		// whose config has ReapOrphans and leaves an orphan in its own
+		// process group, which exits soon after. It prints the orphan's
+		// pid, then waits for stdin to close.
+		config := path.Join(port, serverConfigFileName)
+		if err := ioutil.WriteFile(config, []byte(`{"ReapOrphans": true}`), 0644); err != nil {
+			os.Exit(2)
+		}
+		if _, err := NewServerImpl(port, false, 19000); err != nil {
+			fmt.Fprintf(os.Stderr, "NewServerImpl: %s\n", err)
+			os.Exit(2)
+		}
+		var out bytes.Buffer
+		cmd := exec.Command("sh", "-c", "sleep 0.2 & echo $!")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Stdout = &out
+		if err := startWaited(cmd); err != nil {
+			os.Exit(2)
+		}
+		if err := waitCmd(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "sh: %s\n", err)
+			os.Exit(2)
+		}
+		fmt.Print(out.String())
+		ioutil.ReadAll(os.Stdin)
+		os.Exit(0)
+	case "once":
+		// Passes one health check, then exits successfully.
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "I'm ok!")
+			w.(http.Flusher).Flush()
+			os.Exit(0)
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "report":
+		// Serves like "serve", but each health check first GETs
+		// CAMUS_TEST_REPORT_URL, so the test can see them.
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			resp, err := http.Get(os.Getenv("CAMUS_TEST_REPORT_URL"))
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			resp.Body.Close()
+			fmt.Fprintf(w, "I'm ok!")
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "env":
+		// Serves its environment as its status, a variable per line.
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s\n", strings.Join(os.Environ(), "\n"))
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	case "secret":
+		// Serves the secret read from fd 3 as its status.
+		secret, err := ioutil.ReadAll(os.NewFile(3, "secret"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read secret: %s\n", err)
+			os.Exit(2)
+		}
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(secret)
+		})
+		http.ListenAndServe("127.0.0.1:"+port, nil)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown helper mode %s\n", mode)
+	}
+	os.Exit(2)
+}
+
+// helperRunCmd returns a RunCmd that starts TestHelperProcess in the given
+// mode on the deploy's port.
+func helperRunCmd(mode string) string {
+	return fmt.Sprintf("CAMUS_TEST_HELPER=1 %s -test.run=TestHelperProcess -- %s %%PORT%%",
+		os.Args[0], mode)
+}
+
+// writeTestDeploy creates a deploy directory containing a deploy.json with the
+// given definition.
+func writeTestDeploy(t *testing.T, s *ServerImpl, deployId string, def ApplicationDef) {
+	if err := os.MkdirAll(s.deployDir(deployId), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.deployConfigFile(deployId), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testServerPort returns the localhost port an httptest server listens on.
+func testServerPort(t *testing.T, ts *httptest.Server) int {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func createTestRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "camus-server-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s\n", err)
+	}
+	return root
+}
+
+func TestCustomDirectoryNames(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	configFile := path.Join(root, "camus.json")
+	if err := ioutil.WriteFile(configFile, []byte(`{"Ports": {"9001": "abc"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServerImpl(root, false, 9000,
+		WithDeploysDirName("apps"),
+		WithConfigFileName("camus.json"))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	if s.config.Ports[9001] != "abc" {
+		t.Fatalf("expected config to be read from camus.json, got %v", s.config.Ports)
+	}
+	if s.DeploysPath() != path.Join(root, "apps") {
+		t.Fatalf("expected deploys path under apps, got %s", s.DeploysPath())
+	}
+	if info, err := os.Stat(s.DeploysPath()); err != nil || !info.IsDir() {
+		t.Fatalf("expected deploys dir to be created: %s", err)
+	}
+
+	if err := os.Mkdir(s.deployDir("some-deploy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := s.readDeployIdsFromDisk(); err != nil || len(ids) != 1 || ids[0] != "some-deploy" {
+		t.Fatalf("expected to find some-deploy in apps dir, got %v %v", ids, err)
+	}
+
+	s.config.Ports[9002] = "def"
+	if err := s.writeConfig(); err != nil {
+		t.Fatalf("write config: %s", err)
+	}
+	if _, err := os.Stat(path.Join(root, serverConfigFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected default config file not to be written")
+	}
+	config, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Ports[9002] != "def" {
+		t.Fatalf("expected written config in camus.json, got %v", config.Ports)
+	}
+
+	if id := deriveDeployIdFromCwd("/srv/camus/apps/some-deploy", "apps"); id != "some-deploy" {
+		t.Fatalf("expected deploy id from custom deploys dir, got '%s'", id)
+	}
+	if id := deriveDeployIdFromCwd("/srv/camus/deploys/some-deploy", "apps"); id != "" {
+		t.Fatalf("expected no deploy id outside custom deploys dir, got '%s'", id)
+	}
+}
+
+func TestAuditRunAndStop(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "audited", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+
+	port, err := s.Run("audited")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if err := s.Stop("audited"); err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(s.auditLogFile())
+	if err != nil {
+		t.Fatalf("read audit log: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit lines, got %d: %s", len(lines), data)
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("audit entry isn't valid json: %s", err)
+	}
+	if entry.Operation != "run" || entry.DeployId != "audited" || entry.Port != port {
+		t.Fatalf("unexpected run audit entry %+v", entry)
+	}
+	if entry.Time.IsZero() {
+		t.Fatalf("expected audit entry to have a time")
+	}
+
+	entries, err := s.ReadAudit(1)
+	if err != nil {
+		t.Fatalf("read audit: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Operation != "stop" || entries[0].DeployId != "audited" {
+		t.Fatalf("expected only the stop entry, got %+v", entries)
+	}
+}
+
+func TestAuditActorAndLabel(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Stands in for haproxy, which only needs to accept the reload.
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "audited", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+
+	ctx := WithActor(context.Background(), "alice")
+	if _, err := s.RunContext(ctx, "audited"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	defer s.Stop("audited")
+	if err := s.SetActiveByIdContext(ctx, "audited"); err != nil {
+		t.Fatalf("set active: %s", err)
+	}
+
+	entries, err := s.ReadAudit(2)
+	if err != nil {
+		t.Fatalf("read audit: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %+v", entries)
+	}
+	if run := entries[0]; run.Operation != "run" || run.Actor != "alice" || run.Label != "" {
+		t.Fatalf("unexpected run audit entry %+v", run)
+	}
+	if setActive := entries[1]; setActive.Operation != "set-active" || setActive.Actor != "alice" || setActive.Label != LABEL_ACTIVE {
+		t.Fatalf("unexpected set-active audit entry %+v", setActive)
+	}
+}
+
+func TestFindUnusedPortCancel(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// Every port is busy and slow to check, so a full scan would take ~5s.
+	s.portFree = func(port int) bool {
+		time.Sleep(50 * time.Millisecond)
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = s.findUnusedPort(ctx, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected scan to stop promptly after cancel, took %s", elapsed)
+	}
+}
+
+func TestSetCanaryValidation(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.config.Ports[19001] = "stable"
+	s.config.Ports[19002] = "canary"
+
+	if err := s.SetCanary("canary", 10, false); err == nil {
+		t.Fatalf("expected error setting a canary with no active deploy")
+	}
+
+	s.config.Active = 19001
+	for _, weight := range []int{0, 100, -5} {
+		if err := s.SetCanary("canary", weight, false); err == nil {
+			t.Errorf("expected error for canary weight %d", weight)
+		}
+	}
+	if err := s.SetCanary("stable", 10, false); err == nil {
+		t.Errorf("expected error making the active deploy its own canary")
+	}
+	if err := s.SetCanary("missing", 10, false); err == nil {
+		t.Errorf("expected error for a canary that isn't on a port")
+	}
+}
+
+func TestRenderRunCommand(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "rendered", ApplicationDef{
+		RunCmd: "node app.js --port %PORT% --admin-port=%PORT%",
+	})
+
+	cmd, err := s.RenderRunCommand("rendered", 19005)
+	if err != nil {
+		t.Fatalf("render: %s", err)
+	}
+	if expected := "node app.js --port 19005 --admin-port=19005"; cmd != expected {
+		t.Fatalf("expected rendered command '%s', got '%s'", expected, cmd)
+	}
+	if len(s.config.Ports) != 0 {
+		t.Fatalf("rendering shouldn't configure a port, got %v", s.config.Ports)
+	}
+
+	if _, err := s.RenderRunCommand("missing", 19005); err == nil {
+		t.Fatalf("expected error rendering a deploy that doesn't exist")
+	}
+}
+
+func TestHealthBodyMatch(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			fmt.Fprintf(w, `{"status": "warming up"}`)
+		} else {
+			fmt.Fprintf(w, `{"status": "ok"}`)
+		}
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "body", ApplicationDef{
+		RunCmd:          "true",
+		HealthEndpoint:  "/status",
+		HealthBodyMatch: `"status": *"ok"`,
+	})
+	app, err := s.loadApp("body")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.testApp(testServerPort(t, ts), app); err == nil {
+		t.Fatalf("expected a warming up body not to count as healthy")
+	}
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("expected app to become healthy once the body matched: %s", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("expected health checks to stop once the body matched, got %d requests", n)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000, WithVerifyChecksums(true))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "checked", ApplicationDef{RunCmd: "true"})
+	appFile := path.Join(s.deployDir("checked"), "app.js")
+	if err := ioutil.WriteFile(appFile, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Run("checked"); err == nil || !strings.Contains(err.Error(), "No checksums") {
+		t.Fatalf("expected verified run without checksums to fail, got %v", err)
+	}
+
+	if err := s.RecordChecksums("checked"); err != nil {
+		t.Fatalf("record checksums: %s", err)
+	}
+	if err := s.VerifyChecksums("checked"); err != nil {
+		t.Fatalf("expected unchanged deploy to verify: %s", err)
+	}
+
+	if err := ioutil.WriteFile(appFile, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Run("checked")
+	if err == nil || !strings.Contains(err.Error(), "app.js (modified)") {
+		t.Fatalf("expected verified run of a modified deploy to fail listing app.js, got %v", err)
+	}
+	if len(s.config.Ports) != 0 {
+		t.Fatalf("failed verification shouldn't configure a port, got %v", s.config.Ports)
+	}
+}
+
+func TestStartupDetectsHealthQuicklyOncePortIsOpen(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	// The port is open straight away, but the app drops health check
+	// connections until it has finished initialising.
+	var readyAt atomic.Value
+	readyAt.Store(time.Now().Add(250 * time.Millisecond))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(readyAt.Load().(time.Time)) {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "quick", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	app, err := s.loadApp("quick")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("wait for app: %s", err)
+	}
+	if late := time.Since(readyAt.Load().(time.Time)); late > STARTUP_HEALTH_CHECK_INTERVAL/2 {
+		t.Fatalf("expected health to be detected soon after the app was ready, took %s", late)
+	}
+}
+
+func TestRunIdempotent(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "retried", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	defer s.Stop("retried")
+
+	port1, err1 := s.RunIdempotent("ci-build-42", "retried")
+	if err1 != nil {
+		t.Fatalf("first run: %s", err1)
+	}
+	port2, err2 := s.RunIdempotent("ci-build-42", "retried")
+	if port1 != port2 || err2 != nil {
+		t.Fatalf("expected the retried run to return (%d, nil), got (%d, %v)", port1, port2, err2)
+	}
+	if len(s.config.Ports) != 1 {
+		t.Fatalf("expected a single configured port, got %v", s.config.Ports)
+	}
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+	if len(procs) != 1 {
+		t.Fatalf("expected a single running process, got %v", procs)
+	}
+
+	if _, err := s.RunIdempotent("ci-build-42", "other"); err == nil {
+		t.Fatalf("expected reusing a key for another deploy to fail")
+	}
+	if _, err := s.RunIdempotent("ci-build-43", "retried"); err == nil {
+		t.Fatalf("expected a new key to attempt (and fail) a second run")
+	}
+
+	// A failure isn't remembered, so retrying once it's fixed runs it.
+	if _, err := s.RunIdempotent("ci-build-44", "late"); err == nil {
+		t.Fatalf("expected running a deploy that isn't there yet to fail")
+	}
+	writeTestDeploy(t, s, "late", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	defer s.Stop("late")
+	if _, err := s.RunIdempotent("ci-build-44", "late"); err != nil {
+		t.Fatalf("expected the retry after a failure to run: %s", err)
+	}
+
+	// The key is kept in the state, for after camus restarts.
+	restarted, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	port3, err3 := restarted.RunIdempotent("ci-build-42", "retried")
+	if port3 != port1 || err3 != nil {
+		t.Fatalf("expected the retry after a restart to return (%d, nil), got (%d, %v)", port1, port3, err3)
+	}
+}
+
+func TestDeployStateTimestamps(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	dir := s.NewDeployDir()
+	state, err := s.readDeployState(dir.DeployId)
+	if err != nil {
+		t.Fatalf("read state: %s", err)
+	}
+	if state.Created.IsZero() || !state.FirstRun.IsZero() || !state.LastStopped.IsZero() {
+		t.Fatalf("expected only Created after NewDeployDir, got %+v", state)
+	}
+
+	writeTestDeploy(t, s, dir.DeployId, ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	if _, err := s.Run(dir.DeployId); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if err := s.Stop(dir.DeployId); err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+
+	deploys, err := s.ListDeploys()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(deploys) != 1 {
+		t.Fatalf("expected 1 deploy, got %d", len(deploys))
+	}
+	state = deploys[0].State
+	if state.FirstRun.Before(state.Created) || state.LastStopped.Before(state.FirstRun) {
+		t.Fatalf("expected created <= first run <= last stopped, got %+v", state)
+	}
+	if !state.LastHealthFailure.IsZero() {
+		t.Fatalf("expected no health failure to be recorded, got %+v", state)
+	}
+
+	// a deploy Enforce starts gets its FirstRun too
+	enforced := s.NewDeployDir()
+	writeTestDeploy(t, s, enforced.DeployId, ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	s.config.Ports[19001] = enforced.DeployId
+	s.Enforce()
+	defer s.Stop(enforced.DeployId)
+	if state, err := s.readDeployState(enforced.DeployId); err != nil || state.FirstRun.Before(state.Created) || state.Lifecycle != LIFECYCLE_RUNNING {
+		t.Fatalf("expected Enforce to record the first run, got %+v, %v", state, err)
+	}
+
+	if state, err := s.readDeployState("never-seen"); err != nil || !state.Created.IsZero() {
+		t.Fatalf("expected empty state for an unknown deploy, got %+v, %v", state, err)
+	}
+}
+
+func TestReservePort(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.portFree = func(port int) bool { return port != 19005 }
+	s.config.Ports[19002] = "running"
+	s.config.NamedPorts = map[string]map[string]int{"running": {"metrics": 19004}}
+
+	if err := s.ReservePort(19001, "metrics sidecar"); err != nil {
+		t.Fatalf("reserve: %s", err)
+	}
+	if port, err := s.findUnusedPort(context.Background(), ""); err != nil || port != 19003 {
+		t.Fatalf("expected allocation to skip reserved and used ports, got %d, %v", port, err)
+	}
+
+	if err := s.ReservePort(19001, "again"); err == nil {
+		t.Errorf("expected reserving a reserved port to fail")
+	}
+	if err := s.ReservePort(19002, "taken"); err == nil {
+		t.Errorf("expected reserving a deploy's port to fail")
+	}
+	if err := s.ReservePort(19003, "held"); err == nil {
+		t.Errorf("expected reserving a port held for a deploy being started to fail")
+	}
+	if err := s.ReservePort(19004, "named"); err == nil {
+		t.Errorf("expected reserving one of a deploy's named ports to fail")
+	}
+	if err := s.ReservePort(19005, "listening"); err == nil {
+		t.Errorf("expected reserving a port something's listening on to fail")
+	}
+	if err := s.ReservePort(18000, "outside"); err == nil {
+		t.Errorf("expected reserving a port outside the range to fail")
+	}
+
+	config, err := readConfig(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Reserved[19001] != "metrics sidecar" {
+		t.Fatalf("expected reservation to be saved, got %v", config.Reserved)
+	}
+
+	if err := s.ReleasePort(19001); err != nil {
+		t.Fatalf("release: %s", err)
+	}
+	if port, err := s.findUnusedPort(context.Background(), ""); err != nil || port != 19001 {
+		t.Fatalf("expected released port to be allocated, got %d, %v", port, err)
+	}
+	if err := s.ReleasePort(19001); err == nil {
+		t.Errorf("expected releasing an unreserved port to fail")
+	}
+}
+
+func TestVerboseHealthCheckLogging(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, verbose := range []bool{false, true} {
+		logs.Reset()
+		writeTestDeploy(t, s, "logged", ApplicationDef{
+			RunCmd:         "true",
+			HealthEndpoint: "/status",
+			Verbose:        verbose,
+		})
+		app, err := s.loadApp("logged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+			t.Fatalf("wait for app: %s", err)
+		}
+		if logged := strings.Contains(logs.String(), "health check on"); logged != verbose {
+			t.Errorf("verbose %t: expected health check lines logged to be %t:\n%s",
+				verbose, verbose, logs.String())
+		}
+	}
+}
+
+func TestListDeploysSkipsFilesAndSymlinks(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "real", ApplicationDef{RunCmd: "true"})
+	if err := ioutil.WriteFile(path.Join(s.DeploysPath(), "stray.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(s.deployDir("real"), path.Join(s.DeploysPath(), "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	deploys, err := s.ListDeploys()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(deploys) != 1 || deploys[0].Id != "real" {
+		ids := []string{}
+		for _, d := range deploys {
+			ids = append(ids, d.Id)
+		}
+		t.Fatalf("expected only the real deploy, got %v", ids)
+	}
+}
+
+func TestListDeploysInState(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, deployId := range []string{"live", "crashed", "old", "older"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{RunCmd: "true"})
+	}
+	// crashed is still configured, so it's running as far as Enforce goes
+	s.config.Ports[19001] = "live"
+	s.config.Ports[19002] = "crashed"
+
+	listIds := func(state string) string {
+		deploys, err := s.ListDeploysInState(state)
+		if err != nil {
+			t.Fatalf("list %s: %s", state, err)
+		}
+		ids := []string{}
+		for _, d := range deploys {
+			ids = append(ids, d.Id)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	if ids := listIds(DEPLOYS_RUNNING); ids != "crashed,live" {
+		t.Errorf("running: got %s", ids)
+	}
+	if ids := listIds(DEPLOYS_STOPPED); ids != "old,older" {
+		t.Errorf("stopped: got %s", ids)
+	}
+	if ids := listIds(""); ids != "crashed,live,old,older" {
+		t.Errorf("all: got %s", ids)
+	}
+	if running, err := s.ListRunning(); err != nil || len(running) != 2 {
+		t.Errorf("expected ListRunning to list 2 deploys, got %d (%v)", len(running), err)
+	}
+	if stopped, err := s.ListStopped(); err != nil || len(stopped) != 2 {
+		t.Errorf("expected ListStopped to list 2 deploys, got %d (%v)", len(stopped), err)
+	}
+	if _, err := s.ListDeploysInState("paused"); err == nil {
+		t.Errorf("expected an unknown state to be an error")
+	}
+
+	var reply ListDeploysReply
+	rpc := &RpcServer{server: s}
+	if err := rpc.ListDeploys(ListDeploysRequest{State: DEPLOYS_STOPPED}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Deploys) != 2 {
+		t.Errorf("expected the RPC to list the 2 stopped deploys, got %d", len(reply.Deploys))
+	}
+}
+
+func TestStopSignal(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	signalFile := path.Join(root, "signal")
+	writeTestDeploy(t, s, "interruptible", ApplicationDef{
+		RunCmd:         helperRunCmd("signal"),
+		HealthEndpoint: "/status",
+		StopSignal:     "SIGINT",
+		Env:            map[string]string{"CAMUS_TEST_SIGNAL_FILE": signalFile},
+	})
+
+	if _, err := s.Run("interruptible"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if err := s.Stop("interruptible"); err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+
+	var data []byte
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if data, err = ioutil.ReadFile(signalFile); err == nil && len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if string(data) != syscall.SIGINT.String() {
+		t.Fatalf("expected the app to get %s, got '%s'", syscall.SIGINT, data)
+	}
+}
+
+func TestDeployTags(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "payments-old", ApplicationDef{RunCmd: "true"})
+	writeTestDeploy(t, s, "payments-new", ApplicationDef{RunCmd: "true"})
+	writeTestDeploy(t, s, "search", ApplicationDef{RunCmd: "true"})
+
+	for _, tag := range []struct{ id, key, value string }{
+		{"payments-old", "team", "payments"},
+		{"payments-new", "team", "payments"},
+		{"payments-new", "risk", "high"},
+		{"search", "team", "search"},
+		{"search", "risk", "high"},
+	} {
+		if err := s.SetTag(tag.id, tag.key, tag.value); err != nil {
+			t.Fatalf("set tag: %s", err)
+		}
+	}
+	if err := s.SetTag("missing", "team", "payments"); err == nil {
+		t.Errorf("expected tagging a missing deploy to fail")
+	}
+
+	tags, err := s.GetTags("payments-new")
+	if err != nil {
+		t.Fatalf("get tags: %s", err)
+	}
+	if len(tags) != 2 || tags["team"] != "payments" || tags["risk"] != "high" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	listIds := func(tags map[string]string) string {
+		deploys, err := s.ListDeploysWithTags(tags)
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		ids := []string{}
+		for _, d := range deploys {
+			ids = append(ids, d.Id)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	if ids := listIds(map[string]string{"team": "payments"}); ids != "payments-new,payments-old" {
+		t.Errorf("team=payments: got %s", ids)
+	}
+	if ids := listIds(map[string]string{"team": "payments", "risk": "high"}); ids != "payments-new" {
+		t.Errorf("team=payments,risk=high: got %s", ids)
+	}
+	if ids := listIds(nil); ids != "payments-new,payments-old,search" {
+		t.Errorf("no filter: got %s", ids)
+	}
+
+	if err := s.SetTag("payments-new", "risk", ""); err != nil {
+		t.Fatalf("remove tag: %s", err)
+	}
+	if ids := listIds(map[string]string{"risk": "high"}); ids != "search" {
+		t.Errorf("expected removed tag not to match, got %s", ids)
+	}
+}
+
+func TestResolveLatestDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	if _, err := s.resolveDeployId(LATEST_DEPLOY); err == nil {
+		t.Errorf("expected %s to fail with no deploys", LATEST_DEPLOY)
+	}
+
+	for _, id := range []string{
+		"zany-zurich-2026-03-01-09-00-00",
+		"amazing-athens-2026-03-02-08-30-00",
+		"bold-berlin-2025-12-31-23-59-59",
+		"hand-named",
+	} {
+		writeTestDeploy(t, s, id, ApplicationDef{RunCmd: "true"})
+	}
+
+	latest, err := s.resolveDeployId(LATEST_DEPLOY)
+	if err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+	if latest != "amazing-athens-2026-03-02-08-30-00" {
+		t.Errorf("expected the newest deploy, got %s", latest)
+	}
+	if id, _ := s.resolveDeployId("hand-named"); id != "hand-named" {
+		t.Errorf("expected other ids to be unchanged, got %s", id)
+	}
+}
+
+func TestRpcLatestDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, id := range []string{"bold-berlin-2025-12-31-23-59-59", "amazing-athens-2026-03-02-08-30-00"} {
+		writeTestDeploy(t, s, id, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+	}
+	rpc := &RpcServer{server: s}
+
+	var runReply RunReply
+	if err := rpc.Run(RunRequest{DeployId: LATEST_DEPLOY}, &runReply); err != nil {
+		t.Fatalf("run %s: %s", LATEST_DEPLOY, err)
+	}
+	defer s.Stop("amazing-athens-2026-03-02-08-30-00")
+	if id := s.config.Ports[runReply.Port]; id != "amazing-athens-2026-03-02-08-30-00" {
+		t.Fatalf("expected the newest deploy to be run, got %q", id)
+	}
+
+	var planReply StopDryRunReply
+	if err := rpc.StopDryRun(StopDryRunRequest{DeployId: LATEST_DEPLOY}, &planReply); err != nil {
+		t.Fatalf("stop dry run %s: %s", LATEST_DEPLOY, err)
+	}
+	if planReply.Plan.DeployId != "amazing-athens-2026-03-02-08-30-00" {
+		t.Errorf("expected the plan for the newest deploy, got %+v", planReply.Plan)
+	}
+	if err := rpc.StopDeploy(StopDeployRequest{DeployId: LATEST_DEPLOY}, &StopDeployResponse{}); err != nil {
+		t.Fatalf("stop %s: %s", LATEST_DEPLOY, err)
+	}
+	if _, ok := s.config.Ports[runReply.Port]; ok || !s.portFree(runReply.Port) {
+		t.Fatalf("expected the newest deploy to be stopped")
+	}
+}
+
+func TestHealthCheckConcurrencyLimit(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	const limit = 3
+	s, err := NewServerImpl(root, false, 19000, WithHealthCheckConcurrency(limit))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}))
+	defer ts.Close()
+
+	deploys := []*Deploy{}
+	for i := 0; i < 12; i++ {
+		id := fmt.Sprintf("deploy-%d", i)
+		writeTestDeploy(t, s, id, ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+		deploys = append(deploys, &Deploy{Id: id, Port: testServerPort(t, ts)})
+	}
+	s.checkAllHealth(deploys)
+
+	for _, d := range deploys {
+		if d.Health != http.StatusOK {
+			t.Errorf("expected %s to be healthy, got %d %v", d.Id, d.Health, d.Errors)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > limit {
+		t.Errorf("expected at most %d concurrent health checks, saw %d", limit, max)
+	} else if max < 2 {
+		t.Errorf("expected health checks to run concurrently, saw %d at once", max)
+	}
+}
+
+func TestReattachAfterRestart(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "survivor", ApplicationDef{RunCmd: "true"})
+	writeTestDeploy(t, s, "casualty", ApplicationDef{RunCmd: "true"})
+
+	// Stand in for deploys started by a previous camus: one still running
+	// (though not listening), and one that exited since.
+	survivor := exec.Command("sleep", "60")
+	survivor.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := survivor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer survivor.Process.Kill()
+	exited := make(chan error, 1)
+	go func() { exited <- survivor.Wait() }()
+
+	casualty := exec.Command("true")
+	if err := casualty.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s.recordStarted("survivor", survivor.Process.Pid, 19001)
+	s.recordStarted("casualty", casualty.Process.Pid, 19002)
+	s.config.Ports[19001] = "survivor"
+	if err := s.writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl after restart: %s", err)
+	}
+	if pid, ok := restarted.trackedPid("survivor"); !ok || pid != survivor.Process.Pid {
+		t.Fatalf("expected to reattach to pid %d, got %d %t", survivor.Process.Pid, pid, ok)
+	}
+	if _, ok := restarted.trackedPid("casualty"); ok {
+		t.Errorf("expected the exited deploy to be forgotten")
+	}
+	if state, _ := restarted.readDeployState("casualty"); state.Pid != 0 {
+		t.Errorf("expected the exited deploy's pid to be cleared, got %d", state.Pid)
+	}
+
+	if err := restarted.Stop("survivor"); err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected stop to kill the reattached process")
+	}
+	if state, _ := restarted.readDeployState("survivor"); state.Pid != 0 || state.Started.IsZero() {
+		t.Errorf("expected the stopped deploy's pid to be cleared, got %+v", state)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	os.Setenv("CAMUS_TEST_APP_MODE", "fast")
+	writeTestDeploy(t, s, "effective", ApplicationDef{
+		RunCmd:     "node app.js %PORT% ${CAMUS_TEST_APP_MODE}",
+		StopSignal: "int",
+		Env:        map[string]string{"MODE": "${CAMUS_TEST_APP_MODE:-slow}"},
+	})
+
+	app, err := s.EffectiveConfig("effective")
+	if err != nil {
+		t.Fatalf("effective config: %s", err)
+	}
+	data, err := json.Marshal(app)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	var def ApplicationDef
+	if err := json.Unmarshal(data, &def); err != nil {
+		t.Fatalf("unmarshal %s: %s", data, err)
+	}
+	if def.RunCmd != "node app.js %PORT% fast" || def.Env["MODE"] != "fast" {
+		t.Errorf("expected env to be expanded, got %s", data)
+	}
+	if def.HealthEndpoint != "/" {
+		t.Errorf("expected the default health endpoint, got %s", data)
+	}
+	if def.StopSignal != "SIGINT" {
+		t.Errorf("expected the canonical stop signal, got %s", data)
+	}
+}
+
+func TestStartupLogsSummaryOnly(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+	// The port only opens on the third check.
+	var polls int32
+	s.portFree = func(port int) bool {
+		return atomic.AddInt32(&polls, 1) < 3
+	}
+	writeTestDeploy(t, s, "quiet", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	app, err := s.loadApp("quiet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	port := testServerPort(t, ts)
+	if err := s.waitForAppToStart(port, app); err != nil {
+		t.Fatalf("wait for app: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], fmt.Sprintf("port %d healthy after 3 checks", port)) {
+		t.Errorf("expected just a summary line, got:\n%s", logs.String())
+	}
+}
+
+func TestFindUnusedPortAvoidsRecentlyFreed(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.portFree = func(port int) bool { return true }
+
+	s.recordPortFreed(19001)
+	if port, err := s.findUnusedPort(context.Background(), ""); err != nil || port != 19002 {
+		t.Fatalf("expected the just freed port to be skipped for 19002, got %d (%v)", port, err)
+	}
+
+	// With nothing else free, the recently freed port is still better than
+	// nothing.
+	for port := 19002; port <= 19099; port++ {
+		s.config.Ports[port] = fmt.Sprintf("deploy-%d", port)
+	}
+	if port, err := s.findUnusedPort(context.Background(), ""); err != nil || port != 19001 {
+		t.Fatalf("expected to fall back to 19001, got %d (%v)", port, err)
+	}
+}
+
+func TestWarmupPathsRequestedAfterHealthy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	var requestsLock sync.Mutex
+	requests := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsLock.Lock()
+		requests = append(requests, r.URL.Path)
+		requestsLock.Unlock()
+		if r.URL.Path == "/broken" {
+			http.Error(w, "not warm", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "warm", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+		WarmupPaths:    []string{"/cache", "/broken", "/"},
+	})
+	app, err := s.loadApp("warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("wait for app: %s", err)
+	}
+
+	requestsLock.Lock()
+	defer requestsLock.Unlock()
+	if got := strings.Join(requests, " "); got != "/status /cache /broken /" {
+		t.Errorf("expected the health check then the warmup paths in order, got %s", got)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, id := range []string{"dead", "live-dead", "stray", "idle"} {
+		writeTestDeploy(t, s, id, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+	}
+	s.config.Ports = map[int]string{
+		19001: "gone",
+		19002: "dead",
+		19003: "live-dead",
+	}
+	s.config.Active = 19003
+	s.config.NamedPorts = map[string]map[string]int{"gone": {"metrics": 19006}}
+	if err := s.writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	// running, but on no configured port
+	if err := s.startDeployAndWaitForHealth("stray", 19004); err != nil {
+		t.Fatalf("start stray: %s", err)
+	}
+	defer s.Stop("stray")
+
+	expected := []ReconcileProblem{
+		{Kind: RECONCILE_MISSING_DEPLOY, DeployId: "gone", Port: 19001},
+		{Kind: RECONCILE_DEAD_PORT, DeployId: "dead", Port: 19002},
+		{Kind: RECONCILE_DEAD_PORT, DeployId: "live-dead", Port: 19003},
+		{Kind: RECONCILE_UNCONFIGURED_PROCESS, DeployId: "stray", Port: 19004},
+		{Kind: RECONCILE_IDLE_DEPLOY, DeployId: "idle"},
+	}
+	check := func(report ReconcileReport, fixed map[string]bool) {
+		t.Helper()
+		if len(report.Problems) != len(expected) {
+			t.Fatalf("expected %d problems, got %+v", len(expected), report.Problems)
+		}
+		for i, problem := range report.Problems {
+			want := expected[i]
+			if problem.Kind != want.Kind || problem.DeployId != want.DeployId || problem.Port != want.Port {
+				t.Errorf("problem %d: expected %+v, got %+v", i, want, problem)
+			}
+			if problem.Fixed != fixed[problem.DeployId] {
+				t.Errorf("problem %d: expected fixed %v, got %+v", i, fixed[problem.DeployId], problem)
+			}
+		}
+	}
+
+	report, err := s.Reconcile(false)
+	if err != nil {
+		t.Fatalf("reconcile: %s", err)
+	}
+	check(report, map[string]bool{})
+	if len(s.config.Ports) != 3 {
+		t.Fatalf("expected reporting alone to leave the config, got %v", s.config.Ports)
+	}
+
+	report, err = s.Reconcile(true)
+	if err != nil {
+		t.Fatalf("reconcile: %s", err)
+	}
+	// the active port is left for Enforce
+	check(report, map[string]bool{"gone": true, "dead": true, "stray": true})
+	reread, err := readConfig(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[int]string{19003: "live-dead", 19004: "stray"}; !reflect.DeepEqual(reread.Ports, expected) {
+		t.Fatalf("expected fixed ports %v, got %v", expected, reread.Ports)
+	}
+	if len(reread.NamedPorts) != 0 {
+		t.Errorf("expected the NamedPorts of the dropped deploy to go too, got %v", reread.NamedPorts)
+	}
+}
+
+func TestCompactConfig(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "kept", ApplicationDef{RunCmd: "true"})
+	// Stale entries, as read from a hand edited config.json, which
+	// writeConfig would refuse to write.
+	s.config.Ports = map[int]string{
+		19001: "kept",
+		19002: "deleted",
+		18000: "kept",
+	}
+	s.config.Reserved = map[int]string{
+		19001: "taken by a deploy since",
+		19005: "metrics",
+		20000: "out of range",
+	}
+	s.config.Active = 19002
+	s.config.Canary = &Canary{DeployId: "deleted", Weight: 10}
+	s.config.NamedPorts = map[string]map[string]int{
+		"kept":    {"admin": 19004},
+		"deleted": {"metrics": 19003},
+	}
+
+	removed, err := s.CompactConfig()
+	if err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	if len(removed.Ports) != 2 || removed.Ports[19002] != "deleted" || removed.Ports[18000] != "kept" {
+		t.Errorf("unexpected removed ports %v", removed.Ports)
+	}
+	if len(removed.Reserved) != 2 || removed.Reserved[19005] != "" {
+		t.Errorf("unexpected removed reservations %v", removed.Reserved)
+	}
+	if removed.Active != 19002 || removed.Canary == nil {
+		t.Errorf("expected the active port and canary to be removed, got %d %v",
+			removed.Active, removed.Canary)
+	}
+	if len(removed.NamedPorts) != 1 || removed.NamedPorts["deleted"]["metrics"] != 19003 {
+		t.Errorf("expected the deleted deploy's NamedPorts to be removed, got %v", removed.NamedPorts)
+	}
+
+	reread, err := readConfig(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatalf("read compacted config: %s", err)
+	}
+	if len(reread.Ports) != 1 || reread.Ports[19001] != "kept" {
+		t.Errorf("unexpected compacted ports %v", reread.Ports)
+	}
+	if len(reread.Reserved) != 1 || reread.Reserved[19005] != "metrics" {
+		t.Errorf("unexpected compacted reservations %v", reread.Reserved)
+	}
+	if reread.Active != 0 || reread.Canary != nil {
+		t.Errorf("expected no active port or canary, got %d %v", reread.Active, reread.Canary)
+	}
+	if expected := map[string]map[string]int{"kept": {"admin": 19004}}; !reflect.DeepEqual(reread.NamedPorts, expected) {
+		t.Errorf("expected compacted NamedPorts %v, got %v", expected, reread.NamedPorts)
+	}
+}
+
+func TestHealthCheckHttp2(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok over %s", r.Proto)
+	}))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	for _, http2 := range []bool{false, true} {
+		writeTestDeploy(t, s, "h2", ApplicationDef{
+			RunCmd:         "true",
+			HealthEndpoint: "/status",
+			HealthHttp2:    http2,
+		})
+		app, err := s.loadApp("h2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.testApp(testServerPort(t, ts), app)
+		if healthy := err == nil && status == http.StatusOK; healthy != http2 {
+			t.Errorf("HealthHttp2 %t: expected healthy to be %t, got status %d err %v",
+				http2, http2, status, err)
+		}
+	}
+}
+
+func TestConcurrentRunAndStop(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ids := []string{"first", "second", "third"}
+	for _, id := range ids {
+		writeTestDeploy(t, s, id, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+	}
+	// in case a failure leaves any running
+	defer func() {
+		for _, id := range ids {
+			s.Stop(id)
+		}
+	}()
+
+	// Run and Stop on one deploy at once: whichever goes first, the other
+	// sees the result, so the deploy ends up either running on its port or
+	// not configured at all.
+	var wg sync.WaitGroup
+	var runErr, stopErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, runErr = s.Run("first")
+	}()
+	go func() {
+		defer wg.Done()
+		stopErr = s.Stop("first")
+	}()
+	wg.Wait()
+	if runErr != nil {
+		t.Fatalf("run: %s", runErr)
+	}
+	s.configLock.Lock()
+	port := s.lookupConfiguredPort("first")
+	s.configLock.Unlock()
+	if stopErr == nil && port != 0 {
+		t.Errorf("stop succeeded but first is still configured on %d", port)
+	} else if stopErr != nil && port == 0 {
+		t.Errorf("stop failed (%s) but first isn't configured", stopErr)
+	}
+	if port != 0 {
+		if err := s.Stop("first"); err != nil {
+			t.Fatalf("stop: %s", err)
+		}
+	}
+
+	// Different deploys run at once, each on its own port.
+	ports := make([]int, len(ids))
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			ports[i], errs[i] = s.Run(id)
+		}(i, id)
+	}
+	wg.Wait()
+	seen := map[int]bool{}
+	for i, id := range ids {
+		if errs[i] != nil {
+			t.Fatalf("run %s: %s", id, errs[i])
+		}
+		if seen[ports[i]] {
+			t.Errorf("%s was given port %d, which is already used", id, ports[i])
+		}
+		seen[ports[i]] = true
+	}
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = s.Stop(id)
+		}(i, id)
+	}
+	wg.Wait()
+	for i, id := range ids {
+		if errs[i] != nil {
+			t.Errorf("stop %s: %s", id, errs[i])
+		}
+	}
+}
+
+func TestFindUnusedPortRetriesTransientlyBusyPort(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// 19001 is busy for its first two checks, as if in TIME_WAIT.
+	newServer := func(opts ...ServerOption) *ServerImpl {
+		s, err := NewServerImpl(root, false, 19000, opts...)
+		if err != nil {
+			t.Fatalf("NewServerImpl: %s", err)
+		}
+		checks := 0
+		s.portFree = func(port int) bool {
+			if port == 19001 {
+				checks++
+				return checks > 2
+			}
+			return true
+		}
+		return s
+	}
+
+	s := newServer(WithDebug(true))
+	if port, err := s.findUnusedPort(context.Background(), ""); err != nil || port != 19002 {
+		t.Fatalf("expected busy 19001 to be skipped without retries, got %d (%v)", port, err)
+	}
+	if !strings.Contains(logs.String(), "skipping port 19001: in use after 1 checks") {
+		t.Errorf("expected the skipped port to be logged, got:\n%s", logs.String())
+	}
+
+	s = newServer(WithPortCheckRetry(3, time.Millisecond, time.Second))
+	if port, err := s.findUnusedPort(context.Background(), ""); err != nil || port != 19001 {
+		t.Fatalf("expected 19001 once it became free, got %d (%v)", port, err)
+	}
+
+	// The overall timeout still applies while retrying.
+	s = newServer(WithPortCheckRetry(1000, 10*time.Millisecond, 50*time.Millisecond))
+	s.portFree = func(port int) bool { return false }
+	if _, err := s.findUnusedPort(context.Background(), ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the search to time out, got %v", err)
+	}
+}
+
+func TestSecretsPassedOnFds(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	if err := os.MkdirAll(path.Join(root, secretsDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.secretFile("db-password"), []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestDeploy(t, s, "secretive", ApplicationDef{
+		RunCmd:          helperRunCmd("secret"),
+		HealthEndpoint:  "/status",
+		HealthBodyMatch: "^hunter2$",
+		Secrets:         []string{"db-password"},
+	})
+
+	// Only healthy if the helper read the secret from fd 3.
+	if _, err := s.Run("secretive"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	defer s.Stop("secretive")
+
+	_, cmd, err := s.commandForDeploy("secretive", 19050, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closePipes(cmd)
+	for _, env := range cmd.Env {
+		if strings.Contains(env, "hunter2") {
+			t.Errorf("secret leaked into the environment: %s", env)
+		}
+	}
+
+	writeTestDeploy(t, s, "missing-secret", ApplicationDef{
+		RunCmd:  helperRunCmd("secret"),
+		Secrets: []string{"api-key"},
+	})
+	if _, err := s.Run("missing-secret"); err == nil || !strings.Contains(err.Error(), "api-key") {
+		t.Errorf("expected a missing secret to fail the run, got %v", err)
+	}
+	writeTestDeploy(t, s, "sneaky", ApplicationDef{
+		RunCmd:  helperRunCmd("secret"),
+		Secrets: []string{"../config.json"},
+	})
+	if _, err := s.Run("sneaky"); err == nil {
+		t.Errorf("expected a secret outside the secrets dir to be rejected")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "templated", ApplicationDef{
+		RunCmd:         helperRunCmd("readfile"),
+		HealthEndpoint: "/status",
+		Env:            map[string]string{"CAMUS_TEST_READ_FILE": "conf/app.conf", "GREETING": "hello"},
+		Templates:      []TemplateFile{{Source: "app.conf.tmpl", Dest: "conf/app.conf"}},
+	})
+	source := path.Join(s.deployDir("templated"), "app.conf.tmpl")
+	tmpl := "deploy={{.DeployId}} port={{.Port}} greeting={{.Env.GREETING}}"
+	if err := ioutil.WriteFile(source, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The helper only reads the file once, as it starts.
+	port, err := s.Run("templated")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	defer s.Stop("templated")
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/status", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if expected := fmt.Sprintf("deploy=templated port=%d greeting=hello", port); string(body) != expected {
+		t.Errorf("expected the app to read %q, got %q", expected, body)
+	}
+
+	if err := ioutil.WriteFile(source, []byte("{{.Env.MISSING}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.commandForDeploy("templated", 19050, nil); err == nil || !strings.Contains(err.Error(), "app.conf.tmpl") {
+		t.Errorf("expected a missing key to fail rendering, got %v", err)
+	}
+
+	writeTestDeploy(t, s, "escaping", ApplicationDef{
+		RunCmd:    "true",
+		Templates: []TemplateFile{{Source: "app.conf.tmpl", Dest: "../app.conf"}},
+	})
+	if _, err := s.loadApp("escaping"); err == nil {
+		t.Errorf("expected a Dest outside the deploy dir to be rejected")
+	}
+}
+
+func TestDefaultHealthEndpoint(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	configFile := path.Join(root, serverConfigFileName)
+	if err := ioutil.WriteFile(configFile, []byte(`{"DefaultHealthEndpoint": "/healthz"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "conventional", ApplicationDef{RunCmd: "true"})
+	writeTestDeploy(t, s, "unusual", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+
+	for id, expected := range map[string]string{"conventional": "/healthz", "unusual": "/status"} {
+		app, err := s.loadApp(id)
+		if err != nil {
+			t.Fatalf("load %s: %s", id, err)
+		}
+		if app.HealthEndpoint() != expected {
+			t.Errorf("expected %s to use %s, got %s", id, expected, app.HealthEndpoint())
+		}
+	}
+
+	// The default survives the config being rewritten.
+	if err := s.ReservePort(19050, "metrics"); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DefaultHealthEndpoint != "/healthz" {
+		t.Errorf("expected the default to be kept, got %q", config.DefaultHealthEndpoint)
+	}
+}
+
+func TestEnforceQuarantinesCrashingDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 300 * time.Millisecond
+
+	s, err := NewServerImpl(root, false, 19000, WithQuarantineThreshold(2))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "crashy", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	s.config.Ports[19001] = "crashy"
+
+	s.Enforce()
+	state, _ := s.readDeployState("crashy")
+	if state.Failures != 1 || state.Quarantine != nil {
+		t.Fatalf("expected one failure and no quarantine yet, got %+v", state)
+	}
+	s.Enforce()
+	state, _ = s.readDeployState("crashy")
+	if state.Quarantine == nil {
+		t.Fatalf("expected the deploy to be quarantined after 2 failures, got %+v", state)
+	}
+	if _, ok := s.config.Ports[19001]; ok {
+		t.Fatalf("expected the quarantined deploy's port to be freed, got %v", s.config.Ports)
+	}
+	if _, err := s.Run("crashy"); err == nil {
+		t.Fatalf("expected running a quarantined deploy to fail")
+	}
+
+	if err := s.ClearQuarantine("crashy"); err != nil {
+		t.Fatalf("clear quarantine: %s", err)
+	}
+	writeTestDeploy(t, s, "crashy", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	defer s.Stop("crashy")
+	if _, err := s.Run("crashy"); err != nil {
+		t.Fatalf("expected the deploy to run once cleared: %s", err)
+	}
+	if err := s.ClearQuarantine("crashy"); err == nil {
+		t.Fatalf("expected clearing a deploy that isn't quarantined to fail")
+	}
+}
+
+func TestPauseSupervision(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "paused", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	// configured but not running, as though it had crashed
+	s.config.Ports[19001] = "paused"
+
+	if err := s.PauseSupervision("paused"); err != nil {
+		t.Fatalf("pause: %s", err)
+	}
+	s.Enforce()
+	if !portFree(19001) {
+		s.Stop("paused")
+		t.Fatalf("expected a paused deploy not to be restarted")
+	}
+	state, _ := s.readDeployState("paused")
+	if state.SupervisionPaused.IsZero() {
+		t.Fatalf("expected the pause in the deploy's state, got %+v", state)
+	}
+
+	if err := s.ResumeSupervision("paused"); err != nil {
+		t.Fatalf("resume: %s", err)
+	}
+	defer s.Stop("paused")
+	s.Enforce()
+	if portFree(19001) {
+		t.Fatalf("expected the deploy to be restarted once resumed")
+	}
+	if err := s.ResumeSupervision("paused"); err == nil {
+		t.Fatalf("expected resuming a deploy that isn't paused to fail")
+	}
+}
+
+func TestDiffDeploys(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "current", ApplicationDef{
+		RunCmd: "./server %PORT%",
+		Env:    map[string]string{"NODE_ENV": "production", "WORKERS": "4"},
+	})
+	writeTestDeploy(t, s, "candidate", ApplicationDef{
+		RunCmd: "./server %PORT%",
+		Env:    map[string]string{"NODE_ENV": "staging", "WORKERS": "4"},
+	})
+	if err := ioutil.WriteFile(path.Join(s.deployDir("candidate"), "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := s.DiffDeploys("current", "candidate")
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	expected := []FieldDiff{{"Env.NODE_ENV", `"production"`, `"staging"`}}
+	if !reflect.DeepEqual(diff.Config, expected) || diff.Files != nil {
+		t.Fatalf("expected only the env change %v, got %+v", expected, diff)
+	}
+
+	diff, err = s.DiffDeploysWithFiles("current", "candidate")
+	if err != nil {
+		t.Fatalf("diff with files: %s", err)
+	}
+	expectedFiles := []FileDiff{{"deploy.json", "modified"}, {"new.txt", "added"}}
+	if !reflect.DeepEqual(diff.Files, expectedFiles) {
+		t.Fatalf("expected file changes %v, got %v", expectedFiles, diff.Files)
+	}
+}
+
+func TestHealthTimeout(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_HEALTH_CHECK_TIME = old }(MAX_HEALTH_CHECK_TIME)
+	MAX_HEALTH_CHECK_TIME = 100 * time.Millisecond
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	for _, timeoutMs := range []int{0, 1000} {
+		writeTestDeploy(t, s, "slow", ApplicationDef{
+			RunCmd:          "true",
+			HealthEndpoint:  "/status",
+			HealthTimeoutMs: timeoutMs,
+		})
+		app, err := s.loadApp("slow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.testApp(testServerPort(t, ts), app)
+		if healthy := err == nil && status == http.StatusOK; healthy != (timeoutMs > 0) {
+			t.Errorf("HealthTimeoutMs %d: expected healthy to be %t, got status %d err %v",
+				timeoutMs, timeoutMs > 0, status, err)
+		}
+	}
+
+	for _, timeoutMs := range []int{-1, int(MAX_STARTUP_TIME/time.Millisecond) + 1} {
+		writeTestDeploy(t, s, "invalid", ApplicationDef{RunCmd: "true", HealthTimeoutMs: timeoutMs})
+		if _, err := s.loadApp("invalid"); err == nil {
+			t.Errorf("expected HealthTimeoutMs %d to be rejected", timeoutMs)
+		}
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	var firstCheck atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		firstCheck.CompareAndSwap(nil, time.Now())
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "heavy", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+		StartupDelayMs: 300,
+	})
+	app, err := s.loadApp("heavy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("wait for app: %s", err)
+	}
+	if waited := firstCheck.Load().(time.Time).Sub(start); waited < 300*time.Millisecond {
+		t.Fatalf("expected no health checks during the 300ms delay, first came after %s", waited)
+	}
+}
+
+func TestRunDeadConfiguredPort(t *testing.T) {
+	for _, policy := range []string{"", DEAD_PORT_RESTART, DEAD_PORT_FAIL, DEAD_PORT_EXISTING} {
+		t.Run("policy="+policy, func(t *testing.T) {
+			root := createTestRoot(t)
+			defer os.RemoveAll(root)
+
+			config := fmt.Sprintf(`{"Ports": {"19001": "dead"}, "DeadPortPolicy": %q}`, policy)
+			if err := ioutil.WriteFile(path.Join(root, serverConfigFileName), []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewServerImpl(root, false, 19000)
+			if err != nil {
+				t.Fatalf("NewServerImpl: %s", err)
+			}
+			writeTestDeploy(t, s, "dead", ApplicationDef{
+				RunCmd:         helperRunCmd("serve"),
+				HealthEndpoint: "/status",
+			})
+			defer s.Stop("dead")
+
+			port, err := s.Run("dead")
+			switch policy {
+			case "", DEAD_PORT_RESTART:
+				if port != 19001 || err != nil || s.portFree(19001) {
+					t.Fatalf("expected a restart on 19001, got (%d, %v)", port, err)
+				}
+				if _, err := s.Run("dead"); err == nil {
+					t.Fatalf("expected running it again while it's alive to fail")
+				}
+			case DEAD_PORT_FAIL:
+				if err == nil {
+					t.Fatalf("expected an error, got port %d", port)
+				}
+			case DEAD_PORT_EXISTING:
+				if port != 19001 || err != nil || !s.portFree(19001) {
+					t.Fatalf("expected 19001 to be returned without starting anything, got (%d, %v)", port, err)
+				}
+			}
+			if s.config.Ports[19001] != "dead" || len(s.config.Ports) != 1 {
+				t.Fatalf("expected the config to be unchanged, got %v", s.config.Ports)
+			}
+		})
+	}
+}
+
+func TestHealthMaxLatency(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	for maxLatencyMs, healthy := range map[int]bool{0: true, 50: false, 1000: true} {
+		writeTestDeploy(t, s, "sluggish", ApplicationDef{
+			RunCmd:             "true",
+			HealthEndpoint:     "/status",
+			HealthMaxLatencyMs: maxLatencyMs,
+		})
+		app, err := s.loadApp("sluggish")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.testApp(testServerPort(t, ts), app)
+		if ok := err == nil && status == http.StatusOK; ok != healthy {
+			t.Errorf("HealthMaxLatencyMs %d: expected healthy to be %t, got status %d err %v",
+				maxLatencyMs, healthy, status, err)
+		}
+	}
+
+	deploy := &Deploy{Id: "sluggish", Port: testServerPort(t, ts)}
+	s.checkHealth(deploy)
+	if deploy.HealthLatency < 100*time.Millisecond {
+		t.Errorf("expected the observed latency to be recorded, got %s", deploy.HealthLatency)
+	}
+}
+
+func TestSmokeTest(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	before := []byte(`{"Reserved": {"19001": "metrics"}}`)
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName), before, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "candidate", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+
+	result, err := s.SmokeTest("candidate")
+	if err != nil {
+		t.Fatalf("smoke test: %s", err)
+	}
+	if !result.Healthy || result.Port == 0 {
+		t.Fatalf("expected a healthy result, got %+v", result)
+	}
+	if !s.portFree(result.Port) {
+		t.Fatalf("expected the app on %d to be stopped", result.Port)
+	}
+	after, err := ioutil.ReadFile(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) || len(s.config.Ports) != 0 || len(s.smokePorts) != 0 {
+		t.Fatalf("expected the config to be unchanged, got %s and ports %v", after, s.config.Ports)
+	}
+
+	writeTestDeploy(t, s, "broken", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 200 * time.Millisecond
+	if result, err := s.SmokeTest("broken"); err != nil || result.Healthy || result.Error == "" {
+		t.Fatalf("expected an unhealthy result, got %+v, %v", result, err)
+	}
+}
+
+func TestRunShellAndArgv(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	for _, test := range []struct {
+		def      ApplicationDef
+		expected []string
+	}{
+		{ApplicationDef{RunCmd: "echo %PORT%"}, []string{"sh", "-c", "echo 19001"}},
+		{ApplicationDef{RunCmd: "echo %PORT%", Shell: []string{"bash", "-c"}}, []string{"bash", "-c", "echo 19001"}},
+		{ApplicationDef{RunArgv: []string{"echo", "--port=%PORT%"}}, []string{"echo", "--port=19001"}},
+	} {
+		writeTestDeploy(t, s, "shell", test.def)
+		_, cmd, err := s.commandForDeploy("shell", 19001, nil)
+		if err != nil {
+			t.Fatalf("%+v: %s", test.def, err)
+		}
+		if !reflect.DeepEqual(cmd.Args, test.expected) {
+			t.Errorf("%+v: expected %q, got %q", test.def, test.expected, cmd.Args)
+		}
+	}
+
+	for _, def := range []ApplicationDef{
+		{RunCmd: "echo", Shell: []string{"/nonexistent/sh", "-c"}},
+		{RunArgv: []string{"./missing-server"}},
+		{RunArgv: []string{"echo"}, RunCmd: "echo"},
+	} {
+		writeTestDeploy(t, s, "invalid", def)
+		if _, _, err := s.commandForDeploy("invalid", 19001, nil); err == nil {
+			t.Errorf("%+v: expected an error", def)
+		}
+	}
+
+	// Run straight from argv, with no shell to set the helper's environment.
+	writeTestDeploy(t, s, "direct", ApplicationDef{
+		RunArgv:        []string{os.Args[0], "-test.run=TestHelperProcess", "--", "serve", "%PORT%"},
+		Env:            map[string]string{"CAMUS_TEST_HELPER": "1"},
+		HealthEndpoint: "/status",
+	})
+	defer s.Stop("direct")
+	if _, err := s.Run("direct"); err != nil {
+		t.Fatalf("run without a shell: %s", err)
+	}
+}
+
+func TestWaitUntilHealthy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	var readyAt atomic.Value
+	readyAt.Store(time.Now().Add(300 * time.Millisecond))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(readyAt.Load().(time.Time)) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "ci", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	if health, err := s.WaitUntilHealthy("ci", 50*time.Millisecond); err == nil {
+		t.Fatalf("expected a deploy that isn't on a port to time out, got %d", health)
+	}
+
+	s.configLock.Lock()
+	s.config.Ports[testServerPort(t, ts)] = "ci"
+	s.configLock.Unlock()
+	health, err := s.WaitUntilHealthy("ci", 5*time.Second)
+	if health != http.StatusOK || err != nil {
+		t.Fatalf("expected the deploy to become healthy, got (%d, %v)", health, err)
+	}
+	if late := time.Since(readyAt.Load().(time.Time)); late > 2*STARTUP_HEALTH_CHECK_INTERVAL {
+		t.Fatalf("expected to return soon after the deploy was healthy, took %s", late)
+	}
+}
+
+func TestHealthHeaders(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// The app returns 200 straight away, but only says it's ready in a
+	// header once it is.
+	var readyAt atomic.Value
+	readyAt.Store(time.Now().Add(250 * time.Millisecond))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(readyAt.Load().(time.Time)) {
+			w.Header().Set("X-Health", "starting")
+		} else {
+			w.Header().Set("X-Health", "ok")
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "headed", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+		HealthHeaders:  map[string]string{"X-Health": "ok"},
+	})
+	app, err := s.loadApp("headed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.testApp(testServerPort(t, ts), app); err == nil {
+		t.Fatalf("expected the wrong header to fail the health check")
+	}
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("wait for app: %s", err)
+	}
+	if time.Now().Before(readyAt.Load().(time.Time)) {
+		t.Fatalf("expected the app to only count as started once the header was ok")
+	}
+}
+
+func TestRenameDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "bold-paris-2024-01-02-03-04-05", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+		NamedPorts:     []string{"metrics"},
+	})
+	writeTestDeploy(t, s, "taken", ApplicationDef{RunCmd: "true"})
+	oldId := "bold-paris-2024-01-02-03-04-05"
+	if err := s.SetTag(oldId, "commit", "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordChecksums(oldId); err != nil {
+		t.Fatal(err)
+	}
+	port, err := s.Run(oldId)
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if err := s.RenameDeploy(oldId, "checkout-v2"); err == nil {
+		t.Fatalf("expected renaming a running deploy to fail")
+	}
+	for _, invalid := range []string{"taken", "../escape", "_latest", ""} {
+		if err := s.ForceRenameDeploy(oldId, invalid); err == nil {
+			t.Errorf("expected renaming to %q to fail", invalid)
+		}
+	}
+	if err := s.ForceRenameDeploy(oldId, "checkout-v2"); err != nil {
+		t.Fatalf("forced rename: %s", err)
+	}
+	defer s.Stop("checkout-v2")
+
+	if s.config.Ports[port] != "checkout-v2" {
+		t.Errorf("expected port %d to be configured for the new id, got %v", port, s.config.Ports)
+	}
+	config, err := readConfig(path.Join(root, serverConfigFileName))
+	if err != nil || config.Ports[port] != "checkout-v2" {
+		t.Errorf("expected the written config to have the new id, got %v (%v)", config.Ports, err)
+	}
+	if _, ok := config.NamedPorts[oldId]; ok || config.NamedPorts["checkout-v2"]["metrics"] == 0 {
+		t.Errorf("expected the NamedPorts to follow the deploy, got %v", config.NamedPorts)
+	}
+	if s.deployExists(oldId) || !s.deployExists("checkout-v2") {
+		t.Errorf("expected the deploy dir to be moved")
+	}
+	if tags, err := s.GetTags("checkout-v2"); err != nil || tags["commit"] != "abc123" {
+		t.Errorf("expected the tags to follow the deploy, got %v (%v)", tags, err)
+	}
+	if err := s.VerifyChecksums("checkout-v2"); err != nil {
+		t.Errorf("expected the checksums to follow the deploy: %s", err)
+	}
+	if state, err := s.readDeployState("checkout-v2"); err != nil || state.Port != port {
+		t.Errorf("expected the state to follow the deploy, got %+v (%v)", state, err)
+	}
+	if err := s.Stop("checkout-v2"); err != nil {
+		t.Errorf("expected the renamed deploy to be stoppable by its new id: %s", err)
+	}
+}
+
+func TestManifestFileName(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	configFile := path.Join(root, serverConfigFileName)
+	if err := ioutil.WriteFile(configFile, []byte(`{"ManifestFileName": "app.json"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	if err := os.MkdirAll(s.deployDir("renamed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&ApplicationDef{RunCmd: helperRunCmd("serve"), HealthEndpoint: "/status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(s.deployDir("renamed"), "app.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Run("renamed"); err != nil {
+		t.Fatalf("expected the deploy to run from app.json: %s", err)
+	}
+	if err := s.Stop("renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte(`{"ManifestFileName": "../app.json"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(configFile); err == nil {
+		t.Fatalf("expected a manifest outside the deploy dir to be rejected")
+	}
+}
+
+func TestEnforceCircuitBreaker(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 100 * time.Millisecond
+
+	s, err := NewServerImpl(root, false, 19000,
+		WithQuarantineThreshold(0),
+		WithCircuitBreaker(2, time.Minute, 300*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "flappy", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	s.config.Ports[19001] = "flappy"
+	failures := func() int {
+		state, _ := s.readDeployState("flappy")
+		return state.Failures
+	}
+
+	s.Enforce()
+	if s.breakerState("flappy") != BREAKER_CLOSED {
+		t.Fatalf("expected one failure not to open the breaker")
+	}
+	s.Enforce()
+	if s.breakerState("flappy") != BREAKER_OPEN {
+		t.Fatalf("expected two failures to open the breaker, got %s", s.breakerState("flappy"))
+	}
+	s.Enforce()
+	if failures() != 2 {
+		t.Fatalf("expected no start while the breaker is open, got %d failures", failures())
+	}
+
+	// A failed retry once the cooldown is over opens it again.
+	time.Sleep(300 * time.Millisecond)
+	if s.breakerState("flappy") != BREAKER_HALF_OPEN {
+		t.Fatalf("expected the breaker to be half open after the cooldown, got %s", s.breakerState("flappy"))
+	}
+	s.Enforce()
+	if s.breakerState("flappy") != BREAKER_OPEN || failures() != 3 {
+		t.Fatalf("expected the failed retry to reopen the breaker, got %s", s.breakerState("flappy"))
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	writeTestDeploy(t, s, "flappy", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	MAX_STARTUP_TIME = 5 * time.Second
+	defer s.Stop("flappy")
+	s.Enforce()
+	if s.breakerState("flappy") != BREAKER_CLOSED || failures() != 0 {
+		t.Fatalf("expected a successful retry to close the breaker, got %s", s.breakerState("flappy"))
+	}
+	deploys, err := s.ListDeploys()
+	if err != nil || len(deploys) != 1 || deploys[0].Breaker != BREAKER_CLOSED {
+		t.Fatalf("expected ListDeploys to report the breaker, got %+v (%v)", deploys, err)
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000, WithVerifyChecksums(true))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "monitored", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	if err := s.RecordChecksums("monitored"); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := path.Join(s.deployDir("monitored"), deployPidFileName)
+
+	// Run twice, as the pid file mustn't stop the checksums matching.
+	for i := 0; i < 2; i++ {
+		if _, err := s.Run("monitored"); err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		defer s.Stop("monitored")
+		pid, err := readPid(pidFile)
+		if err != nil {
+			t.Fatalf("read pid file: %s", err)
+		}
+		if tracked, _ := s.trackedPid("monitored"); pid != tracked {
+			t.Fatalf("expected the pid file to have %d, got %d", tracked, pid)
+		}
+		if err := s.Stop("monitored"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Fatalf("expected the pid file to be removed by Stop, got %v", err)
+		}
+	}
+}
+
+func TestHealthBasePath(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	requested := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.Path
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "prefixed", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/healthz",
+		HealthBasePath: "/app1/",
+	})
+	app, err := s.loadApp("prefixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.testApp(testServerPort(t, ts), app); err != nil {
+		t.Fatal(err)
+	}
+	if path := <-requested; path != "/app1/healthz" {
+		t.Fatalf("expected /app1/healthz to be requested, got %s", path)
+	}
+
+	writeTestDeploy(t, s, "invalid", ApplicationDef{RunCmd: "true", HealthBasePath: "app1"})
+	if _, err := s.loadApp("invalid"); err == nil {
+		t.Fatalf("expected a base path without a leading / to be rejected")
+	}
+}
+
+func TestPortMap(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	listening := map[int]bool{19001: true, 19004: true}
+	s.portFree = func(port int) bool { return !listening[port] }
+	s.config.Ports[19001] = "up"
+	s.config.Ports[19002] = "crashed"
+	if err := s.ReservePort(19003, "metrics"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.PortMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Start != 19001 || report.End != 19099 || len(report.Ports) != 99 {
+		t.Fatalf("expected the whole range, got %d-%d with %d ports", report.Start, report.End, len(report.Ports))
+	}
+	expected := []PortInfo{
+		{Port: 19001, Use: PORT_ALLOCATED, DeployId: "up", Listening: true},
+		{Port: 19002, Use: PORT_ALLOCATED, DeployId: "crashed"},
+		{Port: 19003, Use: PORT_RESERVED, Note: "metrics"},
+		{Port: 19004, Use: PORT_BUSY, Listening: true},
+		{Port: 19005, Use: PORT_FREE},
+	}
+	if !reflect.DeepEqual(report.Ports[:5], expected) {
+		t.Errorf("expected %+v, got %+v", expected, report.Ports[:5])
+	}
+	if !reflect.DeepEqual(report.NotListening, []int{19002}) {
+		t.Errorf("expected only 19002 to be flagged as not listening, got %v", report.NotListening)
+	}
+}
+
+func TestPortUtilization(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.config.Ports = map[int]string{
+		19001: "first",
+		19002: "second",
+		19050: "third",
+		18000: "out of range",
+	}
+	s.config.Reserved = map[int]string{
+		19003: "metrics",
+		19002: "reserved since",
+	}
+
+	usage := s.PortUtilization()
+	expected := PortUsage{Total: 99, Allocated: 3, Reserved: 1, Free: 95, Utilization: 400.0 / 99}
+	if usage != expected {
+		t.Fatalf("expected %+v, got %+v", expected, usage)
+	}
+}
+
+func TestAvailablePortCount(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// Everything but 19050, 19060 and 19070 is configured.
+	for port := s.startPort; port <= s.endPort; port++ {
+		if port != 19050 && port != 19060 && port != 19070 {
+			s.config.Ports[port] = fmt.Sprintf("deploy%d", port)
+		}
+	}
+	s.config.Reserved = map[int]string{19060: "metrics"}
+	// Something else is listening on 19070.
+	s.portFree = func(port int) bool { return port != 19070 }
+
+	count, err := s.AvailablePortCount()
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 available port, got %d, %v", count, err)
+	}
+	if ok, err := s.HasFreePort(); err != nil || !ok {
+		t.Fatalf("expected a free port, got %v, %v", ok, err)
+	}
+	if _, ok := s.config.Ports[19050]; ok {
+		t.Fatalf("expected checking not to allocate the port")
+	}
+
+	s.config.Ports[19050] = "last"
+	count, err = s.AvailablePortCount()
+	if err != nil || count != 0 {
+		t.Fatalf("expected no available ports, got %d, %v", count, err)
+	}
+	if ok, err := s.HasFreePort(); err != nil || ok {
+		t.Fatalf("expected no free port, got %v, %v", ok, err)
+	}
+}
+
+func TestStabilizationCatchesFlap(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// Healthy for the first check, then briefly not, then fine.
+	var checks int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&checks, 1); n == 2 || n == 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	for _, stabilizationMs := range []int{0, 300} {
+		atomic.StoreInt32(&checks, 0)
+		writeTestDeploy(t, s, "flappy", ApplicationDef{
+			RunCmd:          "true",
+			HealthEndpoint:  "/status",
+			StabilizationMs: stabilizationMs,
+		})
+		app, err := s.loadApp("flappy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.waitForAppToStart(testServerPort(t, ts), app)
+		if caught := err != nil; caught != (stabilizationMs > 0) {
+			t.Errorf("StabilizationMs %d: expected the flap to be caught to be %t, got %v",
+				stabilizationMs, stabilizationMs > 0, err)
+		}
+	}
+}
+
+func TestStartupCriteria(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "fleeting", ApplicationDef{
+		RunCmd:         helperRunCmd("once"),
+		HealthEndpoint: "/status",
+	})
+	if _, err := s.Run("fleeting"); err == nil || !strings.Contains(err.Error(), "passed its health check") {
+		s.Stop("fleeting")
+		t.Fatalf("expected an app that exits after one health check to fail to start, got %v", err)
+	}
+	if state, _ := s.readDeployState("fleeting"); state.Lifecycle == LIFECYCLE_RUNNING {
+		t.Errorf("expected fleeting not to be running")
+	}
+
+	writeTestDeploy(t, s, "trusting", ApplicationDef{
+		RunCmd:          helperRunCmd("once"),
+		HealthEndpoint:  "/status",
+		StartupCriteria: STARTUP_CRITERIA_HEALTHY,
+	})
+	if _, err := s.Run("trusting"); err != nil {
+		t.Errorf("expected the health check to be enough, got %s", err)
+	}
+	s.Stop("trusting")
+
+	// A RunCmd that backgrounds the app and exits still starts.
+	writeTestDeploy(t, s, "backgrounded", ApplicationDef{
+		RunCmd:         helperRunCmd("serve") + " & exit 0",
+		HealthEndpoint: "/status",
+	})
+	port, err := s.Run("backgrounded")
+	if err != nil {
+		t.Errorf("expected a backgrounded app to start, got %s", err)
+	}
+	s.Stop("backgrounded")
+	for !portFree(port) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRandomPortStrategy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	configFile := path.Join(root, serverConfigFileName)
+	if err := ioutil.WriteFile(configFile, []byte(`{"PortStrategy": "random"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.portFree = func(port int) bool { return true }
+
+	seen := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		port, err := s.findUnusedPort(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port < s.startPort || port > s.endPort {
+			t.Fatalf("expected a port in range, got %d", port)
+		}
+		seen[port] = true
+		s.unholdPort(port)
+	}
+	if len(seen) == 1 {
+		t.Fatalf("expected random ports, always got %v", seen)
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte(`{"PortStrategy": "highest"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(configFile); err == nil {
+		t.Fatalf("expected an unknown strategy to be rejected")
+	}
+}
+
+func TestLifecycleThroughGracefulStop(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "draining", ApplicationDef{
+		RunCmd:         helperRunCmd("drain"),
+		HealthEndpoint: "/status",
+	})
+	lifecycle := func() string {
+		state, err := s.readDeployState("draining")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.Lifecycle
+	}
+
+	if _, err := s.Run("draining"); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	defer s.Stop("draining")
+	if lifecycle() != LIFECYCLE_RUNNING {
+		t.Fatalf("expected the deploy to be running, got %q", lifecycle())
+	}
+	stopped := time.Now()
+	if err := s.Stop("draining"); err != nil {
+		t.Fatal(err)
+	}
+	if lifecycle() != LIFECYCLE_DRAINING {
+		t.Fatalf("expected the deploy to be draining straight after Stop, got %q", lifecycle())
+	}
+	for lifecycle() != LIFECYCLE_STOPPED {
+		if time.Since(stopped) > 5*time.Second {
+			t.Fatalf("expected the deploy to be stopped once it exited, still %q", lifecycle())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if drained := time.Since(stopped); drained < 300*time.Millisecond {
+		t.Fatalf("expected it to be draining until it exited, stopped after %s", drained)
+	}
+}
+
+func TestPortEnv(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, portEnv := range []string{"", "APP_PORT"} {
+		expected := portEnv
+		if expected == "" {
+			expected = "PORT"
+		}
+		writeTestDeploy(t, s, "envport", ApplicationDef{
+			RunCmd:         helperRunCmd("envport"),
+			HealthEndpoint: "/status",
+			Env:            map[string]string{"CAMUS_TEST_PORT_ENV": expected, "PORT": "1"},
+			PortEnv:        portEnv,
+		})
+		port, err := s.Run("envport")
+		if err != nil {
+			t.Fatalf("PortEnv %q: expected the app to listen on the port from %s: %s", portEnv, expected, err)
+		}
+		defer s.Stop("envport")
+		if s.portFree(port) {
+			t.Fatalf("PortEnv %q: expected the app to be on %d", portEnv, port)
+		}
+		if err := s.Stop("envport"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPreferredPort(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	occupied, err := net.Listen("tcp", "127.0.0.1:19005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	writeTestDeploy(t, s, "strict", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+		PreferredPort:  19005,
+	})
+	if _, err := s.Run("strict"); err == nil || !strings.Contains(err.Error(), "Preferred port 19005 is in use") {
+		t.Fatalf("expected a strict deploy to fail with its preferred port taken, got %v", err)
+	}
+	if port := s.lookupConfiguredPort("strict"); port != 0 {
+		t.Fatalf("expected the failed deploy not to be configured, got port %d", port)
+	}
+
+	writeTestDeploy(t, s, "dynamic", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+		PreferredPort:  19005,
+		PortFallback:   PORT_FALLBACK_DYNAMIC,
+	})
+	port, err := s.Run("dynamic")
+	if err != nil {
+		t.Fatalf("expected a dynamic deploy to fall back to another port: %s", err)
+	}
+	defer s.Stop("dynamic")
+	if port == 19005 {
+		t.Fatalf("expected a port other than the taken one")
+	}
+
+	occupied.Close()
+	port, err = s.Run("strict")
+	if err != nil {
+		t.Fatalf("expected the deploy to run once its preferred port is free: %s", err)
+	}
+	defer s.Stop("strict")
+	if port != 19005 {
+		t.Fatalf("expected the preferred port 19005, got %d", port)
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "migrate", ApplicationDef{Type: DEPLOY_TYPE_JOB, RunCmd: "touch migrated"})
+	writeTestDeploy(t, s, "broken", ApplicationDef{Type: DEPLOY_TYPE_JOB, RunCmd: "exit 4"})
+
+	port, err := s.Run("migrate")
+	if err != nil || port != 0 {
+		t.Fatalf("expected the job to succeed on no port, got %d, %v", port, err)
+	}
+	if _, err := os.Stat(path.Join(s.deployDir("migrate"), "migrated")); err != nil {
+		t.Fatalf("expected the job to have run to completion: %s", err)
+	}
+	if len(s.config.Ports) != 0 {
+		t.Fatalf("expected a job not to be configured on a port, got %v", s.config.Ports)
+	}
+	state, _ := s.readDeployState("migrate")
+	if state.LastJob == nil || state.LastJob.ExitCode != 0 || state.LastJob.Error != "" {
+		t.Fatalf("expected the job's result in its state, got %+v", state.LastJob)
+	}
+
+	result, err := s.RunJob("broken")
+	if err != nil {
+		t.Fatalf("run job: %s", err)
+	}
+	if result.ExitCode != 4 || result.Error == "" {
+		t.Fatalf("expected exit code 4, got %+v", result)
+	}
+	if _, err := s.Run("broken"); err == nil || !strings.Contains(err.Error(), "exit status 4") {
+		t.Fatalf("expected Run to report the failed job, got %v", err)
+	}
+
+	writeTestDeploy(t, s, "service", ApplicationDef{RunCmd: "true"})
+	if _, err := s.RunJob("service"); err == nil {
+		t.Fatalf("expected RunJob of a service to fail")
+	}
+}
+
+func TestRunFailsAsSoonAsAppExits(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "crashing", ApplicationDef{
+		RunCmd:         "exit 3",
+		HealthEndpoint: "/status",
+	})
+	start := time.Now()
+	_, err = s.Run("crashing")
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("expected the app's exit status, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > MAX_STARTUP_TIME/4 {
+		t.Fatalf("expected Run to return once the app exited, took %s", elapsed)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 500 * time.Millisecond
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// the helper only serves /status
+	writeTestDeploy(t, s, "second", ApplicationDef{
+		RunCmd:          helperRunCmd("serve"),
+		HealthEndpoints: []string{"/healthz", "/status"},
+	})
+	if _, err := s.Run("second"); err != nil {
+		t.Fatalf("expected the second health endpoint to pass: %s", err)
+	}
+	defer s.Stop("second")
+	result, err := s.CheckHealth("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Health != 200 || result.Endpoint != "/status" {
+		t.Fatalf("expected /status to be the endpoint that passed, got %+v", result)
+	}
+
+	writeTestDeploy(t, s, "neither", ApplicationDef{
+		RunCmd:          helperRunCmd("serve"),
+		HealthEndpoints: []string{"/healthz", "/health"},
+	})
+	_, err = s.Run("neither")
+	// left running for Enforce, like any deploy that fails its health check
+	s.Stop("neither")
+	if err == nil {
+		t.Fatalf("expected a deploy none of whose health endpoints pass to fail")
+	}
+}
+
+func TestCleanEnv(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	t.Setenv("CAMUS_TEST_MANAGER_ONLY", "hunter2")
+
+	for _, clean := range []bool{false, true} {
+		writeTestDeploy(t, s, "env", ApplicationDef{
+			RunCmd:         helperRunCmd("env"),
+			HealthEndpoint: "/status",
+			Env:            map[string]string{"APP_SETTING": "on"},
+			CleanEnv:       clean,
+		})
+		port, err := s.Run("env")
+		if err != nil {
+			t.Fatalf("CleanEnv %v: run: %s", clean, err)
+		}
+		defer s.Stop("env")
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/status", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		env := string(body)
+		if err := s.Stop("env"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range []string{"APP_SETTING=on\n", fmt.Sprintf("PORT=%d\n", port)} {
+			if !strings.Contains(env, expected) {
+				t.Errorf("CleanEnv %v: expected the app's environment to have %s, got %s", clean, expected, env)
+			}
+		}
+		if inherited := strings.Contains(env, "CAMUS_TEST_MANAGER_ONLY=hunter2\n"); inherited == clean {
+			t.Errorf("CleanEnv %v: expected camus's environment to be inherited %v, got %s", clean, !clean, env)
+		}
+	}
+}
+
+func TestNewDeployIdIsUTC(t *testing.T) {
+	defer func(old *time.Location) { time.Local = old }(time.Local)
+	time.Local = time.FixedZone("UTC+13", 13*60*60)
+
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	deployId := s.NewDeployDir().DeployId
+	after := time.Now().UTC()
+
+	parts := strings.Split(deployId, "-")
+	if len(parts) < 6 {
+		t.Fatalf("unexpected deploy id %s", deployId)
+	}
+	stamp, err := time.Parse("2006-01-02-15-04-05", strings.Join(parts[len(parts)-6:], "-"))
+	if err != nil {
+		t.Fatalf("deploy id %s: %s", deployId, err)
+	}
+	if stamp.Before(before) || stamp.After(after) {
+		t.Fatalf("expected %s to have the UTC time, between %s and %s", deployId, before, after)
+	}
+}
+
+func TestStopKillsAppHoldingPort(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "stubborn", ApplicationDef{
+		RunCmd:         helperRunCmd("stubborn"),
+		HealthEndpoint: "/status",
+		StopTimeoutMs:  300,
+	})
+	port, err := s.Run("stubborn")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	stopped := time.Now()
+	if err := s.Stop("stubborn"); err != nil {
+		t.Fatalf("expected Stop to kill the app: %s", err)
+	}
+	if took := time.Since(stopped); took < 300*time.Millisecond {
+		t.Fatalf("expected Stop to give the app its StopTimeoutMs, took %s", took)
+	}
+	if !portFree(port) {
+		t.Fatalf("expected port %d to be released once Stop returned", port)
+	}
+}
+
+func TestQueryAudit(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, entry := range []AuditEntry{
+		{Operation: "run", DeployId: "a", Port: 19001},
+		{Operation: "run", DeployId: "b", Port: 19002},
+		{Operation: "set-active", DeployId: "b", Port: 19002, Label: LABEL_ACTIVE},
+		{Operation: "stop", DeployId: "a", Port: 19001},
+	} {
+		entry.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := s.appendAudit(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		filter   AuditFilter
+		expected []string
+	}{
+		{AuditFilter{}, []string{"run a", "run b", "set-active b", "stop a"}},
+		{AuditFilter{DeployId: "a"}, []string{"run a", "stop a"}},
+		{AuditFilter{Operation: "run"}, []string{"run a", "run b"}},
+		{AuditFilter{DeployId: "b", Operation: "set-active"}, []string{"set-active b"}},
+		{AuditFilter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{"run b", "set-active b"}},
+		{AuditFilter{Label: LABEL_ACTIVE}, []string{"set-active b"}},
+		{AuditFilter{DeployId: "a", Label: LABEL_ACTIVE}, []string{}},
+		{AuditFilter{Label: LABEL_CANARY}, []string{}},
+		{AuditFilter{DeployId: "c"}, []string{}},
+	} {
+		entries, err := s.QueryAudit(c.filter)
+		if err != nil {
+			t.Fatalf("%+v: %s", c.filter, err)
+		}
+		got := []string{}
+		for _, entry := range entries {
+			got = append(got, entry.Operation+" "+entry.DeployId)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("%+v: expected %v, got %v", c.filter, c.expected, got)
+		}
+	}
+
+	var reply QueryAuditReply
+	rpc := &RpcServer{server: s}
+	if err := rpc.QueryAudit(QueryAuditRequest{Filter: AuditFilter{Label: LABEL_ACTIVE}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Entries) != 1 || reply.Entries[0].Operation != "set-active" {
+		t.Fatalf("expected the RPC to return the set-active entry, got %+v", reply.Entries)
+	}
+	if filter, err := parseAuditFilter([]string{"deploy=b", "label=" + LABEL_ACTIVE, "since=2015-06-01T12:01:00Z"}); err != nil ||
+		filter.DeployId != "b" || filter.Label != LABEL_ACTIVE || !filter.Since.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected parsed filter %+v, %v", filter, err)
+	}
+	if _, err := parseAuditFilter([]string{"port=19001"}); err == nil {
+		t.Fatalf("expected an unknown filter to be refused")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	minute := func(n int) time.Time { return start.Add(time.Duration(n) * time.Minute) }
+	for deployId, created := range map[string]time.Time{"a": minute(0), "b": minute(2)} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{RunCmd: "true"})
+		s.updateDeployState(deployId, func(state *DeployState) {
+			state.Created = created
+		})
+	}
+	for _, entry := range []AuditEntry{
+		{Time: minute(1), Operation: "run", DeployId: "a", Port: 19001},
+		{Time: minute(3), Operation: "run", DeployId: "b", Port: 19002},
+		{Time: minute(4), Operation: "set-active", DeployId: "b", Port: 19002},
+		{Time: minute(6), Operation: "stop", DeployId: "a", Port: 19001},
+	} {
+		if err := s.appendAudit(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.recordHealthResult("a", HealthResult{Time: minute(5), Health: 503})
+	s.recordHealthResult("b", HealthResult{Time: minute(5).Add(time.Second), Health: 200})
+	s.recordHealthResult("b", HealthResult{Time: minute(7), Health: -1, Error: "connection refused"})
+
+	events, err := s.Timeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, event := range events {
+		got = append(got, event.Event+" "+event.DeployId)
+	}
+	expected := []string{"created a", "run a", "created b", "run b", "set-active b",
+		"health-failure a", "stop a", "health-failure b"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if events[5].Detail != "status 503" || events[7].Detail != "connection refused" {
+		t.Errorf("expected the health failures to say why, got %q and %q", events[5].Detail, events[7].Detail)
+	}
+
+	data, err := s.TimelineJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported []TimelineEvent
+	if err := json.Unmarshal(data, &exported); err != nil {
+		t.Fatalf("expected JSON, got %s: %s", data, err)
+	}
+	if !reflect.DeepEqual(exported, events) {
+		t.Errorf("expected the export to round trip, got %+v", exported)
+	}
+}
+
+func TestSoakAbortsOnFailure(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// Healthy at first, then crashes.
+	var checks int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&checks, 1) > 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+	writeTestDeploy(t, s, "soaked", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+	})
+	s.config.Ports[testServerPort(t, ts)] = "soaked"
+
+	start := time.Now()
+	if err := s.SoakAndSetActiveById("soaked", 5*time.Second); err == nil {
+		t.Fatalf("expected the soak to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("expected the soak to stop at the first failure, took %s", took)
+	}
+	if s.config.Active != 0 {
+		t.Fatalf("expected the deploy not to become active, active is %d", s.config.Active)
+	}
+}
+
+func TestHealthRedirects(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer elsewhere.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.Redirect(w, r, "/health", http.StatusMovedPermanently)
+		case "/away":
+			http.Redirect(w, r, elsewhere.URL+"/health", http.StatusMovedPermanently)
+		default:
+			fmt.Fprintf(w, "ok")
+		}
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		redirects string
+		endpoint  string
+		healthy   bool
+	}{
+		{"", "/", false},
+		{HEALTH_REDIRECTS_SAME_ORIGIN, "/", true},
+		{HEALTH_REDIRECTS_SAME_ORIGIN, "/away", false},
+	} {
+		writeTestDeploy(t, s, "redirected", ApplicationDef{
+			RunCmd:          "true",
+			HealthEndpoint:  c.endpoint,
+			HealthRedirects: c.redirects,
+		})
+		app, err := s.loadApp("redirected")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.testApp(testServerPort(t, ts), app)
+		if healthy := err == nil && status == 200; healthy != c.healthy {
+			t.Errorf("HealthRedirects %q, %s: expected healthy to be %t, got %d, %v",
+				c.redirects, c.endpoint, c.healthy, status, err)
+		}
+	}
+}
+
+func TestSwapLabels(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Stands in for haproxy, failing the reload once the fail file exists.
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	failFile := path.Join(root, "fail")
+	script := fmt.Sprintf("#!/bin/sh\nif [ -e %s ]; then exit 1; fi\nexit 0\n", failFile)
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, deployId := range []string{"blue", "green"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+		if _, err := s.Run(deployId); err != nil {
+			t.Fatalf("run %s: %s", deployId, err)
+		}
+		defer s.Stop(deployId)
+	}
+	// before the deploys are stopped, as stopping the canary reloads
+	defer os.Remove(failFile)
+	if err := s.SwapLabels(LABEL_ACTIVE, LABEL_CANARY); err == nil {
+		t.Fatalf("expected swapping without a canary to fail")
+	}
+	if err := s.SetActiveById("blue"); err != nil {
+		t.Fatalf("set active: %s", err)
+	}
+	if err := s.SetCanary("green", 10, true); err != nil {
+		t.Fatalf("set canary: %s", err)
+	}
+	if err := s.SwapLabels(LABEL_ACTIVE, "staging"); err == nil {
+		t.Fatalf("expected swapping an unknown label to fail")
+	}
+
+	if err := s.SwapLabels(LABEL_CANARY, LABEL_ACTIVE); err != nil {
+		t.Fatalf("swap: %s", err)
+	}
+	expected := map[string][]string{"green": {LABEL_ACTIVE}, "blue": {LABEL_CANARY}}
+	if labels := s.routingLabels(); !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("expected %v after the swap, got %v", expected, labels)
+	}
+	if s.config.Canary.Weight != 10 || !s.config.Canary.Sticky {
+		t.Fatalf("expected the canary to keep its weight, got %+v", s.config.Canary)
+	}
+	entries, err := s.QueryAudit(AuditFilter{Operation: "swap-labels"})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected an audit entry for each label, got %+v, %v", entries, err)
+	}
+
+	cfgFile := path.Join(root, haproxyConfig)
+	cfgBefore, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(failFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SwapLabels(LABEL_ACTIVE, LABEL_CANARY); err == nil {
+		t.Fatalf("expected the swap to fail with the reload")
+	}
+	if labels := s.routingLabels(); !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("expected the failed swap to change nothing, got %v", labels)
+	}
+	config, err := readConfig(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Active != s.config.Active || config.Canary == nil || config.Canary.DeployId != "blue" {
+		t.Fatalf("expected the saved config to be unchanged, got %d, %+v", config.Active, config.Canary)
+	}
+	if cfgAfter, err := ioutil.ReadFile(cfgFile); err != nil || string(cfgAfter) != string(cfgBefore) {
+		t.Fatalf("expected haproxy's config to be put back, got %v", err)
+	}
+}
+
+func TestStopClearsCanary(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Stands in for haproxy, failing the reload once the fail file exists.
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	failFile := path.Join(root, "fail")
+	script := fmt.Sprintf("#!/bin/sh\nif [ -e %s ]; then exit 1; fi\nexit 0\n", failFile)
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, deployId := range []string{"stable", "trial"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+		if _, err := s.Run(deployId); err != nil {
+			t.Fatalf("run %s: %s", deployId, err)
+		}
+		defer s.Stop(deployId)
+	}
+	if err := s.SetActiveById("stable"); err != nil {
+		t.Fatalf("set active: %s", err)
+	}
+	if err := s.SetCanary("trial", 10, false); err != nil {
+		t.Fatalf("set canary: %s", err)
+	}
+
+	// a canary that can't be cleared isn't stopped
+	if err := ioutil.WriteFile(failFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop("trial"); err == nil {
+		t.Fatalf("expected the stop to fail when the canary can't be cleared")
+	}
+	if s.config.Canary == nil || s.lookupConfiguredPort("trial") == 0 {
+		t.Fatalf("expected the canary to be left as it was")
+	}
+	os.Remove(failFile)
+
+	if err := s.Stop("trial"); err != nil {
+		t.Fatalf("stop: %s", err)
+	}
+	if s.config.Canary != nil {
+		t.Fatalf("expected stopping the canary to clear it, got %+v", s.config.Canary)
+	}
+	entries, err := s.QueryAudit(AuditFilter{Operation: "clear-canary", Label: LABEL_CANARY})
+	if err != nil || len(entries) != 1 || entries[0].DeployId != "trial" {
+		t.Fatalf("expected the cleared canary in the audit log, got %+v, %v", entries, err)
+	}
+}
+
+func TestRebalanceKeepsActiveDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Stands in for haproxy, which only needs to accept the reload.
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	oldPorts := map[string]int{}
+	for _, deployId := range []string{"live", "spare"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+		port, err := s.Run(deployId)
+		if err != nil {
+			t.Fatalf("run %s: %s", deployId, err)
+		}
+		defer s.Stop(deployId)
+		oldPorts[deployId] = port
+	}
+	if err := s.SetActiveById("live"); err != nil {
+		t.Fatalf("set active: %s", err)
+	}
+
+	results, err := s.Rebalance()
+	if err != nil {
+		t.Fatalf("rebalance: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected both deploys to be rebalanced, got %+v", results)
+	}
+	for _, result := range results {
+		if result.Error != "" || result.NewPort == 0 || result.NewPort == result.OldPort {
+			t.Fatalf("expected %s to move, got %+v", result.DeployId, result)
+		}
+		if result.OldPort != oldPorts[result.DeployId] {
+			t.Fatalf("expected %s to move from %d, got %+v", result.DeployId, oldPorts[result.DeployId], result)
+		}
+		if !portFree(result.OldPort) || portFree(result.NewPort) {
+			t.Fatalf("expected %s to be on %d only", result.DeployId, result.NewPort)
+		}
+		if s.lookupConfiguredPort(result.DeployId) != result.NewPort {
+			t.Fatalf("expected the config to have %s on %d", result.DeployId, result.NewPort)
+		}
+		if result.DeployId == "live" {
+			if s.config.Active != result.NewPort {
+				t.Fatalf("expected the active port to follow live to %d, got %d", result.NewPort, s.config.Active)
+			}
+			cfg, err := ioutil.ReadFile(path.Join(root, haproxyConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(cfg), fmt.Sprintf(":%d", result.NewPort)) {
+				t.Fatalf("expected haproxy to be sent to %d, got\n%s", result.NewPort, cfg)
+			}
+		}
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	config, err := json.Marshal(map[string][]string{"AllowedCommands": {os.Args[0]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	writeTestDeploy(t, s, "shell", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	if _, err := s.Run("shell"); err == nil || !strings.Contains(err.Error(), "AllowedCommands") {
+		t.Fatalf("expected a RunCmd run with sh to be refused, got %v", err)
+	}
+
+	writeTestDeploy(t, s, "allowed", ApplicationDef{
+		RunArgv:        []string{os.Args[0], "-test.run=TestHelperProcess", "--", "serve", "%PORT%"},
+		Env:            map[string]string{"CAMUS_TEST_HELPER": "1"},
+		HealthEndpoint: "/status",
+	})
+	if _, err := s.Run("allowed"); err != nil {
+		t.Fatalf("expected an allowed command to run: %s", err)
+	}
+	if err := s.Stop("allowed"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthHistory(t *testing.T) {
+	defer func(old int) { HEALTH_HISTORY_SIZE = old }(HEALTH_HISTORY_SIZE)
+	HEALTH_HISTORY_SIZE = 4
+
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// Passes every other check.
+	var checks int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&checks, 1)%2 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+	writeTestDeploy(t, s, "flapping", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+	})
+
+	for i := 0; i < 5; i++ {
+		s.checkHealth(&Deploy{Id: "flapping", Port: testServerPort(t, ts)})
+	}
+
+	history, err := s.HealthHistory("flapping", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	healths := []int{}
+	for _, result := range history {
+		if result.Time.IsZero() || result.Latency <= 0 {
+			t.Fatalf("expected a time and latency, got %+v", result)
+		}
+		healths = append(healths, result.Health)
+	}
+	// the first of the 5 checks is dropped
+	if expected := []int{503, 200, 503, 200}; !reflect.DeepEqual(healths, expected) {
+		t.Fatalf("expected %v, got %v", expected, healths)
+	}
+
+	if last, _ := s.HealthHistory("flapping", 1); len(last) != 1 || last[0].Health != 200 {
+		t.Fatalf("expected only the last check, got %+v", last)
+	}
+	if none, _ := s.HealthHistory("unchecked", 0); len(none) != 0 {
+		t.Fatalf("expected no history for an unchecked deploy, got %+v", none)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	var failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+	writeTestDeploy(t, s, "running", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+	})
+
+	if _, err := s.CheckHealth("running"); err == nil {
+		t.Fatalf("expected checking a deploy that isn't on a port to fail")
+	}
+	s.config.Ports[testServerPort(t, ts)] = "running"
+
+	result, err := s.CheckHealth("running")
+	if err != nil {
+		t.Fatalf("check health: %s", err)
+	}
+	if result.Health != 200 || result.Error != "" || result.Time.IsZero() {
+		t.Fatalf("expected a healthy result, got %+v", result)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	result, err = s.CheckHealth("running")
+	if err != nil {
+		t.Fatalf("check health: %s", err)
+	}
+	if result.Health != 503 {
+		t.Fatalf("expected an unhealthy result, got %+v", result)
+	}
+	if history, _ := s.HealthHistory("running", 0); len(history) != 2 {
+		t.Fatalf("expected both checks in the history, got %+v", history)
+	}
+
+	ts.Close()
+	if _, err := s.CheckHealth("running"); err == nil {
+		t.Fatalf("expected checking a deploy with nothing on its port to fail")
+	}
+}
+
+func TestConfigReader(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	config := strings.NewReader(`{"Ports": {"19005": "from-stdin"}, "Reserved": {"19010": "metrics"}}`)
+	s, err := NewServerImpl(root, false, 19000, WithConfigReader(config), WithConfigWrites(false))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	if s.lookupConfiguredPort("from-stdin") != 19005 || s.config.Reserved[19010] != "metrics" {
+		t.Fatalf("expected the config from the reader, got %+v", s.config)
+	}
+
+	if err := s.ReservePort(19011, "tracing"); err != nil {
+		t.Fatalf("reserve: %s", err)
+	}
+	if s.config.Reserved[19011] != "tracing" {
+		t.Fatalf("expected the change to be kept in memory, got %+v", s.config)
+	}
+	if _, err := os.Stat(path.Join(root, serverConfigFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no config file to be written, got %v", err)
+	}
+
+	if _, err := NewServerImpl(root, false, 19000, WithConfigReader(strings.NewReader("{"))); err == nil {
+		t.Fatalf("expected invalid config from the reader to be an error")
+	}
+}
+
+func TestHostBudget(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName),
+		[]byte(`{"HostBudget": {"MemoryMb": 1024}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for deployId, memoryMb := range map[string]int{"big": 768, "small": 256, "more": 1} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+			MemoryMb:       memoryMb,
+		})
+	}
+
+	for _, deployId := range []string{"big", "small"} {
+		if _, err := s.Run(deployId); err != nil {
+			t.Fatalf("expected %s to fit in the budget: %s", deployId, err)
+		}
+		defer s.Stop(deployId)
+	}
+	_, err = s.Run("more")
+	if err == nil || !strings.Contains(err.Error(), "only 0MB is left") {
+		t.Fatalf("expected a deploy over the budget to be refused, got %v", err)
+	}
+	if s.lookupConfiguredPort("more") != 0 {
+		t.Fatalf("expected the refused deploy not to get a port")
+	}
+}
+
+func TestHealthUserAgent(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	userAgents := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.UserAgent()
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		def      ApplicationDef
+		expected string
+	}{
+		{ApplicationDef{RunCmd: "true"}, "camus-healthcheck"},
+		{ApplicationDef{RunCmd: "true", Name: "MyApp"}, "camus-healthcheck/MyApp"},
+		{ApplicationDef{RunCmd: "true", Name: "MyApp", HealthUserAgent: "prober/2"}, "prober/2"},
+	} {
+		writeTestDeploy(t, s, "agent", c.def)
+		app, err := s.loadApp("agent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.testApp(testServerPort(t, ts), app); err != nil {
+			t.Fatal(err)
+		}
+		if userAgent := <-userAgents; userAgent != c.expected {
+			t.Errorf("expected User-Agent %q, got %q", c.expected, userAgent)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	old := time.Now().UTC().Add(-48 * time.Hour).Format("2006-01-02-15-04-05")
+	recent := time.Now().UTC().Add(-time.Hour).Format("2006-01-02-15-04-05")
+	for _, deployId := range []string{
+		"old-a-" + old, "old-b-" + old, "old-configured-" + old, "old-canary-" + old, "old-running-" + old,
+		"recent-" + recent,
+	} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+	}
+	s.config.Ports[19050] = "old-configured-" + old
+	s.config.Canary = &Canary{DeployId: "old-canary-" + old, Weight: 10}
+	if _, err := s.Run("old-running-" + old); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	defer s.Stop("old-running-" + old)
+	s.SetTag("old-a-"+old, "note", "goes anyway")
+
+	removedIds := func(removed []GCRemoval) []string {
+		ids := []string{}
+		for _, r := range removed {
+			ids = append(ids, r.DeployId)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// The newest old deploys are kept by KeepLast: recent, then old-running,
+	// old-configured and so on in reverse order of name.
+	removed, err := s.GC(GCPolicy{MaxAge: 24 * time.Hour, KeepLast: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := removedIds(removed); !reflect.DeepEqual(ids, []string{"old-a-" + old}) {
+		t.Fatalf("expected only the oldest unprotected deploy to go, got %v", ids)
+	}
+	if !strings.Contains(removed[0].Reason, "older than") {
+		t.Fatalf("expected the age as the reason, got %q", removed[0].Reason)
+	}
+	if _, err := os.Stat(s.deployDir("old-a-" + old)); !os.IsNotExist(err) {
+		t.Fatalf("expected the deploy dir to be removed, got %v", err)
+	}
+	if _, err := os.Stat(s.tagsFile("old-a-" + old)); !os.IsNotExist(err) {
+		t.Fatalf("expected its tags to be removed, got %v", err)
+	}
+
+	// Without KeepLast, only the configured, canary, running, pinned and
+	// recent deploys are left.
+	writeTestDeploy(t, s, "old-pinned-"+old, ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+	if err := s.Pin("old-pinned-" + old); err != nil {
+		t.Fatalf("pin: %s", err)
+	}
+	removed, err = s.GC(GCPolicy{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := removedIds(removed); !reflect.DeepEqual(ids, []string{"old-b-" + old}) {
+		t.Fatalf("expected the protected deploys to be kept, got %v", ids)
+	}
+	left, err := s.readDeployIdsFromDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(left)
+	expected := []string{"old-canary-" + old, "old-configured-" + old, "old-pinned-" + old, "old-running-" + old, "recent-" + recent}
+	if !reflect.DeepEqual(left, expected) {
+		t.Fatalf("expected %v to be left, got %v", expected, left)
+	}
+
+	if err := s.Unpin("old-pinned-" + old); err != nil {
+		t.Fatalf("unpin: %s", err)
+	}
+	removed, err = s.GC(GCPolicy{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := removedIds(removed); !reflect.DeepEqual(ids, []string{"old-pinned-" + old}) {
+		t.Fatalf("expected the unpinned deploy to go, got %v", ids)
+	}
+	if err := s.Pin("missing-" + old); err == nil {
+		t.Fatalf("expected pinning a missing deploy to fail")
+	}
+
+	if _, err := s.GC(GCPolicy{}); err == nil {
+		t.Fatalf("expected an empty policy to be refused")
+	}
+}
+
+func TestDetach(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Stands in for haproxy, which only needs to accept the reload.
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ports := map[string]int{}
+	for _, deployId := range []string{"detached", "fallback"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+		port, err := s.Run(deployId)
+		if err != nil {
+			t.Fatalf("run %s: %s", deployId, err)
+		}
+		defer s.Stop(deployId)
+		ports[deployId] = port
+	}
+	// both labels, as SetCanary wouldn't allow
+	s.config.Active = ports["detached"]
+	s.config.Canary = &Canary{DeployId: "detached", Weight: 10}
+
+	if _, err := s.Detach("detached", DetachOptions{}); err == nil {
+		t.Fatalf("expected detaching the active deploy without a fallback to fail")
+	}
+	if s.config.Active != ports["detached"] || s.portFree(ports["detached"]) {
+		t.Fatalf("expected the failed detach to leave the deploy serving")
+	}
+
+	var reply DetachReply
+	rpc := &RpcServer{server: s}
+	if err := rpc.Detach(DetachRequest{DeployId: "detached", Options: DetachOptions{Fallback: "fallback", Remove: true}}, &reply); err != nil || reply.Error != "" {
+		t.Fatalf("detach: %v %s, after %+v", err, reply.Error, reply.Steps)
+	}
+	steps := reply.Steps
+	if len(steps) != 4 {
+		t.Fatalf("expected the active, canary, stop and remove steps, got %+v", steps)
+	}
+	for _, step := range steps {
+		if step.Error != "" {
+			t.Fatalf("expected every step to succeed, got %+v", steps)
+		}
+	}
+	if labels := s.routingLabels(); len(labels["detached"]) != 0 || !reflect.DeepEqual(labels["fallback"], []string{LABEL_ACTIVE}) {
+		t.Fatalf("expected only the fallback to be labeled, got %v", labels)
+	}
+	if s.lookupConfiguredPort("detached") != 0 || !s.portFree(ports["detached"]) {
+		t.Fatalf("expected the deploy to be stopped")
+	}
+	if _, err := os.Stat(s.deployDir("detached")); !os.IsNotExist(err) {
+		t.Fatalf("expected the deploy dir to be removed, got %v", err)
+	}
+}
+
+func TestDeletePinnedDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	old := time.Now().UTC().Add(-48 * time.Hour).Format("2006-01-02-15-04-05")
+	for _, deployId := range []string{"kept-" + old, "forced-" + old} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{RunCmd: "true"})
+	}
+	rpc := &RpcServer{server: s}
+	for _, deployId := range []string{"kept-" + old, "forced-" + old} {
+		if err := rpc.Pin(PinRequest{DeployId: deployId}, &PinReply{}); err != nil {
+			t.Fatalf("pin %s: %s", deployId, err)
+		}
+	}
+
+	if err := rpc.DeleteDeploy(DeleteDeployRequest{DeployId: "kept-" + old}, &DeleteDeployReply{}); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Fatalf("expected deleting a pinned deploy to be refused, got %v", err)
+	}
+	if err := rpc.DeleteDeploy(DeleteDeployRequest{DeployId: "forced-" + old, Force: true}, &DeleteDeployReply{}); err != nil {
+		t.Fatalf("expected a forced delete to remove a pinned deploy: %s", err)
+	}
+	if _, err := os.Stat(s.deployDir("forced-" + old)); !os.IsNotExist(err) {
+		t.Fatalf("expected the deploy dir to be removed, got %v", err)
+	}
+
+	if removed, err := s.GC(GCPolicy{MaxAge: 24 * time.Hour}); err != nil || len(removed) != 0 {
+		t.Fatalf("expected GC to keep the pinned deploy, got %+v, %v", removed, err)
+	}
+	removed, err := s.GC(GCPolicy{MaxAge: 24 * time.Hour, Force: true})
+	if err != nil || len(removed) != 1 || removed[0].DeployId != "kept-"+old {
+		t.Fatalf("expected a forced GC to remove the pinned deploy, got %+v, %v", removed, err)
+	}
+
+	writeTestDeploy(t, s, "unpinned-"+old, ApplicationDef{RunCmd: "true"})
+	s.Pin("unpinned-" + old)
+	if err := rpc.Unpin(PinRequest{DeployId: "unpinned-" + old}, &PinReply{}); err != nil {
+		t.Fatalf("unpin: %s", err)
+	}
+	if err := s.DeleteDeploy("unpinned-"+old, false); err != nil {
+		t.Fatalf("expected an unpinned deploy to be deleted: %s", err)
+	}
+}
+
+func TestReadinessFile(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "filed", ApplicationDef{
+		RunCmd:           "sleep 30",
+		ReadinessFile:    "ready",
+		ReadinessContent: "ok",
+	})
+	readyFile := path.Join(s.deployDir("filed"), "ready")
+	// left by a previous run, so must be ignored
+	if err := ioutil.WriteFile(readyFile, []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		ioutil.WriteFile(readyFile, []byte("not yet"), 0644)
+		time.Sleep(200 * time.Millisecond)
+		ioutil.WriteFile(readyFile, []byte("ok\n"), 0644)
+	}()
+	if _, err := s.Run("filed"); err != nil {
+		t.Fatalf("expected the deploy to be up once its readiness file was: %s", err)
+	}
+	defer s.Stop("filed")
+	if took := time.Since(start); took < 500*time.Millisecond {
+		t.Fatalf("expected to wait for the readiness file with the content, took %s", took)
+	}
+	state, err := s.readDeployState("filed")
+	if err != nil || state.Lifecycle != LIFECYCLE_RUNNING {
+		t.Fatalf("expected the deploy to be running, got %q, %v", state.Lifecycle, err)
+	}
+}
+
+func TestHealthChecksMustAllPass(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 2 * time.Second
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	started := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/status", r.URL.Path == "/db":
+			w.WriteHeader(200)
+		case r.URL.Path == "/cache" && time.Since(started) > 400*time.Millisecond:
+			// the cache is the last to warm up
+			w.WriteHeader(200)
+		case r.URL.Path == "/queue" && r.Method == "HEAD":
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(503)
+		}
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "checked", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+		HealthChecks: []HealthCheck{
+			{Path: "/db"},
+			{Path: "/cache"},
+			{Path: "/queue", Method: "HEAD", Status: 204},
+		},
+	})
+	app, err := s.loadApp("checked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("expected the app to start once every check passed: %s", err)
+	}
+	if took := time.Since(started); took < 400*time.Millisecond {
+		t.Fatalf("expected startup to wait for the lagging check, took %s", took)
+	}
+
+	writeTestDeploy(t, s, "never", ApplicationDef{
+		RunCmd:         "true",
+		HealthEndpoint: "/status",
+		HealthChecks:   []HealthCheck{{Path: "/db"}, {Path: "/search"}},
+	})
+	MAX_STARTUP_TIME = 300 * time.Millisecond
+	app, err = s.loadApp("never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.waitForAppToStart(testServerPort(t, ts), app)
+	if err == nil || !strings.Contains(err.Error(), "GET /search: status 503, not 200") {
+		t.Fatalf("expected the failing check to be reported, got %v", err)
+	}
+}
+
+func TestReadinessCmd(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "managed", ApplicationDef{
+		RunCmd: "rm -f started; sleep 0.4 && touch started && exec sleep 30",
+		ReadinessCmd: `if [ -e started ]; then echo '{"db": {"state": "ready"}}'; ` +
+			`else echo '{"db": {"state": "migrating"}}'; fi`,
+		ReadinessField: "db.state",
+		ReadinessValue: "ready",
+	})
+
+	start := time.Now()
+	if _, err := s.Run("managed"); err != nil {
+		t.Fatalf("expected the deploy to be up once its readiness command said so: %s", err)
+	}
+	defer s.Stop("managed")
+	if took := time.Since(start); took < 400*time.Millisecond {
+		t.Fatalf("expected to wait for the readiness command to report ready, took %s", took)
+	}
+
+	app, err := s.loadApp("managed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := s.checkReadinessCmd(0, app); status != 200 || err != nil {
+		t.Fatalf("expected the app to still be ready, got %d, %v", status, err)
+	}
+	os.Remove(path.Join(s.deployDir("managed"), "started"))
+	if _, err := s.checkReadinessCmd(0, app); err == nil || !strings.Contains(err.Error(), `db.state is "migrating", not "ready"`) {
+		t.Fatalf("expected the app not to be ready, got %v", err)
+	}
+}
+
+func TestReadinessCmdAllowedAndTimeout(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.config.HealthTimeoutMs = 200
+	writeTestDeploy(t, s, "hanging", ApplicationDef{
+		RunCmd: "sleep 30",
+		// the background sleep keeps stdout open after sh is killed
+		ReadinessCmd:   "sleep 30 & sleep 30",
+		ReadinessField: "state",
+		ReadinessValue: "ready",
+	})
+	app, err := s.loadApp("hanging")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := s.checkReadinessCmd(0, app); err == nil {
+		t.Fatalf("expected the hanging readiness command to fail")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("expected the readiness command to be given up on after its timeout, took %s", took)
+	}
+
+	s.config.AllowedCommands = []string{os.Args[0]}
+	if _, err := s.checkReadinessCmd(0, app); err == nil || !strings.Contains(err.Error(), "AllowedCommands") {
+		t.Fatalf("expected a readiness command run with sh to be refused, got %v", err)
+	}
+}
+
+func TestStatsd(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 500 * time.Millisecond
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.statsd, err = newStatsdClient(&StatsdConfig{Address: listener.LocalAddr().String(), Tags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestDeploy(t, s, "good", ApplicationDef{RunCmd: helperRunCmd("serve"), HealthEndpoint: "/status"})
+	if _, err := s.Run("good"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop("good")
+	writeTestDeploy(t, s, "bad", ApplicationDef{RunCmd: helperRunCmd("serve"), HealthEndpoint: "/missing"})
+	_, err = s.Run("bad")
+	s.Stop("bad")
+	if err == nil {
+		t.Fatalf("expected bad to fail its health check")
+	}
+
+	lines := map[string]bool{}
+	buf := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		line := string(buf[:n])
+		// the duration varies
+		if strings.HasPrefix(line, "camus.deploy.duration:") {
+			line = "camus.deploy.duration:" + line[strings.Index(line, "|"):]
+		}
+		lines[line] = true
+	}
+	for _, expected := range []string{
+		"camus.deploy.start:1|c|#deploy:good",
+		"camus.deploy.success:1|c|#deploy:good",
+		"camus.deploy.duration:|ms|#deploy:good",
+		"camus.deploy.start:1|c|#deploy:bad",
+		"camus.deploy.failure:1|c|#deploy:bad",
+		"camus.deploy.duration:|ms|#deploy:bad",
+	} {
+		if !lines[expected] {
+			t.Errorf("expected %s to be sent, got %v", expected, lines)
+		}
+	}
+}
+
+func TestMaxHealthChecks(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName),
+		[]byte(`{"MaxHealthChecks": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	var lock sync.Mutex
+	inFlight, most := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+	}))
+	defer ts.Close()
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+
+	file := writeTestConfig(t, `{"RunCmd": "true", "HealthChecks": [{"Path": "/a"}, {"Path": "/b"}]}`)
+	defer os.RemoveAll(path.Dir(file))
+	app, err := ApplicationFromConfig(false, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if status, err := s.testAppEndpoint(port, app, "/status"); err != nil || status != 200 {
+				t.Errorf("expected the health check to pass, got %d %v", status, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := s.testHealthChecks(port, app); err != nil {
+				t.Errorf("expected the health checks to pass: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("expected at most 2 health checks in flight, got %d", most)
+	}
+	if most < 2 {
+		t.Errorf("expected health checks to run concurrently, got %d at most", most)
+	}
+}
+
+func TestHealthTokenFile(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	var token atomic.Value
+	token.Store("first")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	tokenFile := path.Join(root, "health-token")
+	writeTestDeploy(t, s, "authed", ApplicationDef{
+		RunCmd:          "true",
+		HealthEndpoint:  "/status",
+		HealthTokenFile: tokenFile,
+	})
+	app, err := s.loadApp("authed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.testApp(testServerPort(t, ts), app); err == nil || !strings.Contains(err.Error(), "HealthTokenFile") {
+		t.Errorf("expected a missing token file to be reported, got %v", err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.testApp(testServerPort(t, ts), app); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("expected an empty token file to be reported, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.waitForAppToStart(testServerPort(t, ts), app); err != nil {
+		t.Fatalf("expected the health check to pass with the token: %s", err)
+	}
+
+	// rotated
+	token.Store("second")
+	if status, _ := s.testApp(testServerPort(t, ts), app); status != http.StatusUnauthorized {
+		t.Errorf("expected the old token to be refused, got %d", status)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := s.testApp(testServerPort(t, ts), app); status != 200 {
+		t.Errorf("expected the token to be read again for each check, got %d %v", status, err)
+	}
+}
+
+func TestMissingDeploysDir(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "gone", ApplicationDef{RunCmd: helperRunCmd("serve"), HealthEndpoint: "/status"})
+	if err := os.RemoveAll(s.deploysPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListDeploys(); err != ErrDeploysDirMissing {
+		t.Errorf("expected ListDeploys to return ErrDeploysDirMissing, got %v", err)
+	}
+	if _, err := s.Run("gone"); err != ErrDeploysDirMissing {
+		t.Errorf("expected Run to return ErrDeploysDirMissing, got %v", err)
+	}
+	if _, err := s.Run(LATEST_DEPLOY); err != ErrDeploysDirMissing {
+		t.Errorf("expected Run of %s to return ErrDeploysDirMissing, got %v", LATEST_DEPLOY, err)
+	}
+	// Nothing else that lists the deploys panics either.
+	if err := s.Stop(LATEST_DEPLOY); err != ErrDeploysDirMissing {
+		t.Errorf("expected Stop of %s to return ErrDeploysDirMissing, got %v", LATEST_DEPLOY, err)
+	}
+	if _, err := s.GetFullDeployIdFromShortName("gon"); err != ErrDeploysDirMissing {
+		t.Errorf("expected a short name lookup to return ErrDeploysDirMissing, got %v", err)
+	}
+	if _, err := s.GC(GCPolicy{KeepLast: 1}); err != ErrDeploysDirMissing {
+		t.Errorf("expected GC to return ErrDeploysDirMissing, got %v", err)
+	}
+	if _, err := s.Reconcile(false); err != ErrDeploysDirMissing {
+		t.Errorf("expected Reconcile to return ErrDeploysDirMissing, got %v", err)
+	}
+	if _, err := s.findUnknownProcesses(); err != ErrDeploysDirMissing {
+		t.Errorf("expected finding unknown processes to return ErrDeploysDirMissing, got %v", err)
+	}
+	if _, err := os.Stat(s.deploysPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the deploys dir not to be recreated by default")
+	}
+
+	s.config.MissingDeploysDir = MISSING_DEPLOYS_DIR_RECREATE
+	deploys, err := s.ListDeploys()
+	if err != nil || len(deploys) != 0 {
+		t.Fatalf("expected the deploys dir to be recreated empty, got %v %v", deploys, err)
+	}
+	if info, err := os.Stat(s.deploysPath); err != nil || !info.IsDir() {
+		t.Fatalf("expected the deploys dir to be there again: %v", err)
+	}
+	os.RemoveAll(s.deploysPath)
+	if _, err := s.Run("gone"); err == nil || err == ErrDeploysDirMissing {
+		t.Errorf("expected Run of a deploy that went with the dir to fail as usual, got %v", err)
+	}
+	if _, err := os.Stat(s.deploysPath); err != nil {
+		t.Errorf("expected Run to recreate the deploys dir: %s", err)
+	}
+}
+
+func TestMaxRestarts(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000, WithQuarantineThreshold(0))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "crashy", ApplicationDef{
+		RunCmd:          helperRunCmd("serve"),
+		HealthEndpoint:  "/status",
+		MaxRestarts:     2,
+		RestartWindowMs: 1000,
+	})
+	s.config.Ports[19001] = "crashy"
+	// Starts fine every time, then dies.
+	crash := func() {
+		pid, ok := s.trackedPid("crashy")
+		if !ok {
+			t.Fatalf("expected crashy to be running")
+		}
+		syscall.Kill(-pid, syscall.SIGKILL)
+		for !portFree(19001) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	s.Enforce()
+	crash()
+	s.Enforce()
+	crash()
+	s.Enforce()
+	state, _ := s.readDeployState("crashy")
+	if !portFree(19001) || state.Quarantine == nil {
+		s.Stop("crashy")
+		t.Fatalf("expected crashy to be quarantined rather than restarted a third time, got %+v", state)
+	}
+	if !strings.Contains(state.Quarantine.Reason, "MaxRestarts 2") {
+		t.Errorf("expected the reason to name the limit, got %s", state.Quarantine.Reason)
+	}
+	if _, ok := s.config.Ports[19001]; ok {
+		t.Fatalf("expected the quarantined deploy's port to be freed")
+	}
+
+	// Restarts further apart than the window don't add up.
+	if err := s.ClearQuarantine("crashy"); err != nil {
+		t.Fatal(err)
+	}
+	s.config.Ports[19001] = "crashy"
+	for i := 0; i < 3; i++ {
+		s.Enforce()
+		crash()
+		time.Sleep(600 * time.Millisecond)
+	}
+	s.Enforce()
+	defer s.Stop("crashy")
+	if state, _ := s.readDeployState("crashy"); portFree(19001) || state.Quarantine != nil {
+		t.Fatalf("expected restarts outside the window to be forgotten, got %+v", state)
+	}
+}
+
+func TestDeployManifest(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	if err := os.MkdirAll(s.deployDir("audited"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{
+  // shared health settings
+  "Include": ["common.json"],
+  "RunCmd": "./server %PORT%"
+}`
+	if err := ioutil.WriteFile(s.deployConfigFile("audited"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(s.deployDir("audited"), "common.json"),
+		[]byte(`{"HealthEndpoint": "/status"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.DeployManifest("audited")
+	if err != nil || string(data) != manifest {
+		t.Fatalf("expected the deploy.json as it is on disk, got %q %v", data, err)
+	}
+	data, err = s.EffectiveDeployManifest("audited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var effective map[string]interface{}
+	if err := json.Unmarshal(data, &effective); err != nil {
+		t.Fatalf("expected the effective manifest to be json: %s\n%s", err, data)
+	}
+	if effective["HealthEndpoint"] != "/status" || effective["RunCmd"] != "./server %PORT%" {
+		t.Errorf("expected the include to be merged in, got %s", data)
+	}
+
+	// for ".." to find, were it allowed
+	if err := ioutil.WriteFile(path.Join(root, deployConfigFileName), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, deployId := range []string{"..", "../..", "audited/../..", "/etc", ".hidden", ""} {
+		if data, err := s.DeployManifest(deployId); err == nil {
+			t.Errorf("expected deploy id %q to be rejected, got %q", deployId, data)
+		}
+	}
+	if _, err := s.DeployManifest("missing"); err == nil {
+		t.Errorf("expected a missing deploy to be an error")
+	}
+}
+
+func TestConfigTimeouts(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName),
+		[]byte(`{"StartupTimeoutMs": 400, "HealthTimeoutMs": 100, "StopTimeoutMs": 250}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprintf(w, "ok")
+	}))
+	defer ts.Close()
+
+	writeTestDeploy(t, s, "silent", ApplicationDef{RunCmd: "true", HealthEndpoint: "/status"})
+	silent, err := s.loadApp("silent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.testApp(testServerPort(t, ts), silent); err == nil {
+		t.Errorf("expected the config's HealthTimeoutMs to fail a 200ms health check")
+	}
+	start := time.Now()
+	if err := s.waitForAppToStart(testServerPort(t, ts), silent); err == nil {
+		t.Errorf("expected the app never to count as started")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expected the config's StartupTimeoutMs to be used, took %s", took)
+	}
+	if timeout := s.stopTimeout(silent); timeout != 250*time.Millisecond {
+		t.Errorf("expected the config's StopTimeoutMs, got %s", timeout)
+	}
+
+	writeTestDeploy(t, s, "explicit", ApplicationDef{
+		RunCmd:          "true",
+		HealthEndpoint:  "/status",
+		HealthTimeoutMs: 300,
+		StopTimeoutMs:   1000,
+	})
+	explicit, err := s.loadApp("explicit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := s.testApp(testServerPort(t, ts), explicit); err != nil || status != 200 {
+		t.Errorf("expected the deploy.json's HealthTimeoutMs to win, got %d %v", status, err)
+	}
+	if timeout := s.stopTimeout(explicit); timeout != time.Second {
+		t.Errorf("expected the deploy.json's StopTimeoutMs to win, got %s", timeout)
+	}
+
+	writeTestDeploy(t, s, "invalid", ApplicationDef{RunCmd: "true", HealthTimeoutMs: 500})
+	if _, err := s.loadApp("invalid"); err == nil {
+		t.Errorf("expected a HealthTimeoutMs longer than the config's StartupTimeoutMs to be rejected")
+	}
+}
+
+func TestStopDryRun(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "live", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+		StopSignal:     "SIGINT",
+		StopTimeoutMs:  3000,
+	})
+	port, err := s.Run("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop("live")
+	// without reloading haproxy, which isn't running
+	s.configLock.Lock()
+	s.config.Active = port
+	s.configLock.Unlock()
+	pid, _ := s.trackedPid("live")
+	configBefore, err := ioutil.ReadFile(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := s.StopDryRun("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the listening process, which may be a child of the one camus started
+	if pgid, _ := syscall.Getpgid(plan.Pid); pgid != pid {
+		t.Errorf("expected the plan's pid to be in the deploy's process group %d, got %d", pid, plan.Pid)
+	}
+	if plan.Port != port || !plan.Group || plan.Signal != "SIGINT" ||
+		plan.Timeout != 3*time.Second || !reflect.DeepEqual(plan.Labels, []string{LABEL_ACTIVE}) {
+		t.Errorf("expected the plan to match the running deploy on %d, got %+v", port, plan)
+	}
+	if len(plan.Warnings) != 1 || !strings.Contains(plan.Warnings[0], "active") {
+		t.Errorf("expected a warning that it's the active deploy, got %v", plan.Warnings)
+	}
+
+	if configAfter, _ := ioutil.ReadFile(path.Join(root, serverConfigFileName)); string(configAfter) != string(configBefore) {
+		t.Errorf("expected the config not to change, got %s", configAfter)
+	}
+	if s.lookupConfiguredPort("live") != port || portFree(port) || !processAlive(pid) {
+		t.Errorf("expected the deploy to be left running on its port")
+	}
+
+	if _, err := s.StopDryRun("missing"); err == nil {
+		t.Errorf("expected a deploy on no port to be an error")
+	}
+}
+
+func TestHealthStatuses(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	defer func(old time.Duration) { MAX_STARTUP_TIME = old }(MAX_STARTUP_TIME)
+	MAX_STARTUP_TIME = 300 * time.Millisecond
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		statuses string
+		healthy  bool
+	}{
+		{"", false},
+		{"200-299", true},
+		{"200, 204", true},
+		{"200,201-203", false},
+	} {
+		writeTestDeploy(t, s, "nocontent", ApplicationDef{
+			RunCmd:         "true",
+			HealthEndpoint: "/status",
+			HealthStatuses: c.statuses,
+		})
+		app, err := s.loadApp("nocontent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.waitForAppToStart(testServerPort(t, ts), app)
+		if healthy := err == nil; healthy != c.healthy {
+			t.Errorf("HealthStatuses %q: expected a 204 to be healthy %t, got %v", c.statuses, c.healthy, err)
+		}
+	}
+
+	for _, statuses := range []string{"2xx", "299-200", "200-", "99", "200,,204"} {
+		writeTestDeploy(t, s, "invalid", ApplicationDef{RunCmd: "true", HealthStatuses: statuses})
+		if _, err := s.loadApp("invalid"); err == nil {
+			t.Errorf("expected HealthStatuses %q to be rejected", statuses)
+		}
+	}
+}
+
+func TestRestartPolicies(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000, WithQuarantineThreshold(0))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	sickFile := path.Join(root, "sick")
+	writeTestDeploy(t, s, "restarts", ApplicationDef{
+		RunCmd:          helperRunCmd("sickfile"),
+		HealthEndpoint:  "/status",
+		Env:             map[string]string{"CAMUS_TEST_SICK_FILE": sickFile},
+		OnUnhealthy:     RESTART_POLICY_RESTART,
+		UnhealthyChecks: 2,
+	})
+	writeTestDeploy(t, s, "leaves", ApplicationDef{
+		RunCmd:         helperRunCmd("sickfile"),
+		HealthEndpoint: "/status",
+		Env:            map[string]string{"CAMUS_TEST_SICK_FILE": sickFile},
+		OnCrash:        RESTART_POLICY_LEAVE,
+	})
+	s.config.Ports[19001] = "restarts"
+	s.config.Ports[19002] = "leaves"
+	defer s.Stop("restarts")
+	defer s.Stop("leaves")
+
+	s.Enforce()
+	restartsPid, ok := s.trackedPid("restarts")
+	leavesPid, ok2 := s.trackedPid("leaves")
+	if !ok || !ok2 {
+		t.Fatalf("expected both deploys to be started")
+	}
+
+	// Alive but unhealthy: only the deploy whose OnUnhealthy is restart is
+	// restarted, and only once it's failed UnhealthyChecks in a row.
+	if err := ioutil.WriteFile(sickFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Enforce()
+	if pid, _ := s.trackedPid("restarts"); pid != restartsPid {
+		t.Fatalf("expected restarts to be left after one failed check")
+	}
+	s.Enforce()
+	if pid, ok := s.trackedPid("restarts"); !ok || pid == restartsPid {
+		t.Fatalf("expected restarts to be restarted after failing 2 checks, got pid %d (was %d)", pid, restartsPid)
+	}
+	if pid, ok := s.trackedPid("leaves"); !ok || pid != leavesPid {
+		t.Fatalf("expected leaves, whose OnUnhealthy is the default leave, to still be running as %d, got %d", leavesPid, pid)
+	}
+	if state, _ := s.readDeployState("restarts"); state.UnhealthyChecks != 0 {
+		t.Errorf("expected the failed checks to be reset after the restart, got %d", state.UnhealthyChecks)
+	}
+
+	// Crashed: the default OnCrash restarts it, leave doesn't.
+	restartsPid, _ = s.trackedPid("restarts")
+	syscall.Kill(-restartsPid, syscall.SIGKILL)
+	syscall.Kill(-leavesPid, syscall.SIGKILL)
+	for !portFree(19001) || !portFree(19002) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Enforce()
+	if pid, ok := s.trackedPid("restarts"); !ok || pid == restartsPid {
+		t.Fatalf("expected restarts to be restarted after crashing")
+	}
+	if !portFree(19002) {
+		t.Fatalf("expected leaves, whose OnCrash is leave, not to be restarted")
+	}
+	state, _ := s.readDeployState("leaves")
+	if state.Lifecycle != LIFECYCLE_FAILED {
+		t.Errorf("expected leaves to be failed, got %s", state.Lifecycle)
+	}
+	if _, ok := s.config.Ports[19002]; !ok {
+		t.Errorf("expected leaves to keep its port")
+	}
+}
+
+func TestLivenessCheck(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000, WithQuarantineThreshold(0))
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// All start with the HTTP health check, which fails while they're sick.
+	deploys := map[string]ApplicationDef{
+		"http": {},
+		"tcp":  {LivenessCheck: LIVENESS_CHECK_TCP},
+		"rare": {LivenessIntervalMs: 3600000},
+	}
+	ports := map[string]int{"http": 19001, "tcp": 19002, "rare": 19003}
+	for deployId, def := range deploys {
+		def.RunCmd = helperRunCmd("sickfile")
+		def.HealthEndpoint = "/status"
+		def.Env = map[string]string{"CAMUS_TEST_SICK_FILE": path.Join(root, deployId+"-sick")}
+		def.OnUnhealthy = RESTART_POLICY_RESTART
+		def.UnhealthyChecks = 1
+		writeTestDeploy(t, s, deployId, def)
+		s.config.Ports[ports[deployId]] = deployId
+		defer s.Stop(deployId)
+	}
+
+	s.Enforce()
+	pids := map[string]int{}
+	for deployId := range deploys {
+		pid, ok := s.trackedPid(deployId)
+		if !ok {
+			t.Fatalf("expected %s to be started", deployId)
+		}
+		pids[deployId] = pid
+	}
+	// all healthy, and rare's interval starts
+	s.Enforce()
+	for deployId := range deploys {
+		if err := ioutil.WriteFile(path.Join(root, deployId+"-sick"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Enforce()
+
+	if pid, _ := s.trackedPid("http"); pid == pids["http"] {
+		t.Errorf("expected http to be restarted for failing its HTTP liveness check")
+	}
+	if pid, _ := s.trackedPid("tcp"); pid != pids["tcp"] {
+		t.Errorf("expected tcp to be left running, as it still accepts connections")
+	}
+	if pid, _ := s.trackedPid("rare"); pid != pids["rare"] {
+		t.Errorf("expected rare not to be checked again within its LivenessIntervalMs")
+	}
+
+	// The TCP check fails once nothing's listening, though the crash is
+	// what restarts it.
+	app, err := s.loadApp("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkLiveness(ports["tcp"], app); err != nil {
+		t.Errorf("expected tcp to pass its TCP check while sick, got %s", err)
+	}
+	syscall.Kill(-pids["tcp"], syscall.SIGKILL)
+	for !portFree(ports["tcp"]) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.checkLiveness(ports["tcp"], app); err == nil {
+		t.Errorf("expected the TCP check to fail with nothing listening")
+	}
+}
+
+func TestMaxConcurrentRuns(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName),
+		[]byte(`{"MaxConcurrentRuns": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	// Health checks in flight, over all the deploys.
+	var lock sync.Mutex
+	inFlight, most := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	deployIds := []string{}
+	for i := 0; i < 6; i++ {
+		deployId := fmt.Sprintf("mass%d", i)
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("report"),
+			HealthEndpoint: "/status",
+			Env:            map[string]string{"CAMUS_TEST_REPORT_URL": ts.URL},
+		})
+		deployIds = append(deployIds, deployId)
+		defer s.Stop(deployId)
+	}
+
+	var wg sync.WaitGroup
+	for _, deployId := range deployIds[:4] {
+		wg.Add(1)
+		go func(deployId string) {
+			defer wg.Done()
+			if _, err := s.Run(deployId); err != nil {
+				t.Errorf("run %s: %s", deployId, err)
+			}
+		}(deployId)
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("expected at most 2 Runs health checking at once, got %d", most)
+	}
+	if most < 1 {
+		t.Fatalf("expected the deploys to be health checked")
+	}
+
+	// With both slots taken, a Run that can't wait long enough fails.
+	s.config.RunQueueTimeoutMs = 1
+	for _, deployId := range deployIds[4:] {
+		wg.Add(1)
+		go func(deployId string) {
+			defer wg.Done()
+			s.Run(deployId)
+		}(deployId)
+	}
+	for start := time.Now(); len(s.runSlots) < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected both slots to be taken")
+		}
+	}
+	if _, err := s.Run(deployIds[0]); !errors.Is(err, ErrTooManyRuns) {
+		t.Errorf("expected ErrTooManyRuns, got %v", err)
+	}
+	wg.Wait()
+}
+
+func TestPortHooks(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	reserved := path.Join(root, "reserved")
+	released := path.Join(root, "released")
+	config, err := json.Marshal(map[string]string{
+		"PortReserveCmd": fmt.Sprintf(`echo $CAMUS_PORT $CAMUS_DEPLOY_ID >> %s; [ $CAMUS_PORT != 19001 ]`, reserved),
+		"PortReleaseCmd": fmt.Sprintf(`echo $CAMUS_PORT $CAMUS_DEPLOY_ID >> %s`, released),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, serverConfigFileName), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "hooked", ApplicationDef{
+		RunCmd:         helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+	})
+
+	defer s.Stop("hooked")
+	port, err := s.Run("hooked")
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if port != 19002 {
+		t.Errorf("expected the port after the rejected 19001, got %d", port)
+	}
+	if data, _ := ioutil.ReadFile(reserved); string(data) != "19001 hooked\n19002 hooked\n" {
+		t.Errorf("expected 19001 to be rejected before 19002 was reserved, got %q", data)
+	}
+	if _, err := os.Stat(released); !os.IsNotExist(err) {
+		t.Errorf("expected nothing released while it's running, got %v", err)
+	}
+
+	if err := s.Stop("hooked"); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(released); string(data) != "19002 hooked\n" {
+		t.Errorf("expected 19002 to be released by Stop, got %q", data)
+	}
+}
+
+func TestLiveDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.portFree = func(port int) bool { return true }
+	writeTestDeploy(t, s, "blue", ApplicationDef{RunCmd: "true"})
+	writeTestDeploy(t, s, "green", ApplicationDef{RunCmd: "true"})
+	s.config.Ports[19001] = "blue"
+	s.config.Ports[19002] = "green"
+	s.config.Active = 19001
+
+	if _, err := s.LiveDeploy(); !errors.Is(err, ErrNoLiveDeploy) {
+		t.Errorf("expected ErrNoLiveDeploy with no LiveLabel, got %v", err)
+	}
+
+	s.config.LiveLabel = LABEL_ACTIVE
+	if deploy, err := s.LiveDeploy(); err != nil || deploy.Id != "blue" || deploy.Port != 19001 {
+		t.Errorf("expected the active blue on 19001, got %+v, %v", deploy, err)
+	}
+
+	s.config.LiveLabel = LABEL_CANARY
+	if _, err := s.LiveDeploy(); !errors.Is(err, ErrNoLiveDeploy) {
+		t.Errorf("expected ErrNoLiveDeploy with no canary, got %v", err)
+	}
+	s.config.Canary = &Canary{DeployId: "green", Weight: 10}
+	if deploy, err := s.LiveDeploy(); err != nil || deploy.Id != "green" || deploy.Port != 19002 {
+		t.Errorf("expected the canary green on 19002, got %+v, %v", deploy, err)
+	}
+}
+
+func TestStartupHealthTimeouts(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	// Accepts connections and hangs until the test is done.
+	hung := make(chan struct{})
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-hung
+	}))
+	defer ts.Close()
+	defer close(hung)
+
+	writeTestDeploy(t, s, "hanging", ApplicationDef{
+		RunCmd:                "true",
+		HealthEndpoint:        "/status",
+		HealthTimeoutMs:       50,
+		StartupHealthTimeouts: 3,
+	})
+	app, err := s.loadApp("hanging")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = s.waitForAppToStart(testServerPort(t, ts), app)
+	if err == nil || !strings.Contains(err.Error(), "timed out 3 times in a row") {
+		t.Fatalf("expected the start to fail after 3 timeouts, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected 3 health checks, got %d", n)
+	}
+	if took := time.Since(start); took > s.startupTime()/2 {
+		t.Errorf("expected the start to fail well before the startup time, took %s", took)
+	}
+
+	// Nothing listening is refused, not a timeout.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	if _, err := http.Get("http://" + addr); classifyHealthError(err) != HEALTH_ERROR_REFUSED {
+		t.Errorf("expected a closed port to be refused, got %v", err)
+	}
+}
+
+func TestDeployStateConflict(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Two camus processes sharing the root, e.g. the supervisor and a CLI.
+	supervisor, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	cli, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+
+	supervisor.updateDeployState("shared", func(state *DeployState) {
+		state.Failures = 1
+	})
+	stale, err := supervisor.readDeployState("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.Version != 1 {
+		t.Fatalf("expected version 1 after one write, got %d", stale.Version)
+	}
+
+	// The other writes in between the read and the write.
+	cli.updateDeployState("shared", func(state *DeployState) {
+		state.SupervisionPaused = time.Now().UTC()
+	})
+
+	stale.Failures++
+	if err := supervisor.writeDeployState("shared", stale); !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("expected a stale write to conflict, got %v", err)
+	}
+	state, err := supervisor.readDeployState("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != 2 || state.Failures != 1 || state.SupervisionPaused.IsZero() {
+		t.Fatalf("expected the other's write to be kept, got %+v", state)
+	}
+
+	// Updates apply to what's there now, so neither is lost.
+	var wg sync.WaitGroup
+	for _, s := range []*ServerImpl{supervisor, cli} {
+		wg.Add(1)
+		go func(s *ServerImpl) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				s.updateDeployState("shared", func(state *DeployState) {
+					state.Failures++
+				})
+			}
+		}(s)
+	}
+	wg.Wait()
+	if state, _ := supervisor.readDeployState("shared"); state.Failures != 21 || state.Version != 22 {
+		t.Fatalf("expected all 20 updates to be applied, got %d failures at version %d", state.Failures, state.Version)
+	}
+}
+
+func TestNamedPorts(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "multi", ApplicationDef{
+		RunCmd:         "echo %PORT% %PORT_METRICS% $PORT_ADMIN > ports; " + helperRunCmd("serve"),
+		HealthEndpoint: "/status",
+		NamedPorts:     []string{"metrics", "admin"},
+	})
+	defer s.Stop("multi")
+	port, err := s.Run("multi")
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	named := s.configuredNamedPorts("multi")
+	if len(named) != 2 || named["metrics"] == named["admin"] ||
+		named["metrics"] == port || named["admin"] == port {
+		t.Fatalf("expected distinct metrics and admin ports besides %d, got %v", port, named)
+	}
+	data, err := ioutil.ReadFile(path.Join(s.deployDir("multi"), "ports"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("%d %d %d\n", port, named["metrics"], named["admin"]); string(data) != expected {
+		t.Errorf("expected the app to be given %q, got %q", expected, data)
+	}
+
+	// Another deploy doesn't get any of them.
+	for _, taken := range []int{port, named["metrics"], named["admin"]} {
+		if !s.portConfigured(taken) {
+			t.Errorf("expected %d to count as configured", taken)
+		}
+	}
+	config, err := readConfig(path.Join(root, serverConfigFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.NamedPorts["multi"], named) {
+		t.Errorf("expected the named ports to be in config.json, got %v", config.NamedPorts)
+	}
+
+	if err := s.Stop("multi"); err != nil {
+		t.Fatalf("Stop: %s", err)
+	}
+	if named := s.configuredNamedPorts("multi"); len(named) != 0 {
+		t.Errorf("expected Stop to free the named ports, got %v", named)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "blue", ApplicationDef{RunCmd: "true"})
+	writeTestDeploy(t, s, "green", ApplicationDef{RunCmd: "true"})
+	s.config.Ports[19001] = "blue"
+	s.config.Ports[19002] = "green"
+	s.config.Reserved[19005] = "metrics"
+	s.config.Active = 19001
+	s.config.Canary = &Canary{DeployId: "green", Weight: 10}
+	if err := s.writeConfig(); err != nil {
+		t.Fatalf("write a valid config: %s", err)
+	}
+	configFile := path.Join(root, serverConfigFileName)
+	written, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, breakConfig := range map[string]func(){
+		"port out of range":      func() { s.config.Ports[70000] = "other" },
+		"deploy on two ports":    func() { s.config.Ports[19003] = "blue" },
+		"reserved and allocated": func() { s.config.Reserved[19002] = "oops" },
+		"missing canary":         func() { s.config.Canary = &Canary{DeployId: "missing", Weight: 10} },
+		"canary is active":       func() { s.config.Canary = &Canary{DeployId: "blue", Weight: 10} },
+		"named ports doubled": func() {
+			s.config.NamedPorts = map[string]map[string]int{"green": {"metrics": 19001}}
+		},
+	} {
+		previous := s.config
+		s.config.Ports = map[int]string{19001: "blue", 19002: "green"}
+		s.config.Reserved = map[int]string{19005: "metrics"}
+		breakConfig()
+		if err := s.writeConfig(); err == nil {
+			t.Errorf("%s: expected the config to be refused", name)
+		}
+		s.config = previous
+		if data, _ := ioutil.ReadFile(configFile); !bytes.Equal(data, written) {
+			t.Fatalf("%s: expected config.json to be unchanged, got %s", name, data)
+		}
+	}
+
+	// Stopping the active deploy leaves its port active, as before.
+	delete(s.config.Ports, 19001)
+	if err := s.writeConfig(); err != nil {
+		t.Errorf("expected an active port with nothing on it to be written, got %s", err)
+	}
+}
+
+func TestPrewarmAndPromote(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, deployId := range []string{"warm", "cold"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+		defer s.Stop(deployId)
+	}
+
+	port, err := s.Prewarm("warm")
+	if err != nil {
+		t.Fatalf("prewarm: %s", err)
+	}
+	if s.config.Active != 0 {
+		t.Fatalf("expected prewarming not to route to it, got active %d", s.config.Active)
+	}
+	if again, err := s.Prewarm("warm"); err != nil || again != port {
+		t.Fatalf("expected prewarming a warm deploy to leave it on %d, got %d, %v", port, again, err)
+	}
+	warmed, _ := s.readDeployState("warm")
+
+	start := time.Now()
+	if err := s.Promote("warm"); err != nil {
+		t.Fatalf("promote: %s", err)
+	}
+	if took := time.Since(start); took > STARTUP_HEALTH_CHECK_INTERVAL {
+		t.Errorf("expected promoting a warm deploy to be a switch, took %s", took)
+	}
+	if s.config.Active != port {
+		t.Errorf("expected %d to be active, got %d", port, s.config.Active)
+	}
+	if state, _ := s.readDeployState("warm"); state.Pid != warmed.Pid || !state.Started.Equal(warmed.Started) {
+		t.Errorf("expected the warm deploy not to be started again, was pid %d at %s, now %d at %s",
+			warmed.Pid, warmed.Started, state.Pid, state.Started)
+	}
+
+	// One that isn't running is started first.
+	if err := s.Promote("cold"); err != nil {
+		t.Fatalf("promote cold: %s", err)
+	}
+	if coldPort := s.lookupConfiguredPort("cold"); coldPort == 0 || s.config.Active != coldPort {
+		t.Errorf("expected cold to be started and active, got active %d, cold on %d", s.config.Active, coldPort)
+	}
+}
+
+func TestStderrTail(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	s.config.StderrTailBytes = 32
+	writeTestDeploy(t, s, "crashing", ApplicationDef{
+		RunCmd:         "echo early output that is dropped >&2; echo crashed: bad config >&2; exit 1",
+		HealthEndpoint: "/status",
+	})
+	_, err = s.Run("crashing")
+	if err == nil {
+		t.Fatal("expected Run to fail")
+	}
+	if !strings.Contains(err.Error(), "crashed: bad config") {
+		t.Errorf("expected the error to end with the deploy's stderr, got %q", err)
+	}
+	if strings.Contains(err.Error(), "early") {
+		t.Errorf("expected only the last 32 bytes of stderr, got %q", err)
+	}
+
+	// The whole of it is in the deploy's stderr file, emptied when it's
+	// started again.
+	if _, err := s.Run("crashing"); err == nil {
+		t.Fatal("expected Run to fail again")
+	}
+	data, err := ioutil.ReadFile(s.stderrFile("crashing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "early output that is dropped\ncrashed: bad config\n"; string(data) != expected {
+		t.Errorf("expected the stderr file to have %q, got %q", expected, data)
+	}
+}
+
+func TestEnsureDeploy(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	// Counts reloads, to tell that a second EnsureDeploy doesn't do one.
+	bin := path.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	reloads := path.Join(root, "reloads")
+	script := fmt.Sprintf("#!/bin/sh\necho reload >> %s\n", reloads)
+	if err := ioutil.WriteFile(path.Join(bin, "haproxy"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	countReloads := func() int {
+		data, _ := ioutil.ReadFile(reloads)
+		return strings.Count(string(data), "reload")
+	}
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for _, deployId := range []string{"stable", "next"} {
+		writeTestDeploy(t, s, deployId, ApplicationDef{
+			RunCmd:         helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+		})
+		defer s.Stop(deployId)
+	}
+
+	if err := s.EnsureDeploy("stable", LABEL_ACTIVE); err != nil {
+		t.Fatalf("ensure: %s", err)
+	}
+	port := s.lookupConfiguredPort("stable")
+	if port == 0 || s.config.Active != port {
+		t.Fatalf("expected stable to be running and active, got active %d, stable on %d", s.config.Active, port)
+	}
+	started, _ := s.readDeployState("stable")
+	before := countReloads()
+
+	if err := s.EnsureDeploy("stable", LABEL_ACTIVE); err != nil {
+		t.Fatalf("ensure again: %s", err)
+	}
+	if state, _ := s.readDeployState("stable"); state.Pid != started.Pid || !state.Started.Equal(started.Started) {
+		t.Errorf("expected stable not to be started again, was pid %d at %s, now %d at %s",
+			started.Pid, started.Started, state.Pid, state.Started)
+	}
+	if s.config.Active != port || s.lookupConfiguredPort("stable") != port {
+		t.Errorf("expected stable to still be active on %d, got active %d", port, s.config.Active)
+	}
+	if n := countReloads(); n != before {
+		t.Errorf("expected no haproxy reload the second time, got %d more", n-before)
+	}
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+	if n := len(makeProcessDeployIdLookup(procs)); n != 1 {
+		t.Errorf("expected one running deploy, got %d", n)
+	}
+
+	// The canary, too.
+	for i := 0; i < 2; i++ {
+		if err := s.EnsureDeploy("next", LABEL_CANARY); err != nil {
+			t.Fatalf("ensure canary: %s", err)
+		}
+	}
+	if s.config.Canary == nil || s.config.Canary.DeployId != "next" || s.config.Canary.Weight != DEFAULT_CANARY_WEIGHT {
+		t.Errorf("expected next to be the canary with weight %d, got %+v", DEFAULT_CANARY_WEIGHT, s.config.Canary)
+	}
+	if s.config.Active != port {
+		t.Errorf("expected stable to stay active, got %d", s.config.Active)
+	}
+	events := 0
+	timeline, err := s.Timeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range timeline {
+		if event.Event == "ensure-canary" {
+			events++
+		}
+	}
+	if events != 1 {
+		t.Errorf("expected the canary to be set once, got %d", events)
+	}
+
+	if err := s.EnsureDeploy("stable", "primary"); err == nil {
+		t.Errorf("expected an unknown label to be refused")
+	}
+}
+
+func TestPortSearchDoesntHoldConfigLock(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	// Slow to check and slow to reserve.
+	s.portFree = func(port int) bool {
+		time.Sleep(50 * time.Millisecond)
+		return port == 19003
+	}
+	s.config.PortReserveCmd = "sleep 0.3"
+
+	found := make(chan int)
+	go func() {
+		port, err := s.findUnusedPort(context.Background(), "searching")
+		if err != nil {
+			t.Error(err)
+		}
+		found <- port
+	}()
+	time.Sleep(75 * time.Millisecond)
+	start := time.Now()
+	s.PortUtilization()
+	if took := time.Since(start); took > 40*time.Millisecond {
+		t.Errorf("expected reading the config not to wait for the port search, took %s", took)
+	}
+	time.Sleep(150 * time.Millisecond)
+	start = time.Now()
+	s.PortUtilization()
+	if took := time.Since(start); took > 40*time.Millisecond {
+		t.Errorf("expected reading the config not to wait for the PortReserveCmd, took %s", took)
+	}
+
+	port := <-found
+	if port != 19003 {
+		t.Fatalf("expected 19003, got %d", port)
+	}
+	// Held from other searches until it's let go.
+	if taken := s.holdPort(port, "other"); taken != "held for searching" {
+		t.Errorf("expected the found port to be held, got %q", taken)
+	}
+	s.unholdPort(port)
+	if taken := s.holdPort(port, "other"); taken != "" {
+		t.Errorf("expected the port to be free to hold once let go, got %q", taken)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"syscall"
+	"time"
+)
+
+// How long a smoke tested app has to exit after its StopSignal before it's
+// killed.
+var SMOKE_TEST_STOP_TIME = time.Duration(5) * time.Second
+
+// SmokeResult is the outcome of starting a deploy with SmokeTest.
+type SmokeResult struct {
+	DeployId string
+
+	// The scratch port it ran on.
+	Port int
+
+	Healthy bool
+
+	// Why it wasn't healthy.
+	Error string
+
+	// How long it took to become healthy, or to fail.
+	StartupTime time.Duration
+}
+
+// SmokeTest starts deployId on a scratch port, waits for it to be healthy and
+// stops it again, without configuring it on the port. Failing to become
+// healthy is reported in the result; the error is for not getting as far as
+// starting it.
+func (s *ServerImpl) SmokeTest(deployId string) (SmokeResult, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return SmokeResult{}, err
+	}
+	unlock := s.lockDeploy(deployId)
+	defer unlock()
+
+	// Held from other deploys in memory only, so nothing is left in the
+	// config if camus stops half way through.
+	port, err := s.findUnusedPort(context.Background(), deployId)
+	if err != nil {
+		return SmokeResult{}, err
+	}
+	named, err := s.findNamedPorts(context.Background(), deployId, port)
+	if err != nil {
+		s.unholdPort(port)
+		s.releasePort(port, deployId)
+		return SmokeResult{}, err
+	}
+	defer func() {
+		s.unholdPort(port)
+		s.releasePort(port, deployId)
+		for _, p := range named {
+			s.unholdPort(p)
+		}
+		s.releaseNamedPorts(deployId, named)
+	}()
+
+	app, cmd, err := s.commandForDeploy(deployId, port, named)
+	if err != nil {
+		return SmokeResult{}, err
+	}
+	result := SmokeResult{DeployId: deployId, Port: port}
+	start := time.Now()
+	if err := startCmd(cmd); err != nil {
+		return result, err
+	}
+	exit := watchExit(cmd)
+
+	err = s.waitForProcessToStart(port, app, exit)
+	result.StartupTime = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Healthy = true
+	}
+
+	// The process group, so the app's children are stopped too. The shell
+	// can exit before them, so it's the whole group that's waited for.
+	target := startedTarget(app, cmd.Process.Pid)
+	syscall.Kill(target, app.StopSignal())
+	deadline := time.Now().Add(SMOKE_TEST_STOP_TIME)
+	for syscall.Kill(target, 0) != syscall.ESRCH {
+		if time.Now().After(deadline) {
+			log.Printf("smoke test of %s didn't stop in %s, killing it\n", deployId, SMOKE_TEST_STOP_TIME)
+			syscall.Kill(target, syscall.SIGKILL)
+			break
+		}
+		time.Sleep(STARTUP_OPEN_PORT_CHECK_INTERVAL)
+	}
+	<-exit.done
+	s.recordEvent("smoke-test", deployId, port)
+	if !result.Healthy {
+		log.Printf("smoke test of %s failed: %s\n", deployId, result.Error)
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SoakAndSetActiveById makes deployId the active deploy only if it stays
+// healthy for soak first, so one that fails soon after starting never gets
+// the traffic. Any failed health check during the soak aborts it.
+func (s *ServerImpl) SoakAndSetActiveById(deployId string, soak time.Duration) error {
+	if soak <= 0 {
+		return fmt.Errorf("Soak time must be positive")
+	}
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	s.configLock.Lock()
+	port := s.lookupConfiguredPort(deployId)
+	s.configLock.Unlock()
+	if port == 0 {
+		return fmt.Errorf("No deploy %s, run 'list' to see valid deploys", deployId)
+	}
+	app, err := s.loadApp(deployId)
+	if err != nil {
+		return err
+	}
+
+	// Not under configLock, which would hold up every other change for the
+	// whole soak.
+	if err := s.healthyFor(port, app, soak); err != nil {
+		s.recordHealthFailure(deployId)
+		return fmt.Errorf("Not making %s active, it failed a health check during its soak: %s", deployId, err)
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	if s.config.Ports[port] != deployId {
+		return fmt.Errorf("%s was moved off port %d during its soak", deployId, port)
+	}
+	if err := s.setActive(port, nil); err != nil {
+		return err
+	}
+	s.recordEventFor(context.Background(), LABEL_ACTIVE, "set-active", deployId, port)
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Per deploy state is kept under the root rather than in the deploy dir, so
+// it is never part of what was uploaded.
+const stateDirName = "state"
+
+// The pid of a running deploy is also written to this file in its deploy
+// dir, for monitoring tools. Unlike appPid, camus writes it, not the app.
+const deployPidFileName = "pid"
+
+// Where a deploy is in its lifecycle, as in DeployState.Lifecycle.
+const (
+	// Started, but not healthy yet.
+	LIFECYCLE_STARTING = "starting"
+
+	// Started and passed its health check.
+	LIFECYCLE_RUNNING = "running"
+
+	// Told to stop, but still exiting.
+	LIFECYCLE_DRAINING = "draining"
+
+	LIFECYCLE_STOPPED = "stopped"
+
+	// Didn't become healthy, or exited other than by Stop.
+	LIFECYCLE_FAILED = "failed"
+
+	// See enforceFailed.
+	LIFECYCLE_QUARANTINED = "quarantined"
+)
+
+// How often Stop checks whether a deploy has finished exiting.
+var STOP_CHECK_INTERVAL = time.Duration(50) * time.Millisecond
+
+// DeployState is what camus remembers about a deploy over its lifetime. Times
+// are zero if the event hasn't happened (or happened before camus recorded
+// it).
+type DeployState struct {
+	Created           time.Time
+	FirstRun          time.Time
+	LastStopped       time.Time
+	LastHealthFailure time.Time
+
+	// The process camus last started for the deploy, and when, so Stop can
+	// still find it after camus restarts. Pid is 0 once it's stopped.
+	Pid     int
+	Port    int
+	Started time.Time
+
+	// The last health seen by ListDeploys, as in Deploy.Health.
+	Health int
+
+	// One of the LIFECYCLE_ values, empty if the deploy has never run.
+	Lifecycle string
+
+	// How many times in a row Enforce has failed to start the deploy, and
+	// whether it gave up, see enforceFailed.
+	Failures   int
+	Quarantine *Quarantine
+
+	// When Enforce restarted the deploy within its RestartWindow, oldest
+	// first, for its MaxRestarts.
+	Restarts []time.Time
+
+	// How many health checks in a row Enforce has seen the running deploy
+	// fail, for its OnUnhealthy.
+	UnhealthyChecks int
+
+	// When PauseSupervision stopped Enforce restarting the deploy, zero if
+	// it hasn't.
+	SupervisionPaused time.Time
+
+	// How the last run of a job deploy went, nil for services.
+	LastJob *JobResult
+
+	// The key of the last RunIdempotent that started the deploy, and when,
+	// so a retry with it after camus restarts still isn't run again.
+	IdempotencyKey string    `json:",omitempty"`
+	IdempotentRun  time.Time `json:",omitempty"`
+
+	// Set by Pin, so GC keeps the deploy whatever its policy.
+	Pinned bool `json:",omitempty"`
+
+	// Incremented by every write, so a write based on an older read, e.g.
+	// by another camus process on the same root, fails with
+	// ErrStateConflict rather than losing what was written since.
+	Version int
+}
+
+// ErrStateConflict is returned by writeDeployState when the state was written
+// since it was read.
+var ErrStateConflict = errors.New("Deploy state was changed since it was read")
+
+// How many times updateDeployState reapplies its update when another process
+// wrote the state in between.
+const STATE_UPDATE_ATTEMPTS = 5
+
+// Held with flock while a state file is compared and swapped, so camus
+// processes sharing the root take turns.
+const stateLockFileName = ".lock"
+
+func (s *ServerImpl) stateFile(deployId string) string {
+	return path.Join(s.root, stateDirName, deployId+".json")
+}
+
+// readDeployState returns the recorded state of deployId, which is empty if
+// nothing has been recorded yet.
+func (s *ServerImpl) readDeployState(deployId string) (DeployState, error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.readDeployStateNolock(deployId)
+}
+
+func (s *ServerImpl) readDeployStateNolock(deployId string) (DeployState, error) {
+	var state DeployState
+	data, err := ioutil.ReadFile(s.stateFile(deployId))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// updateDeployState applies update to the recorded state of deployId, trying
+// again on what's there now if another process wrote it in between. State is
+// informational, so failures are logged rather than returned.
+func (s *ServerImpl) updateDeployState(deployId string, update func(state *DeployState)) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		state, err := s.readDeployStateNolock(deployId)
+		if err != nil {
+			log.Printf("warning: could not read state of %s: %s\n", deployId, err)
+			return
+		}
+		update(&state)
+
+		err = s.writeDeployStateNolock(deployId, state)
+		if errors.Is(err, ErrStateConflict) && attempt < STATE_UPDATE_ATTEMPTS {
+			continue
+		}
+		if err != nil {
+			log.Printf("warning: could not write state of %s: %s\n", deployId, err)
+		}
+		return
+	}
+}
+
+// writeDeployState replaces the recorded state of deployId with state, as long
+// as its Version is still the one on disk, returning ErrStateConflict if not.
+// The file is replaced in one go, so readers never see half of it.
+func (s *ServerImpl) writeDeployState(deployId string, state DeployState) error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.writeDeployStateNolock(deployId, state)
+}
+
+func (s *ServerImpl) writeDeployStateNolock(deployId string, state DeployState) error {
+	file := s.stateFile(deployId)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path.Join(path.Dir(file), stateLockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	current, err := s.readDeployStateNolock(deployId)
+	if err != nil {
+		return err
+	}
+	if current.Version != state.Version {
+		return fmt.Errorf("%w: %s is at version %d, not %d", ErrStateConflict, deployId, current.Version, state.Version)
+	}
+	state.Version++
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (s *ServerImpl) recordCreated(deployId string) {
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Created = now
+	})
+}
+
+func (s *ServerImpl) recordRun(deployId string) {
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		if state.FirstRun.IsZero() {
+			state.FirstRun = now
+		}
+		state.Lifecycle = LIFECYCLE_RUNNING
+	})
+}
+
+func (s *ServerImpl) recordStarted(deployId string, pid int, port int) {
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Pid = pid
+		state.Port = port
+		state.Started = now
+		state.Lifecycle = LIFECYCLE_STARTING
+		s.processes[deployId] = pid
+	})
+	pidFile := path.Join(s.deployDir(deployId), deployPidFileName)
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		log.Printf("warning: could not write %s: %s\n", pidFile, err)
+	}
+}
+
+// removePidFile removes the pid file recordStarted wrote for deployId.
+func (s *ServerImpl) removePidFile(deployId string) {
+	pidFile := path.Join(s.deployDir(deployId), deployPidFileName)
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		log.Printf("warning: could not remove %s: %s\n", pidFile, err)
+	}
+}
+
+func (s *ServerImpl) recordStopped(deployId string) {
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.LastStopped = now
+		state.Pid = 0
+		state.Port = 0
+		state.Lifecycle = LIFECYCLE_DRAINING
+		delete(s.processes, deployId)
+	})
+	s.removePidFile(deployId)
+}
+
+// awaitStopped records deployId as stopped once what Stop signalled, a
+// signalTarget, has exited. 0 means there was nothing left.
+func (s *ServerImpl) awaitStopped(deployId string, target int) {
+	if target != 0 {
+		pid := target
+		if pid < 0 {
+			pid = -pid
+		}
+		// Reaps the group leader if this camus started it, so it doesn't
+		// linger as a zombie. It's ECHILD otherwise, which is fine.
+		var status syscall.WaitStatus
+		syscall.Wait4(pid, &status, 0, nil)
+		for syscall.Kill(target, 0) != syscall.ESRCH {
+			time.Sleep(STOP_CHECK_INTERVAL)
+		}
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		// unless it was run again in the meantime
+		if state.Lifecycle == LIFECYCLE_DRAINING {
+			state.Lifecycle = LIFECYCLE_STOPPED
+		}
+	})
+}
+
+func (s *ServerImpl) recordHealth(deployId string, health int) {
+	if state, err := s.readDeployState(deployId); err == nil && state.Health == health {
+		return
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.Health = health
+	})
+}
+
+// trackedPid returns the pid camus started deployId with, if it is still
+// running.
+func (s *ServerImpl) trackedPid(deployId string) (int, bool) {
+	s.stateLock.Lock()
+	pid, ok := s.processes[deployId]
+	s.stateLock.Unlock()
+	return pid, ok && processAlive(pid)
+}
+
+// reconcileState rebuilds the running processes from the state files when
+// camus starts, forgetting those that exited while it wasn't running.
+func (s *ServerImpl) reconcileState() error {
+	infos, err := ioutil.ReadDir(path.Join(s.root, stateDirName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || path.Ext(info.Name()) != ".json" {
+			continue
+		}
+		deployId := strings.TrimSuffix(info.Name(), ".json")
+		state, err := s.readDeployState(deployId)
+		if err != nil {
+			log.Printf("warning: could not read state of %s: %s\n", deployId, err)
+			continue
+		}
+		if state.Pid == 0 {
+			continue
+		}
+		if processAlive(state.Pid) {
+			s.stateLock.Lock()
+			s.processes[deployId] = state.Pid
+			s.stateLock.Unlock()
+		} else {
+			log.Printf("%s (pid %d) exited while camus was down\n", deployId, state.Pid)
+			s.updateDeployState(deployId, func(state *DeployState) {
+				state.Pid = 0
+				state.Port = 0
+				if state.Lifecycle != LIFECYCLE_DRAINING {
+					state.Lifecycle = LIFECYCLE_FAILED
+				} else {
+					state.Lifecycle = LIFECYCLE_STOPPED
+				}
+			})
+			s.removePidFile(deployId)
+		}
+	}
+	return nil
+}
+
+// processAlive reports whether pid is still running as the leader of its own
+// process group, as deploys are started, or in camus's group for those with
+// NoDetach. The group check makes it less likely that a reused pid is mistaken
+// for the deploy.
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	pgid, err := syscall.Getpgid(pid)
+	return err == nil && (pgid == pid || pgid == syscall.Getpgrp())
+}
+
+// signalTarget returns what to pass to kill to signal the deploy running as
+// pid: its whole process group as -pgid, so its children are signalled too,
+// or just pid if it's in camus's own group (NoDetach), so camus isn't. It's 0
+// if pid isn't running.
+func signalTarget(pid int) int {
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		return 0
+	}
+	if pgid == syscall.Getpgrp() {
+		return pid
+	}
+	return -pgid
+}
+
+// startedTarget is the signalTarget of the deploy camus just started as pid,
+// which unlike signalTarget stays right once pid has exited.
+func startedTarget(app Application, pid int) int {
+	if app.Detach() {
+		return -pid
+	}
+	return pid
+}
+
+func (s *ServerImpl) recordHealthFailure(deployId string) {
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.LastHealthFailure = now
+		state.Lifecycle = LIFECYCLE_FAILED
+	})
+}
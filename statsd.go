@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// StatsdConfig is where config.json's Statsd sends deploy metrics.
+type StatsdConfig struct {
+	// host:port of the statsd server, over UDP.
+	Address string
+
+	// Put before every metric name, "camus." if empty.
+	Prefix string `json:",omitempty"`
+
+	// Add the deploy id to metrics as a Datadog style deploy tag.
+	Tags bool `json:",omitempty"`
+}
+
+const DEFAULT_STATSD_PREFIX = "camus."
+
+// statsdClient sends metrics to statsd. Sending is best effort: a metric that
+// can't be sent is dropped, so statsd being down never holds up a deploy. A
+// nil client sends nothing.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+func newStatsdClient(config *StatsdConfig) (*statsdClient, error) {
+	if config == nil {
+		return nil, nil
+	}
+	// Only resolves the address, as UDP has no connection to make.
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %s", err)
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = DEFAULT_STATSD_PREFIX
+	}
+	return &statsdClient{conn: conn, prefix: prefix, tags: config.Tags}, nil
+}
+
+// count adds one to the counter name for deployId.
+func (c *statsdClient) count(name string, deployId string) {
+	c.send(name, deployId, "1|c")
+}
+
+// timing records d for the timer name for deployId.
+func (c *statsdClient) timing(name string, deployId string, d time.Duration) {
+	c.send(name, deployId, fmt.Sprintf("%d|ms", d.Milliseconds()))
+}
+
+func (c *statsdClient) send(name string, deployId string, value string) {
+	if c == nil {
+		return
+	}
+	line := c.prefix + name + ":" + value
+	if c.tags {
+		line += "|#deploy:" + deployId
+	}
+	// UDP writes don't wait for the other end.
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		log.Printf("warning: could not send %s to statsd: %s\n", line, err)
+	}
+}
+
+// startupFinished records how starting deployId, begun at start, went.
+func (s *ServerImpl) startupFinished(deployId string, start time.Time, err error) {
+	if err != nil {
+		s.statsd.count("deploy.failure", deployId)
+	} else {
+		s.statsd.count("deploy.success", deployId)
+	}
+	s.statsd.timing("deploy.duration", deployId, time.Since(start))
+}
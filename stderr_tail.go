@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// With the config's StderrTailBytes, each deploy's stderr is written to a file
+// under the root, rather than a pipe to camus, so a detached deploy can keep
+// writing to it after camus exits.
+const stderrDirName = "stderr"
+
+func (s *ServerImpl) stderrFile(deployId string) string {
+	return path.Join(s.root, stderrDirName, deployId+".log")
+}
+
+// captureStderr points cmd's stderr at deployId's stderr file, emptied for
+// this start, if the config has a StderrTailBytes. camus's copy of the file is
+// closed by startCmd or closePipes like the secret pipes. Like
+// commandForDeploy, it may be called with the configLock held.
+func (s *ServerImpl) captureStderr(deployId string, cmd *exec.Cmd) error {
+	if s.config.StderrTailBytes == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(path.Join(s.root, stderrDirName), 0700); err != nil {
+		return fmt.Errorf("stderr dir: %s", err)
+	}
+	f, err := os.OpenFile(s.stderrFile(deployId), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("stderr file: %s", err)
+	}
+	cmd.Stderr = f
+	return nil
+}
+
+// withStderrTail adds the last StderrTailBytes of deployId's stderr file to
+// err, the reason it failed to start, if there's anything in it.
+func (s *ServerImpl) withStderrTail(deployId string, err error) error {
+	size := int64(s.config.StderrTailBytes)
+	if size == 0 {
+		return err
+	}
+	f, openErr := os.Open(s.stderrFile(deployId))
+	if openErr != nil {
+		return err
+	}
+	defer f.Close()
+	info, statErr := f.Stat()
+	if statErr != nil {
+		return err
+	}
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
+	}
+	tail, readErr := io.ReadAll(io.NewSectionReader(f, offset, size))
+	if readErr != nil {
+		return err
+	}
+	output := strings.TrimRight(string(tail), "\n")
+	if output == "" {
+		return err
+	}
+	return fmt.Errorf("%w, stderr ends with:\n%s", err, output)
+}
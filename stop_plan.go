@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// StopPlan is what Stop would do to a deploy, see StopDryRun.
+type StopPlan struct {
+	DeployId string
+
+	// The port Stop would free.
+	Port int
+
+	// The process Stop would signal, 0 if it isn't running, and whether
+	// its whole process group would be signalled rather than just it.
+	Pid   int
+	Group bool
+
+	// The signal, e.g. SIGTERM, and how long the deploy would have to exit
+	// before it's sent SIGKILL.
+	Signal  string
+	Timeout time.Duration
+
+	// The LABEL_ values of the deploy, i.e. whether haproxy routes to it.
+	Labels []string
+
+	// Anything to be careful of, e.g. that the deploy is serving traffic.
+	Warnings []string
+}
+
+// StopDryRun returns what Stop would do to deployId, without stopping
+// anything. It's an error if Stop would fail before signalling anything, e.g.
+// because the deploy isn't on a port.
+func (s *ServerImpl) StopDryRun(deployId string) (StopPlan, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return StopPlan{}, err
+	}
+	plan := StopPlan{DeployId: deployId, Signal: "SIGTERM", Timeout: s.stopTimeout(nil)}
+
+	s.configLock.Lock()
+	plan.Port = s.lookupConfiguredPort(deployId)
+	s.configLock.Unlock()
+	if plan.Port == 0 {
+		return StopPlan{}, fmt.Errorf("Deploy not running or not on a port")
+	}
+
+	if app, err := s.loadApp(deployId); err == nil {
+		plan.Signal = signalName(app.StopSignal())
+		plan.Timeout = s.stopTimeout(app)
+	} else {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("Unreadable deploy.json, so %s is used: %s", plan.Signal, err))
+	}
+
+	// the same way Stop finds it
+	procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+	proc, running := makeProcessDeployIdLookup(procs)[deployId]
+	if !running {
+		proc.Pid, running = s.trackedPid(deployId)
+	}
+	if running {
+		plan.Pid = proc.Pid
+		target := signalTarget(proc.Pid)
+		plan.Group = target < 0
+	} else {
+		plan.Warnings = append(plan.Warnings, "Not running, so only its port would be freed")
+	}
+
+	plan.Labels = s.routingLabels()[deployId]
+	for _, label := range plan.Labels {
+		switch label {
+		case LABEL_ACTIVE:
+			plan.Warnings = append(plan.Warnings, "It's the active deploy: haproxy would have nothing to send traffic to")
+		case LABEL_CANARY:
+			plan.Warnings = append(plan.Warnings, "It's the canary: all the traffic would go back to the active deploy")
+		}
+	}
+	return plan, nil
+}
+
+// signalName is the name of sig in a deploy.json's StopSignal.
+func signalName(sig syscall.Signal) string {
+	for name, stopSignal := range stopSignals {
+		if stopSignal == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
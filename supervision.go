@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// PauseSupervision stops Enforce from restarting deployId, e.g. while it's
+// being worked on by hand. Run and Stop still work as usual. The pause is
+// kept in the deploy's state, so it lasts until ResumeSupervision even if
+// camus restarts.
+func (s *ServerImpl) PauseSupervision(deployId string) error {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	if !s.deployExists(deployId) {
+		return fmt.Errorf("No deploy %s", deployId)
+	}
+	now := time.Now().UTC()
+	s.updateDeployState(deployId, func(state *DeployState) {
+		if state.SupervisionPaused.IsZero() {
+			state.SupervisionPaused = now
+		}
+	})
+	s.recordEvent("pause-supervision", deployId, 0)
+	return nil
+}
+
+// ResumeSupervision lets Enforce restart deployId again.
+func (s *ServerImpl) ResumeSupervision(deployId string) error {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return err
+	}
+	state, err := s.readDeployState(deployId)
+	if err != nil {
+		return err
+	}
+	if state.SupervisionPaused.IsZero() {
+		return fmt.Errorf("Supervision of %s isn't paused", deployId)
+	}
+	s.updateDeployState(deployId, func(state *DeployState) {
+		state.SupervisionPaused = time.Time{}
+	})
+	s.recordEvent("resume-supervision", deployId, 0)
+	return nil
+}
+
+// supervisionPaused reports whether Enforce should leave deployId alone.
+func (s *ServerImpl) supervisionPaused(deployId string) bool {
+	state, err := s.readDeployState(deployId)
+	return err == nil && !state.SupervisionPaused.IsZero()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// SwapLabels exchanges the deploys labels a and b point at, which must be
+// LABEL_ACTIVE and LABEL_CANARY in either order: the canary becomes the
+// active deploy and the active deploy the canary, with the same weight. It's
+// one haproxy reload under configLock, so there's no moment where both
+// point at the same deploy, and if the reload fails neither label changes.
+func (s *ServerImpl) SwapLabels(a string, b string) error {
+	if !((a == LABEL_ACTIVE && b == LABEL_CANARY) || (a == LABEL_CANARY && b == LABEL_ACTIVE)) {
+		return fmt.Errorf("Can only swap %s and %s, not %s and %s", LABEL_ACTIVE, LABEL_CANARY, a, b)
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.config.Canary == nil {
+		return fmt.Errorf("No canary to swap with the active deploy")
+	}
+	activeDeployId, ok := s.config.Ports[s.config.Active]
+	if !ok {
+		return fmt.Errorf("No active deploy to swap with the canary")
+	}
+	oldActive, oldCanary := s.config.Active, s.config.Canary
+	newActive := s.lookupConfiguredPort(oldCanary.DeployId)
+	if newActive == 0 {
+		return fmt.Errorf("Canary deploy %s is not on a port", oldCanary.DeployId)
+	}
+	newCanary := &Canary{DeployId: activeDeployId, Weight: oldCanary.Weight, Sticky: oldCanary.Sticky}
+
+	// so a failed reload leaves haproxy's config as it was
+	cfgFile := path.Join(s.root, haproxyConfig)
+	oldCfg, readErr := ioutil.ReadFile(cfgFile)
+	if err := s.reloadHaproxy(newActive, newCanary); err != nil {
+		if readErr == nil {
+			ioutil.WriteFile(cfgFile, oldCfg, os.FileMode(0644))
+		}
+		return err
+	}
+	s.config.Active = newActive
+	s.config.Canary = newCanary
+	if err := s.writeConfig(); err != nil {
+		s.config.Active = oldActive
+		s.config.Canary = oldCanary
+		if reloadErr := s.reloadHaproxy(oldActive, oldCanary); reloadErr != nil {
+			return fmt.Errorf("write config: %s, and restoring haproxy: %s", err, reloadErr)
+		}
+		return fmt.Errorf("write config: %s", err)
+	}
+	s.recordEventFor(context.Background(), LABEL_ACTIVE, "swap-labels", oldCanary.DeployId, newActive)
+	s.recordEventFor(context.Background(), LABEL_CANARY, "swap-labels", activeDeployId, oldActive)
+	return nil
+}
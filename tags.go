@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Tags are free-form key/value metadata on a deploy (team=payments,
+// risk=high), for people and filtering. Unlike labels they never affect
+// routing. Like state, they're kept under the root rather than in the
+// deploy dir.
+const tagsDirName = "tags"
+
+func (s *ServerImpl) tagsFile(deployId string) string {
+	return path.Join(s.root, tagsDirName, deployId+".json")
+}
+
+// SetTag sets the tag key of deployId to value, or removes it if value is
+// empty.
+func (s *ServerImpl) SetTag(deployId string, key string, value string) error {
+	if key == "" {
+		return fmt.Errorf("Tag key can't be empty")
+	}
+	if _, err := os.Stat(s.deployDir(deployId)); err != nil {
+		return fmt.Errorf("Unknown deploy %s", deployId)
+	}
+
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+
+	tags, err := s.getTagsNolock(deployId)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+
+	data, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := s.tagsFile(deployId)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, os.FileMode(0644))
+}
+
+// GetTags returns the tags of deployId, which are empty if none have been
+// set.
+func (s *ServerImpl) GetTags(deployId string) (map[string]string, error) {
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+	return s.getTagsNolock(deployId)
+}
+
+func (s *ServerImpl) getTagsNolock(deployId string) (map[string]string, error) {
+	tags := map[string]string{}
+	data, err := ioutil.ReadFile(s.tagsFile(deployId))
+	if os.IsNotExist(err) {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("Invalid tags for %s: %s", deployId, err)
+	}
+	return tags, nil
+}
+
+// ListDeploysWithTags is ListDeploys, keeping only the deploys that have
+// every one of tags. No tags lists everything.
+func (s *ServerImpl) ListDeploysWithTags(tags map[string]string) ([]*Deploy, error) {
+	deploys, err := s.ListDeploys()
+	if err != nil || len(tags) == 0 {
+		return deploys, err
+	}
+	matching := []*Deploy{}
+	for _, deploy := range deploys {
+		if hasTags(deploy, tags) {
+			matching = append(matching, deploy)
+		}
+	}
+	return matching, nil
+}
+
+func hasTags(deploy *Deploy, tags map[string]string) bool {
+	for key, value := range tags {
+		if deploy.Tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
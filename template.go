@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// templateContext is what a deploy.json's Templates are rendered with, e.g.
+// {{.Port}} or {{.Env.NODE_ENV}}.
+type templateContext struct {
+	DeployId string
+	Port     int
+
+	// The app's NamedPorts, e.g. {{.Ports.metrics}}.
+	Ports map[string]int
+
+	// The environment the app is started with, including its port.
+	Env map[string]string
+}
+
+// renderTemplates renders app's Templates for deployId starting on port, and
+// its NamedPorts on named. A
+// missing key is an error rather than an empty string, so a typo doesn't
+// start the app with a broken config.
+func renderTemplates(app Application, deployId string, port int, named map[string]int) error {
+	templates := app.Templates()
+	if len(templates) == 0 {
+		return nil
+	}
+	ctx := templateContext{DeployId: deployId, Port: port, Ports: named, Env: map[string]string{}}
+	for _, kv := range appEnv(app, port, named) {
+		if i := strings.Index(kv, "="); i >= 0 {
+			ctx.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for _, tmpl := range templates {
+		if err := renderTemplate(tmpl, ctx); err != nil {
+			return fmt.Errorf("Render template %s: %s", path.Base(tmpl.Source), err)
+		}
+	}
+	return nil
+}
+
+// renderTemplate writes tmpl's Dest all at once, so an app never reads half
+// of it.
+func renderTemplate(tmpl TemplateFile, ctx templateContext) error {
+	info, err := os.Stat(tmpl.Source)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(tmpl.Source)
+	if err != nil {
+		return err
+	}
+	t, err := template.New(path.Base(tmpl.Source)).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, ctx); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(tmpl.Dest), 0755); err != nil {
+		return err
+	}
+	tmp := tmpl.Dest + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tmpl.Dest)
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type TerminalClient struct {
@@ -24,6 +26,11 @@ func NewTerminalClient(flags *flag.FlagSet, client Client) *TerminalClient {
 	c.commands["set"] = c.setCmd
 	c.commands["help"] = c.helpCmd
 	c.commands["stop"] = c.stopCmd
+	c.commands["pin"] = c.pinCmd
+	c.commands["unpin"] = c.unpinCmd
+	c.commands["delete"] = c.deleteCmd
+	c.commands["doctor"] = c.doctorCmd
+	c.commands["audit"] = c.auditCmd
 	// TODO(koz): Consider not exposing these in the terminal client.
 	c.commands["cleanup"] = c.cleanupCmd
 	c.commands["shutdown"] = c.shutdownCmd
@@ -155,6 +162,133 @@ func (c *TerminalClient) stopCmd() error {
 	return nil
 }
 
+func (c *TerminalClient) pinCmd() error {
+	deployId := c.flags.Arg(1)
+	if deployId == "" {
+		return errors.New("Missing deploy id")
+	}
+	return c.client.Pin(deployId)
+}
+
+func (c *TerminalClient) unpinCmd() error {
+	deployId := c.flags.Arg(1)
+	if deployId == "" {
+		return errors.New("Missing deploy id")
+	}
+	return c.client.Unpin(deployId)
+}
+
+// deleteCmd deletes a stopped deploy, "delete <id> force" even if it's
+// pinned.
+func (c *TerminalClient) deleteCmd() error {
+	deployId := c.flags.Arg(1)
+	if deployId == "" {
+		return errors.New("Missing deploy id")
+	}
+	force := c.flags.Arg(2) == "force"
+	if c.flags.Arg(2) != "" && !force {
+		return fmt.Errorf("Unknown delete option %s, only force", c.flags.Arg(2))
+	}
+	if err := c.client.Delete(deployId, force); err != nil {
+		return err
+	}
+	println("deleted")
+	return nil
+}
+
+func (c *TerminalClient) doctorCmd() error {
+	diagnostics, err := c.client.Doctor()
+	if err != nil {
+		return err
+	}
+
+	tbl := TableDef{
+		Columns: []ColumnDef{
+			ColumnDef{"check", 18},
+			ColumnDef{"st", 4},
+			ColumnDef{"message", 40},
+			ColumnDef{"hint", 40},
+		},
+	}
+	tbl.PrintHeader()
+
+	failed := false
+	for _, d := range diagnostics {
+		tbl.PrintRow(d.Check, string(d.Level), d.Message, d.Hint)
+		failed = failed || d.Level == Fail
+	}
+	if failed {
+		return errors.New("Some checks failed")
+	}
+	return nil
+}
+
+// auditCmd lists the audit log entries matching its deploy=, operation=,
+// label=, since= and until= args, the times in RFC 3339.
+func (c *TerminalClient) auditCmd() error {
+	filter, err := parseAuditFilter(c.flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	entries, err := c.client.QueryAudit(filter)
+	if err != nil {
+		return err
+	}
+
+	tbl := TableDef{
+		Columns: []ColumnDef{
+			ColumnDef{"time", 20},
+			ColumnDef{"operation", 14},
+			ColumnDef{"id", 25},
+			ColumnDef{"port", 5},
+			ColumnDef{"label", 6},
+			ColumnDef{"actor", 12},
+		},
+	}
+	tbl.PrintHeader()
+
+	for _, entry := range entries {
+		tbl.PrintRow(
+			entry.Time.Format(time.RFC3339),
+			entry.Operation,
+			entry.DeployId,
+			entry.Port,
+			entry.Label,
+			entry.Actor,
+		)
+	}
+	return nil
+}
+
+func parseAuditFilter(args []string) (AuditFilter, error) {
+	var filter AuditFilter
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return filter, fmt.Errorf("Expected key=value, not %q", arg)
+		}
+		var err error
+		switch key {
+		case "deploy":
+			filter.DeployId = value
+		case "operation":
+			filter.Operation = value
+		case "label":
+			filter.Label = value
+		case "since":
+			filter.Since, err = time.Parse(time.RFC3339, value)
+		case "until":
+			filter.Until, err = time.Parse(time.RFC3339, value)
+		default:
+			return filter, fmt.Errorf("Unknown audit filter %s, should be deploy, operation, label, since or until", key)
+		}
+		if err != nil {
+			return filter, fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return filter, nil
+}
+
 func (c *TerminalClient) cleanupCmd() error {
 	c.client.KillUnknownProcesses()
 	return nil
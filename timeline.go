@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeline events that don't come from the audit log, where the rest are
+// named by their AuditEntry.Operation.
+const (
+	// From the deploy's state, when camus first saw it.
+	TIMELINE_CREATED = "created"
+
+	// A failed health check, from the deploy's health history, or its
+	// state's LastHealthFailure if that's older than the history goes.
+	TIMELINE_HEALTH_FAILURE = "health-failure"
+)
+
+// TimelineEvent is one thing that happened to a deploy, in Timeline.
+type TimelineEvent struct {
+	Time     time.Time
+	DeployId string
+
+	// An AuditEntry.Operation, or one of the TIMELINE_ values.
+	Event string
+
+	Port int `json:",omitempty"`
+
+	// Why a health check failed.
+	Detail string `json:",omitempty"`
+}
+
+// Timeline returns what happened to every deploy, oldest first, for looking
+// back over an incident: the audit log, which has runs, stops and changes to
+// what's live, merged with when each deploy was created and its health check
+// failures. Events at the same time keep the audit log's order.
+func (s *ServerImpl) Timeline() ([]TimelineEvent, error) {
+	events := []TimelineEvent{}
+	err := s.scanAudit(func(entry AuditEntry) {
+		events = append(events, TimelineEvent{
+			Time:     entry.Time,
+			DeployId: entry.DeployId,
+			Event:    entry.Operation,
+			Port:     entry.Port,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(path.Join(s.root, stateDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.IsDir() || path.Ext(info.Name()) != ".json" {
+			continue
+		}
+		deployId := strings.TrimSuffix(info.Name(), ".json")
+		state, err := s.readDeployState(deployId)
+		if err != nil {
+			return nil, fmt.Errorf("Read state of %s: %s", deployId, err)
+		}
+		if !state.Created.IsZero() {
+			events = append(events, TimelineEvent{Time: state.Created, DeployId: deployId, Event: TIMELINE_CREATED})
+		}
+		events = append(events, s.healthFailureEvents(deployId, state)...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
+}
+
+// healthFailureEvents returns deployId's failed health checks for Timeline.
+func (s *ServerImpl) healthFailureEvents(deployId string, state DeployState) []TimelineEvent {
+	healthy := func(status int) bool { return status == 200 }
+	if app, err := s.loadApp(deployId); err == nil {
+		healthy = app.HealthyStatus
+	}
+	s.healthHistoryLock.Lock()
+	history := append([]HealthResult{}, s.healthHistory[deployId]...)
+	s.healthHistoryLock.Unlock()
+
+	events := []TimelineEvent{}
+	for _, result := range history {
+		if result.Error == "" && healthy(result.Health) {
+			continue
+		}
+		detail := result.Error
+		if detail == "" {
+			detail = fmt.Sprintf("status %d", result.Health)
+		}
+		events = append(events, TimelineEvent{Time: result.Time, DeployId: deployId, Event: TIMELINE_HEALTH_FAILURE, Detail: detail})
+	}
+	last := state.LastHealthFailure
+	if !last.IsZero() && (len(history) == 0 || last.Before(history[0].Time)) {
+		events = append(events, TimelineEvent{Time: last, DeployId: deployId, Event: TIMELINE_HEALTH_FAILURE})
+	}
+	return events
+}
+
+// TimelineJson is the Timeline as indented JSON, for exporting.
+func (s *ServerImpl) TimelineJson() ([]byte, error) {
+	events, err := s.Timeline()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(events, "", "  ")
+}
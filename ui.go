@@ -0,0 +1,81 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// Labels of the deploys haproxy routes to, see routingLabels.
+const (
+	LABEL_ACTIVE = "active"
+	LABEL_CANARY = "canary"
+)
+
+//go:embed ui.html
+var uiPageText string
+
+var uiPageTemplate = template.Must(template.New("ui").Parse(uiPageText))
+
+// UIHandler serves a page listing the deploys, with buttons that run, stop
+// and activate them through the JSON-RPC endpoint, for operators without a
+// frontend of their own.
+type UIHandler struct {
+	server *ServerImpl
+}
+
+func NewUIHandler(server *ServerImpl) *UIHandler {
+	return &UIHandler{server: server}
+}
+
+type uiPage struct {
+	Deploys []*uiDeploy
+	Error   string
+}
+
+type uiDeploy struct {
+	*Deploy
+
+	// LABEL_ values
+	Labels []string
+}
+
+func (h *UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET the page", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := uiPage{Deploys: []*uiDeploy{}}
+	deploys, err := h.server.ListDeploys()
+	if err != nil {
+		page.Error = err.Error()
+	}
+	labels := h.server.routingLabels()
+	for _, deploy := range deploys {
+		page.Deploys = append(page.Deploys, &uiDeploy{Deploy: deploy, Labels: labels[deploy.Id]})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := uiPageTemplate.Execute(w, &page); err != nil {
+		log.Printf("warning: could not render the UI: %s\n", err)
+	}
+}
+
+// routingLabels returns the LABEL_ values of each deploy haproxy sends
+// traffic to.
+func (s *ServerImpl) routingLabels() map[string][]string {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	labels := map[string][]string{}
+	if deployId, ok := s.config.Ports[s.config.Active]; ok {
+		labels[deployId] = append(labels[deployId], LABEL_ACTIVE)
+	}
+	if s.config.Canary != nil {
+		deployId := s.config.Canary.DeployId
+		labels[deployId] = append(labels[deployId], LABEL_CANARY)
+	}
+	return labels
+}
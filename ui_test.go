@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUIPage(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "live", ApplicationDef{RunCmd: helperRunCmd("serve"), HealthEndpoint: "/status"})
+	writeTestDeploy(t, s, "idle", ApplicationDef{RunCmd: helperRunCmd("serve"), HealthEndpoint: "/status"})
+	port, err := s.Run("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop("live")
+	// without reloading haproxy, which isn't running
+	s.configLock.Lock()
+	s.config.Active = port
+	s.configLock.Unlock()
+
+	w := httptest.NewRecorder()
+	NewUIHandler(s).ServeHTTP(w, httptest.NewRequest("GET", "/ui", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the page, got %d: %s", w.Code, w.Body.String())
+	}
+	page := w.Body.String()
+	rows := map[string]string{}
+	for _, row := range strings.Split(page, "<tr ")[1:] {
+		deployId := strings.SplitN(strings.TrimPrefix(row, `data-deploy="`), `"`, 2)[0]
+		rows[deployId] = row
+	}
+	live, idle := rows["live"], rows["idle"]
+	if live == "" || idle == "" {
+		t.Fatalf("expected a row for each deploy, got %s", page)
+	}
+	for _, expected := range []string{
+		"<td>" + strconv.Itoa(port) + "</td>",
+		`<td class="healthy">200</td>`,
+		"<td>" + LIFECYCLE_RUNNING + "</td>",
+		`<span class="label">` + LABEL_ACTIVE + "</span>",
+	} {
+		if !strings.Contains(live, expected) {
+			t.Errorf("expected %s in the live deploy's row, got %s", expected, live)
+		}
+	}
+	if strings.Contains(idle, `class="label"`) || strings.Contains(idle, `class="healthy"`) {
+		t.Errorf("expected the idle deploy to be neither active nor healthy, got %s", idle)
+	}
+	if !strings.Contains(page, "RpcServer.") {
+		t.Errorf("expected the buttons to call the JSON-RPC endpoint")
+	}
+
+	w = httptest.NewRecorder()
+	NewUIHandler(s).ServeHTTP(w, httptest.NewRequest("POST", "/ui", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestUmask(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	for umask, expected := range map[string]os.FileMode{"077": 0600, "0022": 0644} {
+		writeTestDeploy(t, s, "masked", ApplicationDef{
+			RunCmd:         "touch created && " + helperRunCmd("serve"),
+			HealthEndpoint: "/status",
+			Umask:          umask,
+		})
+		if _, err := s.Run("masked"); err != nil {
+			t.Fatalf("run: %s", err)
+		}
+		created := path.Join(s.deployDir("masked"), "created")
+		info, err := os.Stat(created)
+		s.Stop("masked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != expected {
+			t.Errorf("Umask %s: expected %s, got %s", umask, expected, mode)
+		}
+		os.Remove(created)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The limit applies to both the upload and what it extracts to, so a small
+// gzip can't expand to fill the disk.
+const MAX_UPLOAD_SIZE = 512 * 1024 * 1024
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// The Content-Types an upload may have, none of which a page on another
+// site can post without CORS allowing it, see checkLocalRequest.
+var uploadContentTypes = []string{"application/x-tar", "application/gzip", "application/x-gzip", "application/octet-stream"}
+
+// UploadHandler accepts a POSTed tar (optionally gzipped) and extracts it into
+// a new deploy dir, replying with the NewDeployDirResponse as json.
+type UploadHandler struct {
+	server  *ServerImpl
+	maxSize int64
+}
+
+func NewUploadHandler(server *ServerImpl) *UploadHandler {
+	return &UploadHandler{server: server, maxSize: MAX_UPLOAD_SIZE}
+}
+
+func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a tarball to upload a deploy", http.StatusMethodNotAllowed)
+		return
+	}
+	if status, err := checkLocalRequest(r, uploadContentTypes...); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	deploy := h.server.NewDeployDir()
+	budget := &limitedReader{r: r.Body, remaining: h.maxSize}
+	if err := extractTarball(budget, deploy.Path, h.maxSize); err != nil {
+		log.Printf("upload of %s failed: %s\n", deploy.DeployId, err)
+		os.RemoveAll(deploy.Path)
+		os.Remove(h.server.stateFile(deploy.DeployId))
+		if errors.Is(err, errUploadTooLarge) {
+			http.Error(w, fmt.Sprintf("Upload larger than %d bytes", h.maxSize),
+				http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, fmt.Sprintf("Invalid tarball: %s", err), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&deploy)
+}
+
+// limitedReader is io.LimitReader, except that reading past the limit is an
+// error rather than a silent EOF.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// extractTarball extracts the tar (or tar.gz) in r into dir, writing at most
+// maxSize bytes of file contents. Entries may not escape dir, either by name
+// or by being written through a symlink from an earlier entry.
+func extractTarball(r io.Reader, dir string, maxSize int64) error {
+	buffered := bufio.NewReader(r)
+	var in io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	written := &limitedReader{remaining: maxSize}
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("entry %s is outside the deploy dir", header.Name)
+		}
+		if err := checkNoSymlinkParents(dir, name); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			written.r = tr
+			_, err = io.Copy(f, written)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("entry %s has unsupported type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// checkNoSymlinkParents returns an error if any directory on the way from dir
+// to name is a symlink, which could point anywhere.
+func checkNoSymlinkParents(dir string, name string) error {
+	parts := strings.Split(name, "/")
+	current := dir
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("entry %s is written through a symlink", name)
+		}
+	}
+	return nil
+}
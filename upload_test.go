@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+type testTarEntry struct {
+	name     string
+	body     string
+	linkname string
+}
+
+func makeTestTarball(t *testing.T, entries []testTarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body))}
+		if e.linkname != "" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = e.linkname
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestUploadRequest(body []byte) *http.Request {
+	r := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+	r.Host = "localhost:8000"
+	r.Header.Set("Content-Type", "application/gzip")
+	return r
+}
+
+func postTestUpload(h *UploadHandler, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestUploadRequest(body))
+	return w
+}
+
+func TestUploadTarball(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	h := NewUploadHandler(s)
+
+	w := postTestUpload(h, makeTestTarball(t, []testTarEntry{
+		{name: "deploy.json", body: `{"RunCmd": "node app.js %PORT%"}`},
+		{name: "./lib/app.js", body: "console.log('hi')"},
+	}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected upload to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp NewDeployDirResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	data, err := ioutil.ReadFile(path.Join(s.deployDir(resp.DeployId), "lib", "app.js"))
+	if err != nil || string(data) != "console.log('hi')" {
+		t.Errorf("expected lib/app.js to be extracted, got '%s' (err %v)", data, err)
+	}
+	if _, err := s.loadApp(resp.DeployId); err != nil {
+		t.Errorf("expected uploaded deploy to load: %s", err)
+	}
+}
+
+func TestUploadRejectsBadTarballs(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	h := NewUploadHandler(s)
+	h.maxSize = 1024
+
+	big := make([]byte, 4096)
+	tests := []struct {
+		name    string
+		entries []testTarEntry
+		code    int
+	}{
+		{"too large", []testTarEntry{{name: "big", body: string(big)}}, http.StatusRequestEntityTooLarge},
+		{"parent entry", []testTarEntry{{name: "../escaped", body: "x"}}, http.StatusBadRequest},
+		{"nested parent entry", []testTarEntry{{name: "a/../../escaped", body: "x"}}, http.StatusBadRequest},
+		{"through symlink", []testTarEntry{
+			{name: "link", linkname: root},
+			{name: "link/escaped", body: "x"},
+		}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := postTestUpload(h, makeTestTarball(t, test.entries))
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d: %s", test.name, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	if _, err := os.Stat(path.Join(root, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the deploy dir")
+	}
+	deploys, err := ioutil.ReadDir(s.DeploysPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deploys) != 0 {
+		t.Errorf("expected failed uploads to be cleaned up, found %d deploys", len(deploys))
+	}
+}
+
+func TestUploadRejectsCrossSiteRequests(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	h := NewUploadHandler(s)
+	tarball := makeTestTarball(t, []testTarEntry{{name: "deploy.json", body: `{"RunCmd": "true"}`}})
+
+	for _, test := range []struct {
+		name   string
+		modify func(r *http.Request)
+		status int
+	}{
+		{"typeless blob", func(r *http.Request) { r.Header.Del("Content-Type") }, http.StatusUnsupportedMediaType},
+		{"text post", func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, http.StatusUnsupportedMediaType},
+		{"form post", func(r *http.Request) { r.Header.Set("Content-Type", "application/x-www-form-urlencoded") }, http.StatusUnsupportedMediaType},
+		{"rebound host", func(r *http.Request) { r.Host = "attacker.example.com:8000" }, http.StatusForbidden},
+		{"foreign origin", func(r *http.Request) { r.Header.Set("Origin", "https://attacker.example.com") }, http.StatusForbidden},
+	} {
+		r := newTestUploadRequest(tarball)
+		test.modify(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %q", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+	if ids, err := s.readDeployIdsFromDisk(); err != nil || len(ids) != 0 {
+		t.Errorf("expected no deploys to be created, got %v %v", ids, err)
+	}
+}
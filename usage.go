@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ResourceUsage is what a running deploy's processes are using, summed over
+// its process group.
+type ResourceUsage struct {
+	Pid       int
+	Processes int
+
+	// Resident memory, in bytes.
+	Rss int64
+
+	// User plus system CPU time used so far.
+	CpuTime time.Duration
+}
+
+// DeployResourceUsage returns the resources currently used by deployId's
+// process group. It's an error if the deploy isn't running.
+func (s *ServerImpl) DeployResourceUsage(deployId string) (ResourceUsage, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return ResourceUsage{}, err
+	}
+	pid, ok := s.trackedPid(deployId)
+	if !ok {
+		procs := FindListeningProcesses(s.startPort, s.endPort, s.deploysDirName)
+		proc, running := makeProcessDeployIdLookup(procs)[deployId]
+		if !running {
+			return ResourceUsage{}, fmt.Errorf("Deploy %s isn't running", deployId)
+		}
+		pid = proc.Pid
+	}
+	return processGroupUsage(pid)
+}
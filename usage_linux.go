@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kernel clock ticks per second, which /proc reports CPU times in. It's 100 on
+// every Linux camus is likely to run on, and can't be read without cgo.
+const clockTicks = 100
+
+// processGroupUsage adds up the usage of every process in pid's process group,
+// read from /proc.
+func processGroupUsage(pid int) (ResourceUsage, error) {
+	usage := ResourceUsage{Pid: pid}
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		return usage, fmt.Errorf("Process %d isn't running: %s", pid, err)
+	}
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return usage, err
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		// Processes can exit while we look, so unreadable ones are skipped.
+		data, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		stat, err := parseProcStat(string(data))
+		if err != nil || stat.pgrp != pgid {
+			continue
+		}
+		usage.Processes++
+		usage.Rss += stat.rssPages * int64(os.Getpagesize())
+		usage.CpuTime += time.Duration(stat.utime+stat.stime) * time.Second / clockTicks
+	}
+	if usage.Processes == 0 {
+		return usage, fmt.Errorf("Process %d isn't running", pid)
+	}
+	return usage, nil
+}
+
+type procStat struct {
+	// e.g. "R", or "Z" for a zombie
+	state    string
+	ppid     int
+	pgrp     int
+	utime    int64
+	stime    int64
+	nice     int
+	rssPages int64
+}
+
+// parseProcStat parses the parts of /proc/<pid>/stat used here. See proc(5).
+func parseProcStat(stat string) (procStat, error) {
+	// The command name is in parens and may contain spaces, so the fields
+	// are counted from after its closing paren, starting at field 3.
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return procStat{}, fmt.Errorf("Invalid stat %q", stat)
+	}
+	fields := strings.Fields(stat[end+1:])
+	field := func(n int) (int64, error) {
+		if n-3 >= len(fields) {
+			return 0, fmt.Errorf("Stat has no field %d", n)
+		}
+		return strconv.ParseInt(fields[n-3], 10, 64)
+	}
+
+	var s procStat
+	if len(fields) == 0 {
+		return s, fmt.Errorf("Stat has no field 3")
+	}
+	s.state = fields[0]
+	ppid, err := field(4)
+	if err != nil {
+		return s, err
+	}
+	s.ppid = int(ppid)
+	pgrp, err := field(5)
+	if err != nil {
+		return s, err
+	}
+	s.pgrp = int(pgrp)
+	if s.utime, err = field(14); err != nil {
+		return s, err
+	}
+	if s.stime, err = field(15); err != nil {
+		return s, err
+	}
+	nice, err := field(19)
+	if err != nil {
+		return s, err
+	}
+	s.nice = int(nice)
+	if s.rssPages, err = field(24); err != nil {
+		return s, err
+	}
+	return s, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDeployResourceUsage(t *testing.T) {
+	root := createTestRoot(t)
+	defer os.RemoveAll(root)
+
+	s, err := NewServerImpl(root, false, 19000)
+	if err != nil {
+		t.Fatalf("NewServerImpl: %s", err)
+	}
+	writeTestDeploy(t, s, "busy", ApplicationDef{RunCmd: "true"})
+
+	if _, err := s.DeployResourceUsage("busy"); err == nil {
+		t.Errorf("expected usage of a deploy that isn't running to fail")
+	}
+
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	}()
+	s.recordStarted("busy", cmd.Process.Pid, 19001)
+
+	// The shell may not have started its children yet.
+	var usage ResourceUsage
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		if usage, err = s.DeployResourceUsage("busy"); err != nil {
+			t.Fatalf("usage: %s", err)
+		} else if usage.Processes >= 2 {
+			break
+		}
+	}
+	if usage.Pid != cmd.Process.Pid || usage.Processes < 2 {
+		t.Errorf("expected the shell and its children, got %+v", usage)
+	}
+	if usage.Rss <= 0 {
+		t.Errorf("expected non-zero memory, got %+v", usage)
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	stat, err := parseProcStat("1234 (my app (v2)) S 1 1234 1234 0 -1 4194560 100 0 0 0 " +
+		"25 5 0 0 20 0 1 0 100 1000000 321 18446744073709551615\n")
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if stat.pgrp != 1234 || stat.utime != 25 || stat.stime != 5 || stat.rssPages != 321 {
+		t.Errorf("unexpected stat %+v", stat)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func processGroupUsage(pid int) (ResourceUsage, error) {
+	return ResourceUsage{Pid: pid}, fmt.Errorf("Resource usage is only available on Linux")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// WaitUntilHealthy returns once deployId passes its health check on the port
+// it's configured on, or with an error once timeout has passed. The deploy
+// needn't be configured on a port yet, e.g. if a Run has only just been
+// asked for. It returns the last health seen, as in Deploy.Health.
+func (s *ServerImpl) WaitUntilHealthy(deployId string, timeout time.Duration) (int, error) {
+	deployId, err := s.resolveDeployId(deployId)
+	if err != nil {
+		return 0, err
+	}
+	app, err := s.loadApp(deployId)
+	if err != nil {
+		return -2, err
+	}
+
+	end := time.Now().Add(timeout)
+	health := 0
+	var lastErr error
+	for {
+		s.configLock.Lock()
+		port := s.lookupConfiguredPort(deployId)
+		s.configLock.Unlock()
+
+		if port != 0 {
+			health, lastErr = s.testApp(port, app)
+			if lastErr == nil && app.HealthyStatus(health) {
+				return health, nil
+			}
+		}
+
+		if time.Now().After(end) {
+			if port == 0 {
+				return health, fmt.Errorf("%s wasn't on a port after %s", deployId, timeout)
+			} else if lastErr != nil {
+				return health, fmt.Errorf("%s wasn't healthy after %s: %s", deployId, timeout, lastErr)
+			}
+			return health, fmt.Errorf("%s wasn't healthy after %s: status %d", deployId, timeout, health)
+		}
+		time.Sleep(STARTUP_HEALTH_CHECK_INTERVAL)
+	}
+}